@@ -0,0 +1,299 @@
+// Package shipper sends log entries to a TinyTail ingest endpoint in the
+// background. Logging never waits on the network: entries are queued and
+// posted by a few workers, and dropped if the queue is full.
+//
+// It is shared by the logging library integrations in this module; most
+// applications use one of those instead.
+package shipper
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one log entry, in the JSON the ingest endpoint accepts
+type Entry struct {
+	Source    string    `json:"source"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	Logger    string    `json:"logger,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Options tune a Shipper. The zero value of each field picks its default.
+type Options struct {
+	// Source names the application in entries that don't set one. It
+	// defaults to the Lambda function name, or "unknown".
+	Source string
+
+	// QueueSize is how many entries can wait to be sent (default 1000)
+	QueueSize int
+
+	// Workers is how many requests are sent at once (default 4)
+	Workers int
+
+	// Timeout bounds each request (default 5 seconds)
+	Timeout time.Duration
+
+	// MaxRetries is how many more times a failed request is tried
+	// (default 1, or none if negative). Authentication failures and other
+	// client errors are not retried.
+	MaxRetries int
+
+	// RetryDelay is the wait between attempts (default 200 milliseconds)
+	RetryDelay time.Duration
+
+	// HTTPClient sends the requests (default a client with Timeout)
+	HTTPClient *http.Client
+
+	// OnError is told about entries that could not be sent. By default
+	// they are reported on stderr, which in Lambda ends up in CloudWatch.
+	OnError func(error)
+}
+
+const (
+	defaultQueueSize  = 1000
+	defaultWorkers    = 4
+	defaultTimeout    = 5 * time.Second
+	defaultMaxRetries = 1
+	defaultRetryDelay = 200 * time.Millisecond
+)
+
+// ErrClosed is returned by Send after Close
+var ErrClosed = errors.New("tinytail: shipper is closed")
+
+// ErrQueueFull is returned by Send when entries are logged faster than they
+// can be sent
+var ErrQueueFull = errors.New("tinytail: queue is full; entry dropped")
+
+// Shipper queues entries and posts them to the ingest endpoint
+type Shipper struct {
+	endpoint string
+	secret   string
+	options  Options
+	queue    chan Entry
+	dropped  atomic.Int64
+
+	// pending counts entries queued or being sent; Flush waits for it to
+	// reach zero
+	mu      sync.Mutex
+	pending int
+	idle    []chan struct{}
+	closed  bool
+}
+
+// New starts a shipper posting to endpoint, the full URL of /logs/ingest,
+// with secret as the bearer token. opts may be nil.
+func New(endpoint, secret string, opts *Options) *Shipper {
+	var options Options
+	if opts != nil {
+		options = *opts
+	}
+	if options.Source == "" {
+		options.Source = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	}
+	if options.Source == "" {
+		options.Source = "unknown"
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+	if options.Workers <= 0 {
+		options.Workers = defaultWorkers
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+	switch {
+	case options.MaxRetries == 0:
+		options.MaxRetries = defaultMaxRetries
+	case options.MaxRetries < 0:
+		options.MaxRetries = 0
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = defaultRetryDelay
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: options.Timeout}
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			fmt.Fprintln(os.Stderr, "[tinytail]", err)
+		}
+	}
+
+	s := &Shipper{
+		endpoint: endpoint,
+		secret:   secret,
+		options:  options,
+		queue:    make(chan Entry, options.QueueSize),
+	}
+	for range options.Workers {
+		go s.work()
+	}
+	return s
+}
+
+// Send queues an entry without waiting for it to be sent
+func (s *Shipper) Send(entry Entry) error {
+	if entry.Source == "" {
+		entry.Source = s.options.Source
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	select {
+	case s.queue <- entry:
+		s.pending++
+		return nil
+	default:
+		s.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Dropped is how many entries were discarded because the queue was full
+func (s *Shipper) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Flush waits until every entry queued so far has been sent or given up on.
+// Call it before a Lambda handler returns: the execution environment is
+// frozen afterwards, and entries still queued wait until the next
+// invocation, or are lost if there isn't one.
+func (s *Shipper) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	if s.pending == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	s.idle = append(s.idle, idle)
+	s.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends what is queued, waiting as long as ctx allows, and stops the
+// workers. Entries sent afterwards are rejected.
+func (s *Shipper) Close(ctx context.Context) error {
+	err := s.Flush(ctx)
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Shipper) work() {
+	for entry := range s.queue {
+		if err := s.sendWithRetry(entry); err != nil {
+			s.options.OnError(fmt.Errorf("failed to send log entry: %w", err))
+		}
+		s.done()
+	}
+}
+
+// done marks an entry as finished, waking Flush callers once none are left
+func (s *Shipper) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	if s.pending == 0 {
+		for _, idle := range s.idle {
+			close(idle)
+		}
+		s.idle = nil
+	}
+}
+
+// statusError is a response other than 2xx
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("TinyTail returned status %d", e.status)
+}
+
+// retryable reports whether another attempt could succeed: network errors,
+// throttling and server errors are worth retrying, rejected requests aren't
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.status == http.StatusTooManyRequests || status.status >= 500
+	}
+	return true
+}
+
+// sendWithRetry posts an entry, sending the same Idempotency-Key with each
+// attempt so one that timed out after the entry was stored doesn't store it
+// twice
+func (s *Shipper) sendWithRetry(entry Entry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = s.post(body, hex.EncodeToString(key[:]))
+		if err == nil || attempt >= s.options.MaxRetries || !retryable(err) {
+			return err
+		}
+		time.Sleep(s.options.RetryDelay)
+	}
+}
+
+func (s *Shipper) post(body []byte, idempotencyKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+s.secret)
+	request.Header.Set("Idempotency-Key", idempotencyKey)
+
+	response, err := s.options.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return &statusError{status: response.StatusCode}
+	}
+	return nil
+}
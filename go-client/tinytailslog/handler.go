@@ -0,0 +1,211 @@
+// Package tinytailslog is a log/slog handler that ships records to TinyTail.
+//
+// Records are queued and sent in the background, so logging never waits on
+// the network. One line sends everything logged through slog to TinyTail:
+//
+//	slog.SetDefault(slog.New(tinytailslog.New(os.Getenv("TINYTAIL_ENDPOINT"), os.Getenv("TINYTAIL_SECRET"), nil)))
+//
+// In Lambda, queued records must be sent before the handler returns, since
+// the execution environment is frozen until the next invocation. Wrap the
+// handler with FlushAfter, or call Flush yourself.
+package tinytailslog
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/go-client/shipper"
+)
+
+// Options configure a Handler. The zero value ships records at info level
+// and above with the shipper's defaults.
+type Options struct {
+	// Level is the minimum level shipped (default info)
+	Level slog.Leveler
+
+	// Next also receives every record, e.g. a slog.JSONHandler writing to
+	// stdout so the logs still reach CloudWatch. It applies its own level.
+	Next slog.Handler
+
+	// Shipper tunes queueing and sending, and sets the source name
+	Shipper shipper.Options
+}
+
+// Handler is a slog.Handler sending records to a TinyTail ingest endpoint
+type Handler struct {
+	shipper *shipper.Shipper
+	level   slog.Leveler
+	next    slog.Handler
+
+	// attrs were added with WithAttrs, their keys already qualified by the
+	// group they were added in
+	attrs []slog.Attr
+	group string
+}
+
+// New returns a handler posting to endpoint, the full URL of /logs/ingest,
+// with secret as the bearer token. opts may be nil.
+func New(endpoint, secret string, opts *Options) *Handler {
+	var options Options
+	if opts != nil {
+		options = *opts
+	}
+	level := options.Level
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &Handler{
+		shipper: shipper.New(endpoint, secret, &options.Shipper),
+		level:   level,
+		next:    options.Next,
+	}
+}
+
+// Flush waits until every record logged so far has been sent, or ctx is done
+func (h *Handler) Flush(ctx context.Context) error {
+	return h.shipper.Flush(ctx)
+}
+
+// Close sends what is queued and stops shipping
+func (h *Handler) Close(ctx context.Context) error {
+	return h.shipper.Close(ctx)
+}
+
+// FlushAfter wraps a Lambda handler so the records it logs are sent before
+// each invocation returns:
+//
+//	lambda.Start(tinytailslog.FlushAfter(h, handle))
+//
+// The flush stops at the invocation's deadline; whatever is left goes out
+// during the next invocation.
+func FlushAfter[In, Out any](h *Handler, fn func(context.Context, In) (Out, error)) func(context.Context, In) (Out, error) {
+	return func(ctx context.Context, in In) (Out, error) {
+		out, err := fn(ctx, in)
+		_ = h.Flush(ctx)
+		return out, err
+	}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() || (h.next != nil && h.next.Enabled(ctx, level))
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	var err error
+	if h.next != nil && h.next.Enabled(ctx, record.Level) {
+		err = h.next.Handle(ctx, record)
+	}
+	if record.Level < h.level.Level() {
+		return err
+	}
+
+	entry := shipper.Entry{
+		Level:     levelName(record.Level),
+		Timestamp: record.Time,
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	var message strings.Builder
+	message.WriteString(record.Message)
+	write := func(a slog.Attr) {
+		// The correlation fields TinyTail searches on are sent as such,
+		// from the top level only
+		switch a.Key {
+		case "request_id", "requestId", "aws_request_id":
+			if entry.RequestID == "" {
+				entry.RequestID = a.Value.String()
+				return
+			}
+		case "logger":
+			if entry.Logger == "" {
+				entry.Logger = a.Value.String()
+				return
+			}
+		}
+		message.WriteByte(' ')
+		message.WriteString(a.String())
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		for _, flat := range flatten(h.group, a) {
+			write(flat)
+		}
+		return true
+	})
+	entry.Message = message.String()
+
+	if sendErr := h.shipper.Send(entry); err == nil {
+		err = sendErr
+	}
+	return err
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	clone := *h
+	clone.attrs = h.attrs[:len(h.attrs):len(h.attrs)]
+	for _, a := range attrs {
+		clone.attrs = append(clone.attrs, flatten(h.group, a)...)
+	}
+	if h.next != nil {
+		clone.next = h.next.WithAttrs(attrs)
+	}
+	return &clone
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.group = h.group + name + "."
+	if h.next != nil {
+		clone.next = h.next.WithGroup(name)
+	}
+	return &clone
+}
+
+// flatten resolves an attribute into key=value pairs, naming those inside
+// groups by their path, e.g. "http.status"
+func flatten(prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return nil
+	}
+	if a.Value.Kind() != slog.KindGroup {
+		a.Key = prefix + a.Key
+		return []slog.Attr{a}
+	}
+
+	// A group without a key is inlined
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	var flat []slog.Attr
+	for _, member := range a.Value.Group() {
+		flat = append(flat, flatten(prefix, member)...)
+	}
+	return flat
+}
+
+// levelName matches the level names other TinyTail producers send
+func levelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARN"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
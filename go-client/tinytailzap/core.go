@@ -0,0 +1,171 @@
+// Package tinytailzap is a zap core that ships entries to TinyTail.
+//
+// Entries are queued and sent in the background, so logging never waits on
+// the network. Tee it with an existing core to keep that output too:
+//
+//	logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+//		return zapcore.NewTee(core, tinytailzap.New(endpoint, secret, nil))
+//	}))
+//
+// Logger.Sync waits for queued entries to be sent. In Lambda, call it before
+// the handler returns, since the execution environment is frozen until the
+// next invocation.
+package tinytailzap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/go-client/shipper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Options configure a core. The zero value ships every entry at info level
+// and above with the shipper's defaults.
+type Options struct {
+	// Level decides which entries are shipped (default info and above)
+	Level zapcore.LevelEnabler
+
+	// Sampling, if set, caps repeated entries: each second, the first
+	// Initial entries with the same level and message are shipped, then
+	// every Thereafter-th. Noisy loops then cost a few requests, not
+	// thousands.
+	Sampling *zap.SamplingConfig
+
+	// SyncTimeout bounds how long Sync waits for queued entries to be sent
+	// (default 5 seconds)
+	SyncTimeout time.Duration
+
+	// Shipper tunes queueing and sending, and sets the source name
+	Shipper shipper.Options
+}
+
+const defaultSyncTimeout = 5 * time.Second
+
+// core is a zapcore.Core sending entries to a TinyTail ingest endpoint
+type core struct {
+	zapcore.LevelEnabler
+	shipper     *shipper.Shipper
+	syncTimeout time.Duration
+
+	// fields were added with With
+	fields []zapcore.Field
+}
+
+// New returns a core posting to endpoint, the full URL of /logs/ingest,
+// with secret as the bearer token. opts may be nil.
+func New(endpoint, secret string, opts *Options) zapcore.Core {
+	var options Options
+	if opts != nil {
+		options = *opts
+	}
+	if options.Level == nil {
+		options.Level = zapcore.InfoLevel
+	}
+	if options.SyncTimeout <= 0 {
+		options.SyncTimeout = defaultSyncTimeout
+	}
+
+	var c zapcore.Core = &core{
+		LevelEnabler: options.Level,
+		shipper:      shipper.New(endpoint, secret, &options.Shipper),
+		syncTimeout:  options.SyncTimeout,
+	}
+	if sampling := options.Sampling; sampling != nil {
+		c = zapcore.NewSamplerWithOptions(c, time.Second, sampling.Initial, sampling.Thereafter)
+	}
+	return c
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = append(c.fields[:len(c.fields):len(c.fields)], fields...)
+	return &clone
+}
+
+func (c *core) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *core) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range c.fields {
+		field.AddTo(encoder)
+	}
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+
+	shipped := shipper.Entry{
+		Level:     levelName(entry.Level),
+		Timestamp: entry.Time,
+		Logger:    entry.LoggerName,
+	}
+	// The correlation field TinyTail searches on is sent as such
+	for _, key := range []string{"request_id", "requestId", "aws_request_id"} {
+		if id, ok := encoder.Fields[key].(string); ok {
+			shipped.RequestID = id
+			delete(encoder.Fields, key)
+			break
+		}
+	}
+
+	var message strings.Builder
+	message.WriteString(entry.Message)
+	writeFields(&message, "", encoder.Fields)
+	if entry.Stack != "" {
+		message.WriteString("\n")
+		message.WriteString(entry.Stack)
+	}
+	shipped.Message = message.String()
+
+	return c.shipper.Send(shipped)
+}
+
+// Sync waits for the entries queued so far to be sent
+func (c *core) Sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.syncTimeout)
+	defer cancel()
+	return c.shipper.Flush(ctx)
+}
+
+// writeFields appends fields as key=value in key order, naming those in
+// namespaces and objects by their path, e.g. "http.status"
+func writeFields(message *strings.Builder, prefix string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if nested, ok := fields[key].(map[string]interface{}); ok {
+			writeFields(message, prefix+key+".", nested)
+			continue
+		}
+		fmt.Fprintf(message, " %s%s=%v", prefix, key, fields[key])
+	}
+}
+
+// levelName matches the level names other TinyTail producers send
+func levelName(level zapcore.Level) string {
+	switch {
+	case level >= zapcore.PanicLevel:
+		return "FATAL"
+	case level >= zapcore.ErrorLevel:
+		return "ERROR"
+	case level >= zapcore.WarnLevel:
+		return "WARN"
+	case level >= zapcore.InfoLevel:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
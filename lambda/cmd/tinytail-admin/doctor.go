@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/tinytail/tinytail/internal/awsapi"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/doctor"
+)
+
+// doctorCallTimeout bounds each Lambda and EventBridge call; invoking the
+// function for its permission checks can include a cold start
+const doctorCallTimeout = 30 * time.Second
+
+// runDoctor checks a deployment and prints what it found, with a fix for
+// each problem. It returns the exit status: 1 if any check failed.
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	functionName := flags.String("function", "tinytail", "deployed function to check, or empty to check only the tables and SES")
+	_ = flags.Parse(args)
+
+	ctx := context.Background()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load AWS config: %v\n", err)
+		return 1
+	}
+	lambda := awsapi.New(awsConfig, "lambda", "", doctorCallTimeout)
+
+	report := &doctorReport{}
+	var function *doctor.Function
+	if *functionName != "" {
+		function, err = doctor.GetFunction(ctx, lambda, *functionName)
+		if err != nil {
+			report.section("Function", []doctor.Result{{
+				Check:  "function " + *functionName,
+				Detail: err.Error(),
+				Fix:    "check --function and the region, and that you may call lambda:GetFunction",
+			}})
+		} else {
+			// Check what the function is configured with, not this shell
+			for name, value := range function.Environment {
+				if strings.HasPrefix(name, "TINYTAIL_") {
+					os.Setenv(name, value)
+				}
+			}
+		}
+	}
+
+	tables, err := config.TablesFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	db := dynamoClient(awsConfig)
+
+	report.section("Tables", doctor.Tables(ctx, db, tables, os.Getenv("TINYTAIL_NO_AUTH") == "true"))
+	if function != nil {
+		report.section("Stream", doctor.Stream(ctx, db, lambda, function, tables.Logs))
+	}
+	report.section("SES", doctor.Sender(ctx, sesv2.NewFromConfig(awsConfig), os.Getenv("TINYTAIL_ALERT_FROM_EMAIL")))
+	if function != nil {
+		report.section("IAM permissions of "+function.Role, doctor.RemotePermissions(ctx, lambda, function))
+		report.section("Schedules", doctor.Schedules(ctx, awsapi.New(awsConfig, "events", "", doctorCallTimeout), function))
+	}
+
+	if report.failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", report.failed, report.checks)
+		return 1
+	}
+	fmt.Printf("\nAll %d checks passed\n", report.checks)
+	return 0
+}
+
+// doctorReport prints results as they come, counting failures
+type doctorReport struct {
+	checks int
+	failed int
+}
+
+// section prints a heading and its results. Passing permission checks
+// would drown out the rest, so only their count is printed.
+func (r *doctorReport) section(heading string, results []doctor.Result) {
+	fmt.Printf("\n%s\n", heading)
+	quiet := strings.HasPrefix(heading, "IAM permissions")
+	passed := 0
+	for _, result := range results {
+		r.checks++
+		if result.OK {
+			passed++
+			if !quiet {
+				fmt.Printf("  ✓ %s: %s\n", result.Check, result.Detail)
+			}
+			continue
+		}
+		r.failed++
+		fmt.Printf("  ✗ %s: %s\n", result.Check, result.Detail)
+		if result.Fix != "" {
+			fmt.Printf("      fix: %s\n", result.Fix)
+		}
+	}
+	if quiet && passed > 0 {
+		fmt.Printf("  ✓ %d actions allowed\n", passed)
+	}
+}
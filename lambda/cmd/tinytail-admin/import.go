@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinytail/tinytail/internal/agent"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// importProgressInterval is how often import-file reports how far it has got
+const importProgressInterval = 10 * time.Second
+
+// importer writes the entries parsed from files to a logs table
+type importer struct {
+	input     agent.FileInput
+	multiline *regexp.Regexp
+	logs      *store.LogStore // nil for a dry run
+	limiter   <-chan time.Time
+	skip      int
+
+	read     int // Entries parsed, including those skipped
+	imported int
+	undated  int
+	reported time.Time
+}
+
+// importFile backfills logs from files, such as an old ELK export, writing
+// them straight to the logs table at a limited rate. It returns the exit
+// status.
+func importFile(args []string) int {
+	flags := flag.NewFlagSet("import-file", flag.ExitOnError)
+	var imp importer
+	env := flags.String("env", "", "environment to import into (default the main logs table)")
+	flags.StringVar(&imp.input.Format, "format", "", "how lines are parsed: json, text or regex (default json for .json, .jsonl and .ndjson files, otherwise text)")
+	flags.StringVar(&imp.input.Pattern, "pattern", "", "regex format: expression whose named groups message, level, timestamp, source, logger and request_id fill those fields")
+	flags.StringVar(&imp.input.TimestampFormat, "timestamp-format", "", "regex format: Go layout of the timestamp group (default RFC3339)")
+	flags.StringVar(&imp.input.MultilinePattern, "multiline-pattern", "", "expression matching the first line of an entry; lines that don't match are joined to the entry before")
+	flags.StringVar(&imp.input.Source, "source", "", "source for entries without one (default the file's name)")
+	flags.StringVar(&imp.input.Logger, "logger", "", "logger for entries without one")
+	flags.StringVar(&imp.input.Level, "level", "INFO", "level for entries without one")
+	rate := flags.Float64("rate", 100, "most entries written per second, or 0 for no limit")
+	flags.IntVar(&imp.skip, "skip", 0, "entries to skip first, to carry on after a failed import")
+	dryRun := flags.Bool("dry-run", false, "print the parsed entries as JSON lines instead of writing them")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: tinytail-admin import-file [flags] FILE|s3://bucket/key...\n\nFiles ending in .gz are decompressed.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if imp.input.Format != "" {
+		if _, err := agent.NewParser(imp.input); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if imp.input.MultilinePattern != "" {
+		var err error
+		if imp.multiline, err = regexp.Compile(imp.input.MultilinePattern); err != nil {
+			fmt.Fprintf(os.Stderr, "multiline-pattern: %v\n", err)
+			return 2
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load AWS config: %v\n", err)
+		return 1
+	}
+
+	if !*dryRun {
+		tables, err := config.TablesFromEnv()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		table := tables.Logs
+		if *env != "" && *env != store.DefaultEnvironment {
+			var ok bool
+			if table, ok = tables.EnvironmentLogs[*env]; !ok {
+				fmt.Fprintf(os.Stderr, "Unknown environment %q; environments come from TINYTAIL_ENVIRONMENTS\n", *env)
+				return 1
+			}
+		}
+		maxMessageSize, err := store.MaxMessageSizeFromEnv()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		imp.logs = store.NewLogStore(dynamoClient(awsConfig), table, maxMessageSize)
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			imp.limiter = ticker.C
+		}
+	}
+
+	imp.reported = time.Now()
+	for _, location := range flags.Args() {
+		if err := imp.importFrom(ctx, awsConfig, location); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", location, err)
+			if imp.imported > 0 || imp.skip > 0 {
+				fmt.Fprintf(os.Stderr, "Imported %d entries; run again with --skip %d to carry on\n", imp.imported, imp.read)
+			}
+			return 1
+		}
+	}
+
+	if imp.undated > 0 {
+		fmt.Fprintf(os.Stderr, "%d entries had no timestamp and were given the time they were imported\n", imp.undated)
+	}
+	if !*dryRun {
+		fmt.Printf("✓ Imported %d entries\n", imp.imported)
+	}
+	return 0
+}
+
+// importFrom imports one file. Entries up to a failure are kept, and
+// imp.read says where to carry on from.
+func (imp *importer) importFrom(ctx context.Context, awsConfig aws.Config, location string) error {
+	body, err := openImportFile(ctx, awsConfig, location)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	name := strings.TrimSuffix(path.Base(location), ".gz")
+	input := imp.input
+	if input.Format == "" {
+		input.Format = "text"
+		switch path.Ext(name) {
+		case ".json", ".jsonl", ".ndjson":
+			input.Format = "json"
+		}
+	}
+	if input.Source == "" {
+		input.Source = strings.TrimSuffix(name, path.Ext(name))
+	}
+	parse, err := agent.NewParser(input)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		text := strings.Join(pending, "\n")
+		pending = nil
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		if input.Format == "json" {
+			text = unwrapElasticsearchHit(text)
+		}
+		return imp.store(ctx, parse(text), input)
+	}
+
+	reader := bufio.NewReader(body)
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" || readErr == nil {
+			if imp.multiline == nil || imp.multiline.MatchString(line) || pending == nil {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			pending = append(pending, line)
+		}
+		if errors.Is(readErr, io.EOF) {
+			return flush()
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// store fills in an entry's defaults and writes it, unless it is one of
+// those to skip
+func (imp *importer) store(ctx context.Context, entry store.LogEntry, input agent.FileInput) error {
+	if entry.Level == "" {
+		entry.Level = strings.ToUpper(input.Level)
+	}
+	entry.Source = cmp.Or(entry.Source, input.Source)
+	entry.Logger = cmp.Or(entry.Logger, input.Logger)
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+		imp.undated++
+	}
+
+	imp.read++
+	if imp.read <= imp.skip {
+		return nil
+	}
+	if imp.logs == nil {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(line))
+		return nil
+	}
+
+	if imp.limiter != nil {
+		select {
+		case <-imp.limiter:
+		case <-ctx.Done():
+			imp.read--
+			return ctx.Err()
+		}
+	}
+	if err := imp.logs.StoreLogEntry(ctx, &entry); err != nil {
+		imp.read--
+		return fmt.Errorf("failed to store entry %d: %w", imp.read+1, err)
+	}
+	imp.imported++
+	if time.Since(imp.reported) >= importProgressInterval {
+		fmt.Fprintf(os.Stderr, "Imported %d entries\n", imp.imported)
+		imp.reported = time.Now()
+	}
+	return nil
+}
+
+// openImportFile opens a local file or an S3 object, decompressing it if
+// its name ends in .gz
+func openImportFile(ctx context.Context, awsConfig aws.Config, location string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(location, "s3://") {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("must be s3://bucket/key")
+		}
+		output, err := s3.NewFromConfig(awsConfig).GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return nil, err
+		}
+		body = output.Body
+	} else {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		body = file
+	}
+
+	if !strings.HasSuffix(location, ".gz") {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, body}, nil
+}
+
+// unwrapElasticsearchHit returns the document in a line exported from
+// Elasticsearch (e.g. by elasticdump), whose fields are under _source
+func unwrapElasticsearchHit(text string) string {
+	if !strings.Contains(text, `"_source"`) {
+		return text
+	}
+	var hit struct {
+		Source json.RawMessage `json:"_source"`
+	}
+	if err := json.Unmarshal([]byte(text), &hit); err != nil || !strings.HasPrefix(string(hit.Source), "{") {
+		return text
+	}
+	return string(hit.Source)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/ingest"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// loadgenMaxBatch is the most entries the ingest API takes in one request
+const loadgenMaxBatch = 100
+
+// loadgenHealthWindow is the longest span the function's health counters
+// can be summed over
+const loadgenHealthWindow = 99 * time.Minute
+
+// messageSize is one choice in the distribution of message sizes
+type messageSize struct {
+	bytes  int
+	weight int
+}
+
+// loadStep is one rate held for the step's duration, and what happened
+type loadStep struct {
+	rate float64
+
+	mu        sync.Mutex
+	elapsed   time.Duration
+	requests  int
+	entries   int // Entries in requests that were answered with 2xx
+	queued    int // Requests answered 202: entries queued, not stored
+	throttled int // Requests answered 429 by API Gateway or Lambda
+	server    int // Requests answered 5xx
+	failed    int // Other responses and network errors
+	skipped   int // Requests not sent because --concurrency were in flight
+	latencies []time.Duration
+	lastError string
+}
+
+// loadgen sends synthetic log entries to the ingest API at one or more
+// rates, then reports latency, errors and the DynamoDB throttling the
+// function saw. It returns the exit status.
+func loadgen(args []string) int {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	baseURL := flags.String("url", "", "TinyTail API URL including the stage (default $TINYTAIL_URL)")
+	rates := flags.String("rate", "50", "entries per second; a comma-separated list runs each rate in turn, e.g. 50,100,200")
+	duration := flags.Duration("duration", time.Minute, "how long each rate is held")
+	batch := flags.Int("batch", 25, fmt.Sprintf("entries per request, at most %d", loadgenMaxBatch))
+	sizes := flags.String("sizes", "200:90,2000:9,16000:1", "message sizes in bytes with their relative weights")
+	concurrency := flags.Int("concurrency", 16, "most requests in flight; requests due while this many are waiting are skipped and counted")
+	source := flags.String("source", "tinytail-loadgen", "source of the generated entries")
+	level := flags.String("level", "INFO", "level of the generated entries; ERROR entries can fire alert rules")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: tinytail-admin loadgen [flags]\n\nThe ingest secret comes from TINYTAIL_INGEST_SECRET. Generated entries are stored like any others until they expire.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	steps, err := parseRates(*rates)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	distribution, err := parseSizes(*sizes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	largest := slices.MaxFunc(distribution, func(a, b messageSize) int { return a.bytes - b.bytes }).bytes
+	switch {
+	case *batch < 1 || *batch > loadgenMaxBatch:
+		fmt.Fprintf(os.Stderr, "--batch must be between 1 and %d\n", loadgenMaxBatch)
+		return 2
+	case *batch*largest > ingest.MaxBatchBytes:
+		fmt.Fprintf(os.Stderr, "--batch %d of messages up to %d bytes could exceed the %d byte request limit\n", *batch, largest, ingest.MaxBatchBytes)
+		return 2
+	case *concurrency < 1 || *duration <= 0:
+		fmt.Fprintln(os.Stderr, "--concurrency and --duration must be positive")
+		return 2
+	}
+
+	if *baseURL == "" {
+		*baseURL = os.Getenv("TINYTAIL_URL")
+	}
+	secret := os.Getenv("TINYTAIL_INGEST_SECRET")
+	if *baseURL == "" || secret == "" {
+		fmt.Fprintln(os.Stderr, "TINYTAIL_URL (or --url) and TINYTAIL_INGEST_SECRET are required")
+		return 2
+	}
+	client := ingest.NewClient(*baseURL, secret)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	gen := newEntryGenerator(distribution, largest, *source, *level)
+	fmt.Printf("Sending entries with request_id %s, %d per request\n", gen.requestID, *batch)
+	started := time.Now()
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Printf("→ %g entries/s for %s\n", step.rate, *duration)
+		step.run(ctx, client, gen, *batch, *concurrency, *duration)
+	}
+
+	fmt.Println()
+	printSteps(steps)
+	fmt.Println()
+	printServerCounters(started)
+	return 0
+}
+
+// parseRates reads --rate
+func parseRates(value string) ([]*loadStep, error) {
+	var steps []*loadStep
+	for _, field := range strings.Split(value, ",") {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("--rate: %q is not a positive number of entries per second", field)
+		}
+		steps = append(steps, &loadStep{rate: rate})
+	}
+	return steps, nil
+}
+
+// parseSizes reads --sizes: comma-separated BYTES:WEIGHT pairs, where a
+// missing weight is 1
+func parseSizes(value string) ([]messageSize, error) {
+	var sizes []messageSize
+	for _, field := range strings.Split(value, ",") {
+		bytesText, weightText, hasWeight := strings.Cut(strings.TrimSpace(field), ":")
+		size := messageSize{weight: 1}
+		var err error
+		if size.bytes, err = strconv.Atoi(bytesText); err != nil || size.bytes < 1 || size.bytes > ingest.MaxBatchBytes {
+			return nil, fmt.Errorf("--sizes: %q is not a size between 1 and %d bytes", bytesText, ingest.MaxBatchBytes)
+		}
+		if hasWeight {
+			if size.weight, err = strconv.Atoi(weightText); err != nil || size.weight < 1 {
+				return nil, fmt.Errorf("--sizes: %q is not a positive weight", weightText)
+			}
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// run sends batches at the step's rate until its duration is up, then
+// waits for the requests still in flight
+func (s *loadStep) run(ctx context.Context, client *ingest.Client, gen *entryGenerator, batch, concurrency int, duration time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Duration(float64(batch) / s.rate * float64(time.Second)))
+	defer ticker.Stop()
+	inFlight := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	started := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			s.elapsed = time.Since(started)
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			s.mu.Lock()
+			s.skipped++
+			s.mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			entries := gen.batch(batch)
+			sent := time.Now()
+			// In-flight requests are let finish when the step ends
+			queued, err := client.Post(context.WithoutCancel(ctx), entries)
+			s.record(len(entries), time.Since(sent), queued, err)
+		}()
+	}
+}
+
+// record counts the outcome of one request
+func (s *loadStep) record(entries int, latency time.Duration, queued bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	var status *ingest.StatusError
+	switch {
+	case err == nil:
+		s.entries += entries
+		s.latencies = append(s.latencies, latency)
+		if queued {
+			s.queued++
+		}
+		return
+	case errors.As(err, &status) && status.Status == http.StatusTooManyRequests:
+		s.throttled++
+	case errors.As(err, &status) && status.Status >= 500:
+		s.server++
+	default:
+		s.failed++
+	}
+	s.lastError = err.Error()
+}
+
+// percentile returns the latency p of the way through the sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(len(sorted)-1, int(p*float64(len(sorted))))]
+}
+
+// printSteps prints a row per rate, so the point where latency climbs or
+// errors start stands out
+func printSteps(steps []*loadStep) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "rate/s\taccepted/s\trequests\tp50\tp90\tp99\tmax\t202 queued\t429\t5xx\tfailed\tskipped\t")
+	for _, s := range steps {
+		if s.elapsed == 0 {
+			continue // Interrupted before it started
+		}
+		slices.Sort(s.latencies)
+		fmt.Fprintf(w, "%g\t%.1f\t%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t\n",
+			s.rate, float64(s.entries)/s.elapsed.Seconds(), s.requests,
+			roundLatency(percentile(s.latencies, 0.5)), roundLatency(percentile(s.latencies, 0.9)),
+			roundLatency(percentile(s.latencies, 0.99)), roundLatency(percentile(s.latencies, 1)),
+			s.queued, s.throttled, s.server, s.failed, s.skipped)
+	}
+	w.Flush()
+
+	for _, s := range steps {
+		if s.lastError != "" {
+			fmt.Printf("At %g/s the last error was: %s\n", s.rate, s.lastError)
+		}
+	}
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
+
+// printServerCounters reports what the function's health counters saw
+// during the run. They are written to the alerts table by every invocation,
+// so they include any other traffic at the time.
+func printServerCounters(started time.Time) {
+	if time.Since(started) > loadgenHealthWindow {
+		started = time.Now().Add(-loadgenHealthWindow)
+		fmt.Printf("The function's counters for the last %s (all traffic):\n", loadgenHealthWindow)
+	} else {
+		fmt.Println("The function's counters during the run (all traffic):")
+	}
+
+	ctx := context.Background()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Printf("  not available: failed to load AWS config: %v\n", err)
+		return
+	}
+	tables, err := config.TablesFromEnv()
+	if err != nil {
+		fmt.Printf("  not available: %v\n", err)
+		return
+	}
+	health := store.NewHealthCounters(dynamoClient(awsConfig), tables.Alerts)
+	for _, counter := range []struct{ name, describe string }{
+		{store.CounterDynamoDBThrottles, "DynamoDB requests throttled after retries"},
+		{store.CounterIngestDropped, "entries queued that could not be stored"},
+		{store.CounterIngestErrors, "ingest requests failed with 5xx"},
+	} {
+		n, err := health.Sum(ctx, counter.name, started)
+		if err != nil {
+			fmt.Printf("  not available from %s: %v\n", tables.Alerts, err)
+			return
+		}
+		fmt.Printf("  %d %s\n", n, counter.describe)
+	}
+}
+
+// entryGenerator makes log entries with messages drawn from a size
+// distribution. Each run's entries share a request ID, so they can be found.
+type entryGenerator struct {
+	sizes     []messageSize
+	total     int // Sum of the weights
+	filler    string
+	requestID string
+	source    string
+	level     string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newEntryGenerator(sizes []messageSize, largest int, source, level string) *entryGenerator {
+	id := make([]byte, 6)
+	_, _ = rand.Read(id)
+	const words = "lorem ipsum dolor sit amet consectetur adipiscing elit "
+	gen := &entryGenerator{
+		sizes:     sizes,
+		filler:    strings.Repeat(words, largest/len(words)+1),
+		requestID: "loadgen-" + hex.EncodeToString(id),
+		source:    source,
+		level:     level,
+	}
+	for _, size := range sizes {
+		gen.total += size.weight
+	}
+	return gen
+}
+
+// batch returns n new entries
+func (g *entryGenerator) batch(n int) []store.LogEntry {
+	g.mu.Lock()
+	first := g.seq
+	g.seq += n
+	g.mu.Unlock()
+
+	entries := make([]store.LogEntry, n)
+	for i := range entries {
+		prefix := fmt.Sprintf("loadgen entry %d ", first+i)
+		size := max(g.size(), len(prefix))
+		entries[i] = store.LogEntry{
+			Timestamp: time.Now(),
+			Level:     g.level,
+			Source:    g.source,
+			Logger:    "loadgen",
+			RequestID: g.requestID,
+			Message:   prefix + g.filler[:size-len(prefix)],
+		}
+	}
+	return entries
+}
+
+// size picks a message size from the distribution
+func (g *entryGenerator) size() int {
+	pick := mathrand.IntN(g.total)
+	for _, size := range g.sizes {
+		if pick < size.weight {
+			return size.bytes
+		}
+		pick -= size.weight
+	}
+	return g.sizes[len(g.sizes)-1].bytes
+}
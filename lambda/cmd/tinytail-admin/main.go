@@ -0,0 +1,133 @@
+// Command tinytail-admin manages a TinyTail deployment from the command
+// line.
+//
+//	tinytail-admin bootstrap          create the tables, or add what existing ones are missing
+//	tinytail-admin bootstrap --check  report how existing tables differ from what TinyTail expects
+//	tinytail-admin import-file FILE   backfill logs from local or S3 files
+//	tinytail-admin doctor             check a deployment and suggest fixes
+//	tinytail-admin loadgen            measure ingest capacity with synthetic traffic
+//
+// Table names come from the same TINYTAIL_*_TABLE_NAME variables as the
+// function, and TINYTAIL_DYNAMODB_ENDPOINT points it at DynamoDB Local.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+const usage = `usage: tinytail-admin <command> [flags]
+
+commands:
+  bootstrap [--check]         create or validate the DynamoDB tables
+  import-file [flags] FILE... backfill logs from NDJSON or text files, local or s3://
+  doctor [--function NAME]    check tables, stream, SES, IAM permissions and schedules
+  loadgen [flags]             send synthetic logs and report latency, errors and throttling
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "bootstrap":
+		os.Exit(bootstrap(os.Args[2:]))
+	case "import-file":
+		os.Exit(importFile(os.Args[2:]))
+	case "doctor":
+		os.Exit(runDoctor(os.Args[2:]))
+	case "loadgen":
+		os.Exit(loadgen(os.Args[2:]))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// bootstrap creates the tables idempotently, or with --check only reports
+// problems. It returns the exit status: 1 if anything is wrong.
+func bootstrap(args []string) int {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	check := flags.Bool("check", false, "validate the existing tables without changing anything")
+	_ = flags.Parse(args)
+
+	ctx := context.Background()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load AWS config: %v\n", err)
+		return 1
+	}
+	client := dynamoClient(awsConfig)
+
+	tables, err := config.TablesFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, schema := range store.Schemas(tables) {
+		if *check {
+			problems, err := store.CheckSchema(ctx, client, schema)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", schema.Name, err)
+				status = 1
+				continue
+			}
+			for _, problem := range problems {
+				fmt.Printf("✗ %s\n", problem)
+				status = 1
+			}
+			if len(problems) == 0 {
+				fmt.Printf("✓ %s\n", schema.Name)
+			}
+			continue
+		}
+
+		changes, err := store.Bootstrap(ctx, client, schema)
+		for _, change := range changes {
+			fmt.Printf("+ %s\n", change)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", schema.Name, err)
+			status = 1
+			continue
+		}
+
+		// Whatever couldn't be fixed in place still needs reporting
+		problems, err := store.CheckSchema(ctx, client, schema)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", schema.Name, err)
+			status = 1
+			continue
+		}
+		for _, problem := range problems {
+			fmt.Printf("✗ %s\n", problem)
+			status = 1
+		}
+		if len(changes) == 0 && len(problems) == 0 {
+			fmt.Printf("✓ %s already up to date\n", schema.Name)
+		}
+	}
+	return status
+}
+
+// dynamoClient returns a DynamoDB client, pointed at TINYTAIL_DYNAMODB_ENDPOINT
+// if it is set
+func dynamoClient(awsConfig aws.Config) *dynamodb.Client {
+	return dynamodb.NewFromConfig(awsConfig, func(o *dynamodb.Options) {
+		if endpoint := os.Getenv("TINYTAIL_DYNAMODB_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+// Command tinytail-agent ships log files from a server to TinyTail.
+//
+//	tinytail-agent --config /etc/tinytail-agent.json
+//
+// It follows the files the configuration lists, or as a Kubernetes
+// DaemonSet the node's container logs, through rotation, along with the
+// systemd journal, Fluentd forwarders and OpenTelemetry exporters, and
+// posts what they log to the ingest API, authenticating with
+// TINYTAIL_INGEST_SECRET.
+// It stops on SIGINT or SIGTERM after sending what it has read.
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tinytail/tinytail/internal/agent"
+	"github.com/tinytail/tinytail/internal/logging"
+)
+
+func main() {
+	configPath := flag.String("config", "/etc/tinytail-agent.json", "configuration file")
+	flag.Parse()
+
+	logging.Setup()
+	cfg, err := agent.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	secret := os.Getenv("TINYTAIL_INGEST_SECRET")
+	if secret == "" {
+		slog.Error("TINYTAIL_INGEST_SECRET is required")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	slog.Info("TinyTail agent started", "url", cfg.URL, "inputs", cfg.Inputs())
+	if err := agent.Run(ctx, cfg, secret); err != nil {
+		slog.Error("Agent stopped", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("TinyTail agent stopped")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/ingest"
+)
+
+// clientCommands talk to a deployed TinyTail over HTTP, so they run without
+// any of the function's configuration. Each returns the exit status.
+var clientCommands = map[string]func(args []string) int{
+	"search": searchCommand,
+	"export": exportCommand,
+	"ship":   shipCommand,
+}
+
+// clientTimeout bounds each request; the API answers within 29 seconds
+const clientTimeout = 35 * time.Second
+
+// apiClient calls the TinyTail API with an API key
+type apiClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// newAPIClient reads the API's URL, including the stage (e.g.
+// https://abc123.execute-api.us-east-2.amazonaws.com/prod), from the flag
+// or TINYTAIL_URL, and the key from TINYTAIL_API_KEY
+func newAPIClient(baseURL string) (*apiClient, error) {
+	baseURL, apiKey, err := clientSettings(baseURL, "TINYTAIL_API_KEY")
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{baseURL: baseURL, apiKey: apiKey, http: &http.Client{Timeout: clientTimeout}}, nil
+}
+
+// newIngestClient is like newAPIClient, but sends logs with the ingest
+// secret in TINYTAIL_INGEST_SECRET
+func newIngestClient(baseURL string) (*ingest.Client, error) {
+	baseURL, secret, err := clientSettings(baseURL, "TINYTAIL_INGEST_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	return ingest.NewClient(baseURL, secret), nil
+}
+
+// clientSettings returns the API's URL, from the flag or TINYTAIL_URL, and
+// the bearer token in the named variable
+func clientSettings(baseURL, tokenVariable string) (string, string, error) {
+	if baseURL == "" {
+		baseURL = os.Getenv("TINYTAIL_URL")
+	}
+	if baseURL == "" {
+		return "", "", errors.New("TINYTAIL_URL or --url is required")
+	}
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", "", fmt.Errorf("the TinyTail URL must be an http or https URL, got %q", baseURL)
+	}
+
+	token := os.Getenv(tokenVariable)
+	if token == "" {
+		return "", "", fmt.Errorf("%s is required", tokenVariable)
+	}
+	return strings.TrimSuffix(baseURL, "/"), token, nil
+}
+
+// get reads the JSON response to a GET request into v
+func (c *apiClient) get(ctx context.Context, path string, query url.Values, v any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("%s: %s", response.Status, apiError.Error)
+		}
+		return fmt.Errorf("%s", response.Status)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/tinytail/tinytail/internal/cloudtrail"
+	"github.com/tinytail/tinytail/internal/handler"
+	"github.com/tinytail/tinytail/internal/logging"
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/tracing"
+)
+
+// eventProbe is an invocation event decoded just far enough to tell what
+// sent it
+type eventProbe map[string]interface{}
+
+// requestContext returns the event's requestContext object, if any
+func (p eventProbe) requestContext() (map[string]interface{}, bool) {
+	rc, ok := p["requestContext"].(map[string]interface{})
+	return rc, ok
+}
+
+// firstRecord returns the first entry of a batched event's Records array
+func (p eventProbe) firstRecord() (map[string]interface{}, bool) {
+	records, ok := p["Records"].([]interface{})
+	if !ok || len(records) == 0 {
+		return nil, false
+	}
+	first, ok := records[0].(map[string]interface{})
+	return first, ok
+}
+
+// eventSource recognises one kind of invocation event and handles it.
+// Sources are tried in priority order, lowest first, so more specific
+// shapes are checked before the general ones they resemble: ALB and HTTP
+// API events both carry a requestContext, like REST API events.
+type eventSource struct {
+	name     string
+	priority int
+	matches  func(eventProbe) bool
+	handle   func(ctx context.Context, event json.RawMessage, probe eventProbe) (interface{}, error)
+
+	// quiet sources are handled without any AWS calls, so the health
+	// counters are left for the next invocation to flush
+	quiet bool
+}
+
+// eventRouter dispatches invocation events to the first matching source
+type eventRouter struct {
+	sources []eventSource
+
+	// tracer wraps each handled event in an X-Ray subsegment; nil when
+	// tracing is off
+	tracer *tracing.Tracer
+}
+
+func (r *eventRouter) register(source eventSource) {
+	r.sources = append(r.sources, source)
+	sort.SliceStable(r.sources, func(i, j int) bool { return r.sources[i].priority < r.sources[j].priority })
+}
+
+// dispatch routes the event, logging the decision so it can be filtered
+// on in CloudWatch Logs Insights. Everything logged while handling the
+// event carries its source and the Lambda request ID. It returns the source
+// that handled the event, or nil if none recognised it.
+func (r *eventRouter) dispatch(ctx context.Context, event json.RawMessage) (interface{}, *eventSource, error) {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		ctx = logging.With(ctx, "aws_request_id", lc.AwsRequestID)
+	}
+
+	var probe eventProbe
+	if err := json.Unmarshal(event, &probe); err == nil {
+		for i := range r.sources {
+			source := &r.sources[i]
+			if source.matches(probe) {
+				ctx = logging.With(ctx, "event_source", source.name)
+				slog.InfoContext(ctx, "Event routed", "bytes", len(event))
+				ctx, segment := r.tracer.Start(ctx, "tinytail "+source.name)
+				segment.Annotate("event_source", source.name)
+				result, err := handleRecovered(ctx, source, event, probe)
+				segment.Close(err)
+				return result, source, err
+			}
+		}
+	}
+
+	slog.WarnContext(ctx, "Event not recognised", "bytes", len(event), "event", string(event))
+	return nil, nil, nil
+}
+
+// handleRecovered runs the source's handler, turning a panic into an error
+// so the invocation fails the way any other error does, with the stack
+// logged, instead of crashing the runtime
+func handleRecovered(ctx context.Context, source *eventSource, event json.RawMessage, probe eventProbe) (result interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			slog.ErrorContext(ctx, "Recovered from panic handling event", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			metrics.Emit(map[string]string{"Handler": source.name},
+				metrics.Metric{Name: "Panics", Unit: metrics.Count, Value: 1})
+			result, err = nil, fmt.Errorf("panic handling %s event: %v", source.name, recovered)
+		}
+	}()
+	return source.handle(ctx, event, probe)
+}
+
+// isWarmer recognises keep-warm pings: {"warmer": true} or
+// {"action": "warmup"} sent directly or as a scheduled event's detail, and
+// serverless-plugin-warmup's events
+func isWarmer(p eventProbe) bool {
+	marked := func(m map[string]interface{}) bool {
+		return m["warmer"] == true || m["action"] == "warmup"
+	}
+	if marked(p) || p["source"] == "serverless-plugin-warmup" {
+		return true
+	}
+	detail, ok := p["detail"].(map[string]interface{})
+	return ok && p["detail-type"] != nil && marked(detail)
+}
+
+// decodeEvent unmarshals the event into the handler's input type
+func decodeEvent[T any](handle func(context.Context, T) (interface{}, error)) func(context.Context, json.RawMessage, eventProbe) (interface{}, error) {
+	return func(ctx context.Context, event json.RawMessage, _ eventProbe) (interface{}, error) {
+		var decoded T
+		if err := json.Unmarshal(event, &decoded); err != nil {
+			return nil, err
+		}
+		return handle(ctx, decoded)
+	}
+}
+
+// newEventRouter registers every event source the function serves
+func (u *UniversalHandler) newEventRouter() *eventRouter {
+	router := &eventRouter{tracer: u.tracer}
+
+	// Keep-warm pings return straight away, before anything else can
+	// mistake them for real work such as a scheduled alert evaluation
+	router.register(eventSource{
+		name:     "warmer",
+		priority: 0,
+		matches:  isWarmer,
+		handle: func(context.Context, json.RawMessage, eventProbe) (interface{}, error) {
+			return map[string]bool{"warm": true}, nil
+		},
+		quiet: true,
+	})
+
+	// tinytail-admin doctor invokes the function directly to check its
+	// role's permissions
+	router.register(eventSource{
+		name:     "doctor",
+		priority: 5,
+		matches: func(p eventProbe) bool {
+			return p["action"] == "doctor"
+		},
+		handle: func(ctx context.Context, _ json.RawMessage, _ eventProbe) (interface{}, error) {
+			return u.checkPermissions(ctx), nil
+		},
+	})
+
+	// Other functions invoke the function directly to store entries,
+	// without the cost and latency of API Gateway
+	router.register(eventSource{
+		name:     "invoke-ingest",
+		priority: 6,
+		matches: func(p eventProbe) bool {
+			return p["action"] == "ingest"
+		},
+		handle: decodeEvent(func(ctx context.Context, e handler.InvokeIngest) (interface{}, error) {
+			return u.httpHandler.HandleInvokeIngest(ctx, e)
+		}),
+	})
+
+	// Application Load Balancers identify themselves in the request context
+	router.register(eventSource{
+		name:     "alb",
+		priority: 10,
+		matches: func(p eventProbe) bool {
+			rc, ok := p.requestContext()
+			return ok && rc["elb"] != nil
+		},
+		handle: decodeEvent(func(ctx context.Context, e events.ALBTargetGroupRequest) (interface{}, error) {
+			return u.httpHandler.HandleALB(ctx, e)
+		}),
+	})
+
+	// HTTP APIs (and function URLs) send payload format 2.0
+	router.register(eventSource{
+		name:     "http-api",
+		priority: 20,
+		matches: func(p eventProbe) bool {
+			_, ok := p.requestContext()
+			return ok && p["version"] == "2.0"
+		},
+		handle: decodeEvent(func(ctx context.Context, e events.APIGatewayV2HTTPRequest) (interface{}, error) {
+			return u.httpHandler.HandleHTTPAPI(ctx, e)
+		}),
+	})
+
+	router.register(eventSource{
+		name:     "rest-api",
+		priority: 30,
+		matches: func(p eventProbe) bool {
+			_, ok := p.requestContext()
+			return ok
+		},
+		handle: decodeEvent(func(ctx context.Context, e events.APIGatewayProxyRequest) (interface{}, error) {
+			return u.httpHandler.Handle(ctx, e)
+		}),
+	})
+
+	// New log entries from the logs table's stream, for realtime alerts
+	router.register(eventSource{
+		name:     "dynamodb-stream",
+		priority: 40,
+		matches: func(p eventProbe) bool {
+			first, ok := p.firstRecord()
+			return ok && first["eventSource"] == "aws:dynamodb"
+		},
+		handle: decodeEvent(func(ctx context.Context, e events.DynamoDBEvent) (interface{}, error) {
+			return nil, u.handleStreamEvent(ctx, e)
+		}),
+	})
+
+	// Entries queued after failing to store, delivered back for another
+	// attempt. Failed messages are reported individually so the rest of
+	// the batch isn't redelivered.
+	if u.ingestQueue != nil {
+		router.register(eventSource{
+			name:     "sqs-dlq",
+			priority: 45,
+			matches: func(p eventProbe) bool {
+				first, ok := p.firstRecord()
+				arn, _ := first["eventSourceARN"].(string)
+				return ok && first["eventSource"] == "aws:sqs" && u.ingestQueue.IsSource(arn)
+			},
+			handle: decodeEvent(func(ctx context.Context, e events.SQSEvent) (interface{}, error) {
+				return u.ingestQueue.Reprocess(ctx, e, u.environments, u.health), nil
+			}),
+		})
+	}
+
+	// Forwarding deliveries queued after failing, delivered back for another
+	// attempt, reported individually like the ingest dead-letter queue's
+	if u.forwarder != nil {
+		router.register(eventSource{
+			name:     "sqs-forward",
+			priority: 46,
+			matches: func(p eventProbe) bool {
+				first, ok := p.firstRecord()
+				arn, _ := first["eventSourceARN"].(string)
+				return ok && first["eventSource"] == "aws:sqs" && u.forwarder.IsSource(arn)
+			},
+			handle: decodeEvent(func(ctx context.Context, e events.SQSEvent) (interface{}, error) {
+				return u.forwarder.Redeliver(ctx, e), nil
+			}),
+		})
+	}
+
+	// Entries from Kinesis streams, with failures reported so the shard is
+	// retried from the first record that wasn't stored
+	router.register(eventSource{
+		name:     "kinesis",
+		priority: 47,
+		matches: func(p eventProbe) bool {
+			first, ok := p.firstRecord()
+			return ok && first["eventSource"] == "aws:kinesis"
+		},
+		handle: decodeEvent(func(ctx context.Context, e events.KinesisEvent) (interface{}, error) {
+			return u.handleKinesis(ctx, e), nil
+		}),
+	})
+
+	// CloudTrail log files delivered to S3, and files dropped into the log
+	// bucket, announced by the buckets' event notifications
+	if u.cloudTrail.Enabled || u.logFiles != nil {
+		router.register(eventSource{
+			name:     "s3",
+			priority: 48,
+			matches: func(p eventProbe) bool {
+				first, ok := p.firstRecord()
+				return ok && first["eventSource"] == "aws:s3"
+			},
+			handle: decodeEvent(func(ctx context.Context, e events.S3Event) (interface{}, error) {
+				return nil, u.handleS3Event(ctx, e)
+			}),
+		})
+	}
+
+	// SES bounce and complaint notifications
+	router.register(eventSource{
+		name:     "sns",
+		priority: 50,
+		matches: func(p eventProbe) bool {
+			first, ok := p.firstRecord()
+			return ok && first["EventSource"] == "aws:sns"
+		},
+		handle: decodeEvent(func(ctx context.Context, e events.SNSEvent) (interface{}, error) {
+			return nil, u.handleSNSEvent(ctx, e)
+		}),
+	})
+
+	// CloudTrail events matched by an EventBridge rule, which would
+	// otherwise look like alert triggers
+	if u.cloudTrail.Enabled {
+		router.register(eventSource{
+			name:     "cloudtrail",
+			priority: 55,
+			matches: func(p eventProbe) bool {
+				detailType, _ := p["detail-type"].(string)
+				return strings.HasSuffix(detailType, " via CloudTrail")
+			},
+			handle: decodeEvent(func(ctx context.Context, e events.CloudWatchEvent) (interface{}, error) {
+				var event cloudtrail.Event
+				if err := json.Unmarshal(e.Detail, &event); err != nil {
+					return nil, err
+				}
+				return nil, u.handleCloudTrail(ctx, []cloudtrail.Event{event})
+			}),
+		})
+	}
+
+	// Applications' own events, from sources with a configured prefix
+	if u.appEvents.Enabled() {
+		router.register(eventSource{
+			name:     "app-event",
+			priority: 58,
+			matches: func(p eventProbe) bool {
+				source, _ := p["source"].(string)
+				_, hasDetailType := p["detail-type"]
+				return hasDetailType && u.appEvents.Matches(source)
+			},
+			handle: decodeEvent(func(ctx context.Context, e events.CloudWatchEvent) (interface{}, error) {
+				return nil, u.handleAppEvent(ctx, e)
+			}),
+		})
+	}
+
+	// Scheduled and on-demand alert evaluation
+	router.register(eventSource{
+		name:     "eventbridge",
+		priority: 60,
+		matches: func(p eventProbe) bool {
+			_, hasSource := p["source"]
+			_, hasDetailType := p["detail-type"]
+			return hasSource && hasDetailType
+		},
+		handle: func(ctx context.Context, _ json.RawMessage, p eventProbe) (interface{}, error) {
+			return u.handleAlertTrigger(ctx, p["detail"])
+		},
+	})
+
+	return router
+}
@@ -3,99 +3,494 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/tinytail/tinytail/internal/alerts"
+	"github.com/tinytail/tinytail/internal/appevents"
+	"github.com/tinytail/tinytail/internal/cloudtrail"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/dlq"
+	"github.com/tinytail/tinytail/internal/doctor"
+	"github.com/tinytail/tinytail/internal/forwarding"
 	"github.com/tinytail/tinytail/internal/handler"
+	"github.com/tinytail/tinytail/internal/logfiles"
+	"github.com/tinytail/tinytail/internal/logging"
 	"github.com/tinytail/tinytail/internal/store"
+	"github.com/tinytail/tinytail/internal/tracing"
 )
 
 type UniversalHandler struct {
 	httpHandler  *handler.Handler
-	alertHandler *alerts.AlertHandler
+	health       *store.HealthCounters
+	environments *store.Environments
+	ingestQueue  *dlq.Queue
+	forwarder    *forwarding.Forwarder
+	tracer       *tracing.Tracer
+	router       *eventRouter
+
+	// cloudTrail says which CloudTrail events are stored; cloudTrailFiles
+	// reads the log files delivered to S3, and is nil unless enabled
+	cloudTrail      cloudtrail.Config
+	cloudTrailFiles *cloudtrail.Files
+
+	// kinesisEnv is the environment Kinesis records are stored in
+	kinesisEnv string
+
+	// logFilesConfig names the bucket log files are dropped into; logFiles
+	// reads them, and is nil unless a bucket is set
+	logFilesConfig logfiles.Config
+	logFiles       *logfiles.Files
+
+	// appEvents says which custom EventBridge events are stored
+	appEvents appevents.Config
+
+	// checkPermissions makes tinytail-admin doctor's dry-run calls with the
+	// function's role
+	checkPermissions func(context.Context) []doctor.Result
+
+	// The alert handler loads rules and connects to SES, so it is only
+	// created for invocations that need it
+	alertHandlerMu  sync.Mutex
+	alertHandler    *alerts.AlertHandler
+	newAlertHandler func() (*alerts.AlertHandler, error)
+}
+
+// alerting returns the alert handler, creating it on first use. A failure
+// fails just the invocation that needed it, and the next one tries again.
+func (u *UniversalHandler) alerting() (*alerts.AlertHandler, error) {
+	u.alertHandlerMu.Lock()
+	defer u.alertHandlerMu.Unlock()
+	if u.alertHandler == nil {
+		alertHandler, err := u.newAlertHandler()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create alert handler: %w", err)
+		}
+		u.alertHandler = alertHandler
+	}
+	return u.alertHandler, nil
+}
+
+// alertTrigger is the optional EventBridge detail used to target specific
+// rules, e.g. {"rule_id": "payments-errors"} or {"action": "evaluate_all"}.
+type alertTrigger struct {
+	Action  string   `json:"action"`
+	RuleID  string   `json:"rule_id"`
+	RuleIDs []string `json:"rule_ids"`
 }
 
 func (u *UniversalHandler) Handle(ctx context.Context, event json.RawMessage) (interface{}, error) {
-	// Try to detect event type by checking for API Gateway fields
-	var apiGatewayCheck map[string]interface{}
-	if err := json.Unmarshal(event, &apiGatewayCheck); err == nil {
-		if _, hasRequestContext := apiGatewayCheck["requestContext"]; hasRequestContext {
-			// It's an API Gateway event
-			var apiEvent events.APIGatewayProxyRequest
-			if err := json.Unmarshal(event, &apiEvent); err != nil {
-				return nil, err
+	result, source, err := u.router.dispatch(ctx, event)
+
+	// Persist self-monitoring counts before the execution environment freezes
+	if source == nil || !source.quiet {
+		if err := u.health.Flush(ctx); err != nil {
+			slog.WarnContext(ctx, "Failed to flush health counters", "error", err)
+		}
+	}
+
+	return result, err
+}
+
+func (u *UniversalHandler) handleStreamEvent(ctx context.Context, streamEvent events.DynamoDBEvent) error {
+	var entries []store.LogEntry
+	for _, record := range streamEvent.Records {
+		if record.EventName != "INSERT" {
+			continue
+		}
+		if entry, ok := store.LogEntryFromStreamImage(record.Change.NewImage); ok {
+			entries = append(entries, entry)
+			// Problems evaluating TinyTail's own entries aren't stored
+			// again, or one failure could keep feeding itself
+			if entry.Source == logging.SelfIngestSource {
+				ctx = logging.WithoutSelfIngest(ctx)
 			}
-			return u.httpHandler.Handle(ctx, apiEvent)
 		}
+	}
+
+	// Forwarding comes first, as it's what needs to happen straight away;
+	// it never fails the batch, but a batch retried because alerting failed
+	// is forwarded again
+	u.forwarder.Forward(ctx, entries)
+
+	slog.InfoContext(ctx, "Processing new log entries from stream for realtime alerts", "entries", len(entries))
+	alerting, err := u.alerting()
+	if err != nil {
+		return err
+	}
+	_, err = alerting.ProcessNewEntries(ctx, entries)
+	return err
+}
 
-		// Check for EventBridge event
-		if _, hasSource := apiGatewayCheck["source"]; hasSource {
-			if _, hasDetailType := apiGatewayCheck["detail-type"]; hasDetailType {
-				// It's an EventBridge event - process alerts
-				log.Println("Processing alerts triggered by EventBridge")
-				return nil, u.alertHandler.ProcessAlerts(ctx)
+func (u *UniversalHandler) handleSNSEvent(ctx context.Context, snsEvent events.SNSEvent) error {
+	alerting, err := u.alerting()
+	if err != nil {
+		return err
+	}
+	for _, record := range snsEvent.Records {
+		slog.InfoContext(ctx, "Processing SES notification", "topic", record.SNS.TopicArn)
+		if err := alerting.HandleSESNotification(ctx, record.SNS.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleCloudTrail stores the CloudTrail events that are kept
+func (u *UniversalHandler) handleCloudTrail(ctx context.Context, trail []cloudtrail.Event) error {
+	entries := u.cloudTrail.Entries(trail)
+	slog.InfoContext(ctx, "Storing CloudTrail events", "events", len(trail), "kept", len(entries))
+	return u.httpHandler.Ingest(ctx, u.cloudTrail.Env, entries)
+}
+
+// handleAppEvent stores an application's custom EventBridge event
+func (u *UniversalHandler) handleAppEvent(ctx context.Context, event events.CloudWatchEvent) error {
+	slog.InfoContext(ctx, "Storing application event", "source", event.Source, "detail_type", event.DetailType)
+	return u.httpHandler.Ingest(ctx, u.appEvents.Env, []store.LogEntry{appevents.Entry(event)})
+}
+
+// handleS3Event stores what the objects an S3 notification announces
+// hold: CloudTrail log files' events, and the lines of files dropped into
+// the log bucket. Failing returns the whole notification for another
+// attempt, so objects read before the failure are stored twice.
+func (u *UniversalHandler) handleS3Event(ctx context.Context, s3Event events.S3Event) error {
+	for _, record := range s3Event.Records {
+		bucket, key := record.S3.Bucket.Name, record.S3.Object.URLDecodedKey
+		switch {
+		case u.cloudTrailFiles != nil && cloudtrail.IsLogFile(key):
+			trail, err := u.cloudTrailFiles.Read(ctx, bucket, key)
+			if err != nil {
+				return err
+			}
+			if err := u.handleCloudTrail(ctx, trail); err != nil {
+				return err
+			}
+		case u.logFiles != nil && bucket == u.logFilesConfig.Bucket:
+			if err := u.handleLogFile(ctx, bucket, key); err != nil {
+				return err
 			}
+		default:
+			slog.InfoContext(ctx, "Skipping S3 object that isn't a log file", "bucket", bucket, "key", key)
 		}
 	}
+	return nil
+}
+
+// logFileWriteEntries is how many of a log file's entries are stored at
+// once
+const logFileWriteEntries = 500
+
+// handleLogFile stores the lines of a log file, each read as
+// handler.LineEntry does with a source named after the file's key
+func (u *UniversalHandler) handleLogFile(ctx context.Context, bucket, key string) error {
+	source := logfiles.Source(key)
+	var pending []store.LogEntry
+	stored := 0
+	write := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := u.httpHandler.IngestBatch(ctx, u.logFilesConfig.Env, pending); err != nil {
+			return fmt.Errorf("storing s3://%s/%s after %d entries: %w", bucket, key, stored, err)
+		}
+		stored += len(pending)
+		pending = pending[:0]
+		return nil
+	}
 
-	log.Printf("Unknown event type: %s", string(event))
-	return nil, nil
+	err := u.logFiles.Read(ctx, bucket, key, func(line string) error {
+		pending = append(pending, handler.LineEntry(line, source))
+		if len(pending) >= logFileWriteEntries {
+			return write()
+		}
+		return nil
+	})
+	if err == nil {
+		err = write()
+	}
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Stored log file", "bucket", bucket, "key", key, "entries", stored)
+	return nil
 }
 
-func main() {
-	tableName := os.Getenv("TINYTAIL_TABLE_NAME")
-	if tableName == "" {
-		tableName = "TinyTailLogs"
+// kinesisWriteEntries is how many entries are written at once from Kinesis
+// records, a BatchWriteItem call's worth
+const kinesisWriteEntries = 25
+
+// handleKinesis stores the entries in a batch of Kinesis records, each
+// read as handler.RecordEntries does with the stream's name as the source.
+// Entries are written a BatchWriteItem's worth at a time; when a write
+// fails, the first record in it is reported as failed, so Lambda retries
+// the shard from there rather than from the start of the batch.
+func (u *UniversalHandler) handleKinesis(ctx context.Context, kinesisEvent events.KinesisEvent) events.KinesisEventResponse {
+	var response events.KinesisEventResponse
+	var pending []store.LogEntry
+	first := 0 // The first record with entries in pending
+	write := func() bool {
+		if len(pending) == 0 {
+			return true
+		}
+		if err := u.httpHandler.IngestBatch(ctx, u.kinesisEnv, pending); err != nil {
+			slog.ErrorContext(ctx, "Failed to store Kinesis records", "sequence_number", kinesisEvent.Records[first].Kinesis.SequenceNumber, "error", err)
+			response.BatchItemFailures = []events.KinesisBatchItemFailure{{ItemIdentifier: kinesisEvent.Records[first].Kinesis.SequenceNumber}}
+			return false
+		}
+		pending = pending[:0]
+		return true
 	}
 
-	sessionsTableName := os.Getenv("TINYTAIL_SESSIONS_TABLE_NAME")
-	if sessionsTableName == "" {
-		sessionsTableName = "TinyTailSessions"
+	for i, record := range kinesisEvent.Records {
+		stream := record.EventSourceArn[strings.LastIndex(record.EventSourceArn, "/")+1:]
+		entries, err := handler.RecordEntries(record.Kinesis.Data, stream)
+		if err != nil {
+			// A record that can't be read never will be, and retrying it
+			// would hold up the shard
+			slog.WarnContext(ctx, "Skipping unreadable Kinesis record", "sequence_number", record.Kinesis.SequenceNumber, "error", err)
+			continue
+		}
+		if len(pending) == 0 {
+			first = i
+		}
+		pending = append(pending, entries...)
+		if len(pending) >= kinesisWriteEntries && !write() {
+			return response
+		}
 	}
+	write()
+	return response
+}
 
-	alertsTableName := os.Getenv("TINYTAIL_ALERTS_TABLE_NAME")
-	if alertsTableName == "" {
-		alertsTableName = "TinyTailAlerts"
+// handleAlertTrigger evaluates rules and returns the evaluation summary as
+// the invocation result. The "maintenance" and "digest" actions run the
+// cleanup job and the daily digest instead.
+func (u *UniversalHandler) handleAlertTrigger(ctx context.Context, detail interface{}) (interface{}, error) {
+	var trigger alertTrigger
+	if detail != nil {
+		// Scheduled events carry an empty detail object; anything we can't
+		// read is treated the same way and evaluates every rule
+		detailJSON, _ := json.Marshal(detail)
+		if err := json.Unmarshal(detailJSON, &trigger); err != nil {
+			slog.WarnContext(ctx, "Ignoring unreadable EventBridge detail", "error", err)
+		}
 	}
 
-	ingestSecret := os.Getenv("TINYTAIL_INGEST_SECRET")
-	if ingestSecret == "" {
-		log.Fatal("TINYTAIL_INGEST_SECRET environment variable is required")
+	ruleIDs := trigger.RuleIDs
+	if trigger.RuleID != "" {
+		ruleIDs = append(ruleIDs, trigger.RuleID)
 	}
 
-	uiPassword := os.Getenv("TINYTAIL_UI_PASSWORD")
-	if uiPassword == "" {
-		log.Fatal("TINYTAIL_UI_PASSWORD environment variable is required")
+	switch {
+	case trigger.Action == "" && len(ruleIDs) > 0, trigger.Action == "evaluate_rules":
+		slog.InfoContext(ctx, "Processing alert rules triggered by EventBridge", "rule_ids", ruleIDs)
+		alerting, err := u.alerting()
+		if err != nil {
+			return nil, err
+		}
+		return alerting.ProcessRules(ctx, ruleIDs)
+	case trigger.Action == "", trigger.Action == "evaluate_all":
+		slog.InfoContext(ctx, "Processing alerts triggered by EventBridge")
+		alerting, err := u.alerting()
+		if err != nil {
+			return nil, err
+		}
+		return alerting.ProcessAlerts(ctx)
+	case trigger.Action == "maintenance":
+		slog.InfoContext(ctx, "Running maintenance triggered by EventBridge")
+		return u.runMaintenance(ctx)
+	case trigger.Action == "digest":
+		slog.InfoContext(ctx, "Sending daily digest triggered by EventBridge")
+		alerting, err := u.alerting()
+		if err != nil {
+			return nil, err
+		}
+		return alerting.SendDigest(ctx)
+	default:
+		slog.WarnContext(ctx, "Unknown EventBridge action", "action", trigger.Action)
+		return nil, nil
 	}
+}
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := clientCommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	logging.Setup()
+	universalHandler := newUniversalHandler()
+
+	// "tinytail serve" runs the HTTP routes as a local web server
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(universalHandler, os.Args[2:])
+		return
 	}
 
-	dbClient := dynamodb.NewFromConfig(cfg)
-	sesClient := ses.NewFromConfig(cfg)
+	lambda.Start(universalHandler.Handle)
+}
 
-	logStore := store.NewLogStore(dbClient, tableName)
-	sessionStore := store.NewSessionStore(dbClient, sessionsTableName)
+// fatal logs an error that stops the function from starting, and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
 
-	httpHandler := handler.NewHandler(logStore, sessionStore, ingestSecret, uiPassword)
+// newUniversalHandler builds the handlers from the configuration, exiting
+// if it is invalid
+func newUniversalHandler() *UniversalHandler {
+	awsConfig, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		fatal("Failed to load AWS config", "error", err)
+	}
 
-	alertHandler, err := alerts.NewAlertHandler(logStore, dbClient, sesClient, alertsTableName)
+	cfg, err := config.Load(context.Background(), awsConfig)
 	if err != nil {
-		log.Fatalf("Failed to create alert handler: %v", err)
+		fatal("Invalid configuration", "error", err)
+	}
+	logging.SetLevel(cfg.LogLevel)
+	if cfg.Handler.UIPassword == nil {
+		slog.Info("TINYTAIL_UI_PASSWORD_SHA256 not set; bootstrap admin login is disabled")
 	}
 
-	universalHandler := &UniversalHandler{
-		httpHandler:  httpHandler,
-		alertHandler: alertHandler,
+	// Every client created from here on traces its calls
+	var tracer *tracing.Tracer
+	if cfg.Tracing {
+		tracer, err = tracing.New()
+		if err != nil {
+			fatal("Failed to start tracing", "error", err)
+		}
+		awsConfig.APIOptions = append(awsConfig.APIOptions, tracer.Instrument)
 	}
 
-	lambda.Start(universalHandler.Handle)
+	dbClient := dynamodb.NewFromConfig(awsConfig, func(o *dynamodb.Options) {
+		if cfg.DynamoDBEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoDBEndpoint)
+		}
+	})
+	ses := &sesConnection{awsConfig: awsConfig, checkSender: !cfg.SkipStartupChecks}
+
+	// Problems that would otherwise surface as SDK errors on first use
+	// switch off what can't work, with an explanation, instead. The table
+	// checks run while the rest is set up. The alerts table is optional,
+	// so its absence is always looked for.
+	reportReady := make(chan *preflightReport, 1)
+	go func() {
+		if cfg.SkipStartupChecks {
+			reportReady <- checkAlertsTable(context.Background(), cfg.Tables.Alerts, dbClient)
+		} else {
+			reportReady <- preflight(context.Background(), cfg.Tables, dbClient, cfg.Handler.NoAuth)
+		}
+	}()
+
+	logStore := store.NewLogStore(dbClient, cfg.Tables.Logs, cfg.MaxMessageSize)
+	// Other environments only differ in where their logs are kept
+	envStores := map[string]*store.LogStore{}
+	for name, table := range cfg.Tables.EnvironmentLogs {
+		envStores[name] = store.NewLogStore(dbClient, table, cfg.MaxMessageSize)
+	}
+	environments := store.NewEnvironments(logStore, envStores)
+	// No-auth mode never touches the sessions table, so it needn't exist
+	var sessionStore *store.SessionStore
+	if cfg.Handler.NoAuth {
+		slog.Warn("TINYTAIL_NO_AUTH is set; sign-in is disabled and every IAM-authorized caller is an admin")
+	} else {
+		sessionStore = store.NewSessionStore(dbClient, cfg.Tables.Sessions, cfg.SessionLifetime)
+	}
+	userStore := store.NewUserStore(dbClient, cfg.Tables.Users)
+	apiKeyStore := store.NewAPIKeyStore(dbClient, cfg.Tables.APIKeys)
+	auditStore := store.NewAuditStore(dbClient, cfg.Tables.Logs)
+
+	if cfg.SelfIngest {
+		logging.SelfIngest(logStore)
+	}
+
+	// Entries that fail to store wait in the dead-letter queue for another
+	// attempt
+	var ingestQueue *dlq.Queue
+	if cfg.IngestDLQ.URL != "" {
+		ingestQueue = dlq.NewQueue(sqs.NewFromConfig(awsConfig), cfg.IngestDLQ)
+	}
+
+	report := <-reportReady
+	report.logDegradedModes(context.Background())
+
+	// Self-monitoring counters, forwarding and drop rules, heartbeats and
+	// alert history share the alerts table; without it they are left nil,
+	// which records, forwards and drops nothing
+	var health *store.HealthCounters
+	var forwardingRules *store.ForwardingRuleStore
+	var dropRules *store.DropRuleStore
+	var heartbeats *store.HeartbeatStore
+	var alertHistory *store.AlertHistory
+	var forwarder *forwarding.Forwarder
+	if !report.AlertsTableMissing {
+		health = store.NewHealthCounters(dbClient, cfg.Tables.Alerts)
+		alertHistory = store.NewAlertHistory(dbClient, cfg.Tables.Alerts)
+		forwardingRules = store.NewForwardingRuleStore(dbClient, cfg.Tables.Alerts)
+		dropRules = store.NewDropRuleStore(dbClient, cfg.Tables.Alerts)
+		heartbeats = store.NewHeartbeatStore(dbClient, cfg.Tables.Alerts)
+		var forwardQueue *sqs.Client
+		if cfg.Forwarding.URL != "" {
+			forwardQueue = sqs.NewFromConfig(awsConfig)
+		}
+		forwarder = forwarding.NewForwarder(forwardingRules, forwarding.NewCloudWatchLogs(awsConfig), forwardQueue, cfg.Forwarding, health)
+	}
+
+	// Account notifications go out through the same SES setup as alerts
+	mailer := alerts.NewLazyMailer(ses.connect, health)
+
+	httpHandler := handler.NewHandler(environments, sessionStore, userStore, apiKeyStore, auditStore, health, mailer, ingestQueue, forwardingRules, dropRules, heartbeats, alertHistory, cfg.Handler)
+
+	u := &UniversalHandler{
+		httpHandler:    httpHandler,
+		health:         health,
+		environments:   environments,
+		ingestQueue:    ingestQueue,
+		forwarder:      forwarder,
+		tracer:         tracer,
+		cloudTrail:     cfg.CloudTrail,
+		kinesisEnv:     cfg.KinesisEnv,
+		logFilesConfig: cfg.LogFiles,
+		appEvents:      cfg.AppEvents,
+		checkPermissions: func(ctx context.Context) []doctor.Result {
+			return doctor.Permissions(ctx, awsConfig, dbClient, cfg)
+		},
+	}
+	if cfg.CloudTrail.Enabled || cfg.LogFiles.Bucket != "" {
+		s3Client := s3.NewFromConfig(awsConfig)
+		if cfg.CloudTrail.Enabled {
+			u.cloudTrailFiles = cloudtrail.NewFiles(s3Client)
+		}
+		if cfg.LogFiles.Bucket != "" {
+			u.logFiles = logfiles.NewFiles(s3Client)
+		}
+	}
+	u.newAlertHandler = func() (*alerts.AlertHandler, error) {
+		sesClient, senderProblem := ses.connect()
+		alertHandler, err := alerts.NewAlertHandler(logStore, dbClient, sesClient, cfg.Tables.Alerts, cfg.AlertRules, health)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case report.AlertsTableMissing:
+			alertHandler.Disable("the alerts table does not exist")
+		case senderProblem != "":
+			alertHandler.Disable(senderProblem)
+		}
+		return alertHandler, nil
+	}
+	u.router = u.newEventRouter()
+	return u
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/tinytail/tinytail/internal/alerts"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// maintenanceReport is what a maintenance run cleaned up, returned as the
+// invocation result. A task that fails is reported in Errors and the others
+// still run.
+type maintenanceReport struct {
+	Sessions   *store.PruneResult       `json:"sessions,omitempty"`
+	AlertState *alerts.StatePruneResult `json:"alert_state,omitempty"`
+	Errors     []string                 `json:"errors,omitempty"`
+}
+
+// runMaintenance removes debris DynamoDB TTL leaves behind: expired sessions
+// it hasn't got to yet and sessions of removed users, and expired or
+// orphaned alert state. Triggered by the EventBridge detail
+// {"action": "maintenance"}.
+func (u *UniversalHandler) runMaintenance(ctx context.Context) (*maintenanceReport, error) {
+	report := &maintenanceReport{}
+
+	sessions, err := u.httpHandler.PruneSessions(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Maintenance failed to prune sessions", "error", err)
+		report.Errors = append(report.Errors, "sessions: "+err.Error())
+	}
+	report.Sessions = sessions
+
+	alerting, err := u.alerting()
+	if err == nil {
+		report.AlertState, err = alerting.PruneState(ctx)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Maintenance failed to prune alert state", "error", err)
+		report.Errors = append(report.Errors, "alert state: "+err.Error())
+	}
+
+	slog.InfoContext(ctx, "Maintenance complete", "report", report)
+	return report, nil
+}
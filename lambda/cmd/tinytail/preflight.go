@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/doctor"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// preflightTimeout bounds the startup checks so a slow AWS API can't eat
+// into the first request's time
+const preflightTimeout = 5 * time.Second
+
+// preflightReport is what the startup checks found
+type preflightReport struct {
+	// Tables maps each table name to the problems found with it
+	Tables map[string][]string
+
+	// AlertsTableMissing means alerting and health counters can't work
+	AlertsTableMissing bool
+}
+
+// preflight checks at cold start that the tables exist with the expected
+// keys, index, stream and TTL. Each problem is logged with how to fix it;
+// checks that can't run (usually for lack of IAM permissions) are logged
+// and otherwise ignored. The alert sender is checked when email is first
+// needed (see sesConnection).
+func preflight(ctx context.Context, tables config.Tables, dbClient *dynamodb.Client, noAuth bool) *preflightReport {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	report := &preflightReport{Tables: map[string][]string{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, schema := range store.Schemas(tables) {
+		if noAuth && schema.Name == tables.Sessions {
+			continue
+		}
+		wg.Add(1)
+		go func(schema store.TableSchema) {
+			defer wg.Done()
+			problems, err := store.CheckSchema(ctx, dbClient, schema)
+			if err != nil {
+				slog.WarnContext(ctx, "Startup check could not inspect table", "table", schema.Name, "error", err,
+					"hint", "grant dynamodb:DescribeTable and dynamodb:DescribeTimeToLive, or set TINYTAIL_SKIP_STARTUP_CHECKS=true")
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(problems) > 0 {
+				report.Tables[schema.Name] = problems
+			}
+			if schema.Name == tables.Alerts && tableMissing(problems) {
+				report.AlertsTableMissing = true
+			}
+		}(schema)
+	}
+
+	wg.Wait()
+
+	for table, problems := range report.Tables {
+		if table == tables.Alerts && report.AlertsTableMissing {
+			continue // Optional; logDegradedModes says what that means
+		}
+		for _, problem := range problems {
+			slog.ErrorContext(ctx, "Startup check found a table problem", "table", table, "problem", problem,
+				"hint", doctor.TableFix(tables, table, problem))
+		}
+	}
+	return report
+}
+
+// checkAlertsTable only looks for the alerts table, for when the other
+// startup checks are turned off
+func checkAlertsTable(ctx context.Context, name string, dbClient *dynamodb.Client) *preflightReport {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	exists, err := store.TableExists(ctx, dbClient, name)
+	if err != nil {
+		slog.WarnContext(ctx, "Startup check could not inspect table", "table", name, "error", err,
+			"hint", "grant dynamodb:DescribeTable on the alerts table")
+	}
+	return &preflightReport{AlertsTableMissing: err == nil && !exists}
+}
+
+// tableMissing reports whether CheckSchema found no table at all
+func tableMissing(problems []string) bool {
+	return len(problems) == 1 && strings.HasSuffix(problems[0], "does not exist")
+}
+
+// sesConnection creates the SES client and checks the alert sender the
+// first time email is needed, so cold starts that only serve the UI or
+// ingest do neither
+type sesConnection struct {
+	awsConfig   aws.Config
+	checkSender bool
+
+	once    sync.Once
+	client  *sesv2.Client
+	problem string
+}
+
+// connect returns the client, and why the sender can't send if it can't
+func (s *sesConnection) connect() (*sesv2.Client, string) {
+	s.once.Do(func() {
+		s.client = sesv2.NewFromConfig(s.awsConfig)
+		if !s.checkSender {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+		defer cancel()
+		if s.problem = checkSender(ctx, s.client); s.problem != "" {
+			from := os.Getenv("TINYTAIL_ALERT_FROM_EMAIL")
+			slog.ErrorContext(ctx, "Running in degraded mode: alert and account emails disabled", "reason", s.problem,
+				"hint", fmt.Sprintf("verify it with `aws sesv2 create-email-identity --email-identity %s` and follow the link SES sends, or change ALERT_FROM_EMAIL", from))
+		}
+	})
+	return s.client, s.problem
+}
+
+// checkSender returns why TINYTAIL_ALERT_FROM_EMAIL can't send, or "" if
+// it can or couldn't be checked. The address is verified if either it or
+// its domain is a verified identity.
+func checkSender(ctx context.Context, sesClient *sesv2.Client) string {
+	from := os.Getenv("TINYTAIL_ALERT_FROM_EMAIL")
+	if from == "" {
+		// Each alert is sent from its recipient, which can't be checked ahead
+		return ""
+	}
+
+	problem, err := doctor.SenderProblem(ctx, sesClient, from)
+	if err != nil {
+		slog.WarnContext(ctx, "Startup check could not look up the alert sender in SES", "error", err,
+			"hint", "grant ses:GetEmailIdentity, or set TINYTAIL_SKIP_STARTUP_CHECKS=true")
+		return ""
+	}
+	return problem
+}
+
+// logDegradedModes explains what is being switched off and how to fix it
+func (r *preflightReport) logDegradedModes(ctx context.Context) {
+	// The alerts table is optional, so this is a warning rather than an error
+	if r.AlertsTableMissing {
+		slog.WarnContext(ctx, "Starting in degraded mode: alerting and self-monitoring disabled",
+			"reason", "the alerts table does not exist", "hint", "to use alerts, "+doctor.BootstrapFix)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// searchOptions are the flags shared by search and export
+type searchOptions struct {
+	url    string
+	env    string
+	since  string
+	until  string
+	format string
+	limit  int
+	output string
+}
+
+func (o *searchOptions) register(flags *flag.FlagSet, format string, limit int) {
+	flags.StringVar(&o.url, "url", "", "TinyTail API URL including the stage (default $TINYTAIL_URL)")
+	flags.StringVar(&o.env, "env", "", "environment to search (default the default environment)")
+	flags.StringVar(&o.since, "since", "", "only entries newer than this: a duration such as 2h or 7d, or an RFC3339 time")
+	flags.StringVar(&o.until, "until", "", "only entries older than this: a duration or an RFC3339 time")
+	flags.StringVar(&o.format, "format", format, "output format: text, json or csv")
+	flags.IntVar(&o.limit, "limit", limit, "stop after this many entries (0 for all)")
+	flags.StringVar(&o.output, "output", "", "write to this file instead of stdout")
+}
+
+// searchCommand prints the entries matching a query, newest first:
+//
+//	tinytail search "timeout" --since 2h --format json
+func searchCommand(args []string) int {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: tinytail search [flags] <query>")
+		flags.PrintDefaults()
+	}
+	var opts searchOptions
+	opts.register(flags, "text", 100)
+	_ = flags.Parse(reorderFlags(flags, args))
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	return runSearch(flags.Arg(0), opts)
+}
+
+// exportCommand writes every entry matching a query, or every entry if
+// there is none, as JSON lines by default:
+//
+//	tinytail export --since 7d --output last-week.jsonl
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: tinytail export [flags] [query]")
+		flags.PrintDefaults()
+	}
+	var opts searchOptions
+	opts.register(flags, "json", 0)
+	_ = flags.Parse(reorderFlags(flags, args))
+
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+	return runSearch(flags.Arg(0), opts)
+}
+
+// reorderFlags moves flags ahead of positional arguments, so the query can
+// come first as in `tinytail search "timeout" --since 2h`
+func reorderFlags(flags *flag.FlagSet, args []string) []string {
+	var named, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		named = append(named, arg)
+		// A flag's value is the next argument unless given with =, or the
+		// flag is a boolean
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := flags.Lookup(name); f != nil && !isBoolFlag(f) && i+1 < len(args) {
+			i++
+			named = append(named, args[i])
+		}
+	}
+	return append(named, positional...)
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func runSearch(query string, opts searchOptions) int {
+	client, err := newAPIClient(opts.url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	now := time.Now()
+	params := url.Values{"q": {query}}
+	if opts.env != "" {
+		params.Set("env", opts.env)
+	}
+	for name, value := range map[string]string{"since": opts.since, "until": opts.until} {
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeFlag(value, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--%s: %v\n", name, err)
+			return 2
+		}
+		params.Set(name, t.UTC().Format(time.RFC3339))
+	}
+
+	out := io.Writer(os.Stdout)
+	if opts.output != "" {
+		file, err := os.Create(opts.output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	buffered := bufio.NewWriter(out)
+	defer buffered.Flush()
+
+	writer, err := newEntryWriter(opts.format, buffered)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	written, err := searchPages(context.Background(), client, params, opts.limit, writer.write)
+	if flushErr := writer.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Search failed after %d entries: %v\n", written, err)
+		return 1
+	}
+	if opts.output != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %d entries to %s\n", written, opts.output)
+	}
+	return 0
+}
+
+// searchPages follows the search's cursors until there are no more
+// matches or limit entries have been written, newest first. A page can
+// repeat entries from the one before, so they're told apart by cursor.
+func searchPages(ctx context.Context, client *apiClient, params url.Values, limit int, write func(store.LogEntry) error) (int, error) {
+	seen := map[string]bool{}
+	written := 0
+	before := ""
+	for {
+		if before != "" {
+			params.Set("before", before)
+		}
+		var page store.SearchResponse
+		if err := client.get(ctx, "/logs/search", params, &page); err != nil {
+			return written, err
+		}
+
+		for _, entry := range page.Logs {
+			if entry.Cursor != "" {
+				if seen[entry.Cursor] {
+					continue
+				}
+				seen[entry.Cursor] = true
+			}
+			if err := write(entry); err != nil {
+				return written, err
+			}
+			written++
+			if limit > 0 && written >= limit {
+				return written, nil
+			}
+		}
+
+		// The search only returns a cursor when there may be more: when the
+		// page filled up, or it stopped reading early
+		next := page.ContinuationCursor
+		if next == "" || next == before {
+			return written, nil
+		}
+		before = next
+	}
+}
+
+// parseTimeFlag reads an RFC3339 time, or a duration before now such as
+// 90m, 2h or 7d
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("expected a duration such as 2h or 7d, or an RFC3339 time, got %q", value)
+		}
+		return now.AddDate(0, 0, -n), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("expected a duration such as 2h or 7d, or an RFC3339 time, got %q", value)
+	}
+	return now.Add(-d), nil
+}
+
+// entryWriter formats entries for output
+type entryWriter struct {
+	write func(store.LogEntry) error
+	flush func() error
+}
+
+func newEntryWriter(format string, out io.Writer) (*entryWriter, error) {
+	noFlush := func() error { return nil }
+	switch format {
+	case "text":
+		return &entryWriter{
+			write: func(entry store.LogEntry) error {
+				_, err := fmt.Fprintf(out, "%s %-5s [%s] %s\n", entry.Timestamp.Format(time.RFC3339Nano), entry.Level, entry.Source, entry.Message)
+				return err
+			},
+			flush: noFlush,
+		}, nil
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		return &entryWriter{
+			write: func(entry store.LogEntry) error {
+				entry.Cursor = ""
+				return encoder.Encode(entry)
+			},
+			flush: noFlush,
+		}, nil
+	case "csv":
+		writer := csv.NewWriter(out)
+		if err := writer.Write([]string{"timestamp", "level", "source", "logger", "request_id", "message"}); err != nil {
+			return nil, err
+		}
+		return &entryWriter{
+			write: func(entry store.LogEntry) error {
+				return writer.Write([]string{entry.Timestamp.Format(time.RFC3339Nano), entry.Level, entry.Source, entry.Logger, entry.RequestID, entry.Message})
+			},
+			flush: func() error {
+				writer.Flush()
+				return writer.Error()
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("--format must be text, json or csv, got %q", format)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// serve runs the HTTP routes behind net/http, translating each request to
+// the API Gateway event the Lambda function would receive. It's meant for
+// developing the UI and handlers against DynamoDB Local
+// (TINYTAIL_DYNAMODB_ENDPOINT) without deploying.
+func serve(u *UniversalHandler, args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", envOr("TINYTAIL_LISTEN_ADDR", "localhost:8080"), "address to listen on")
+	_ = flags.Parse(args)
+
+	slog.Info("TinyTail listening", "url", "http://"+*addr)
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, err := proxyRequestFromHTTP(r)
+		if err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+
+		response, err := u.httpHandler.Handle(r.Context(), request)
+		if err := u.health.Flush(r.Context()); err != nil {
+			slog.Warn("Failed to flush health counters", "error", err)
+		}
+		if err != nil {
+			slog.Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writeProxyResponse(w, response)
+	}))
+	fatal("Server stopped", "error", err)
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// proxyRequestFromHTTP builds the API Gateway REST event for a request.
+// There is no stage, so routes are served from the root.
+func proxyRequestFromHTTP(r *http.Request) (events.APIGatewayProxyRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	headers := make(map[string]string, len(r.Header)+1)
+	for name, values := range r.Header {
+		headers[name] = values[0]
+	}
+	headers["Host"] = r.Host
+
+	query := r.URL.Query()
+	singleQuery := make(map[string]string, len(query))
+	for name, values := range query {
+		singleQuery[name] = values[len(values)-1]
+	}
+
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+
+	request := events.APIGatewayProxyRequest{
+		Path:                            r.URL.Path,
+		HTTPMethod:                      r.Method,
+		Headers:                         headers,
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           singleQuery,
+		MultiValueQueryStringParameters: query,
+		Body:                            string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID:  uuid.NewString(),
+			HTTPMethod: r.Method,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  sourceIP,
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+	if !utf8.Valid(body) {
+		request.Body = base64.StdEncoding.EncodeToString(body)
+		request.IsBase64Encoded = true
+	}
+	return request, nil
+}
+
+func writeProxyResponse(w http.ResponseWriter, response events.APIGatewayProxyResponse) {
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	body := []byte(response.Body)
+	if response.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(response.Body)
+		if err != nil {
+			slog.Error("Failed to decode response body", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = decoded
+	}
+
+	w.WriteHeader(response.StatusCode)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tinytail/tinytail/internal/handler"
+	"github.com/tinytail/tinytail/internal/ingest"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// shipOptions are the ship command's flags
+type shipOptions struct {
+	url        string
+	source     string
+	level      string
+	logger     string
+	requestID  string
+	batchSize  int
+	interval   time.Duration
+	retries    int
+	retryDelay time.Duration
+	tee        bool
+}
+
+// shipCommand sends each line of stdin as a log entry:
+//
+//	backup.sh 2>&1 | tinytail ship --source backup-job
+//
+// Lines are sent in batches, whenever one fills up or a second has passed
+// since its first line, so a slow job's output shows up as it happens.
+func shipCommand(args []string) int {
+	flags := flag.NewFlagSet("ship", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: <command> | tinytail ship [flags]")
+		flags.PrintDefaults()
+	}
+	var opts shipOptions
+	flags.StringVar(&opts.url, "url", "", "TinyTail API URL including the stage (default $TINYTAIL_URL)")
+	flags.StringVar(&opts.source, "source", "unknown", "source of the entries, e.g. the job's name")
+	flags.StringVar(&opts.level, "level", "INFO", "level of the entries")
+	flags.StringVar(&opts.logger, "logger", "", "logger of the entries")
+	flags.StringVar(&opts.requestID, "request-id", "", "request ID shared by the entries, to find this run's output (default a new ID)")
+	flags.IntVar(&opts.batchSize, "batch-size", handler.MaxIngestBatch, "most lines sent in one request")
+	flags.DurationVar(&opts.interval, "interval", time.Second, "longest a line waits to be sent")
+	flags.IntVar(&opts.retries, "retries", 3, "further attempts for a batch that fails to send")
+	flags.DurationVar(&opts.retryDelay, "retry-delay", time.Second, "wait before the first retry, doubling for each one after")
+	flags.BoolVar(&opts.tee, "tee", false, "also copy stdin to stdout")
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	if opts.batchSize < 1 || opts.batchSize > handler.MaxIngestBatch {
+		fmt.Fprintf(os.Stderr, "--batch-size must be between 1 and %d\n", handler.MaxIngestBatch)
+		return 2
+	}
+	client, err := newIngestClient(opts.url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.requestID == "" {
+		opts.requestID = uuid.NewString()
+	}
+
+	var out io.Writer
+	if opts.tee {
+		out = os.Stdout
+	}
+	shipped, failed := ship(context.Background(), client, os.Stdin, out, opts)
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "tinytail: %d of %d lines could not be sent (request ID %s)\n", failed, shipped+failed, opts.requestID)
+		return 1
+	}
+	return 0
+}
+
+// ship reads lines until the input ends, sending them in batches. It
+// returns how many lines were sent and how many were given up on.
+func ship(ctx context.Context, client *ingest.Client, in io.Reader, out io.Writer, opts shipOptions) (shipped, failed int) {
+	lines := make(chan store.LogEntry)
+	go readLines(in, out, lines, opts)
+
+	send := func(batch []store.LogEntry) {
+		sent, err := client.Send(ctx, batch, ingest.Retry{Attempts: opts.retries, Delay: opts.retryDelay})
+		var rejected *ingest.RejectedError
+		if errors.As(err, &rejected) {
+			// Rejected lines are counted in sent, but weren't stored
+			sent -= len(rejected.Reasons)
+		}
+		shipped += sent
+		if err != nil {
+			failed += len(batch) - sent
+			fmt.Fprintf(os.Stderr, "tinytail: failed to send %d lines: %v\n", len(batch)-sent, err)
+		}
+	}
+	batching := ingest.BatchOptions{Size: opts.batchSize, Interval: opts.interval}
+	ingest.Batches(lines, batching, func(entry store.LogEntry) int { return len(entry.Message) }, send)
+	return shipped, failed
+}
+
+// readLines turns each line of the input into an entry, timestamped when
+// it was read, until the input ends
+func readLines(in io.Reader, out io.Writer, lines chan<- store.LogEntry, opts shipOptions) {
+	defer close(lines)
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadString('\n')
+		if out != nil && line != "" {
+			_, _ = io.WriteString(out, line)
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			lines <- store.LogEntry{
+				Level:     opts.level,
+				Message:   line,
+				Source:    opts.source,
+				Logger:    opts.logger,
+				Timestamp: time.Now(),
+				RequestID: opts.requestID,
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Fprintf(os.Stderr, "tinytail: failed to read input: %v\n", err)
+			}
+			return
+		}
+	}
+}
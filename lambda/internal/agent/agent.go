@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/ingest"
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+const (
+	// retryDelay and maxRetryDelay pace attempts to send a batch while the
+	// API is failing
+	retryDelay    = time.Second
+	maxRetryDelay = time.Minute
+
+	// shutdownGrace is how long buffered entries may take to send once the
+	// agent is asked to stop; the rest are sent when it next starts
+	shutdownGrace = 5 * time.Second
+
+	// metricsInterval is how often the buffer's depth is reported
+	metricsInterval = time.Minute
+)
+
+// Run ships the configured inputs until ctx is done. What they read is
+// written to the disk buffer and sent from there, with failed batches
+// retried until they succeed, so nothing is lost during an outage; once
+// the buffer is full, the inputs wait.
+func Run(ctx context.Context, cfg *Config, secret string) error {
+	st, err := loadState(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+	buf, err := openBuffer(cfg.BufferDir, int64(cfg.BufferMaxMB)<<20)
+	if err != nil {
+		return err
+	}
+	defer buf.close()
+	if entries, _ := buf.depth(); entries > 0 {
+		slog.InfoContext(ctx, "Sending log entries buffered by an earlier run", "entries", entries)
+	}
+
+	records := make(chan record, cfg.BatchSize)
+	tailer, err := newTailer(cfg, st, records)
+	if err != nil {
+		return err
+	}
+	var forward *forwardListener
+	if cfg.Forward != nil {
+		if forward, err = listenForward(cfg.Forward, buf); err != nil {
+			return err
+		}
+	}
+	var otlp *otlpReceiver
+	if cfg.OTLP != nil {
+		if otlp, err = listenOTLP(cfg.OTLP, buf); err != nil {
+			if forward != nil {
+				forward.listener.Close()
+			}
+			return err
+		}
+	}
+	client := ingest.NewClient(cfg.URL, secret)
+
+	// Sending outlives ctx briefly, to ship what has already been read
+	sendCtx, cancelSend := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelSend()
+	stop := context.AfterFunc(ctx, func() { time.AfterFunc(shutdownGrace, cancelSend) })
+	defer stop()
+
+	var reading sync.WaitGroup
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+		tailer.run(ctx)
+	}()
+	if cfg.Journal != nil {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			(&journal{input: cfg.Journal, state: st, records: records}).run(ctx)
+		}()
+	}
+	go func() {
+		reading.Wait()
+		close(records)
+	}()
+	// Entries the listeners accept go straight to the buffer, so it is
+	// finished once they have all stopped
+	var listening sync.WaitGroup
+	if forward != nil {
+		listening.Add(1)
+		go func() {
+			defer listening.Done()
+			forward.serve(ctx)
+		}()
+	}
+	if otlp != nil {
+		listening.Add(1)
+		go func() {
+			defer listening.Done()
+			otlp.serve(ctx)
+		}()
+	}
+	shipped := make(chan struct{})
+	go func() {
+		ship(sendCtx, client, buf, cfg.BatchSize)
+		close(shipped)
+	}()
+	go reportBuffer(sendCtx, buf)
+
+	batching := ingest.BatchOptions{Size: cfg.BatchSize, Interval: cfg.flushInterval()}
+	entries := make([]store.LogEntry, 0, cfg.BatchSize)
+	stopped := false
+	ingest.Batches(records, batching, func(r record) int { return len(r.entry.Message) }, func(batch []record) {
+		// After a batch is left out, later ones are too, or their positions
+		// would be saved past it; what is left is read again on restart
+		if stopped {
+			return
+		}
+		entries = entries[:0]
+		for _, r := range batch {
+			entries = append(entries, r.entry)
+		}
+		for {
+			err := buf.append(ctx, entries)
+			if err == nil {
+				break
+			}
+			if ctx.Err() == nil {
+				slog.Error("Failed to buffer log entries", "entries", len(entries), "error", err)
+			}
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				stopped = true
+				return
+			}
+		}
+		for _, r := range batch {
+			if r.cursor != "" {
+				st.advanceJournal(r.cursor)
+			} else {
+				st.advance(r.fileID, r.path, r.offset)
+			}
+		}
+		if err := st.save(); err != nil {
+			slog.Error("Failed to save file positions", "path", cfg.StateFile, "error", err)
+		}
+	})
+
+	listening.Wait()
+	buf.finish()
+	<-shipped
+	if entries, _ := buf.depth(); entries > 0 {
+		slog.Info("Log entries left in the buffer will be sent on restart", "entries", entries)
+	}
+	return st.save()
+}
+
+// ship sends entries from the buffer until it is finished and empty, or
+// ctx is done
+func ship(ctx context.Context, client *ingest.Client, buf *buffer, batchSize int) {
+	for {
+		read, err := buf.read(ctx, batchSize)
+		if err != nil {
+			return
+		}
+		sent := send(ctx, client, read.entries)
+		if err := buf.ack(read, sent); err != nil {
+			slog.Error("Failed to save log buffer position", "error", err)
+		}
+		if sent < len(read.entries) {
+			return
+		}
+	}
+}
+
+// send ships a batch, returning how many of its entries were stored or
+// given up on. Entries the API rejects as invalid are skipped, since they
+// would never be accepted; anything else is retried until ctx is done.
+func send(ctx context.Context, client *ingest.Client, entries []store.LogEntry) int {
+	sent := 0
+	for {
+		stored, err := client.Send(ctx, entries[sent:], ingest.Retry{Attempts: -1, Delay: retryDelay, MaxDelay: maxRetryDelay})
+		sent += stored
+		var rejected *ingest.RejectedError
+		if errors.As(err, &rejected) {
+			slog.Error("TinyTail rejected log entries; skipping them", "entries", len(rejected.Reasons), "error", rejected)
+		}
+		if err == nil || sent == len(entries) {
+			return sent
+		}
+
+		var status *ingest.StatusError
+		if errors.As(err, &status) && status.Status == http.StatusBadRequest {
+			slog.Error("TinyTail rejected log entries; skipping them", "entries", len(entries)-sent, "error", err)
+			return len(entries)
+		}
+		if ctx.Err() != nil {
+			return sent
+		}
+
+		// Authentication failures won't fix themselves, but the logs are
+		// kept until the secret is
+		slog.Error("Failed to send log entries", "entries", len(entries)-sent, "error", err)
+		select {
+		case <-time.After(maxRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// reportBuffer publishes the buffer's depth every metricsInterval, in the
+// Embedded Metric Format the CloudWatch agent reads from its log
+func reportBuffer(ctx context.Context, buf *buffer) {
+	hostname, _ := os.Hostname()
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		entries, bytes := buf.depth()
+		metrics.Emit(map[string]string{"Host": hostname},
+			metrics.Metric{Name: "AgentBufferedEntries", Unit: metrics.Count, Value: float64(entries)},
+			metrics.Metric{Name: "AgentBufferedBytes", Unit: metrics.Bytes, Value: float64(bytes)})
+	}
+}
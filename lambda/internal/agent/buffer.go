@@ -0,0 +1,408 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/ingest"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+const (
+	// segmentBytes is the size at which the buffer starts a new file, so
+	// sent entries can be deleted a file at a time
+	segmentBytes = 8 << 20
+
+	// fullWarning is how long appending waits for room before warning
+	fullWarning = 10 * time.Second
+
+	segmentSuffix = ".ndjson"
+	cursorFile    = "cursor.json"
+)
+
+// buffer is a queue on disk between reading logs and sending them, so what
+// is read during an outage is kept, across restarts, until it can be sent.
+// Entries are appended as JSON lines to numbered segment files and read
+// back in order; a cursor file records how far sending has got, and
+// segments are deleted once everything in them is sent. When the buffer
+// holds maxBytes, appending waits, which stops the inputs reading until
+// there is room.
+type buffer struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []segment // Oldest first; the last is appended to
+	writer   *os.File
+	cursor   bufferPosition // The next entry to send
+	entries  int            // Appended and not yet sent
+	bytes    int64
+	finished bool // Nothing more will be appended
+
+	appended chan struct{}
+	freed    chan struct{}
+}
+
+type segment struct {
+	seq  int64
+	size int64
+}
+
+// bufferPosition is an offset in a segment
+type bufferPosition struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// bufferRead is a run of entries read from one segment. ends holds the
+// offset after each entry, and lines how many lines it and those before it
+// took, counting any that couldn't be read.
+type bufferRead struct {
+	seq     int64
+	entries []store.LogEntry
+	ends    []int64
+	lines   []int
+}
+
+// errBufferFinished is returned by read once everything appended before
+// finish has been read
+var errBufferFinished = errors.New("buffer finished")
+
+// openBuffer opens the buffer in dir, carrying on from the entries left in
+// it by an earlier run
+func openBuffer(dir string, maxBytes int64) (*buffer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	b := &buffer{
+		dir:      dir,
+		maxBytes: maxBytes,
+		appended: make(chan struct{}, 1),
+		freed:    make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, cursorFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &b.cursor); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, cursorFile), err)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if seq < b.cursor.Segment {
+			os.Remove(name) // Sent before the last run stopped
+			continue
+		}
+		b.segments = append(b.segments, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i].seq < b.segments[j].seq })
+
+	if len(b.segments) > 0 && b.segments[0].seq != b.cursor.Segment {
+		b.cursor = bufferPosition{Segment: b.segments[0].seq}
+	}
+	for _, s := range b.segments {
+		offset := int64(0)
+		if s.seq == b.cursor.Segment {
+			offset = min(b.cursor.Offset, s.size)
+		}
+		lines, err := countLines(b.segmentPath(s.seq), offset)
+		if err != nil {
+			return nil, err
+		}
+		b.entries += lines
+		b.bytes += s.size - offset
+	}
+
+	// Appending always starts a new segment, so a line torn by a crash
+	// stays at the end of the one before
+	next := int64(1)
+	if len(b.segments) > 0 {
+		next = b.segments[len(b.segments)-1].seq + 1
+	}
+	if err := b.startSegment(next); err != nil {
+		return nil, err
+	}
+	if len(b.segments) == 1 {
+		b.cursor = bufferPosition{Segment: next}
+	}
+	return b, nil
+}
+
+func (b *buffer) segmentPath(seq int64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// startSegment opens a new segment to append to
+func (b *buffer) startSegment(seq int64) error {
+	file, err := os.OpenFile(b.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if b.writer != nil {
+		b.writer.Close()
+	}
+	b.writer = file
+	b.segments = append(b.segments, segment{seq: seq})
+	return nil
+}
+
+// append writes entries to the buffer, waiting while it is full. They are
+// on disk when it returns, so the inputs can record them as read.
+func (b *buffer) append(ctx context.Context, entries []store.LogEntry) error {
+	var data bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+
+	// The buffer fills briefly whenever reading outpaces sending, so only
+	// a wait that lasts is worth a warning
+	warn := time.After(fullWarning)
+	warned := false
+	for {
+		b.mu.Lock()
+		// An empty buffer takes any batch, so one larger than the limit
+		// can't wait forever
+		if b.bytes == 0 || b.bytes+int64(data.Len()) <= b.maxBytes {
+			break
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.freed:
+		case <-warn:
+			slog.WarnContext(ctx, "Log buffer is full; reading waits until entries are sent", "dir", b.dir, "max_bytes", b.maxBytes)
+			warned = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer b.mu.Unlock()
+	if warned {
+		slog.InfoContext(ctx, "Log buffer has room again; reading resumes", "dir", b.dir)
+	}
+
+	current := &b.segments[len(b.segments)-1]
+	if current.size >= segmentBytes {
+		if err := b.startSegment(current.seq + 1); err != nil {
+			return err
+		}
+		current = &b.segments[len(b.segments)-1]
+	}
+	n, err := b.writer.Write(data.Bytes())
+	current.size += int64(n)
+	b.bytes += int64(n)
+	if err == nil {
+		err = b.writer.Sync()
+	}
+	if err != nil {
+		// Whatever part was written is read back as lines that can't be
+		// parsed and skipped; the caller keeps the entries to try again
+		return fmt.Errorf("writing to log buffer: %w", err)
+	}
+	b.entries += len(entries)
+	notify(b.appended)
+	return nil
+}
+
+// read returns up to limit entries, and roughly up to ingest.MaxBatchBytes,
+// waiting for some to be appended. They stay in the buffer until ack.
+// Once finish has been called and everything is read, it returns
+// errBufferFinished.
+func (b *buffer) read(ctx context.Context, limit int) (*bufferRead, error) {
+	for {
+		b.mu.Lock()
+		b.dropSentSegments()
+		s := b.segments[0]
+		start := b.cursor.Offset
+		finished := b.finished
+		b.mu.Unlock()
+
+		if start >= s.size {
+			if finished {
+				return nil, errBufferFinished
+			}
+			select {
+			case <-b.appended:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		read, err := b.readSegment(ctx, s, start, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(read.entries) > 0 {
+			return read, nil
+		}
+		// Nothing in the run could be parsed
+		if err := b.ack(read, 0); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readSegment reads entries from s starting at offset. Lines that don't
+// parse, such as one torn by a crash while it was written, are skipped.
+func (b *buffer) readSegment(ctx context.Context, s segment, offset int64, limit int) (*bufferRead, error) {
+	file, err := os.Open(b.segmentPath(s.seq))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	read := &bufferRead{seq: s.seq}
+	reader := bufio.NewReader(io.LimitReader(file, s.size-offset))
+	lines, size := 0, 0
+	for len(read.entries) < limit && size < ingest.MaxBatchBytes {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 {
+			break
+		}
+		offset += int64(len(line))
+		lines++
+
+		var entry store.LogEntry
+		if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+			slog.WarnContext(ctx, "Skipping unreadable entry in log buffer", "segment", s.seq, "offset", offset-int64(len(line)), "error", jsonErr)
+			if len(read.entries) > 0 {
+				read.ends[len(read.ends)-1] = offset
+				read.lines[len(read.lines)-1] = lines
+			}
+		} else {
+			read.entries = append(read.entries, entry)
+			read.ends = append(read.ends, offset)
+			read.lines = append(read.lines, lines)
+			size += len(entry.Message)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// A run of lines that are all unreadable is acknowledged as a whole
+	if len(read.entries) == 0 {
+		read.ends = []int64{offset}
+		read.lines = []int{lines}
+	}
+	return read, nil
+}
+
+// ack removes the first n entries of read from the buffer, or all of a
+// read with no entries
+func (b *buffer) ack(read *bufferRead, n int) error {
+	i := n - 1
+	if len(read.entries) == 0 {
+		i = 0
+	}
+	if i < 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	b.bytes -= read.ends[i] - b.cursor.Offset
+	b.entries -= read.lines[i]
+	b.cursor = bufferPosition{Segment: read.seq, Offset: read.ends[i]}
+	b.dropSentSegments()
+	data, err := json.Marshal(b.cursor)
+	b.mu.Unlock()
+	notify(b.freed)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(b.dir, cursorFile), data)
+}
+
+// dropSentSegments deletes segments that have been read to the end, other
+// than the one being appended to. b.mu must be held.
+func (b *buffer) dropSentSegments() {
+	for len(b.segments) > 1 && b.cursor.Offset >= b.segments[0].size {
+		if err := os.Remove(b.segmentPath(b.segments[0].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to delete sent log buffer segment", "segment", b.segments[0].seq, "error", err)
+		}
+		b.segments = b.segments[1:]
+		b.cursor = bufferPosition{Segment: b.segments[0].seq}
+	}
+}
+
+// finish says nothing more will be appended, so read can stop once it has
+// caught up
+func (b *buffer) finish() {
+	b.mu.Lock()
+	b.finished = true
+	b.mu.Unlock()
+	notify(b.appended)
+}
+
+// depth is how much is waiting to be sent
+func (b *buffer) depth() (entries int, bytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.entries, b.bytes
+}
+
+func (b *buffer) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writer.Close()
+}
+
+// notify wakes a waiter on ch, if there is one, without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// countLines counts the lines in a file after offset, including a last
+// line without a newline
+func countLines(path string, offset int64) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	data = data[min(offset, int64(len(data))):]
+	lines := bytes.Count(data, []byte{'\n'})
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lines++
+	}
+	return lines, nil
+}
@@ -0,0 +1,249 @@
+// Package agent ships logs from servers to TinyTail. It follows files
+// matching glob patterns through rotation, container logs, the systemd
+// journal, Fluentd forwarders and OpenTelemetry exporters, and buffers what they produce on disk
+// until it is posted to the ingest API in batches, remembering how far it
+// got in each input so a restart carries on where it stopped.
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/handler"
+)
+
+// Config is the agent's JSON configuration file
+type Config struct {
+	// URL is the TinyTail API, including the stage; TINYTAIL_URL overrides
+	// it. The ingest secret is always read from TINYTAIL_INGEST_SECRET.
+	URL string `json:"url"`
+
+	// StateFile records how far each file has been read
+	StateFile string `json:"state_file"`
+
+	// BufferDir holds entries read and not yet sent (default a buffer
+	// directory beside the state file), up to BufferMaxMB megabytes
+	// (default 256); when it is full, reading waits
+	BufferDir   string `json:"buffer_dir"`
+	BufferMaxMB int    `json:"buffer_max_mb"`
+
+	BatchSize            int `json:"batch_size"`
+	FlushIntervalSeconds int `json:"flush_interval_seconds"`
+	PollIntervalSeconds  int `json:"poll_interval_seconds"`
+
+	Files []FileInput `json:"files"`
+
+	// Kubernetes ships the node's container logs
+	Kubernetes *KubernetesInput `json:"kubernetes"`
+
+	// Forward accepts logs from Fluentd forwarders and Docker's fluentd
+	// logging driver
+	Forward *ForwardInput `json:"forward"`
+
+	// Journal follows the systemd journal
+	Journal *JournalInput `json:"journal"`
+
+	// OTLP accepts logs from OpenTelemetry SDKs and collectors
+	OTLP *OTLPInput `json:"otlp"`
+}
+
+// FileInput is a set of files shipped the same way
+type FileInput struct {
+	// Paths are glob patterns, e.g. /var/log/app/*.log. Include rotated
+	// names (app.log.1) so lines written just before a rotation are not
+	// missed.
+	Paths []string `json:"paths"`
+
+	// Exclude are glob patterns matched against file names, e.g. *.gz
+	Exclude []string `json:"exclude"`
+
+	// Source names the entries (default the host name); Logger defaults to
+	// the file's path
+	Source string `json:"source"`
+	Logger string `json:"logger"`
+
+	// Level is used for lines without one (default INFO)
+	Level string `json:"level"`
+
+	// Format is how lines are parsed: text (the default), json or regex
+	Format string `json:"format"`
+
+	// Pattern is the regex format's expression. Its named groups message,
+	// level, timestamp, source, logger and request_id fill those fields.
+	Pattern string `json:"pattern"`
+
+	// TimestampFormat is the Go layout of timestamps read by the regex
+	// format (default RFC3339)
+	TimestampFormat string `json:"timestamp_format"`
+
+	// MultilinePattern matches the first line of an entry; lines that
+	// don't, such as a stack trace's, are added to the entry before them
+	MultilinePattern string `json:"multiline_pattern"`
+
+	// ReadFrom is where files without a saved position are started when
+	// the agent starts: "end" (the default) or "beginning". Files created
+	// while it runs are always read from the beginning.
+	ReadFrom string `json:"read_from"`
+}
+
+const (
+	defaultBatchSize     = handler.MaxIngestBatch
+	defaultFlushInterval = time.Second
+	defaultPollInterval  = time.Second
+	defaultStateFile     = "/var/lib/tinytail-agent/state.json"
+	defaultBufferMaxMB   = 256
+)
+
+// LoadConfig reads and checks the configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if url := os.Getenv("TINYTAIL_URL"); url != "" {
+		cfg.URL = url
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	var problems []string
+	if c.URL == "" {
+		problems = append(problems, "url or TINYTAIL_URL is required")
+	}
+	if c.StateFile == "" {
+		c.StateFile = defaultStateFile
+	}
+	if c.BufferDir == "" {
+		c.BufferDir = filepath.Join(filepath.Dir(c.StateFile), "buffer")
+	}
+	if c.BufferMaxMB == 0 {
+		c.BufferMaxMB = defaultBufferMaxMB
+	}
+	if c.BufferMaxMB < 0 {
+		problems = append(problems, "buffer_max_mb must not be negative")
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.BatchSize < 1 || c.BatchSize > handler.MaxIngestBatch {
+		problems = append(problems, fmt.Sprintf("batch_size must be between 1 and %d", handler.MaxIngestBatch))
+	}
+	if c.FlushIntervalSeconds < 0 || c.PollIntervalSeconds < 0 {
+		problems = append(problems, "flush_interval_seconds and poll_interval_seconds must not be negative")
+	}
+	if len(c.Files) == 0 && c.Kubernetes == nil && c.Forward == nil && c.Journal == nil && c.OTLP == nil {
+		problems = append(problems, "files must list at least one input, or kubernetes, forward, journal or otlp must be set")
+	}
+
+	for i, input := range c.Files {
+		name := fmt.Sprintf("files[%d]", i)
+		if len(input.Paths) == 0 {
+			problems = append(problems, name+": paths is required")
+		}
+		problems = append(problems, validateInput(name, input)...)
+	}
+	if c.Kubernetes != nil {
+		if len(c.Kubernetes.Paths) == 0 {
+			c.Kubernetes.Paths = []string{defaultContainerLogs}
+		}
+		problems = append(problems, validateInput("kubernetes", c.Kubernetes.FileInput)...)
+	}
+	if c.Forward != nil && c.Forward.Listen == "" {
+		c.Forward.Listen = defaultForwardListen
+	}
+	if c.OTLP != nil {
+		if c.OTLP.GRPCListen == "" {
+			c.OTLP.GRPCListen = defaultOTLPGRPCListen
+		}
+		if c.OTLP.HTTPListen == "" {
+			c.OTLP.HTTPListen = defaultOTLPHTTPListen
+		}
+		if c.OTLP.GRPCListen == otlpOff && c.OTLP.HTTPListen == otlpOff {
+			problems = append(problems, "otlp: grpc_listen and http_listen can't both be \"off\"")
+		}
+	}
+	if c.Journal != nil {
+		switch c.Journal.ReadFrom {
+		case "", "end", "beginning":
+		default:
+			problems = append(problems, fmt.Sprintf("journal: read_from must be \"end\" or \"beginning\", got %q", c.Journal.ReadFrom))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateInput checks how an input's files are matched and parsed
+func validateInput(name string, input FileInput) []string {
+	var problems []string
+	for _, pattern := range append(input.Paths, input.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid glob %q", name, pattern))
+		}
+	}
+	if _, err := NewParser(input); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+	}
+	if input.MultilinePattern != "" {
+		if _, err := regexp.Compile(input.MultilinePattern); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: multiline_pattern: %v", name, err))
+		}
+	}
+	switch input.ReadFrom {
+	case "", "end", "beginning":
+	default:
+		problems = append(problems, fmt.Sprintf("%s: read_from must be \"end\" or \"beginning\", got %q", name, input.ReadFrom))
+	}
+	return problems
+}
+
+// Inputs names the configured inputs, for logging
+func (c *Config) Inputs() []string {
+	var inputs []string
+	if len(c.Files) > 0 {
+		inputs = append(inputs, fmt.Sprintf("files (%d)", len(c.Files)))
+	}
+	if c.Kubernetes != nil {
+		inputs = append(inputs, "kubernetes")
+	}
+	if c.Journal != nil {
+		inputs = append(inputs, "journal")
+	}
+	if c.Forward != nil {
+		inputs = append(inputs, "forward")
+	}
+	if c.OTLP != nil {
+		inputs = append(inputs, "otlp")
+	}
+	return inputs
+}
+
+func (c *Config) flushInterval() time.Duration {
+	if c.FlushIntervalSeconds == 0 {
+		return defaultFlushInterval
+	}
+	return time.Duration(c.FlushIntervalSeconds) * time.Second
+}
+
+func (c *Config) pollInterval() time.Duration {
+	if c.PollIntervalSeconds == 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(c.PollIntervalSeconds) * time.Second
+}
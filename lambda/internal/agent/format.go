@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Parser turns a line, or lines joined into one entry, into an entry. Fields
+// it can't find are left empty for the input's defaults.
+type Parser func(text string) store.LogEntry
+
+// NewParser returns the parser for an input's format, pattern and timestamp
+// format. tinytail-admin import-file parses files with it too.
+func NewParser(input FileInput) (Parser, error) {
+	switch input.Format {
+	case "", "text":
+		return parseText, nil
+	case "json":
+		return parseJSON, nil
+	case "regex":
+		if input.Pattern == "" {
+			return nil, fmt.Errorf("the regex format needs a pattern")
+		}
+		pattern, err := regexp.Compile(input.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+		if pattern.SubexpIndex("message") < 0 {
+			return nil, fmt.Errorf("pattern must have a (?P<message>...) group")
+		}
+		layout := input.TimestampFormat
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return regexParser(pattern, layout), nil
+	default:
+		return nil, fmt.Errorf("format must be text, json or regex, got %q", input.Format)
+	}
+}
+
+// levelPattern finds a level written as a word, as most text formats do
+var levelPattern = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL)\b`)
+
+// parseText keeps the line as the message, taking the first level named in
+// it
+func parseText(text string) store.LogEntry {
+	entry := store.LogEntry{Message: text}
+	if level := levelPattern.FindString(text); level != "" {
+		entry.Level = normalizeLevel(level)
+	}
+	return entry
+}
+
+// JSON field names read by parseJSON, by the entry field they fill, in
+// order of preference
+var (
+	jsonMessageFields   = []string{"message", "msg", "log"}
+	jsonLevelFields     = []string{"level", "severity", "lvl"}
+	jsonTimestampFields = []string{"timestamp", "time", "ts", "@timestamp"}
+	jsonSourceFields    = []string{"source", "service"}
+	jsonLoggerFields    = []string{"logger", "logger_name"}
+	jsonRequestFields   = []string{"request_id", "requestId", "trace_id"}
+)
+
+// parseJSON reads a JSON object per line. Lines that aren't objects are
+// kept as text.
+func parseJSON(text string) store.LogEntry {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return parseText(text)
+	}
+	return entryFromFields(fields)
+}
+
+// entryFromFields fills an entry from a structured record, adding fields it
+// doesn't map to the message as key=value. It removes the fields it maps.
+func entryFromFields(fields map[string]any) store.LogEntry {
+	var entry store.LogEntry
+	take := func(names []string) string {
+		for _, name := range names {
+			if value, ok := fields[name]; ok {
+				delete(fields, name)
+				if s, ok := value.(string); ok {
+					return s
+				}
+				return fmt.Sprint(value)
+			}
+		}
+		return ""
+	}
+	entry.Message = take(jsonMessageFields)
+	entry.Level = normalizeLevel(take(jsonLevelFields))
+	entry.Source = take(jsonSourceFields)
+	entry.Logger = take(jsonLoggerFields)
+	entry.RequestID = take(jsonRequestFields)
+	for _, name := range jsonTimestampFields {
+		if value, ok := fields[name]; ok {
+			if t, ok := parseTimestamp(value); ok {
+				entry.Timestamp = t
+				delete(fields, name)
+			}
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var message strings.Builder
+	message.WriteString(entry.Message)
+	for _, key := range keys {
+		value, err := json.Marshal(fields[key])
+		if err != nil {
+			continue
+		}
+		if s, ok := fields[key].(string); ok && !strings.ContainsAny(s, " \"=") {
+			value = []byte(s)
+		}
+		fmt.Fprintf(&message, " %s=%s", key, value)
+	}
+	entry.Message = strings.TrimPrefix(message.String(), " ")
+	return entry
+}
+
+// parseTimestamp reads an RFC3339 string, or Unix seconds or milliseconds
+func parseTimestamp(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case float64:
+		if v > 1e12 {
+			return time.UnixMilli(int64(v)), true
+		}
+		seconds, fraction := math.Modf(v)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// regexParser fills fields from the pattern's named groups. Lines that
+// don't match are kept as text.
+func regexParser(pattern *regexp.Regexp, layout string) Parser {
+	return func(text string) store.LogEntry {
+		match := pattern.FindStringSubmatch(text)
+		if match == nil {
+			return parseText(text)
+		}
+		group := func(name string) string {
+			if i := pattern.SubexpIndex(name); i >= 0 {
+				return match[i]
+			}
+			return ""
+		}
+
+		entry := store.LogEntry{
+			Message:   group("message"),
+			Level:     normalizeLevel(group("level")),
+			Source:    group("source"),
+			Logger:    group("logger"),
+			RequestID: group("request_id"),
+		}
+		// A multiline entry's later lines belong to its message
+		if end := pattern.FindStringSubmatchIndex(text)[1]; end < len(text) {
+			entry.Message += text[end:]
+		}
+		if timestamp := group("timestamp"); timestamp != "" {
+			if t, err := time.Parse(layout, timestamp); err == nil {
+				entry.Timestamp = t
+			}
+		}
+		return entry
+	}
+}
+
+// normalizeLevel spells levels the way TinyTail's other producers do
+func normalizeLevel(level string) string {
+	switch level = strings.ToUpper(strings.TrimSpace(level)); level {
+	case "WARNING":
+		return "WARN"
+	case "CRITICAL":
+		return "FATAL"
+	default:
+		return level
+	}
+}
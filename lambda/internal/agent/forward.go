@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// defaultForwardListen is Fluentd's port, on loopback since the protocol
+// has no authentication here
+const defaultForwardListen = "127.0.0.1:24224"
+
+// ForwardInput accepts logs over the Fluentd forward protocol, so Docker's
+// fluentd logging driver and Fluentd or Fluent Bit forwarders can send to
+// the agent as they would to Fluentd. Shared-key authentication and TLS
+// aren't supported.
+type ForwardInput struct {
+	// Listen is the TCP address to accept connections on (default
+	// 127.0.0.1:24224)
+	Listen string `json:"listen"`
+
+	// Source, Logger and Level are used for records without them. Source
+	// otherwise defaults to the container's name for Docker records and
+	// the tag for others, and Logger to the tag.
+	Source string `json:"source"`
+	Logger string `json:"logger"`
+	Level  string `json:"level"`
+}
+
+// eventTime is the protocol's timestamp extension: seconds and
+// nanoseconds, each a big-endian uint32
+type eventTime struct {
+	time.Time
+}
+
+func (t *eventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+func (t *eventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("event time has %d bytes, want 8", len(b))
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+	return nil
+}
+
+func init() {
+	msgpack.RegisterExt(0, (*eventTime)(nil))
+}
+
+// forwardListener accepts forward protocol connections, writing what they
+// send to the buffer before acknowledging it
+type forwardListener struct {
+	input    *ForwardInput
+	buf      *buffer
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func listenForward(input *ForwardInput, buf *buffer) (*forwardListener, error) {
+	listener, err := net.Listen("tcp", input.Listen)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Listening for the Fluentd forward protocol", "address", listener.Addr().String())
+	return &forwardListener{input: input, buf: buf, listener: listener, conns: map[net.Conn]bool{}}, nil
+}
+
+// serve accepts connections until ctx is done, then closes them and waits
+// for their handlers to finish
+func (l *forwardListener) serve(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		l.listener.Close()
+		l.mu.Lock()
+		for conn := range l.conns {
+			conn.Close()
+		}
+		l.mu.Unlock()
+	})
+	defer stop()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Forward listener stopped", "error", err)
+			}
+			break
+		}
+		l.mu.Lock()
+		if ctx.Err() != nil {
+			conn.Close()
+			l.mu.Unlock()
+			break
+		}
+		l.conns[conn] = true
+		l.mu.Unlock()
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.handle(ctx, conn)
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+			conn.Close()
+		}()
+	}
+	l.wg.Wait()
+}
+
+// handle reads messages from a connection until it closes. A message is
+// acknowledged, when the sender asks, once its entries are buffered; one
+// that can't be buffered closes the connection unacknowledged, so the
+// sender sends it again.
+func (l *forwardListener) handle(ctx context.Context, conn net.Conn) {
+	dec := msgpack.NewDecoder(bufio.NewReader(conn))
+	dec.UseLooseInterfaceDecoding(true)
+	for {
+		message, err := dec.DecodeInterface()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Closing forward connection", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+
+		entries, chunk, err := l.entries(message)
+		if err != nil {
+			slog.Warn("Closing forward connection after an invalid message", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		if len(entries) > 0 {
+			if err := l.buf.append(ctx, entries); err != nil {
+				if ctx.Err() == nil {
+					slog.Error("Failed to buffer forwarded log entries", "entries", len(entries), "error", err)
+				}
+				return
+			}
+		}
+		if chunk != "" {
+			ack, _ := msgpack.Marshal(map[string]string{"ack": chunk})
+			if _, err := conn.Write(ack); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// entries reads a message in any of the protocol's modes, returning its
+// entries and the chunk ID to acknowledge, if any:
+//
+//	Message:        [tag, time, record, option?]
+//	Forward:        [tag, [[time, record], ...], option?]
+//	PackedForward:  [tag, <time, record pairs as msgpack>, option?]
+func (l *forwardListener) entries(message any) ([]store.LogEntry, string, error) {
+	fields, ok := message.([]any)
+	if !ok || len(fields) < 2 {
+		return nil, "", fmt.Errorf("message is not an array of at least two items")
+	}
+	tag, ok := text(fields[0])
+	if !ok {
+		return nil, "", fmt.Errorf("tag is not a string")
+	}
+
+	var (
+		events []any
+		option any
+	)
+	switch second := fields[1].(type) {
+	case []any:
+		events = second
+		if len(fields) > 2 {
+			option = fields[2]
+		}
+	case string, []byte:
+		if len(fields) > 2 {
+			option = fields[2]
+		}
+		packed, _ := text(second)
+		var err error
+		if events, err = unpackEvents([]byte(packed), optionValue(option, "compressed") == "gzip"); err != nil {
+			return nil, "", err
+		}
+	default:
+		if len(fields) < 3 {
+			return nil, "", fmt.Errorf("message has no record")
+		}
+		events = []any{[]any{fields[1], fields[2]}}
+		if len(fields) > 3 {
+			option = fields[3]
+		}
+	}
+
+	entries := make([]store.LogEntry, 0, len(events))
+	for _, event := range events {
+		pair, ok := event.([]any)
+		if !ok || len(pair) < 2 {
+			return nil, "", fmt.Errorf("event is not a [time, record] pair")
+		}
+		record, ok := pair[1].(map[string]any)
+		if !ok {
+			return nil, "", fmt.Errorf("record is not a map")
+		}
+		entries = append(entries, l.entry(tag, eventTimestamp(pair[0]), record))
+	}
+	return entries, optionValue(option, "chunk"), nil
+}
+
+// unpackEvents decodes the concatenated [time, record] pairs of the
+// PackedForward mode
+func unpackEvents(packed []byte, compressed bool) ([]any, error) {
+	var r io.Reader = bytes.NewReader(packed)
+	if compressed {
+		// Compressed streams can be several gzip members in a row, which
+		// gzip.Reader reads as one
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	dec := msgpack.NewDecoder(r)
+	dec.UseLooseInterfaceDecoding(true)
+	var events []any
+	for {
+		event, err := dec.DecodeInterface()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+// entry turns a record into an entry. Docker's records name the container
+// and use source for the stream, which is added as a field for stderr.
+func (l *forwardListener) entry(tag string, timestamp time.Time, record map[string]any) store.LogEntry {
+	for key, value := range record {
+		if b, ok := value.([]byte); ok {
+			record[key] = string(b)
+		}
+	}
+
+	var container, stream string
+	if name, ok := record["container_name"].(string); ok {
+		container = strings.TrimPrefix(name, "/")
+		stream, _ = record["source"].(string)
+		for _, key := range []string{"container_name", "container_id", "source", "partial_message", "partial_id", "partial_ordinal", "partial_last"} {
+			delete(record, key)
+		}
+	}
+
+	entry := entryFromFields(record)
+	if stream == "stderr" {
+		entry.Message += " stream=stderr"
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = timestamp
+	}
+	if entry.Level == "" {
+		entry.Level = parseText(entry.Message).Level
+	}
+	if entry.Level == "" {
+		entry.Level = normalizeLevel(l.input.Level)
+	}
+	if entry.Level == "" {
+		entry.Level = "INFO"
+	}
+	entry.Source = firstNonEmpty(entry.Source, l.input.Source, container, tag)
+	entry.Logger = firstNonEmpty(entry.Logger, l.input.Logger, tag)
+	return entry
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// eventTimestamp reads an event's time: an EventTime, or Unix seconds
+func eventTimestamp(value any) time.Time {
+	switch v := value.(type) {
+	case *eventTime:
+		return v.Time
+	case int64:
+		return time.Unix(v, 0)
+	case uint64:
+		return time.Unix(int64(v), 0)
+	case float64:
+		if t, ok := parseTimestamp(v); ok {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// optionValue reads a string from a message's option map
+func optionValue(option any, key string) string {
+	options, ok := option.(map[string]any)
+	if !ok {
+		return ""
+	}
+	value, _ := text(options[key])
+	return value
+}
+
+// text reads a msgpack string, which some senders write as binary
+func text(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// journalRestartDelay is how long to wait before running journalctl again
+// after it exits
+const journalRestartDelay = 5 * time.Second
+
+// JournalInput follows the systemd journal. Entries take their level from
+// their priority and their source from their unit.
+type JournalInput struct {
+	// Units limits the input to these systemd units, e.g. nginx.service
+	Units []string `json:"units"`
+
+	// Source replaces the unit as the source
+	Source string `json:"source"`
+
+	// ReadFrom is where the journal is read from the first time, before a
+	// cursor has been saved: "end" (the default) or "beginning"
+	ReadFrom string `json:"read_from"`
+}
+
+// journal reads the journal through journalctl, which keeps the agent free
+// of libsystemd
+type journal struct {
+	input   *JournalInput
+	state   *state
+	records chan<- record
+}
+
+// run follows the journal until ctx is done, carrying on from the saved
+// cursor and running journalctl again if it stops
+func (j *journal) run(ctx context.Context) {
+	cursor := j.state.journalCursor()
+	for {
+		next, err := j.follow(ctx, cursor)
+		if next != "" {
+			cursor = next
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.ErrorContext(ctx, "journalctl stopped; starting it again", "error", err)
+		select {
+		case <-time.After(journalRestartDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow runs journalctl from after cursor, queueing its entries until it
+// exits, and returns the cursor of the last one queued
+func (j *journal) follow(ctx context.Context, cursor string) (string, error) {
+	args := []string{"--follow", "--output=json", "--all", "--no-pager", "--quiet"}
+	switch {
+	case cursor != "":
+		args = append(args, "--after-cursor="+cursor)
+	case j.input.ReadFrom != "beginning":
+		args = append(args, "--lines=0")
+	}
+	for _, unit := range j.input.Units {
+		args = append(args, "--unit="+unit)
+	}
+
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "Following the systemd journal", "units", j.input.Units, "after_cursor", cursor)
+
+	last := ""
+	reader := bufio.NewReaderSize(stdout, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if entry, next, ok := j.parse(line); ok && j.send(ctx, entry, next) {
+				last = next
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.WarnContext(ctx, "Failed to read from journalctl", "error", err)
+			}
+			break
+		}
+	}
+
+	err = cmd.Wait()
+	if err == nil {
+		err = errors.New("journalctl exited")
+	}
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		err = fmt.Errorf("%w: %s", err, message)
+	}
+	return last, err
+}
+
+// parse reads an entry from journalctl's JSON output, returning its cursor
+func (j *journal) parse(line []byte) (store.LogEntry, string, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		slog.Warn("Skipping unreadable journal entry", "error", err)
+		return store.LogEntry{}, "", false
+	}
+	field := func(name string) string {
+		raw, ok := fields[name]
+		if !ok {
+			return ""
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s
+		}
+		// Fields that aren't valid UTF-8 come as arrays of bytes
+		var b []byte
+		var ints []int
+		if json.Unmarshal(raw, &ints) == nil {
+			for _, i := range ints {
+				b = append(b, byte(i))
+			}
+			return string(b)
+		}
+		return ""
+	}
+
+	entry := store.LogEntry{
+		Message: field("MESSAGE"),
+		Level:   priorityLevel(field("PRIORITY")),
+		Logger:  firstNonEmpty(field("SYSLOG_IDENTIFIER"), field("_COMM")),
+	}
+	unit := strings.TrimSuffix(field("_SYSTEMD_UNIT"), ".service")
+	entry.Source = firstNonEmpty(j.input.Source, unit, entry.Logger, field("_HOSTNAME"))
+	if micros, err := strconv.ParseInt(field("__REALTIME_TIMESTAMP"), 10, 64); err == nil {
+		entry.Timestamp = time.UnixMicro(micros)
+	} else {
+		entry.Timestamp = time.Now()
+	}
+	return entry, field("__CURSOR"), true
+}
+
+// send queues an entry, reporting whether it was queued. Like the tailer,
+// it queues nothing once stopping, so the saved cursor can't pass an entry
+// that was dropped.
+func (j *journal) send(ctx context.Context, entry store.LogEntry, cursor string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case j.records <- record{entry: entry, cursor: cursor}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// priorityLevel maps a syslog priority to a level
+func priorityLevel(priority string) string {
+	switch priority {
+	case "0", "1", "2":
+		return "FATAL"
+	case "3":
+		return "ERROR"
+	case "4":
+		return "WARN"
+	case "7":
+		return "DEBUG"
+	default:
+		return "INFO"
+	}
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultContainerLogs is where the kubelet links each container's log
+const defaultContainerLogs = "/var/log/containers/*.log"
+
+// KubernetesInput ships the logs of the containers on the node, for running
+// the agent as a DaemonSet. Entries are named after the pod they came from:
+// the source is namespace/container and the logger the pod, unless Source
+// or Logger say otherwise, and the namespace, pod and container are added
+// to the message as fields.
+type KubernetesInput struct {
+	// FileInput parses what the containers write; Paths default to the
+	// kubelet's links in /var/log/containers
+	FileInput
+
+	// Namespaces, when set, are the only ones shipped; ExcludeNamespaces
+	// are never shipped (e.g. kube-system)
+	Namespaces        []string `json:"namespaces"`
+	ExcludeNamespaces []string `json:"exclude_namespaces"`
+}
+
+// pod identifies the container a log file belongs to
+type pod struct {
+	namespace string
+	name      string
+	container string
+}
+
+// containerLogName is the kubelet's name for a container's log link:
+// <pod>_<namespace>_<container>-<container id>.log
+var containerLogName = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-[0-9a-f]{64}\.log$`)
+
+// podFromPath reads the pod from a container log's file name
+func podFromPath(path string) (*pod, bool) {
+	match := containerLogName.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return nil, false
+	}
+	return &pod{name: match[1], namespace: match[2], container: match[3]}, true
+}
+
+// accepts reports whether a namespace's logs are shipped
+func (k *KubernetesInput) accepts(namespace string) bool {
+	for _, excluded := range k.ExcludeNamespaces {
+		if namespace == excluded {
+			return false
+		}
+	}
+	if len(k.Namespaces) == 0 {
+		return true
+	}
+	for _, included := range k.Namespaces {
+		if namespace == included {
+			return true
+		}
+	}
+	return false
+}
+
+// fields are added to each entry's message, so pods can be searched for
+// whatever the source is
+func (p *pod) fields() string {
+	return fmt.Sprintf("namespace=%s pod=%s container=%s", p.namespace, p.name, p.container)
+}
+
+// containerLine is a line a container wrote, unwrapped from the container
+// runtime's log format
+type containerLine struct {
+	text    string
+	stream  string
+	time    time.Time
+	partial bool // The runtime split a long line; the rest follows
+}
+
+// criLine is the CRI format used by containerd and CRI-O:
+// <time> <stream> <F|P> <text>
+var criLine = regexp.MustCompile(`^(\S+) (stdout|stderr) ([FP])(?: (.*))?$`)
+
+// parseContainerLine unwraps a line in the CRI format or Docker's json-file
+// format
+func parseContainerLine(line string) (containerLine, bool) {
+	if strings.HasPrefix(line, "{") {
+		var docker struct {
+			Log    string    `json:"log"`
+			Stream string    `json:"stream"`
+			Time   time.Time `json:"time"`
+		}
+		if err := json.Unmarshal([]byte(line), &docker); err != nil {
+			return containerLine{}, false
+		}
+		text, complete := strings.CutSuffix(docker.Log, "\n")
+		return containerLine{text: text, stream: docker.Stream, time: docker.Time, partial: !complete}, true
+	}
+
+	match := criLine.FindStringSubmatch(line)
+	if match == nil {
+		return containerLine{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, match[1])
+	if err != nil {
+		return containerLine{}, false
+	}
+	return containerLine{text: match[4], stream: match[2], time: t, partial: match[3] == "P"}, true
+}
@@ -0,0 +1,591 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/protowire"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// OpenTelemetry's ports, on loopback since the receivers have no
+// authentication
+const (
+	defaultOTLPGRPCListen = "127.0.0.1:4317"
+	defaultOTLPHTTPListen = "127.0.0.1:4318"
+)
+
+// otlpOff turns a receiver off
+const otlpOff = "off"
+
+// maxOTLPRequestBytes bounds a decompressed export request, as gRPC's
+// default message size limit does
+const maxOTLPRequestBytes = 4 << 20
+
+// otlpExportMethod is the gRPC path of the logs service's one method
+const otlpExportMethod = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+// OTLPInput accepts logs over the OpenTelemetry protocol, so services
+// instrumented with OpenTelemetry can export to the agent as they would to
+// a collector. Both OTLP/gRPC and OTLP/HTTP (protobuf or JSON) are
+// accepted, without TLS.
+type OTLPInput struct {
+	// GRPCListen and HTTPListen are the addresses of the gRPC and HTTP
+	// receivers (default 127.0.0.1:4317 and 127.0.0.1:4318), or "off"
+	GRPCListen string `json:"grpc_listen"`
+	HTTPListen string `json:"http_listen"`
+
+	// Source, Logger and Level are used for records without them. Source
+	// otherwise defaults to the resource's service.name and then the host
+	// name, and Logger to the instrumentation scope's name.
+	Source string `json:"source"`
+	Logger string `json:"logger"`
+	Level  string `json:"level"`
+}
+
+// otlpReceiver serves the OTLP receivers, writing each export request to
+// the buffer before answering it
+type otlpReceiver struct {
+	input    *OTLPInput
+	buf      *buffer
+	hostname string
+
+	servers   []*http.Server
+	listeners []net.Listener
+}
+
+func listenOTLP(input *OTLPInput, buf *buffer) (*otlpReceiver, error) {
+	r := &otlpReceiver{input: input, buf: buf}
+	r.hostname, _ = os.Hostname()
+
+	if input.GRPCListen != otlpOff {
+		// gRPC clients speak HTTP/2 without TLS from the first byte
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		if err := r.listen(input.GRPCListen, "OTLP/gRPC", &http.Server{Handler: http.HandlerFunc(r.serveGRPC), Protocols: &protocols, ReadHeaderTimeout: 10 * time.Second}); err != nil {
+			return nil, err
+		}
+	}
+	if input.HTTPListen != otlpOff {
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /v1/logs", r.serveHTTP)
+		if err := r.listen(input.HTTPListen, "OTLP/HTTP", &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *otlpReceiver) listen(address, protocol string, server *http.Server) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		for _, l := range r.listeners {
+			l.Close()
+		}
+		return err
+	}
+	slog.Info("Listening for "+protocol, "address", listener.Addr().String())
+	r.servers = append(r.servers, server)
+	r.listeners = append(r.listeners, listener)
+	return nil
+}
+
+// serve answers requests until ctx is done, then waits for those in
+// progress to finish
+func (r *otlpReceiver) serve(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, server := range r.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Serve(r.listeners[i]); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("OTLP receiver stopped", "address", r.listeners[i].Addr().String(), "error", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownGrace)
+	defer cancel()
+	for _, server := range r.servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+	}
+	wg.Wait()
+}
+
+// serveHTTP answers an OTLP/HTTP export. Senders retry 503s, so that is
+// the answer when the entries can't be buffered.
+func (r *otlpReceiver) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+	isJSON := strings.HasPrefix(contentType, "application/json")
+	if !isJSON && !strings.HasPrefix(contentType, "application/x-protobuf") {
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readOTLPBody(req.Body, req.Header.Get("Content-Encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request otlpLogsRequest
+	if isJSON {
+		err = json.Unmarshal(body, &request)
+	} else {
+		request, err = decodeOTLPLogs(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid export request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.store(req.Context(), request); err != nil {
+		http.Error(w, "Failed to buffer log records", http.StatusServiceUnavailable)
+		return
+	}
+	// An empty response: no partial success to report
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// readOTLPBody reads a request body, decompressing it if the sender said
+// it was gzipped
+func readOTLPBody(body io.Reader, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxOTLPRequestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxOTLPRequestBytes {
+		return nil, fmt.Errorf("request is larger than %d bytes", maxOTLPRequestBytes)
+	}
+	return data, nil
+}
+
+// gRPC status codes the receiver answers with
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+)
+
+// serveGRPC answers an OTLP/gRPC export. A gRPC message is framed by a
+// compressed flag and a four-byte length, and the call's status is sent in
+// trailers.
+func (r *otlpReceiver) serveGRPC(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	status := func(code int, message string) {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if message != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+		}
+	}
+	if req.Method != http.MethodPost || req.URL.Path != otlpExportMethod {
+		status(grpcUnimplemented, "unknown method "+req.URL.Path)
+		return
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(req.Body, header[:]); err != nil {
+		status(grpcInvalidArgument, "missing message")
+		return
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxOTLPRequestBytes {
+		status(grpcInvalidArgument, fmt.Sprintf("message is larger than %d bytes", maxOTLPRequestBytes))
+		return
+	}
+	encoding := ""
+	if header[0] == 1 {
+		encoding = req.Header.Get("Grpc-Encoding")
+	}
+	body, err := readOTLPBody(io.LimitReader(req.Body, int64(length)), encoding)
+	if err != nil {
+		status(grpcInvalidArgument, err.Error())
+		return
+	}
+	request, err := decodeOTLPLogs(body)
+	if err != nil {
+		status(grpcInvalidArgument, "invalid export request: "+err.Error())
+		return
+	}
+
+	if err := r.store(req.Context(), request); err != nil {
+		status(grpcUnavailable, "failed to buffer log records")
+		return
+	}
+	// An empty ExportLogsServiceResponse
+	w.Write([]byte{0, 0, 0, 0, 0})
+	status(grpcOK, "")
+}
+
+// store buffers the entries of an export request
+func (r *otlpReceiver) store(ctx context.Context, request otlpLogsRequest) error {
+	var entries []store.LogEntry
+	for _, resourceLogs := range request.ResourceLogs {
+		service := ""
+		for _, attribute := range resourceLogs.Resource.Attributes {
+			if attribute.Key == "service.name" && attribute.Value != nil && attribute.Value.StringValue != nil {
+				service = *attribute.Value.StringValue
+			}
+		}
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, record := range scopeLogs.LogRecords {
+				entries = append(entries, r.entry(service, scopeLogs.Scope.Name, record))
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := r.buf.append(ctx, entries); err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Failed to buffer OTLP log records", "entries", len(entries), "error", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// entry turns a log record into an entry. Its attributes are appended to
+// the message as key=value, as JSON lines' extra fields are, and its trace
+// ID becomes the request ID.
+func (r *otlpReceiver) entry(service, scope string, record otlpLogRecord) store.LogEntry {
+	fields := map[string]any{}
+	for _, attribute := range record.Attributes {
+		fields[attribute.Key] = attribute.Value.value()
+	}
+	// The body is the message, whatever the attributes say
+	delete(fields, "message")
+	entry := entryFromFields(fields)
+	entry.Message = strings.TrimSpace(record.Body.text() + " " + entry.Message)
+
+	switch {
+	case record.TimeUnixNano != 0:
+		entry.Timestamp = time.Unix(0, int64(record.TimeUnixNano))
+	case record.ObservedTimeUnixNano != 0:
+		entry.Timestamp = time.Unix(0, int64(record.ObservedTimeUnixNano))
+	case entry.Timestamp.IsZero():
+		entry.Timestamp = time.Now()
+	}
+	entry.Level = firstNonEmpty(severityLevel(record.SeverityNumber), normalizeLevel(record.SeverityText), entry.Level, normalizeLevel(r.input.Level), "INFO")
+	entry.Source = firstNonEmpty(entry.Source, r.input.Source, service, r.hostname)
+	entry.Logger = firstNonEmpty(entry.Logger, scope, r.input.Logger)
+	if record.TraceID != "" && strings.Trim(record.TraceID, "0") != "" {
+		entry.RequestID = firstNonEmpty(entry.RequestID, record.TraceID)
+	}
+	return entry
+}
+
+// severityLevel maps an OpenTelemetry severity number to a level. Each
+// level spans four numbers, e.g. INFO to INFO4.
+func severityLevel(number int) string {
+	levels := []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+	if number < 1 || number > 4*len(levels) {
+		return ""
+	}
+	return levels[(number-1)/4]
+}
+
+// The parts of an ExportLogsServiceRequest the agent uses. Field names are
+// OTLP/JSON's; protobuf requests are decoded into the same types.
+type (
+	otlpLogsRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpScopeLogs struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano         otlpInt        `json:"timeUnixNano"`
+		ObservedTimeUnixNano otlpInt        `json:"observedTimeUnixNano"`
+		SeverityNumber       int            `json:"severityNumber"`
+		SeverityText         string         `json:"severityText"`
+		Body                 *otlpAnyValue  `json:"body"`
+		Attributes           []otlpKeyValue `json:"attributes"`
+		TraceID              string         `json:"traceId"` // Hex
+	}
+	otlpKeyValue struct {
+		Key   string        `json:"key"`
+		Value *otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string        `json:"stringValue"`
+		BoolValue   *bool          `json:"boolValue"`
+		IntValue    *otlpInt       `json:"intValue"`
+		DoubleValue *float64       `json:"doubleValue"`
+		ArrayValue  *otlpArray     `json:"arrayValue"`
+		KvlistValue *otlpKeyValues `json:"kvlistValue"`
+		BytesValue  []byte         `json:"bytesValue"`
+	}
+	otlpArray struct {
+		Values []otlpAnyValue `json:"values"`
+	}
+	otlpKeyValues struct {
+		Values []otlpKeyValue `json:"values"`
+	}
+)
+
+// otlpInt is a 64-bit integer, which OTLP/JSON may send as a string
+type otlpInt int64
+
+func (i *otlpInt) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*i = otlpInt(n)
+	return nil
+}
+
+// value converts an AnyValue for entryFromFields
+func (v *otlpAnyValue) value() any {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]any, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			values[i] = v.ArrayValue.Values[i].value()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]any, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.value()
+		}
+		return values
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	return nil
+}
+
+// text renders a body as a message: strings as they are, anything else
+// as JSON
+func (v *otlpAnyValue) text() string {
+	switch value := v.value().(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+// decodeOTLPLogs decodes a protobuf ExportLogsServiceRequest
+func decodeOTLPLogs(data []byte) (otlpLogsRequest, error) {
+	var request otlpLogsRequest
+	r := protowire.NewReader(data)
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			var resourceLogs otlpResourceLogs
+			r.Message(resourceLogs.decode)
+			request.ResourceLogs = append(request.ResourceLogs, resourceLogs)
+		default:
+			r.Skip(wireType)
+		}
+	}
+	return request, r.Err()
+}
+
+func (rl *otlpResourceLogs) decode(r *protowire.Reader) {
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			// Resource: its attributes are field 1
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.BytesType:
+						var kv otlpKeyValue
+						r.Message(kv.decode)
+						rl.Resource.Attributes = append(rl.Resource.Attributes, kv)
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+		case field == 2 && wireType == protowire.BytesType:
+			var scopeLogs otlpScopeLogs
+			r.Message(scopeLogs.decode)
+			rl.ScopeLogs = append(rl.ScopeLogs, scopeLogs)
+		default:
+			r.Skip(wireType)
+		}
+	}
+}
+
+func (sl *otlpScopeLogs) decode(r *protowire.Reader) {
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			// InstrumentationScope: its name is field 1
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.BytesType:
+						sl.Scope.Name = string(r.Bytes())
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+		case field == 2 && wireType == protowire.BytesType:
+			var record otlpLogRecord
+			r.Message(record.decode)
+			sl.LogRecords = append(sl.LogRecords, record)
+		default:
+			r.Skip(wireType)
+		}
+	}
+}
+
+func (lr *otlpLogRecord) decode(r *protowire.Reader) {
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.Fixed64Type:
+			lr.TimeUnixNano = otlpInt(r.Fixed(8))
+		case field == 2 && wireType == protowire.VarintType:
+			lr.SeverityNumber = int(r.Varint())
+		case field == 3 && wireType == protowire.BytesType:
+			lr.SeverityText = string(r.Bytes())
+		case field == 5 && wireType == protowire.BytesType:
+			lr.Body = &otlpAnyValue{}
+			r.Message(lr.Body.decode)
+		case field == 6 && wireType == protowire.BytesType:
+			var kv otlpKeyValue
+			r.Message(kv.decode)
+			lr.Attributes = append(lr.Attributes, kv)
+		case field == 9 && wireType == protowire.BytesType:
+			lr.TraceID = hex.EncodeToString(r.Bytes())
+		case field == 11 && wireType == protowire.Fixed64Type:
+			lr.ObservedTimeUnixNano = otlpInt(r.Fixed(8))
+		default:
+			r.Skip(wireType)
+		}
+	}
+}
+
+func (kv *otlpKeyValue) decode(r *protowire.Reader) {
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			kv.Key = string(r.Bytes())
+		case field == 2 && wireType == protowire.BytesType:
+			kv.Value = &otlpAnyValue{}
+			r.Message(kv.Value.decode)
+		default:
+			r.Skip(wireType)
+		}
+	}
+}
+
+func (v *otlpAnyValue) decode(r *protowire.Reader) {
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			s := string(r.Bytes())
+			v.StringValue = &s
+		case field == 2 && wireType == protowire.VarintType:
+			b := r.Varint() != 0
+			v.BoolValue = &b
+		case field == 3 && wireType == protowire.VarintType:
+			i := otlpInt(r.Varint())
+			v.IntValue = &i
+		case field == 4 && wireType == protowire.Fixed64Type:
+			f := math.Float64frombits(r.Fixed(8))
+			v.DoubleValue = &f
+		case field == 5 && wireType == protowire.BytesType:
+			v.ArrayValue = &otlpArray{}
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.BytesType:
+						var item otlpAnyValue
+						r.Message(item.decode)
+						v.ArrayValue.Values = append(v.ArrayValue.Values, item)
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+		case field == 6 && wireType == protowire.BytesType:
+			v.KvlistValue = &otlpKeyValues{}
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.BytesType:
+						var kv otlpKeyValue
+						r.Message(kv.decode)
+						v.KvlistValue.Values = append(v.KvlistValue.Values, kv)
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+		case field == 7 && wireType == protowire.BytesType:
+			v.BytesValue = bytes.Clone(r.Bytes())
+		default:
+			r.Skip(wireType)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileState is how far a file has been shipped
+type fileState struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// state is the agent's saved positions, by file identity rather than path
+// so a file renamed by rotation is carried on with, not read again, and the
+// journal's cursor. Positions only move once what comes before them has
+// been buffered.
+type state struct {
+	path string
+
+	mu      sync.Mutex
+	files   map[string]fileState
+	journal string
+}
+
+func loadState(path string) (*state, error) {
+	s := &state{path: path, files: map[string]fileState{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved savedState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if saved.Files != nil {
+		s.files = saved.Files
+	}
+	s.journal = saved.Journal
+	return s, nil
+}
+
+// savedState is the state file
+type savedState struct {
+	Files   map[string]fileState `json:"files"`
+	Journal string               `json:"journal_cursor,omitempty"`
+}
+
+// get returns a file's saved position
+func (s *state) get(id string) (fileState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[id]
+	return file, ok
+}
+
+// start records where a newly found file is read from
+func (s *state) start(id, path string, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[id]; !ok {
+		s.files[id] = fileState{Path: path, Offset: offset}
+	}
+}
+
+// advance records that a file has been shipped up to offset. Files that
+// have been forgotten stay forgotten.
+func (s *state) advance(id, path string, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if file, ok := s.files[id]; ok && offset > file.Offset {
+		s.files[id] = fileState{Path: path, Offset: offset}
+	}
+}
+
+// journalCursor returns the journal's saved cursor, if any
+func (s *state) journalCursor() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.journal
+}
+
+// advanceJournal records that the journal has been read up to cursor
+func (s *state) advanceJournal(cursor string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal = cursor
+}
+
+// forget drops a file that is no longer followed
+func (s *state) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, id)
+}
+
+// save writes the positions, replacing the file in one step so a crash
+// can't leave half of it
+func (s *state) save() error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(savedState{Files: s.files, Journal: s.journal}, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces a file in one step, creating its directory if
+// needed
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,388 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// maxLineBytes is the longest line kept whole; longer ones are split
+const maxLineBytes = 1 << 20
+
+// record is an entry read by an input, and the input's position after it,
+// which is saved once the entry has been buffered: a file's offset, or the
+// journal's cursor
+type record struct {
+	entry  store.LogEntry
+	fileID string
+	path   string
+	offset int64
+	cursor string
+}
+
+// input is a FileInput ready to read with
+type input struct {
+	FileInput
+	parse     Parser
+	multiline *regexp.Regexp
+
+	// kubernetes is set for container logs
+	kubernetes *KubernetesInput
+}
+
+// lineMeta is what the container runtime recorded about a line
+type lineMeta struct {
+	stream string
+	time   time.Time
+}
+
+// tailedFile is an open file being followed
+type tailedFile struct {
+	id     string
+	path   string
+	input  *input
+	file   *os.File
+	offset int64 // read so far, including any partial line
+
+	partial []byte
+
+	// pod is set for container logs, and container holds a line the
+	// runtime split until its last part is read
+	pod       *pod
+	container strings.Builder
+
+	// pending is a multiline entry that may have more lines to come
+	pending       []string
+	pendingMeta   lineMeta
+	pendingOffset int64
+}
+
+// tailer finds the files matching the inputs and reads new lines from them
+type tailer struct {
+	inputs   []*input
+	state    *state
+	records  chan<- record
+	interval time.Duration
+	hostname string
+
+	files     map[string]*tailedFile
+	firstPoll bool
+}
+
+func newTailer(cfg *Config, st *state, records chan<- record) (*tailer, error) {
+	t := &tailer{
+		state:     st,
+		records:   records,
+		interval:  cfg.pollInterval(),
+		files:     map[string]*tailedFile{},
+		firstPoll: true,
+	}
+	t.hostname, _ = os.Hostname()
+	for _, fileInput := range cfg.Files {
+		in, err := newInput(fileInput)
+		if err != nil {
+			return nil, err
+		}
+		t.inputs = append(t.inputs, in)
+	}
+	if cfg.Kubernetes != nil {
+		in, err := newInput(cfg.Kubernetes.FileInput)
+		if err != nil {
+			return nil, err
+		}
+		in.kubernetes = cfg.Kubernetes
+		t.inputs = append(t.inputs, in)
+	}
+	return t, nil
+}
+
+func newInput(fileInput FileInput) (*input, error) {
+	parse, err := NewParser(fileInput)
+	if err != nil {
+		return nil, err
+	}
+	in := &input{FileInput: fileInput, parse: parse}
+	if fileInput.MultilinePattern != "" {
+		in.multiline = regexp.MustCompile(fileInput.MultilinePattern)
+	}
+	return in, nil
+}
+
+// run polls the files until ctx is done
+func (t *tailer) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		t.poll(ctx)
+		select {
+		case <-ctx.Done():
+			for _, f := range t.files {
+				f.file.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads what has been written since the last poll. Files that no
+// longer match are read to the end, since a rotated file can still have
+// lines written just before it was renamed, and then let go.
+func (t *tailer) poll(ctx context.Context) {
+	seen := map[string]bool{}
+	for _, in := range t.inputs {
+		for _, path := range t.match(in) {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			id := fileID(path, info)
+			if seen[id] {
+				continue // Matched by an earlier input
+			}
+			seen[id] = true
+
+			f := t.files[id]
+			if f == nil {
+				if f = t.open(id, path, info, in); f == nil {
+					continue
+				}
+				t.files[id] = f
+			}
+			f.path = path
+
+			if info.Size() < f.offset {
+				slog.InfoContext(ctx, "File was truncated; reading it from the start", "path", path)
+				if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+					slog.WarnContext(ctx, "Failed to rewind file", "path", path, "error", err)
+					continue
+				}
+				f.offset, f.partial, f.pending = 0, nil, nil
+				f.container.Reset()
+			}
+			t.read(ctx, f)
+		}
+	}
+
+	for id, f := range t.files {
+		if seen[id] {
+			continue
+		}
+		t.read(ctx, f)
+		t.flushPending(ctx, f)
+		f.file.Close()
+		delete(t.files, id)
+		t.state.forget(id)
+	}
+	t.firstPoll = false
+}
+
+// match expands an input's globs, leaving out excluded names and
+// namespaces, oldest file first so rotated files are finished before their
+// successors
+func (t *tailer) match(in *input) []string {
+	var paths []string
+	for _, pattern := range in.Paths {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			excluded := false
+			for _, exclude := range in.Exclude {
+				if ok, _ := filepath.Match(exclude, filepath.Base(path)); ok {
+					excluded = true
+					break
+				}
+			}
+			if in.kubernetes != nil {
+				if p, ok := podFromPath(path); ok && !in.kubernetes.accepts(p.namespace) {
+					excluded = true
+				}
+			}
+			if !excluded {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	modified := map[string]time.Time{}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modified[path] = info.ModTime()
+		}
+	}
+	sort.SliceStable(paths, func(i, j int) bool { return modified[paths[i]].Before(modified[paths[j]]) })
+	return paths
+}
+
+// open starts following a file from its saved position, or for a file the
+// agent hasn't seen before, from the start or (when the agent has just
+// started and the input says so) the end
+func (t *tailer) open(id, path string, info os.FileInfo, in *input) *tailedFile {
+	file, err := os.Open(path)
+	if err != nil {
+		slog.Warn("Failed to open log file", "path", path, "error", err)
+		return nil
+	}
+
+	offset := int64(0)
+	if saved, ok := t.state.get(id); ok && saved.Offset <= info.Size() {
+		offset = saved.Offset
+	} else if !ok && t.firstPoll && in.ReadFrom != "beginning" {
+		offset = info.Size()
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		slog.Warn("Failed to seek in log file", "path", path, "error", err)
+		file.Close()
+		return nil
+	}
+	t.state.start(id, path, offset)
+	slog.Info("Following log file", "path", path, "offset", offset)
+	f := &tailedFile{id: id, path: path, input: in, file: file, offset: offset}
+	if in.kubernetes != nil {
+		f.pod, _ = podFromPath(path)
+	}
+	return f
+}
+
+// read sends the complete lines written since the last read
+func (t *tailer) read(ctx context.Context, f *tailedFile) {
+	buf := make([]byte, 64*1024)
+	readAny := false
+	for {
+		n, err := f.file.Read(buf)
+		if n > 0 {
+			readAny = true
+			data := append(f.partial, buf[:n]...)
+			end := f.offset - int64(len(f.partial)) // Where the next line ends, once found
+			for {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					break
+				}
+				end += int64(i) + 1
+				t.line(ctx, f, strings.TrimSuffix(string(data[:i]), "\r"), end)
+				data = data[i+1:]
+			}
+			if len(data) > maxLineBytes {
+				end += int64(len(data))
+				t.line(ctx, f, string(data), end)
+				data = nil
+			}
+			f.partial = append([]byte(nil), data...)
+			f.offset += int64(n)
+		}
+		if err != nil || n == 0 || ctx.Err() != nil {
+			if err != nil && err != io.EOF {
+				slog.WarnContext(ctx, "Failed to read log file", "path", f.path, "error", err)
+			}
+			break
+		}
+	}
+
+	// A multiline entry is complete once nothing more has been written
+	if !readAny {
+		t.flushPending(ctx, f)
+	}
+}
+
+// line handles a complete line ending at offset
+func (t *tailer) line(ctx context.Context, f *tailedFile, text string, offset int64) {
+	var meta lineMeta
+	if f.input.kubernetes != nil {
+		if line, ok := parseContainerLine(text); ok {
+			if f.container.Len()+len(line.text) <= maxLineBytes {
+				f.container.WriteString(line.text)
+			}
+			if line.partial {
+				return
+			}
+			text, meta = f.container.String(), lineMeta{stream: line.stream, time: line.time}
+			f.container.Reset()
+		}
+	}
+
+	if f.input.multiline == nil {
+		if text != "" {
+			t.send(ctx, f, text, meta, offset)
+		}
+		return
+	}
+	if f.input.multiline.MatchString(text) || f.pending == nil {
+		t.flushPending(ctx, f)
+		f.pendingMeta = meta
+	}
+	f.pending = append(f.pending, text)
+	f.pendingOffset = offset
+}
+
+func (t *tailer) flushPending(ctx context.Context, f *tailedFile) {
+	if len(f.pending) == 0 {
+		return
+	}
+	text := strings.Join(f.pending, "\n")
+	f.pending = nil
+	if strings.TrimSpace(text) != "" {
+		t.send(ctx, f, text, f.pendingMeta, f.pendingOffset)
+	}
+}
+
+// send parses an entry, fills in the input's defaults and queues it for
+// the buffer. It waits while the buffer is full, so an outage longer than
+// the buffer holds pauses reading instead of losing lines.
+func (t *tailer) send(ctx context.Context, f *tailedFile, text string, meta lineMeta, offset int64) {
+	entry := f.input.parse(text)
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = meta.time
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.Level == "" {
+		entry.Level = f.input.Level
+	}
+	if entry.Level == "" {
+		entry.Level = "INFO"
+	}
+	if entry.Source == "" {
+		entry.Source = f.input.Source
+	}
+	if entry.Logger == "" {
+		entry.Logger = f.input.Logger
+	}
+	if f.pod != nil {
+		if entry.Source == "" {
+			entry.Source = f.pod.namespace + "/" + f.pod.container
+		}
+		if entry.Logger == "" {
+			entry.Logger = f.pod.name
+		}
+		entry.Message += " " + f.pod.fields()
+		if meta.stream == "stderr" {
+			entry.Message += " stream=stderr"
+		}
+	}
+	if entry.Source == "" {
+		entry.Source = t.hostname
+	}
+	if entry.Logger == "" {
+		entry.Logger = f.path
+	}
+
+	// Once stopping, nothing more is queued: a later line reaching the
+	// buffer would save a position past the ones dropped
+	if ctx.Err() != nil {
+		return
+	}
+	select {
+	case t.records <- record{entry: entry, fileID: f.id, path: f.path, offset: offset}:
+	case <-ctx.Done():
+	}
+}
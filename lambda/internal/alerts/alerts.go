@@ -2,140 +2,400 @@ package alerts
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/ses"
-	sesTypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/tinytail/tinytail/internal/logging"
+	"github.com/tinytail/tinytail/internal/metrics"
 	"github.com/tinytail/tinytail/internal/store"
 )
 
 type AlertRule struct {
+	ID      string `json:"id,omitempty"`
 	Pattern string `json:"pattern"`
 	Window  string `json:"window"`
 	Email   string `json:"email"`
+
+	// Template names a built-in rule (see ruleTemplates) that fills in
+	// whatever this one leaves empty
+	Template string `json:"template,omitempty"`
+
+	// GroupBy summarizes matches per distinct value of an entry field
+	// (request_id, source, level, logger) or of a field in JSON messages
+	GroupBy string `json:"group_by,omitempty"`
+
+	// Conditions makes this a composite rule: each condition has its own
+	// pattern and window, combined with Operator "and" (default) or "or".
+	// Pattern is ignored when Conditions are set.
+	Conditions []Condition `json:"conditions,omitempty"`
+	Operator   string      `json:"operator,omitempty"`
+
+	// QuietHours lists recurring windows in which notifications are held
+	QuietHours []QuietHours `json:"quiet_hours,omitempty"`
+
+	// SubjectPrefix is prepended to every email subject for this rule
+	// (e.g. "[PROD][payments]") so mail filters can route on it
+	SubjectPrefix string `json:"subject_prefix,omitempty"`
+
+	// Optional Go templates (text/template for subject and body,
+	// html/template for the HTML body) rendered with TemplateData
+	SubjectTemplate  string `json:"subject_template,omitempty"`
+	BodyTemplate     string `json:"body_template,omitempty"`
+	HTMLBodyTemplate string `json:"html_body_template,omitempty"`
 }
 
+// ruleSearchLimit is how many matches a pattern rule's evaluation reads
+const ruleSearchLimit = 200
+
 type AlertHandler struct {
 	logStore        *store.LogStore
 	dbClient        *dynamodb.Client
-	sesClient       *ses.Client
+	sesClient       *sesv2.Client
 	alertsTableName string
 	rules           []AlertRule
+	maxPerHour      int
+	health          *store.HealthCounters
+	history         *store.AlertHistory
+
+	rulesSource    RulesSource
+	rulesVersion   string
+	rulesLoadedAt  time.Time
+	reloadInterval time.Duration
+
+	// disabled is why alerting is off, when a startup check found it
+	// couldn't work; empty when alerting is on
+	disabled string
 }
 
-func NewAlertHandler(logStore *store.LogStore, dbClient *dynamodb.Client, sesClient *ses.Client, alertsTableName string) (*AlertHandler, error) {
-	// Read alert rules from config file
-	rulesFile := "alert-rules.json"
-	rulesData, err := os.ReadFile(rulesFile)
-	if err != nil {
-		log.Printf("No alert rules file found (%s), alerts disabled: %v", rulesFile, err)
-		return &AlertHandler{
-			logStore:        logStore,
-			dbClient:        dbClient,
-			sesClient:       sesClient,
-			alertsTableName: alertsTableName,
-			rules:           []AlertRule{},
-		}, nil
-	}
-
-	var rules []AlertRule
-	if err := json.Unmarshal(rulesData, &rules); err != nil {
-		// Don't crash - just log the error and continue with no rules
-		log.Printf("WARNING: Failed to parse %s, alerts disabled: %v", rulesFile, err)
-		return &AlertHandler{
-			logStore:        logStore,
-			dbClient:        dbClient,
-			sesClient:       sesClient,
-			alertsTableName: alertsTableName,
-			rules:           []AlertRule{},
-		}, nil
-	}
-
-	log.Printf("Loaded %d alert rules from %s", len(rules), rulesFile)
-	return &AlertHandler{
+// Disable turns alerting off for the life of the instance: evaluation,
+// digests, maintenance and SES notifications are skipped with a log line
+// rather than failing on every attempt.
+func (a *AlertHandler) Disable(reason string) {
+	a.disabled = reason
+}
+
+// skipDisabled logs and reports whether alerting is off
+func (a *AlertHandler) skipDisabled(ctx context.Context, task string) bool {
+	if a.disabled == "" {
+		return false
+	}
+	slog.WarnContext(ctx, "Alerting disabled, skipping "+task, "reason", a.disabled)
+	return true
+}
+
+func NewAlertHandler(logStore *store.LogStore, dbClient *dynamodb.Client, sesClient *sesv2.Client, alertsTableName string, rulesSource RulesSource, health *store.HealthCounters) (*AlertHandler, error) {
+	a := &AlertHandler{
 		logStore:        logStore,
 		dbClient:        dbClient,
 		sesClient:       sesClient,
 		alertsTableName: alertsTableName,
-		rules:           rules,
-	}, nil
+		rules:           []AlertRule{},
+		maxPerHour:      maxAlertsPerHour(),
+		health:          health,
+		history:         store.NewAlertHistory(dbClient, alertsTableName),
+		rulesSource:     rulesSource,
+		reloadInterval:  rulesReloadInterval(),
+	}
+
+	// Load eagerly so configuration problems show up as soon as alerting
+	// starts
+	a.reloadRules(context.Background())
+
+	return a, nil
 }
 
-func (a *AlertHandler) ProcessAlerts(ctx context.Context) error {
+func (a *AlertHandler) ProcessAlerts(ctx context.Context) (*Summary, error) {
+	if a.skipDisabled(ctx, "alert evaluation") {
+		return &Summary{}, nil
+	}
+	a.reloadRules(ctx)
+
+	// Self-monitoring runs even without user-defined rules
+	defer a.checkSelfMonitoring(ctx)
+
+	summary := &Summary{}
 	if len(a.rules) == 0 {
-		return nil
+		return summary, nil
+	}
+
+	slog.InfoContext(ctx, "Processing alert rules", "rules", len(a.rules))
+	metrics.Emit(nil, metrics.Metric{Name: "RulesEvaluated", Unit: metrics.Count, Value: float64(len(a.rules))})
+
+	for i, rule := range a.rules {
+		summary.add(a.evaluateRule(ctx, i, rule)) // Errors are recorded; continue with other rules
+	}
+
+	a.sendSuppressionSummaries(ctx)
+	a.sendQuietHoursDigests(ctx)
+
+	summary.log(ctx)
+	return summary, nil
+}
+
+// ProcessRules evaluates only the rules with the given IDs. This lets a
+// faster EventBridge schedule target high-priority rules without
+// re-evaluating everything on every tick. Suppression summaries, quiet
+// hours digests and self-monitoring are left to the schedule that
+// evaluates every rule. IDs that match no rule, such as a rule's since
+// renamed or removed, are logged rather than failing the invocation, which
+// EventBridge would retry to no end.
+func (a *AlertHandler) ProcessRules(ctx context.Context, ruleIDs []string) (*Summary, error) {
+	if a.skipDisabled(ctx, "alert evaluation") {
+		return &Summary{}, nil
 	}
+	a.reloadRules(ctx)
 
-	log.Printf("Processing %d alert rules", len(a.rules))
+	wanted := make(map[string]bool, len(ruleIDs))
+	for _, id := range ruleIDs {
+		wanted[id] = true
+	}
 
+	summary := &Summary{}
 	for i, rule := range a.rules {
-		if err := a.processRule(ctx, i, rule); err != nil {
-			log.Printf("Error processing rule %d: %v", i, err)
-			// Continue processing other rules
+		if !wanted[ruleIDFor(i, rule)] {
+			continue
 		}
+		summary.add(a.evaluateRule(ctx, i, rule))
 	}
 
-	return nil
+	if summary.Evaluated == 0 {
+		slog.WarnContext(ctx, "No alert rules match the targeted IDs", "rule_ids", ruleIDs)
+		return summary, nil
+	}
+
+	summary.log(ctx)
+	return summary, nil
 }
 
-func (a *AlertHandler) processRule(ctx context.Context, ruleIndex int, rule AlertRule) error {
-	// Parse window
-	windowDuration, err := parseWindow(rule.Window)
+// evaluateRule runs processRule and publishes per-rule metrics for the
+// evaluation: matches found, notifications sent, failures and duration.
+func (a *AlertHandler) evaluateRule(ctx context.Context, ruleIndex int, rule AlertRule) RuleResult {
+	start := time.Now()
+	ctx = logging.With(ctx, "rule", ruleIndex, "rule_id", ruleIDFor(ruleIndex, rule))
+	result, err := a.processRule(ctx, ruleIndex, rule)
 	if err != nil {
-		return fmt.Errorf("invalid window: %w", err)
+		slog.ErrorContext(ctx, "Error processing rule", "error", err)
+		result.Status = RuleErrored
+		result.Error = err.Error()
+		if store.IsThrottle(err) {
+			a.health.Add(store.CounterDynamoDBThrottles, 1)
+		}
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	a.health.AddRollup(store.RollupSeries(store.RollupAlertEvaluations, "rule", result.RuleID, "status", string(result.Status)), 1)
+
+	metrics.Emit(map[string]string{"RuleID": result.RuleID},
+		metrics.Metric{Name: "RuleMatches", Unit: metrics.Count, Value: float64(result.Matches)},
+		metrics.Metric{Name: "NotificationsSent", Unit: metrics.Count, Value: boolMetric(result.Status == RuleSent)},
+		metrics.Metric{Name: "RuleFailures", Unit: metrics.Count, Value: boolMetric(result.Status == RuleErrored)},
+		metrics.Metric{Name: "EvaluationDuration", Unit: metrics.Milliseconds, Value: metrics.Since(start)},
+	)
+
+	return result
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ruleIDFor returns the rule's configured ID, falling back to its position
+// in the rules file so existing alert state keys keep working.
+func ruleIDFor(ruleIndex int, rule AlertRule) string {
+	if rule.ID != "" {
+		return rule.ID
+	}
+	return fmt.Sprintf("rule-%d", ruleIndex)
+}
+
+// ProcessNewEntries checks freshly ingested entries (from the logs table
+// stream) against the loaded rules and evaluates any rule that matched
+// immediately, rather than waiting for the next scheduled sweep. A rule
+// that has already alerted within its window is skipped before its logs
+// are searched, so a busy stream costs one state read per matching rule.
+func (a *AlertHandler) ProcessNewEntries(ctx context.Context, entries []store.LogEntry) (*Summary, error) {
+	if a.skipDisabled(ctx, "realtime alerts") {
+		return &Summary{}, nil
+	}
+	a.reloadRules(ctx)
+	summary := &Summary{}
+	if len(a.rules) == 0 || len(entries) == 0 {
+		return summary, nil
+	}
+
+	for i, rule := range a.rules {
+		if !rule.isRealtime() {
+			continue // Left to the scheduled sweep
+		}
+
+		matches := 0
+		for _, entry := range entries {
+			if matchesPattern(entry, rule.Pattern) {
+				matches++
+			}
+		}
+		if matches == 0 {
+			continue
+		}
+		slog.InfoContext(ctx, "New realtime matches", "rule", i, "matches", matches)
+
+		summary.add(a.evaluateRule(ctx, i, rule))
+	}
+
+	if summary.Evaluated > 0 {
+		summary.log(ctx)
 	}
+	return summary, nil
+}
+
+// isRealtime reports whether a rule can be decided from a single new entry.
+// Rules that need to see the whole window are evaluated by the scheduled
+// sweep only.
+func (r AlertRule) isRealtime() bool {
+	return r.Pattern != "" && !r.isComposite()
+}
 
-	ruleID := fmt.Sprintf("rule-%d", ruleIndex)
+// matchesPattern mirrors the case-insensitive substring match used by
+// LogStore searches.
+func matchesPattern(entry store.LogEntry, pattern string) bool {
+	lowerPattern := strings.ToLower(pattern)
+	return strings.Contains(strings.ToLower(entry.Message), lowerPattern) ||
+		strings.Contains(strings.ToLower(entry.Level), lowerPattern) ||
+		strings.Contains(strings.ToLower(entry.Source), lowerPattern)
+}
+
+// processRule evaluates a single rule and notifies if needed. Problems that
+// don't stop the evaluation (like a failed state write) are only logged; the
+// returned error means the rule couldn't be evaluated at all.
+func (a *AlertHandler) processRule(ctx context.Context, ruleIndex int, rule AlertRule) (RuleResult, error) {
+	result := RuleResult{RuleID: ruleIDFor(ruleIndex, rule)}
+	ruleID := result.RuleID
+
+	// Parse window
+	windowDuration, err := rule.alertWindow()
+	if err != nil {
+		return result, fmt.Errorf("invalid window: %w", err)
+	}
 
 	// Check if we've already alerted within the window
 	shouldAlert, err := a.shouldSendAlert(ctx, ruleID, windowDuration)
 	if err != nil {
-		return fmt.Errorf("failed to check alert state: %w", err)
+		return result, fmt.Errorf("failed to check alert state: %w", err)
 	}
 
 	if !shouldAlert {
-		log.Printf("Rule %d: skipping (already alerted within window)", ruleIndex)
-		return nil
+		slog.InfoContext(ctx, "Rule skipped: already alerted within window")
+		return result.skipped("already alerted within window"), nil
 	}
 
-	// Query logs for matches (limit to 200 to avoid expensive scans)
-	startTime := time.Now().Add(-windowDuration)
-	logs, err := a.logStore.SearchLogsWithLimit(ctx, rule.Pattern, startTime, time.Now(), 200)
+	var logs []store.LogEntry
+	if rule.isComposite() {
+		triggered, matches, err := a.evaluateConditions(ctx, rule)
+		if err != nil {
+			return result, err
+		}
+		if !triggered {
+			slog.InfoContext(ctx, "Rule skipped: conditions not met")
+			return result.skipped("conditions not met"), nil
+		}
+		logs = matches
+	} else {
+		// Query logs for matches, keeping only the first few in memory; the
+		// attachment reads the rest if it's needed
+		startTime := time.Now().Add(-windowDuration)
+		logs, err = a.logStore.SearchLogsWithLimit(ctx, rule.Pattern, startTime, time.Now(), ruleSearchLimit)
+		if err != nil {
+			return result, fmt.Errorf("failed to search logs: %w", err)
+		}
+
+		if len(logs) == 0 {
+			slog.InfoContext(ctx, "Rule skipped: no matches found")
+			return result.skipped("no matches"), nil
+		}
+	}
+
+	result.Matches = len(logs)
+	slog.InfoContext(ctx, "Rule matched", "matches", len(logs))
+
+	// Skip addresses disabled by a bounce or complaint
+	disabledReason, err := a.recipientDisabled(ctx, rule.Email)
 	if err != nil {
-		return fmt.Errorf("failed to search logs: %w", err)
+		slog.WarnContext(ctx, "Failed to check recipient status", "error", err)
+	} else if disabledReason != "" {
+		slog.WarnContext(ctx, "Alert delivery to recipient is disabled; delete the suppressed key from the alerts table to re-enable",
+			"recipient", rule.Email, "reason", disabledReason, "suppressed_key", suppressedRecipientKey(rule.Email))
+		return result.matched("recipient disabled: " + disabledReason), nil
 	}
 
-	if len(logs) == 0 {
-		log.Printf("Rule %d: no matches found", ruleIndex)
-		return nil
+	// During quiet hours, record the alert but don't notify
+	quiet, err := rule.activeQuietHours(time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid quiet_hours, ignoring", "error", err)
+	} else if quiet != nil {
+		slog.InfoContext(ctx, "Holding alert during quiet hours", "start", quiet.Start, "end", quiet.End, "mode", quiet.Mode)
+		if quiet.Mode == "digest" {
+			if err := a.recordQuietMatch(ctx, ruleID, len(logs)); err != nil {
+				slog.WarnContext(ctx, "Failed to record quiet hours match", "error", err)
+			}
+		}
+		if err := a.recordAlert(ctx, ruleID, len(logs), windowDuration); err != nil {
+			slog.WarnContext(ctx, "Failed to record alert state", "error", err)
+		}
+		return result.matched("quiet hours"), nil
 	}
 
-	log.Printf("Rule %d: found %d matches", ruleIndex, len(logs))
+	// Enforce the per-recipient hourly cap across all rules
+	allowed, err := a.reserveNotification(ctx, rule.Email)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to check notification rate limit", "error", err)
+		allowed = true // Fail open - a missed alert is worse than an extra email
+	}
+	if !allowed {
+		slog.InfoContext(ctx, "Alert suppressed: recipient reached the hourly limit", "recipient", rule.Email, "max_per_hour", a.maxPerHour)
+		// Record state so the suppressed alert isn't retried every minute
+		if err := a.recordAlert(ctx, ruleID, len(logs), windowDuration); err != nil {
+			slog.WarnContext(ctx, "Failed to record alert state", "error", err)
+		}
+		return result.matched("recipient rate limit"), nil
+	}
 
 	// Send alert email
-	if err := a.sendAlertEmail(ctx, rule, logs, windowDuration); err != nil {
-		// Don't fail - just log the error and continue
-		log.Printf("Rule %d: WARNING - failed to send alert email: %v", ruleIndex, err)
-		log.Printf("Rule %d: skipping alert (email failed, will retry on next match)", ruleIndex)
-		return nil
+	if err := a.sendAlertEmail(ctx, ruleID, rule, logs, windowDuration); err != nil {
+		slog.WarnContext(ctx, "Skipping alert: email failed, will retry on next match")
+		return result, fmt.Errorf("failed to send alert email: %w", err)
 	}
 
 	// Update alert state (only if email sent successfully)
 	if err := a.recordAlert(ctx, ruleID, len(logs), windowDuration); err != nil {
-		log.Printf("Rule %d: WARNING - failed to record alert state: %v", ruleIndex, err)
+		slog.WarnContext(ctx, "Failed to record alert state", "error", err)
 		// Continue anyway - email was sent
 	}
 
-	log.Printf("Rule %d: alert sent successfully", ruleIndex)
-	return nil
+	// Kept for the errors feed
+	firedAt := time.Now()
+	err = a.history.Record(ctx, store.FiredAlert{
+		RuleID:  ruleID,
+		Pattern: rule.linkPattern(),
+		Matches: len(logs),
+		Window:  formatDuration(windowDuration),
+		Since:   firedAt.Add(-windowDuration),
+		FiredAt: firedAt,
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to record alert history", "error", err)
+	}
+
+	slog.InfoContext(ctx, "Alert sent")
+	result.Status = RuleSent
+	return result, nil
 }
 
 func (a *AlertHandler) shouldSendAlert(ctx context.Context, ruleID string, window time.Duration) (bool, error) {
@@ -184,67 +444,52 @@ func (a *AlertHandler) recordAlert(ctx context.Context, ruleID string, matchCoun
 	return err
 }
 
-func (a *AlertHandler) sendAlertEmail(ctx context.Context, rule AlertRule, logs []store.LogEntry, window time.Duration) error {
-	maxLogsInEmail := 20
-	truncated := len(logs) > maxLogsInEmail
-
-	subject := fmt.Sprintf("[TinyTail Alert] %s (%d matches in %s)",
-		truncateString(rule.Pattern, 50), len(logs), formatDuration(window))
-
-	// Build email body
-	var body strings.Builder
-	body.WriteString(fmt.Sprintf("Found %d matches for pattern: %s\n", len(logs), rule.Pattern))
-	body.WriteString(fmt.Sprintf("Time window: %s\n\n", formatDuration(window)))
-	body.WriteString("Matching logs:\n")
-	body.WriteString(strings.Repeat("=", 80) + "\n\n")
-
-	displayLogs := logs
-	if truncated {
-		displayLogs = logs[:maxLogsInEmail]
-	}
-
-	for _, entry := range displayLogs {
-		body.WriteString(fmt.Sprintf("[%s] [%s] [%s]\n",
-			entry.Timestamp.Format("2006-01-02 15:04:05"),
-			entry.Level,
-			entry.Source))
-		body.WriteString(fmt.Sprintf("%s\n", entry.Message))
-		body.WriteString(strings.Repeat("#", 80) + "\n\n")
-	}
-
-	if truncated {
-		body.WriteString(fmt.Sprintf("... and %d more matches (showing first %d)\n\n",
-			len(logs)-maxLogsInEmail, maxLogsInEmail))
+func (a *AlertHandler) sendAlertEmail(ctx context.Context, ruleID string, rule AlertRule, logs []store.LogEntry, window time.Duration) error {
+	data := newTemplateData(rule, logs, window)
+
+	// Matches beyond the inline cap go out as a gzipped CSV attachment of
+	// every match in the window, read in full if the evaluation stopped at
+	// ruleSearchLimit
+	var attachments []attachment
+	if data.Remaining > 0 {
+		all := logs
+		if !rule.isComposite() && len(logs) >= ruleSearchLimit {
+			complete, err := a.allMatches(ctx, rule, window)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to read every match, attaching those found", "error", err)
+			} else {
+				all = complete
+				data.Count = len(all)
+				data.Remaining = data.Count - len(data.Matches)
+			}
+		}
+		csvData, attached, err := matchesCSV(all, maxAttachmentBytes)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to build matches attachment, sending without it", "error", err)
+		} else {
+			data.Attached = attached
+			data.AttachmentCapped = attached < len(all) || len(all) >= maxAttachedMatches
+			data.Attachment = matchesAttachmentName(ruleID, data.GeneratedAt)
+			attachments = append(attachments, attachment{
+				Filename:    data.Attachment,
+				ContentType: "application/gzip",
+				Data:        csvData,
+			})
+		}
 	}
 
-	body.WriteString(strings.Repeat("=", 80) + "\n")
-	body.WriteString(fmt.Sprintf("\nAutomated alert from TinyTail | %s\n", time.Now().Format(time.RFC3339)))
-
-	// Send via SES
-	fromEmail := os.Getenv("TINYTAIL_ALERT_FROM_EMAIL")
-	if fromEmail == "" {
-		fromEmail = rule.Email // Fallback to recipient if not set
+	subject, textBody, htmlBody, err := renderAlert(data)
+	if err != nil {
+		// A broken template shouldn't swallow the alert itself
+		slog.WarnContext(ctx, "Failed to render alert templates, using default format", "error", err)
+		subject, textBody, htmlBody = defaultAlertSubject(data), defaultAlertBody(data), ""
 	}
+	subject = rule.prefixSubject(subject)
 
-	input := &ses.SendEmailInput{
-		Source: aws.String(fromEmail),
-		Destination: &sesTypes.Destination{
-			ToAddresses: []string{rule.Email},
-		},
-		Message: &sesTypes.Message{
-			Subject: &sesTypes.Content{
-				Data: aws.String(subject),
-			},
-			Body: &sesTypes.Body{
-				Text: &sesTypes.Content{
-					Data: aws.String(body.String()),
-				},
-			},
-		},
+	if len(attachments) > 0 {
+		return a.sendRawEmail(ctx, rule.Email, subject, textBody, htmlBody, attachments)
 	}
-
-	_, err := a.sesClient.SendEmail(ctx, input)
-	return err
+	return a.sendEmail(ctx, rule.Email, subject, textBody, htmlBody)
 }
 
 func parseWindow(window string) (time.Duration, error) {
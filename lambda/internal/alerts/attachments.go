@@ -0,0 +1,213 @@
+package alerts
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesTypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// attachment is a file attached to a raw MIME email.
+type attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// matchesAttachmentName names the CSV attachment for a rule's matches.
+func matchesAttachmentName(ruleID string, now time.Time) string {
+	return fmt.Sprintf("tinytail-%s-%s.csv.gz", ruleID, now.UTC().Format("20060102T150405Z"))
+}
+
+// maxAttachedMatches caps how many matches are read for the attachment, and
+// maxAttachmentBytes its gzipped size, which keeps the email well under
+// SES's 10 MB message limit once base64 encoded
+const (
+	maxAttachedMatches = 50000
+	maxAttachmentBytes = 5 << 20
+)
+
+// matchesCSV renders the matches as a gzipped CSV, so the matches beyond the
+// inline cap aren't lost to the "... and N more" truncation. It stops once
+// the CSV reaches about maxBytes, returning how many matches it holds.
+func matchesCSV(logs []store.LogEntry, maxBytes int) ([]byte, int, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := csv.NewWriter(gz)
+
+	if err := w.Write([]string{"timestamp", "level", "source", "message"}); err != nil {
+		return nil, 0, err
+	}
+	written := 0
+	for _, entry := range logs {
+		// The gzip writer holds back what it hasn't compressed yet, so the
+		// size is a little behind
+		if buf.Len() >= maxBytes {
+			break
+		}
+		record := []string{entry.Timestamp.Format(time.RFC3339Nano), entry.Level, entry.Source, entry.Message}
+		if err := w.Write(record); err != nil {
+			return nil, 0, err
+		}
+		w.Flush()
+		written++
+	}
+	if err := w.Error(); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), written, nil
+}
+
+// allMatches reads every match of a pattern rule in its window, up to
+// maxAttachedMatches, for the attachment; the evaluation itself reads only
+// the first ruleSearchLimit
+func (a *AlertHandler) allMatches(ctx context.Context, rule AlertRule, window time.Duration) ([]store.LogEntry, error) {
+	now := time.Now()
+	return a.logStore.SearchLogsWithLimit(ctx, rule.Pattern, now.Add(-window), now, maxAttachedMatches)
+}
+
+// sendRawEmail sends a multipart message with attachments through SESv2's
+// raw content type. SESv2 has no structured attachment support, so the MIME
+// message is built here.
+func (a *AlertHandler) sendRawEmail(ctx context.Context, to, subject, textBody, htmlBody string, attachments []attachment) error {
+	from := alertFromEmail(to)
+	message, err := buildMIMEMessage(from, to, subject, textBody, htmlBody, attachments)
+	if err != nil {
+		return fmt.Errorf("failed to build MIME message: %w", err)
+	}
+
+	input := &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(from),
+		Destination: &sesTypes.Destination{
+			ToAddresses: []string{to},
+		},
+		Content: &sesTypes.EmailContent{
+			Raw: &sesTypes.RawMessage{Data: message},
+		},
+	}
+
+	if configSet := os.Getenv("TINYTAIL_SES_CONFIGURATION_SET"); configSet != "" {
+		input.ConfigurationSetName = aws.String(configSet)
+	}
+
+	_, err = a.sesClient.SendEmail(ctx, input)
+	if err != nil {
+		a.health.Add(store.CounterSESFailures, 1)
+	}
+	return err
+}
+
+// buildMIMEMessage produces a multipart/mixed message whose first part is
+// the text (and optional HTML) body, followed by the attachments.
+func buildMIMEMessage(from, to, subject, textBody, htmlBody string, attachments []attachment) ([]byte, error) {
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mixed.Boundary())
+
+	if err := writeBodyPart(mixed, textBody, htmlBody); err != nil {
+		return nil, err
+	}
+
+	for _, att := range attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; name=%q", att.ContentType, att.Filename))
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", att.Filename))
+		header.Set("Content-Transfer-Encoding", "base64")
+		part, err := mixed.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(wrapBase64(att.Data)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeBodyPart(mixed *multipart.Writer, textBody, htmlBody string) error {
+	textHeader := textproto.MIMEHeader{}
+	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	textHeader.Set("Content-Transfer-Encoding", "base64")
+
+	if htmlBody == "" {
+		part, err := mixed.CreatePart(textHeader)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(wrapBase64([]byte(textBody)))
+		return err
+	}
+
+	var altBuf bytes.Buffer
+	alt := multipart.NewWriter(&altBuf)
+	for _, body := range []struct {
+		header textproto.MIMEHeader
+		data   string
+	}{
+		{textHeader, textBody},
+		{textproto.MIMEHeader{
+			"Content-Type":              {"text/html; charset=utf-8"},
+			"Content-Transfer-Encoding": {"base64"},
+		}, htmlBody},
+	} {
+		part, err := alt.CreatePart(body.header)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(wrapBase64([]byte(body.data))); err != nil {
+			return err
+		}
+	}
+	if err := alt.Close(); err != nil {
+		return err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", alt.Boundary()))
+	part, err := mixed.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(altBuf.Bytes())
+	return err
+}
+
+// wrapBase64 encodes data as base64 in 76-character lines (RFC 2045).
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,138 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Condition is one clause of a composite rule. It holds when Pattern has at
+// least MinCount matches (default 1) within its own Window, or - with
+// Absent - when it has none.
+type Condition struct {
+	Pattern  string `json:"pattern"`
+	Window   string `json:"window"`
+	MinCount int    `json:"min_count,omitempty"`
+	Absent   bool   `json:"absent,omitempty"`
+}
+
+func (c Condition) String() string {
+	desc := fmt.Sprintf("%q in %s", c.Pattern, c.Window)
+	if c.Absent {
+		return "no " + desc
+	}
+	if c.MinCount > 1 {
+		return fmt.Sprintf("%d+ %s", c.MinCount, desc)
+	}
+	return desc
+}
+
+func (r AlertRule) isComposite() bool {
+	return len(r.Conditions) > 0
+}
+
+// matchAll reports whether every condition must hold ("and", the default)
+// rather than any of them ("or").
+func (r AlertRule) matchAll() bool {
+	return !strings.EqualFold(r.Operator, "or")
+}
+
+// displayPattern describes what the rule looks for, for use in emails.
+func (r AlertRule) displayPattern() string {
+	if !r.isComposite() {
+		return r.Pattern
+	}
+
+	joiner := " AND "
+	if !r.matchAll() {
+		joiner = " OR "
+	}
+	parts := make([]string, len(r.Conditions))
+	for i, c := range r.Conditions {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, joiner)
+}
+
+// linkPattern is the search used for the rule's UI deep link.
+func (r AlertRule) linkPattern() string {
+	for _, c := range r.Conditions {
+		if !c.Absent {
+			return c.Pattern
+		}
+	}
+	return r.Pattern
+}
+
+// alertWindow is the window used for alert de-duplication: the rule's own
+// window, or for composite rules without one, the longest condition window.
+func (r AlertRule) alertWindow() (time.Duration, error) {
+	if r.Window != "" || !r.isComposite() {
+		return parseWindow(r.Window)
+	}
+
+	var longest time.Duration
+	for _, c := range r.Conditions {
+		window, err := parseWindow(c.Window)
+		if err != nil {
+			return 0, fmt.Errorf("condition %q: %w", c.Pattern, err)
+		}
+		if window > longest {
+			longest = window
+		}
+	}
+	return longest, nil
+}
+
+// evaluateConditions searches each condition over its own window and
+// combines the results. The returned entries are the matches of every
+// condition that held (absent conditions contribute none).
+func (a *AlertHandler) evaluateConditions(ctx context.Context, rule AlertRule) (bool, []store.LogEntry, error) {
+	var matches []store.LogEntry
+	now := time.Now()
+	all := rule.matchAll()
+	triggered := all
+
+	for _, c := range rule.Conditions {
+		window, err := parseWindow(c.Window)
+		if err != nil {
+			return false, nil, fmt.Errorf("condition %q: invalid window: %w", c.Pattern, err)
+		}
+
+		minCount := c.MinCount
+		if minCount < 1 {
+			minCount = 1
+		}
+
+		logs, err := a.logStore.SearchLogsWithLimit(ctx, c.Pattern, now.Add(-window), now, 200)
+		if err != nil {
+			return false, nil, fmt.Errorf("condition %q: failed to search logs: %w", c.Pattern, err)
+		}
+
+		holds := len(logs) >= minCount
+		if c.Absent {
+			holds = len(logs) == 0
+		}
+		if holds {
+			matches = append(matches, logs...)
+		}
+
+		if all && !holds {
+			return false, nil, nil // Short-circuit AND
+		}
+		if !all && holds {
+			triggered = true
+		}
+	}
+
+	// Newest first, like a single-pattern search
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.After(matches[j].Timestamp)
+	})
+
+	return triggered, matches, nil
+}
@@ -0,0 +1,276 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+const (
+	// digestPeriod is how far back the daily digest looks
+	digestPeriod = 24 * time.Hour
+
+	// digestMaxEntries caps how many entries a digest reads, so a very busy
+	// day can't run the invocation out of time; the counts are marked as
+	// partial when it is reached
+	digestMaxEntries = 500000
+
+	// digestTopN is how many sources and error fingerprints are listed
+	digestTopN = 10
+)
+
+// Digest summarises a day of logs and alert activity
+type Digest struct {
+	Since     time.Time      `json:"since"`
+	Until     time.Time      `json:"until"`
+	Total     int            `json:"total"`
+	Partial   bool           `json:"partial,omitempty"`
+	ByLevel   map[string]int `json:"by_level"`
+	BySource  []DigestCount  `json:"by_source"`
+	TopErrors []DigestCount  `json:"top_errors"`
+
+	// Alerts lists rules that last sent an alert within the period
+	Alerts           []DigestAlert `json:"alerts"`
+	AlertsSent       int           `json:"alerts_sent"`
+	AlertsSuppressed int           `json:"alerts_suppressed"`
+
+	Recipient string `json:"recipient,omitempty"`
+	Sent      bool   `json:"sent"`
+}
+
+// DigestCount is one row of a digest breakdown
+type DigestCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// DigestAlert is a rule that alerted during the digest period
+type DigestAlert struct {
+	RuleID     string    `json:"rule_id"`
+	LastSent   time.Time `json:"last_sent"`
+	MatchCount int       `json:"match_count"`
+}
+
+// Patterns replaced by placeholders so messages differing only in IDs,
+// numbers or addresses share a fingerprint
+var fingerprintPatterns = []struct {
+	pattern     *regexp.Regexp
+	placeholder string
+}{
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "<uuid>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`), "<ip>"},
+	{regexp.MustCompile(`\b(0x)?[0-9a-fA-F]{8,}\b`), "<hex>"},
+	{regexp.MustCompile(`\d+`), "<n>"},
+}
+
+// errorFingerprint groups error messages that differ only in their
+// variable parts, using the first line with IDs and numbers replaced
+func errorFingerprint(message string) string {
+	line, _, _ := strings.Cut(message, "\n")
+	line = strings.TrimSpace(line)
+	for _, p := range fingerprintPatterns {
+		line = p.pattern.ReplaceAllString(line, p.placeholder)
+	}
+	if runes := []rune(line); len(runes) > 120 {
+		line = string(runes[:120]) + "…"
+	}
+	return line
+}
+
+// isErrorLevel reports whether entries at this level count towards the
+// error fingerprints
+func isErrorLevel(level string) bool {
+	switch strings.ToUpper(level) {
+	case "ERROR", "FATAL", "CRITICAL":
+		return true
+	}
+	return false
+}
+
+// topCounts returns the n largest counts, largest first
+func topCounts(counts map[string]int, n int) []DigestCount {
+	rows := make([]DigestCount, 0, len(counts))
+	for key, count := range counts {
+		rows = append(rows, DigestCount{Key: key, Count: count})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		return rows[i].Key < rows[j].Key
+	})
+	if len(rows) > n {
+		rows = rows[:n]
+	}
+	return rows
+}
+
+// SendDigest emails TINYTAIL_DIGEST_EMAIL a summary of the last day: volume
+// by level and source, the most frequent errors and alert activity.
+// Triggered by the EventBridge detail {"action": "digest"}. The digest is
+// returned whether or not a recipient is configured.
+func (a *AlertHandler) SendDigest(ctx context.Context) (*Digest, error) {
+	if a.skipDisabled(ctx, "the daily digest") {
+		return nil, nil
+	}
+	until := time.Now()
+	digest := &Digest{
+		Since:     until.Add(-digestPeriod),
+		Until:     until,
+		ByLevel:   map[string]int{},
+		Recipient: os.Getenv("TINYTAIL_DIGEST_EMAIL"),
+	}
+
+	sources := map[string]int{}
+	errors := map[string]int{}
+	err := a.logStore.EachLog(ctx, digest.Since, digest.Until, func(entry store.LogEntry) bool {
+		if digest.Total >= digestMaxEntries {
+			digest.Partial = true
+			return false
+		}
+		digest.Total++
+		digest.ByLevel[strings.ToUpper(entry.Level)]++
+		sources[entry.Source]++
+		if isErrorLevel(entry.Level) {
+			errors[errorFingerprint(entry.Message)]++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read logs for the digest: %w", err)
+	}
+	digest.BySource = topCounts(sources, digestTopN)
+	digest.TopErrors = topCounts(errors, digestTopN)
+
+	if err := a.addAlertActivity(ctx, digest); err != nil {
+		return nil, fmt.Errorf("failed to read alert activity for the digest: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Daily digest compiled", "total", digest.Total, "partial", digest.Partial,
+		"errors", len(errors), "alerts", len(digest.Alerts))
+
+	if digest.Recipient == "" {
+		slog.InfoContext(ctx, "TINYTAIL_DIGEST_EMAIL not set; digest not sent")
+		return digest, nil
+	}
+
+	subject := fmt.Sprintf("TinyTail daily digest: %d entries, %d errors", digest.Total, digest.errorCount())
+	if err := a.sendEmail(ctx, digest.Recipient, subject, digest.text(), ""); err != nil {
+		return digest, fmt.Errorf("failed to send the digest: %w", err)
+	}
+	digest.Sent = true
+	return digest, nil
+}
+
+// addAlertActivity reads the rules that alerted and the per-recipient send
+// counts from the alerts table
+func (a *AlertHandler) addAlertActivity(ctx context.Context, digest *Digest) error {
+	since := digest.Since.Unix()
+	paginator := dynamodb.NewScanPaginator(a.dbClient, &dynamodb.ScanInput{
+		TableName: aws.String(a.alertsTableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			key, ok := item["ruleID"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+
+			if rest, ok := strings.CutPrefix(key.Value, "recipient#"); ok {
+				hour, _ := strconv.ParseInt(rest[strings.LastIndex(rest, "#")+1:], 10, 64)
+				if hour >= since {
+					digest.AlertsSent += numberAttr(item, "sentCount")
+					digest.AlertsSuppressed += numberAttr(item, "suppressedCount")
+				}
+				continue
+			}
+
+			lastSent := int64(numberAttr(item, "lastAlertSent"))
+			if lastSent >= since && !strings.Contains(key.Value, "#") {
+				digest.Alerts = append(digest.Alerts, DigestAlert{
+					RuleID:     key.Value,
+					LastSent:   time.Unix(lastSent, 0),
+					MatchCount: numberAttr(item, "matchCount"),
+				})
+			}
+		}
+	}
+
+	sort.Slice(digest.Alerts, func(i, j int) bool { return digest.Alerts[i].LastSent.After(digest.Alerts[j].LastSent) })
+	return nil
+}
+
+func (d *Digest) errorCount() int {
+	n := 0
+	for level, count := range d.ByLevel {
+		if isErrorLevel(level) {
+			n += count
+		}
+	}
+	return n
+}
+
+// text renders the digest email body
+func (d *Digest) text() string {
+	var body strings.Builder
+	fmt.Fprintf(&body, "TinyTail daily digest\n%s to %s\n\n",
+		d.Since.UTC().Format(time.RFC1123), d.Until.UTC().Format(time.RFC1123))
+
+	fmt.Fprintf(&body, "Entries: %d", d.Total)
+	if d.Partial {
+		fmt.Fprintf(&body, " (stopped counting at %d)", digestMaxEntries)
+	}
+	body.WriteString("\n\n")
+
+	body.WriteString("By level:\n")
+	levels := topCounts(d.ByLevel, len(d.ByLevel))
+	for _, row := range levels {
+		fmt.Fprintf(&body, "  %-10s %d\n", row.Key, row.Count)
+	}
+	if len(levels) == 0 {
+		body.WriteString("  (none)\n")
+	}
+
+	body.WriteString("\nTop sources:\n")
+	for _, row := range d.BySource {
+		fmt.Fprintf(&body, "  %-30s %d\n", row.Key, row.Count)
+	}
+	if len(d.BySource) == 0 {
+		body.WriteString("  (none)\n")
+	}
+
+	body.WriteString("\nMost frequent errors:\n")
+	for _, row := range d.TopErrors {
+		fmt.Fprintf(&body, "  %6d  %s\n", row.Count, row.Key)
+	}
+	if len(d.TopErrors) == 0 {
+		body.WriteString("  (none)\n")
+	}
+
+	fmt.Fprintf(&body, "\nAlerts: %d sent, %d suppressed by the hourly cap\n", d.AlertsSent, d.AlertsSuppressed)
+	for _, alert := range d.Alerts {
+		fmt.Fprintf(&body, "  %s: last sent %s (%d matches)\n",
+			alert.RuleID, alert.LastSent.UTC().Format("15:04 MST"), alert.MatchCount)
+	}
+
+	if link := deepLink("", d.Since, d.Until); link != "" {
+		fmt.Fprintf(&body, "\nView the day's logs: %s\n", link)
+	}
+	return body.String()
+}
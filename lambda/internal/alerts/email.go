@@ -0,0 +1,234 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesTypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Mailer sends TinyTail's own emails, such as sign-in notifications,
+// through the same SES setup as alerts
+type Mailer struct {
+	sesClient *sesv2.Client
+	health    *store.HealthCounters
+
+	// connect supplies the client on first use for a lazy mailer
+	connect func() (*sesv2.Client, string)
+	once    sync.Once
+
+	// disabled is why email is off, when a startup check found SES
+	// couldn't send; empty when email is on
+	disabled string
+}
+
+// Disable stops the mailer sending: Send returns an error naming the
+// reason without calling SES
+func (m *Mailer) Disable(reason string) {
+	m.disabled = reason
+}
+
+func NewMailer(sesClient *sesv2.Client, health *store.HealthCounters) *Mailer {
+	return &Mailer{sesClient: sesClient, health: health}
+}
+
+// NewLazyMailer defers creating the SES client to the first email, so
+// requests that send none skip it. connect returns the client and, when
+// SES can't send, why not.
+func NewLazyMailer(connect func() (*sesv2.Client, string), health *store.HealthCounters) *Mailer {
+	return &Mailer{connect: connect, health: health}
+}
+
+// client returns the SES client, connecting first for a lazy mailer
+func (m *Mailer) client() *sesv2.Client {
+	m.once.Do(func() {
+		if m.connect == nil {
+			return
+		}
+		var problem string
+		m.sesClient, problem = m.connect()
+		if m.disabled == "" {
+			m.disabled = problem
+		}
+	})
+	return m.sesClient
+}
+
+func (a *AlertHandler) sendEmail(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	return NewMailer(a.sesClient, a.health).Send(ctx, to, subject, textBody, htmlBody)
+}
+
+// Send sends a simple text (and optional HTML) email through SESv2, tagged
+// with the configured configuration set so bounces and complaints are
+// published back to TinyTail.
+func (m *Mailer) Send(ctx context.Context, to, subject, textBody, htmlBody string) error {
+	client := m.client()
+	if m.disabled != "" {
+		return fmt.Errorf("email disabled: %s", m.disabled)
+	}
+	body := &sesTypes.Body{
+		Text: &sesTypes.Content{
+			Data: aws.String(textBody),
+		},
+	}
+	if htmlBody != "" {
+		body.Html = &sesTypes.Content{
+			Data: aws.String(htmlBody),
+		}
+	}
+
+	input := &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(alertFromEmail(to)),
+		Destination: &sesTypes.Destination{
+			ToAddresses: []string{to},
+		},
+		Content: &sesTypes.EmailContent{
+			Simple: &sesTypes.Message{
+				Subject: &sesTypes.Content{
+					Data: aws.String(subject),
+				},
+				Body: body,
+			},
+		},
+	}
+
+	if configSet := os.Getenv("TINYTAIL_SES_CONFIGURATION_SET"); configSet != "" {
+		input.ConfigurationSetName = aws.String(configSet)
+	}
+
+	_, err := client.SendEmail(ctx, input)
+	if err != nil {
+		m.health.Add(store.CounterSESFailures, 1)
+	}
+	return err
+}
+
+// alertFromEmail returns the configured sender, falling back to the
+// recipient if TINYTAIL_ALERT_FROM_EMAIL is not set.
+func alertFromEmail(recipient string) string {
+	fromEmail := os.Getenv("TINYTAIL_ALERT_FROM_EMAIL")
+	if fromEmail == "" {
+		return recipient
+	}
+	return fromEmail
+}
+
+// sesNotification is the subset of an SES bounce/complaint notification we
+// need. Configuration set event publishing uses eventType; identity
+// notifications use notificationType.
+type sesNotification struct {
+	EventType        string `json:"eventType"`
+	NotificationType string `json:"notificationType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// HandleSESNotification processes an SES bounce or complaint notification
+// delivered via SNS and disables alert delivery to the affected addresses.
+// Transient (soft) bounces are ignored.
+func (a *AlertHandler) HandleSESNotification(ctx context.Context, message string) error {
+	if a.skipDisabled(ctx, "SES notification") {
+		return nil
+	}
+	var notification sesNotification
+	if err := json.Unmarshal([]byte(message), &notification); err != nil {
+		return fmt.Errorf("invalid SES notification: %w", err)
+	}
+
+	eventType := notification.EventType
+	if eventType == "" {
+		eventType = notification.NotificationType
+	}
+
+	switch eventType {
+	case "Bounce":
+		if notification.Bounce.BounceType != "Permanent" {
+			slog.InfoContext(ctx, "Ignoring bounce notification", "bounce_type", notification.Bounce.BounceType)
+			return nil
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			reason := "bounce"
+			if recipient.DiagnosticCode != "" {
+				reason = "bounce: " + recipient.DiagnosticCode
+			}
+			if err := a.disableRecipient(ctx, recipient.EmailAddress, reason); err != nil {
+				return err
+			}
+		}
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			if err := a.disableRecipient(ctx, recipient.EmailAddress, "complaint"); err != nil {
+				return err
+			}
+		}
+	default:
+		slog.InfoContext(ctx, "Ignoring SES notification", "type", eventType)
+	}
+
+	return nil
+}
+
+func suppressedRecipientKey(email string) string {
+	return "suppressed#" + strings.ToLower(email)
+}
+
+func (a *AlertHandler) disableRecipient(ctx context.Context, email, reason string) error {
+	slog.WarnContext(ctx, "Disabling alert delivery", "recipient", email, "reason", reason)
+
+	_, err := a.dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(a.alertsTableName),
+		Item: map[string]types.AttributeValue{
+			"ruleID":     &types.AttributeValueMemberS{Value: suppressedRecipientKey(email)},
+			"reason":     &types.AttributeValueMemberS{Value: reason},
+			"disabledAt": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable recipient %s: %w", email, err)
+	}
+	return nil
+}
+
+// recipientDisabled reports why delivery to email was disabled, or "" if it
+// is still enabled.
+func (a *AlertHandler) recipientDisabled(ctx context.Context, email string) (string, error) {
+	result, err := a.dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(a.alertsTableName),
+		Key: map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: suppressedRecipientKey(email)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Item == nil {
+		return "", nil
+	}
+
+	reason := "disabled"
+	if reasonAttr, ok := result.Item["reason"].(*types.AttributeValueMemberS); ok {
+		reason = reasonAttr.Value
+	}
+	return reason, nil
+}
@@ -0,0 +1,107 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// maxGroupsInEmail caps how many groups are listed in an alert email.
+const maxGroupsInEmail = 20
+
+// MatchGroup summarizes the matches sharing one group_by value.
+type MatchGroup struct {
+	Key    string
+	Count  int
+	First  time.Time
+	Last   time.Time
+	Sample store.LogEntry // Most recent entry in the group
+}
+
+// groupKey extracts the group_by value from an entry. Built-in entry fields
+// are used directly; any other name is looked up as a (dot-separated) field
+// of a JSON-formatted message, e.g. "order.customer_id".
+func groupKey(entry store.LogEntry, groupBy string) string {
+	var key string
+	switch groupBy {
+	case "request_id":
+		key = entry.RequestID
+	case "source":
+		key = entry.Source
+	case "level":
+		key = entry.Level
+	case "logger":
+		key = entry.Logger
+	default:
+		key = jsonField(entry.Message, strings.TrimPrefix(groupBy, "json:"))
+	}
+
+	if key == "" || key == "none" {
+		return "(none)"
+	}
+	return key
+}
+
+func jsonField(message, path string) string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(message), &value); err != nil {
+		return ""
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[part]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// groupMatches buckets matches by the rule's group_by field, largest group
+// first.
+func groupMatches(logs []store.LogEntry, groupBy string) []MatchGroup {
+	byKey := make(map[string]*MatchGroup)
+	var order []string
+
+	for _, entry := range logs {
+		key := groupKey(entry, groupBy)
+		group, exists := byKey[key]
+		if !exists {
+			group = &MatchGroup{Key: key, First: entry.Timestamp, Last: entry.Timestamp, Sample: entry}
+			byKey[key] = group
+			order = append(order, key)
+		}
+
+		group.Count++
+		if entry.Timestamp.Before(group.First) {
+			group.First = entry.Timestamp
+		}
+		if entry.Timestamp.After(group.Last) {
+			group.Last = entry.Timestamp
+			group.Sample = entry
+		}
+	}
+
+	groups := make([]MatchGroup, 0, len(order))
+	for _, key := range order {
+		groups = append(groups, *byKey[key])
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Count > groups[j].Count
+	})
+
+	return groups
+}
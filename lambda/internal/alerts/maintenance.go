@@ -0,0 +1,145 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// StatePruneResult reports what PruneState found and removed
+type StatePruneResult struct {
+	Scanned  int `json:"scanned"`
+	Expired  int `json:"expired"`
+	Orphaned int `json:"orphaned"`
+	Deleted  int `json:"deleted"`
+}
+
+// PruneState deletes alerts table items whose ttl has passed but which
+// DynamoDB TTL hasn't removed yet, and the state of rules that are no longer
+// configured: the last-sent record and held quiet-hours alerts, which would
+// otherwise be picked up again if a rule with the same ID came back.
+// Suppressed recipients are kept.
+func (a *AlertHandler) PruneState(ctx context.Context) (*StatePruneResult, error) {
+	if a.skipDisabled(ctx, "alert state pruning") {
+		return nil, nil
+	}
+	a.reloadRules(ctx)
+
+	// Without a successfully loaded rule set every rule would look removed
+	configured := map[string]bool{}
+	checkOrphans := a.rulesVersion != ""
+	for i, rule := range a.rules {
+		configured[ruleIDFor(i, rule)] = true
+	}
+
+	result := &StatePruneResult{}
+	now := time.Now().Unix()
+
+	var doomed []string
+	paginator := dynamodb.NewScanPaginator(a.dbClient, &dynamodb.ScanInput{
+		TableName:                aws.String(a.alertsTableName),
+		ProjectionExpression:     aws.String("ruleID, #ttl"),
+		ExpressionAttributeNames: map[string]string{"#ttl": "ttl"},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan alert state: %w", err)
+		}
+
+		for _, item := range page.Items {
+			key, ok := item["ruleID"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			result.Scanned++
+
+			switch {
+			case expiredItem(item, now):
+				result.Expired++
+			case checkOrphans && orphanedState(key.Value, configured):
+				result.Orphaned++
+			default:
+				continue
+			}
+			doomed = append(doomed, key.Value)
+		}
+	}
+
+	deleted, err := a.deleteState(ctx, doomed)
+	result.Deleted = deleted
+	if err != nil {
+		return result, err
+	}
+
+	slog.InfoContext(ctx, "Pruned alert state", "scanned", result.Scanned, "expired", result.Expired,
+		"orphaned", result.Orphaned, "deleted", result.Deleted)
+	return result, nil
+}
+
+// expiredItem reports whether the item's ttl has passed
+func expiredItem(item map[string]types.AttributeValue, now int64) bool {
+	ttl, ok := item["ttl"].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(ttl.Value, 10, 64)
+	return err == nil && expires < now
+}
+
+// orphanedState reports whether the key holds state for a rule that isn't
+// configured. Only a rule's own item and its quiet-hours item are
+// considered: counters expire by themselves, and neither self-monitoring
+// checks (tinytail:...) nor TinyTail's own items are configured rules.
+func orphanedState(key string, configured map[string]bool) bool {
+	if ruleID, ok := strings.CutPrefix(key, "quiet#"); ok {
+		return !configured[ruleID]
+	}
+	if strings.Contains(key, "#") || strings.HasPrefix(key, "tinytail:") || store.IsInternalAlertsItem(key) {
+		return false
+	}
+	return !configured[key]
+}
+
+// deleteState deletes alerts table items in batches, returning how many
+// were deleted
+func (a *AlertHandler) deleteState(ctx context.Context, keys []string) (int, error) {
+	deleted := 0
+
+	// BatchWriteItem takes at most 25 requests
+	for start := 0; start < len(keys); start += 25 {
+		end := min(start+25, len(keys))
+		var requests []types.WriteRequest
+		for _, key := range keys[start:end] {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{
+					Key: map[string]types.AttributeValue{
+						"ruleID": &types.AttributeValueMemberS{Value: key},
+					},
+				},
+			})
+		}
+
+		pending := map[string][]types.WriteRequest{a.alertsTableName: requests}
+		for attempt := 0; len(pending[a.alertsTableName]) > 0 && attempt < 5; attempt++ {
+			output, err := a.dbClient.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete alert state: %w", err)
+			}
+			deleted += len(pending[a.alertsTableName]) - len(output.UnprocessedItems[a.alertsTableName])
+			pending = output.UnprocessedItems
+			if len(pending[a.alertsTableName]) > 0 {
+				time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+			}
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,190 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+const (
+	// DefaultPreviewHours is how far back a preview looks by default
+	DefaultPreviewHours = 24
+	// MaxPreviewHours bounds how far back a preview may look
+	MaxPreviewHours = 7 * 24
+
+	// previewMatchLimit caps the matches fetched per pattern
+	previewMatchLimit = 5000
+	// previewTick matches the EventBridge schedule the sweep runs on
+	previewTick = time.Minute
+)
+
+// ErrInvalidRule is wrapped by preview errors caused by the rule itself
+// rather than by the log search.
+var ErrInvalidRule = errors.New("invalid rule")
+
+// PreviewAlert is one notification a rule would have sent.
+type PreviewAlert struct {
+	At      time.Time `json:"at"`
+	Matches int       `json:"matches"`
+	// Held is set when the alert falls within the rule's quiet hours
+	Held bool `json:"held,omitempty"`
+}
+
+// PreviewResult describes what a rule would have done over a past period.
+type PreviewResult struct {
+	Since        time.Time        `json:"since"`
+	Until        time.Time        `json:"until"`
+	TotalMatches int              `json:"total_matches"`
+	Truncated    bool             `json:"truncated"`
+	Alerts       []PreviewAlert   `json:"alerts"`
+	Sample       []store.LogEntry `json:"sample"`
+
+	// Partial is set when the preview ran out of time and older entries in
+	// the period weren't read
+	Partial bool `json:"partial,omitempty"`
+}
+
+// previewCondition is a condition with its matches, oldest first.
+type previewCondition struct {
+	Condition
+	window  time.Duration
+	matches []store.LogEntry
+}
+
+// countIn returns the number of matches in (from, to].
+func (c previewCondition) countIn(from, to time.Time) int {
+	lo := sort.Search(len(c.matches), func(i int) bool { return c.matches[i].Timestamp.After(from) })
+	hi := sort.Search(len(c.matches), func(i int) bool { return c.matches[i].Timestamp.After(to) })
+	return hi - lo
+}
+
+// PreviewRule replays a rule against the past hours of logs without saving
+// state or sending email. The rule is evaluated once per minute, like the
+// scheduled sweep, and de-duplicated over its window the same way. The
+// per-recipient hourly cap is not applied.
+func PreviewRule(ctx context.Context, logStore *store.LogStore, rule AlertRule, hours int) (*PreviewResult, error) {
+	if hours <= 0 {
+		hours = DefaultPreviewHours
+	}
+	if hours > MaxPreviewHours {
+		return nil, fmt.Errorf("%w: hours must be at most %d", ErrInvalidRule, MaxPreviewHours)
+	}
+	rule, err := rule.withTemplate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	if !rule.isComposite() && rule.Pattern == "" {
+		return nil, fmt.Errorf("%w: rule needs a pattern or conditions", ErrInvalidRule)
+	}
+	if err := rule.validateTemplates(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	if _, err := rule.activeQuietHours(time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: quiet_hours: %v", ErrInvalidRule, err)
+	}
+
+	alertWindow, err := rule.alertWindow()
+	if err != nil {
+		return nil, fmt.Errorf("%w: window: %v", ErrInvalidRule, err)
+	}
+
+	conditions := rule.Conditions
+	if !rule.isComposite() {
+		conditions = []Condition{{Pattern: rule.Pattern, Window: rule.Window}}
+	}
+
+	until := time.Now()
+	since := until.Add(-time.Duration(hours) * time.Hour)
+	result := &PreviewResult{Since: since, Until: until, Alerts: []PreviewAlert{}, Sample: []store.LogEntry{}}
+
+	var evaluated []previewCondition
+	for _, c := range conditions {
+		window, err := parseWindow(c.Window)
+		if err != nil {
+			return nil, fmt.Errorf("%w: condition %q: window: %v", ErrInvalidRule, c.Pattern, err)
+		}
+		if c.MinCount < 1 {
+			c.MinCount = 1
+		}
+
+		// Look back one extra window so the first ticks see full windows
+		logs, partial, err := logStore.SearchLogsWithinBudget(ctx, c.Pattern, since.Add(-window), until, previewMatchLimit)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: failed to search logs: %w", c.Pattern, err)
+		}
+		if partial {
+			result.Partial = true
+		}
+		if len(logs) >= previewMatchLimit {
+			result.Truncated = true
+		}
+		sort.SliceStable(logs, func(i, j int) bool {
+			return logs[i].Timestamp.Before(logs[j].Timestamp)
+		})
+
+		pc := previewCondition{Condition: c, window: window, matches: logs}
+		evaluated = append(evaluated, pc)
+		if !c.Absent {
+			result.TotalMatches += pc.countIn(since, until)
+		}
+	}
+
+	all := rule.matchAll()
+	var nextAllowed time.Time
+	for tick := since.Truncate(previewTick).Add(previewTick); !tick.After(until); tick = tick.Add(previewTick) {
+		if tick.Before(nextAllowed) {
+			continue
+		}
+
+		triggered := all
+		matches := 0
+		for _, c := range evaluated {
+			n := c.countIn(tick.Add(-c.window), tick)
+			holds := n >= c.MinCount
+			if c.Absent {
+				holds = n == 0
+			}
+			if holds && !c.Absent {
+				matches += n
+			}
+			if all && !holds {
+				triggered = false
+				break
+			}
+			if !all && holds {
+				triggered = true
+			}
+		}
+		if !triggered {
+			continue
+		}
+
+		quiet, _ := rule.activeQuietHours(tick)
+		result.Alerts = append(result.Alerts, PreviewAlert{At: tick, Matches: matches, Held: quiet != nil})
+		nextAllowed = tick.Add(alertWindow)
+	}
+
+	// Sample the newest matches in the preview period
+	for _, c := range evaluated {
+		if c.Absent {
+			continue
+		}
+		for _, entry := range c.matches {
+			if entry.Timestamp.After(since) {
+				result.Sample = append(result.Sample, entry)
+			}
+		}
+	}
+	sort.SliceStable(result.Sample, func(i, j int) bool {
+		return result.Sample[i].Timestamp.After(result.Sample[j].Timestamp)
+	})
+	if len(result.Sample) > maxLogsInEmail {
+		result.Sample = result.Sample[:maxLogsInEmail]
+	}
+
+	return result, nil
+}
@@ -0,0 +1,214 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	_ "time/tzdata" // Lambda's provided runtime has no zoneinfo
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// QuietHours is a recurring window during which a rule's matches are
+// recorded but no notification is sent. With Mode "digest" the held alerts
+// are summarized in one email once the window ends; the default "suppress"
+// drops them.
+type QuietHours struct {
+	Days     string `json:"days,omitempty"` // e.g. "mon-fri", "sat,sun"; empty means every day
+	Start    string `json:"start"`          // "22:00"
+	End      string `json:"end"`            // "07:00"; may be earlier than Start to span midnight
+	Timezone string `json:"timezone,omitempty"`
+	Mode     string `json:"mode,omitempty"` // "suppress" (default) or "digest"
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseDays expands "mon-fri" or "sat,sun" style lists into a weekday set.
+func parseDays(days string) (map[time.Weekday]bool, error) {
+	set := make(map[time.Weekday]bool)
+	if strings.TrimSpace(days) == "" {
+		for _, d := range weekdays {
+			set[d] = true
+		}
+		return set, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		start, ok := weekdays[strings.TrimSpace(from)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", from)
+		}
+		if !isRange {
+			set[start] = true
+			continue
+		}
+		end, ok := weekdays[strings.TrimSpace(to)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", to)
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			set[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+
+	return set, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t falls inside the quiet window. Windows that
+// span midnight belong to the day they start on.
+func (q QuietHours) contains(t time.Time) (bool, error) {
+	loc := time.UTC
+	if q.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(q.Timezone); err != nil {
+			return false, fmt.Errorf("invalid timezone %q: %w", q.Timezone, err)
+		}
+	}
+	days, err := parseDays(q.Days)
+	if err != nil {
+		return false, err
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return false, err
+	}
+
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	sinceMidnight := local.Sub(midnight)
+
+	if start <= end {
+		return days[local.Weekday()] && sinceMidnight >= start && sinceMidnight < end, nil
+	}
+
+	// Spans midnight: either late on a listed day, or early the day after one
+	if sinceMidnight >= start && days[local.Weekday()] {
+		return true, nil
+	}
+	return sinceMidnight < end && days[(local.Weekday()+6)%7], nil
+}
+
+// activeQuietHours returns the quiet window covering now, if any.
+func (r AlertRule) activeQuietHours(now time.Time) (*QuietHours, error) {
+	for i := range r.QuietHours {
+		inside, err := r.QuietHours[i].contains(now)
+		if err != nil {
+			return nil, err
+		}
+		if inside {
+			return &r.QuietHours[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func quietKey(ruleID string) string {
+	return "quiet#" + ruleID
+}
+
+// recordQuietMatch counts an alert held back by quiet hours so a digest can
+// be sent afterwards.
+func (a *AlertHandler) recordQuietMatch(ctx context.Context, ruleID string, matchCount int) error {
+	now := time.Now().Unix()
+	_, err := a.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(a.alertsTableName),
+		Key: map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: quietKey(ruleID)},
+		},
+		UpdateExpression: aws.String("ADD heldAlerts :one, matchCount :matches SET lastHeld = :now, firstHeld = if_not_exists(firstHeld, :now)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":matches": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", matchCount)},
+			":now":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", now)},
+		},
+	})
+	return err
+}
+
+// sendQuietHoursDigests emails a summary of the alerts held during quiet
+// hours for "digest" rules whose window has ended.
+func (a *AlertHandler) sendQuietHoursDigests(ctx context.Context) {
+	now := time.Now()
+	for i, rule := range a.rules {
+		if !rule.hasDigestQuietHours() {
+			continue
+		}
+		if active, err := rule.activeQuietHours(now); err != nil || active != nil {
+			continue
+		}
+
+		ruleID := ruleIDFor(i, rule)
+		result, err := a.dbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(a.alertsTableName),
+			Key: map[string]types.AttributeValue{
+				"ruleID": &types.AttributeValueMemberS{Value: quietKey(ruleID)},
+			},
+			ConditionExpression: aws.String("attribute_exists(heldAlerts)"),
+			ReturnValues:        types.ReturnValueAllOld,
+		})
+		if err != nil {
+			var condErr *types.ConditionalCheckFailedException
+			if !errors.As(err, &condErr) {
+				slog.WarnContext(ctx, "Failed to read quiet hours digest", "rule", i, "error", err)
+			}
+			continue
+		}
+
+		held, matches := numberAttr(result.Attributes, "heldAlerts"), numberAttr(result.Attributes, "matchCount")
+		first := time.Unix(int64(numberAttr(result.Attributes, "firstHeld")), 0)
+		last := time.Unix(int64(numberAttr(result.Attributes, "lastHeld")), 0)
+
+		subject := rule.prefixSubject(fmt.Sprintf("[TinyTail Digest] %s (%d alerts held during quiet hours)", truncateString(rule.displayPattern(), 50), held))
+		body := fmt.Sprintf("%d alerts (%d matches) for pattern: %s\nwere held during quiet hours between %s and %s.\n",
+			held, matches, rule.displayPattern(), first.Format("2006-01-02 15:04"), last.Format("2006-01-02 15:04 MST"))
+		if link := deepLink(rule.linkPattern(), first.Add(-time.Hour), now); link != "" {
+			body += fmt.Sprintf("\nView in TinyTail: %s\n", link)
+		}
+
+		if err := a.sendEmail(ctx, rule.Email, subject, body, ""); err != nil {
+			slog.WarnContext(ctx, "Failed to send quiet hours digest", "rule", i, "error", err)
+		}
+	}
+}
+
+func (r AlertRule) hasDigestQuietHours() bool {
+	for _, q := range r.QuietHours {
+		if q.Mode == "digest" {
+			return true
+		}
+	}
+	return false
+}
+
+func numberAttr(item map[string]types.AttributeValue, name string) int {
+	var n int
+	if attr, ok := item[name].(*types.AttributeValueMemberN); ok {
+		fmt.Sscanf(attr.Value, "%d", &n)
+	}
+	return n
+}
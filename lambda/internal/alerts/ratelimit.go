@@ -0,0 +1,147 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DefaultMaxAlertsPerHour caps how many alert emails a single address
+// receives per hour across all rules.
+const DefaultMaxAlertsPerHour = 10
+
+// maxAlertsPerHour reads TINYTAIL_ALERT_MAX_PER_HOUR. Zero or a negative
+// value disables the cap.
+func maxAlertsPerHour() int {
+	value := os.Getenv("TINYTAIL_ALERT_MAX_PER_HOUR")
+	if value == "" {
+		return DefaultMaxAlertsPerHour
+	}
+	max, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid TINYTAIL_ALERT_MAX_PER_HOUR, using the default", "value", value, "default", DefaultMaxAlertsPerHour)
+		return DefaultMaxAlertsPerHour
+	}
+	return max
+}
+
+func recipientBucketKey(email string, hour time.Time) string {
+	return fmt.Sprintf("recipient#%s#%d", strings.ToLower(email), hour.Unix())
+}
+
+// reserveNotification claims one slot in the recipient's hourly budget. It
+// returns false (and counts the alert as suppressed) once the cap is hit.
+func (a *AlertHandler) reserveNotification(ctx context.Context, email string) (bool, error) {
+	if a.maxPerHour <= 0 {
+		return true, nil
+	}
+
+	hour := time.Now().Truncate(time.Hour)
+	key := map[string]types.AttributeValue{
+		"ruleID": &types.AttributeValueMemberS{Value: recipientBucketKey(email, hour)},
+	}
+	ttl := fmt.Sprintf("%d", hour.Add(48*time.Hour).Unix())
+
+	_, err := a.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(a.alertsTableName),
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD sentCount :one SET #ttl = :ttl"),
+		ConditionExpression: aws.String("attribute_not_exists(sentCount) OR sentCount < :max"),
+		ExpressionAttributeNames: map[string]string{
+			"#ttl": "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", a.maxPerHour)},
+			":ttl": &types.AttributeValueMemberN{Value: ttl},
+		},
+	})
+	if err == nil {
+		return true, nil
+	}
+
+	var condErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &condErr) {
+		return false, err
+	}
+
+	_, err = a.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(a.alertsTableName),
+		Key:              key,
+		UpdateExpression: aws.String("ADD suppressedCount :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	return false, err
+}
+
+// sendSuppressionSummaries tells each recipient how many alerts were held
+// back during the previous hour. Each summary is sent at most once.
+func (a *AlertHandler) sendSuppressionSummaries(ctx context.Context) {
+	if a.maxPerHour <= 0 {
+		return
+	}
+
+	previousHour := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	seen := make(map[string]bool)
+
+	for _, rule := range a.rules {
+		email := strings.ToLower(rule.Email)
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+
+		result, err := a.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(a.alertsTableName),
+			Key: map[string]types.AttributeValue{
+				"ruleID": &types.AttributeValueMemberS{Value: recipientBucketKey(email, previousHour)},
+			},
+			UpdateExpression:    aws.String("SET summarySent = :true"),
+			ConditionExpression: aws.String("suppressedCount > :zero AND attribute_not_exists(summarySent)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":true": &types.AttributeValueMemberBOOL{Value: true},
+				":zero": &types.AttributeValueMemberN{Value: "0"},
+			},
+			ReturnValues: types.ReturnValueAllNew,
+		})
+		if err != nil {
+			var condErr *types.ConditionalCheckFailedException
+			if !errors.As(err, &condErr) {
+				slog.WarnContext(ctx, "Failed to check suppressed alerts", "recipient", email, "error", err)
+			}
+			continue
+		}
+
+		var suppressed int
+		if countAttr, ok := result.Attributes["suppressedCount"].(*types.AttributeValueMemberN); ok {
+			fmt.Sscanf(countAttr.Value, "%d", &suppressed)
+		}
+
+		if err := a.sendSuppressionSummary(ctx, rule.Email, suppressed, previousHour); err != nil {
+			slog.WarnContext(ctx, "Failed to send suppression summary", "recipient", email, "error", err)
+		}
+	}
+}
+
+func (a *AlertHandler) sendSuppressionSummary(ctx context.Context, email string, suppressed int, hour time.Time) error {
+	subject := fmt.Sprintf("[TinyTail Alert] %d further alerts suppressed", suppressed)
+	body := fmt.Sprintf("%d further alerts for %s were suppressed between %s and %s\n"+
+		"because the limit of %d alert emails per hour was reached.\n\n"+
+		"Check the TinyTail UI for the matching logs.\n",
+		suppressed, email,
+		hour.Format("2006-01-02 15:04"), hour.Add(time.Hour).Format("15:04 MST"),
+		a.maxPerHour)
+
+	return a.sendEmail(ctx, email, subject, body, "")
+}
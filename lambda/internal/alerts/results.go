@@ -0,0 +1,80 @@
+package alerts
+
+import (
+	"context"
+	"log/slog"
+)
+
+// RuleStatus is the outcome of evaluating one rule.
+type RuleStatus string
+
+const (
+	// RuleSkipped means there was nothing to alert on: no matches, unmet
+	// conditions, or an alert was already sent within the window
+	RuleSkipped RuleStatus = "skipped"
+	// RuleMatched means the rule matched but no email was sent (quiet
+	// hours, rate limit, or a disabled recipient)
+	RuleMatched RuleStatus = "matched"
+	// RuleSent means an alert email was sent
+	RuleSent RuleStatus = "sent"
+	// RuleErrored means the rule couldn't be evaluated or the email failed
+	RuleErrored RuleStatus = "errored"
+)
+
+// RuleResult describes what happened to a single rule in an evaluation.
+type RuleResult struct {
+	RuleID     string     `json:"rule_id"`
+	Status     RuleStatus `json:"status"`
+	Matches    int        `json:"matches"`
+	Reason     string     `json:"reason,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	DurationMs int64      `json:"duration_ms"`
+}
+
+func (r RuleResult) skipped(reason string) RuleResult {
+	r.Status = RuleSkipped
+	r.Reason = reason
+	return r
+}
+
+func (r RuleResult) matched(reason string) RuleResult {
+	r.Status = RuleMatched
+	r.Reason = reason
+	return r
+}
+
+// Summary is returned from an evaluation run and used as the Lambda
+// response, so a single erroring rule is visible in the invocation result.
+type Summary struct {
+	Evaluated int          `json:"evaluated"`
+	Sent      int          `json:"sent"`
+	Matched   int          `json:"matched"`
+	Skipped   int          `json:"skipped"`
+	Errored   int          `json:"errored"`
+	Rules     []RuleResult `json:"rules"`
+}
+
+func (s *Summary) add(result RuleResult) {
+	s.Evaluated++
+	switch result.Status {
+	case RuleSent:
+		s.Sent++
+	case RuleMatched:
+		s.Matched++
+	case RuleErrored:
+		s.Errored++
+	default:
+		s.Skipped++
+	}
+	s.Rules = append(s.Rules, result)
+}
+
+func (s *Summary) log(ctx context.Context) {
+	slog.InfoContext(ctx, "Alert summary", "evaluated", s.Evaluated, "sent", s.Sent,
+		"matched", s.Matched, "skipped", s.Skipped, "errored", s.Errored)
+	for _, r := range s.Rules {
+		if r.Status == RuleErrored {
+			slog.ErrorContext(ctx, "Alert summary: rule errored", "rule_id", r.RuleID, "error", r.Error)
+		}
+	}
+}
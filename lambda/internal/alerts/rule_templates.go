@@ -0,0 +1,45 @@
+package alerts
+
+import (
+	"cmp"
+	"fmt"
+
+	"github.com/tinytail/tinytail/internal/cloudtrail"
+)
+
+// ruleTemplates are built-in rules a rule names in its template field,
+// e.g. {"template": "cloudtrail-root-activity", "email": "security@example.com"}.
+// There is one for each kind of sensitive CloudTrail action, and
+// cloudtrail-sensitive for all of them.
+var ruleTemplates = map[string]AlertRule{
+	"cloudtrail-sensitive": {Pattern: "sensitive=", Window: "5m", GroupBy: "logger", SubjectPrefix: "[CloudTrail]"},
+}
+
+func init() {
+	for _, category := range cloudtrail.Categories {
+		ruleTemplates["cloudtrail-"+category.Name] = AlertRule{
+			Pattern:       "sensitive=" + category.Name,
+			Window:        "5m",
+			SubjectPrefix: "[CloudTrail]",
+		}
+	}
+}
+
+// withTemplate fills in what the rule leaves empty from its template. The
+// rule's own pattern, window, grouping and subject prefix win.
+func (r AlertRule) withTemplate() (AlertRule, error) {
+	if r.Template == "" {
+		return r, nil
+	}
+	template, ok := ruleTemplates[r.Template]
+	if !ok {
+		return r, fmt.Errorf("unknown template %q", r.Template)
+	}
+	if !r.isComposite() {
+		r.Pattern = cmp.Or(r.Pattern, template.Pattern)
+		r.GroupBy = cmp.Or(r.GroupBy, template.GroupBy)
+	}
+	r.Window = cmp.Or(r.Window, template.Window)
+	r.SubjectPrefix = cmp.Or(r.SubjectPrefix, template.SubjectPrefix)
+	return r, nil
+}
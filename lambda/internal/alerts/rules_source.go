@@ -0,0 +1,208 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+)
+
+// DefaultRulesFile is the rules file bundled into the deployment package.
+const DefaultRulesFile = "alert-rules.json"
+
+// DefaultRulesReloadInterval is how long loaded rules are cached before an
+// alert invocation checks the source for changes.
+const DefaultRulesReloadInterval = time.Minute
+
+// RulesSource loads the raw alert rules JSON. version identifies the
+// content so unchanged rules aren't re-parsed; unchanged is true when the
+// source reports the caller's version is still current.
+type RulesSource interface {
+	Load(ctx context.Context, currentVersion string) (data []byte, version string, unchanged bool, err error)
+	String() string
+}
+
+// NewRulesSource parses a rules location: a local file path, an SSM
+// parameter ("ssm:/tinytail/alert-rules") or an S3 object
+// ("s3://bucket/alert-rules.json").
+func NewRulesSource(location string, cfg aws.Config) (RulesSource, error) {
+	switch {
+	case location == "":
+		return fileRulesSource{path: DefaultRulesFile}, nil
+	case strings.HasPrefix(location, "ssm:"):
+		name := strings.TrimPrefix(location, "ssm:")
+		if name == "" {
+			return nil, fmt.Errorf("rules source %q is missing a parameter name", location)
+		}
+		return ssmRulesSource{client: ssm.NewFromConfig(cfg), name: name}, nil
+	case strings.HasPrefix(location, "s3://"):
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("rules source %q must be s3://bucket/key", location)
+		}
+		return s3RulesSource{client: s3.NewFromConfig(cfg), bucket: bucket, key: key}, nil
+	default:
+		return fileRulesSource{path: location}, nil
+	}
+}
+
+type fileRulesSource struct {
+	path string
+}
+
+func (f fileRulesSource) Load(ctx context.Context, currentVersion string) ([]byte, string, bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, "", false, err
+	}
+	version := info.ModTime().String()
+	if version == currentVersion {
+		return nil, version, true, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	return data, version, false, err
+}
+
+func (f fileRulesSource) String() string { return f.path }
+
+type ssmRulesSource struct {
+	client *ssm.Client
+	name   string
+}
+
+func (s ssmRulesSource) Load(ctx context.Context, currentVersion string) ([]byte, string, bool, error) {
+	output, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(s.name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	version := strconv.FormatInt(output.Parameter.Version, 10)
+	if version == currentVersion {
+		return nil, version, true, nil
+	}
+	return []byte(aws.ToString(output.Parameter.Value)), version, false, nil
+}
+
+func (s ssmRulesSource) String() string { return "ssm:" + s.name }
+
+type s3RulesSource struct {
+	client *s3.Client
+	bucket string
+	key    string
+}
+
+func (s s3RulesSource) Load(ctx context.Context, currentVersion string) ([]byte, string, bool, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	}
+	if currentVersion != "" {
+		input.IfNoneMatch = aws.String(currentVersion)
+	}
+
+	output, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotModified" {
+			return nil, currentVersion, true, nil
+		}
+		return nil, "", false, err
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return data, aws.ToString(output.ETag), false, nil
+}
+
+func (s s3RulesSource) String() string { return "s3://" + s.bucket + "/" + s.key }
+
+// parseRules decodes a rules JSON array, reporting template problems
+// without rejecting the rules.
+func parseRules(data []byte) ([]AlertRule, error) {
+	var rules []AlertRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		rule, err := rule.withTemplate()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		rules[i] = rule
+		if err := rule.validateTemplates(); err != nil {
+			slog.Warn("Rule has an invalid template, the default format will be used", "rule", i, "error", err)
+		}
+		if _, err := rule.activeQuietHours(time.Now()); err != nil {
+			slog.Warn("Rule has invalid quiet_hours, they will be ignored", "rule", i, "error", err)
+		}
+	}
+
+	return rules, nil
+}
+
+// reloadRules refreshes the rules from their source once the cached copy is
+// older than the reload interval. On any error the previous rules stay in
+// effect.
+func (a *AlertHandler) reloadRules(ctx context.Context) {
+	if !a.rulesLoadedAt.IsZero() && time.Since(a.rulesLoadedAt) < a.reloadInterval {
+		return
+	}
+	a.rulesLoadedAt = time.Now()
+
+	data, version, unchanged, err := a.rulesSource.Load(ctx, a.rulesVersion)
+	if err != nil {
+		if len(a.rules) == 0 && a.rulesVersion == "" {
+			slog.InfoContext(ctx, "No alert rules loaded, alerts disabled", "source", a.rulesSource.String(), "error", err)
+		} else {
+			slog.WarnContext(ctx, "Failed to reload alert rules, keeping the existing rules", "source", a.rulesSource.String(), "rules", len(a.rules), "error", err)
+		}
+		return
+	}
+	if unchanged {
+		return
+	}
+
+	rules, err := parseRules(data)
+	if err != nil {
+		// Don't crash - just log the error and keep the previous rules
+		slog.WarnContext(ctx, "Failed to parse alert rules, keeping the existing rules", "source", a.rulesSource.String(), "rules", len(a.rules), "error", err)
+		return
+	}
+
+	a.rules = rules
+	a.rulesVersion = version
+	slog.InfoContext(ctx, "Loaded alert rules", "rules", len(rules), "source", a.rulesSource.String())
+}
+
+// rulesReloadInterval reads TINYTAIL_ALERT_RULES_RELOAD_SECONDS.
+func rulesReloadInterval() time.Duration {
+	value := os.Getenv("TINYTAIL_ALERT_RULES_RELOAD_SECONDS")
+	if value == "" {
+		return DefaultRulesReloadInterval
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		slog.Warn("Invalid TINYTAIL_ALERT_RULES_RELOAD_SECONDS, using the default", "value", value, "default", DefaultRulesReloadInterval.String())
+		return DefaultRulesReloadInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
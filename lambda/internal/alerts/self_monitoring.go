@@ -0,0 +1,138 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// selfMonitorWindow is both the lookback for the internal counters and the
+// minimum time between repeat notifications for the same problem.
+const selfMonitorWindow = 15 * time.Minute
+
+// Thresholds for the ingest error rate check: at least this many 5xx
+// responses, making up at least this percentage of ingest requests.
+const (
+	selfMonitorMinIngestErrors  = 5
+	selfMonitorIngestErrorRatio = 5
+)
+
+// selfMonitorCheck is a built-in rule evaluated against TinyTail's own
+// health counters rather than the logs table.
+type selfMonitorCheck struct {
+	id       string
+	describe string
+	evaluate func(ctx context.Context, since time.Time) (int, bool, error)
+}
+
+func (a *AlertHandler) selfMonitorChecks() []selfMonitorCheck {
+	return []selfMonitorCheck{
+		{
+			id:       "tinytail:dynamodb-throttling",
+			describe: "DynamoDB requests were throttled",
+			evaluate: func(ctx context.Context, since time.Time) (int, bool, error) {
+				n, err := a.health.Sum(ctx, store.CounterDynamoDBThrottles, since)
+				return n, n > 0, err
+			},
+		},
+		{
+			id:       "tinytail:ingest-errors",
+			describe: "Log ingestion returned 5xx errors",
+			evaluate: func(ctx context.Context, since time.Time) (int, bool, error) {
+				errs, err := a.health.Sum(ctx, store.CounterIngestErrors, since)
+				if err != nil || errs < selfMonitorMinIngestErrors {
+					return errs, false, err
+				}
+				requests, err := a.health.Sum(ctx, store.CounterIngestRequests, since)
+				if err != nil {
+					return errs, false, err
+				}
+				return errs, errs*100 >= requests*selfMonitorIngestErrorRatio, nil
+			},
+		},
+		{
+			id:       "tinytail:ingest-dropped",
+			describe: "Queued log entries could not be stored and were dropped",
+			evaluate: func(ctx context.Context, since time.Time) (int, bool, error) {
+				n, err := a.health.Sum(ctx, store.CounterIngestDropped, since)
+				return n, n > 0, err
+			},
+		},
+		{
+			id:       "tinytail:forward-dropped",
+			describe: "Log entries could not be forwarded and were dropped",
+			evaluate: func(ctx context.Context, since time.Time) (int, bool, error) {
+				n, err := a.health.Sum(ctx, store.CounterForwardDropped, since)
+				return n, n > 0, err
+			},
+		},
+		{
+			id:       "tinytail:ses-failures",
+			describe: "Alert emails failed to send",
+			evaluate: func(ctx context.Context, since time.Time) (int, bool, error) {
+				n, err := a.health.Sum(ctx, store.CounterSESFailures, since)
+				return n, n > 0, err
+			},
+		},
+	}
+}
+
+// checkSelfMonitoring evaluates the built-in rules and notifies
+// TINYTAIL_SELF_MONITOR_EMAIL when TinyTail itself is failing. Each problem
+// is also logged and published as a metric, since a broken SES setup means
+// the email may never arrive.
+func (a *AlertHandler) checkSelfMonitoring(ctx context.Context) {
+	recipient := os.Getenv("TINYTAIL_SELF_MONITOR_EMAIL")
+	if recipient == "" || a.health == nil {
+		return
+	}
+
+	if err := a.health.Flush(ctx); err != nil {
+		slog.WarnContext(ctx, "Self-monitoring failed to flush health counters", "error", err)
+	}
+
+	since := time.Now().Add(-selfMonitorWindow)
+	for _, check := range a.selfMonitorChecks() {
+		count, triggered, err := check.evaluate(ctx, since)
+		if err != nil {
+			slog.WarnContext(ctx, "Self-monitoring failed to read health counters", "check", check.id, "error", err)
+			continue
+		}
+		if !triggered {
+			continue
+		}
+
+		slog.ErrorContext(ctx, "Self-monitoring check triggered", "check", check.id, "description", check.describe, "count", count, "window", formatDuration(selfMonitorWindow))
+		metrics.Emit(map[string]string{"Check": check.id},
+			metrics.Metric{Name: "SelfMonitorTriggered", Unit: metrics.Count, Value: 1})
+
+		shouldAlert, err := a.shouldSendAlert(ctx, check.id, selfMonitorWindow)
+		if err != nil {
+			slog.WarnContext(ctx, "Self-monitoring failed to check alert state", "check", check.id, "error", err)
+			continue
+		}
+		if !shouldAlert {
+			continue
+		}
+
+		subject := fmt.Sprintf("TinyTail self-monitoring: %s", check.describe)
+		body := fmt.Sprintf("TinyTail detected a problem with its own operation.\n\n"+
+			"Check: %s\nProblem: %s\nOccurrences: %d in the last %s\n\n"+
+			"See the TinyTail Lambda logs in CloudWatch for details.\n",
+			check.id, check.describe, count, formatDuration(selfMonitorWindow))
+
+		if err := a.sendEmail(ctx, recipient, subject, body, ""); err != nil {
+			slog.WarnContext(ctx, "Self-monitoring failed to send alert email", "check", check.id, "error", err)
+			continue
+		}
+
+		if err := a.recordAlert(ctx, check.id, count, selfMonitorWindow); err != nil {
+			slog.WarnContext(ctx, "Self-monitoring failed to record alert state", "check", check.id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package alerts
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// maxLogsInEmail caps how many matches are rendered into an alert email.
+const maxLogsInEmail = 20
+
+// TemplateData is the context passed to a rule's subject and body
+// templates.
+type TemplateData struct {
+	Rule        AlertRule
+	Matches     []store.LogEntry // Matches shown in the email (capped)
+	Count       int              // Total number of matches found
+	Remaining   int              // Matches not included in Matches
+	Window      string           // Formatted time window, e.g. "10m"
+	Groups      []MatchGroup     // Matches grouped by Rule.GroupBy (empty when not grouping)
+	Link        string           // UI deep link for the pattern and window (empty without TINYTAIL_BASE_URL)
+	Attachment  string           // Filename of the attached CSV of all matches (empty when all are shown)
+	GeneratedAt time.Time
+
+	// Attached is how many matches the attachment holds, fewer than Count
+	// when AttachmentCapped
+	Attached         int
+	AttachmentCapped bool
+}
+
+var templateFuncs = map[string]interface{}{
+	"truncate": truncateString,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"formatTime": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+}
+
+func newTemplateData(rule AlertRule, logs []store.LogEntry, window time.Duration) TemplateData {
+	displayLogs := logs
+	if len(logs) > maxLogsInEmail {
+		displayLogs = logs[:maxLogsInEmail]
+	}
+
+	var groups []MatchGroup
+	if rule.GroupBy != "" {
+		groups = groupMatches(logs, rule.GroupBy)
+	}
+
+	now := time.Now()
+	return TemplateData{
+		Rule:        rule,
+		Matches:     displayLogs,
+		Count:       len(logs),
+		Remaining:   len(logs) - len(displayLogs),
+		Window:      formatDuration(window),
+		Groups:      groups,
+		Link:        deepLink(rule.linkPattern(), now.Add(-window), now),
+		GeneratedAt: now,
+	}
+}
+
+// deepLink builds a UI URL pre-filtered to a search pattern and time range.
+// TINYTAIL_BASE_URL is the externally reachable UI address, e.g.
+// https://abc123.execute-api.us-east-2.amazonaws.com/prod/
+func deepLink(pattern string, since, until time.Time) string {
+	baseURL := os.Getenv("TINYTAIL_BASE_URL")
+	if baseURL == "" {
+		return ""
+	}
+
+	query := url.Values{}
+	query.Set("q", pattern)
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	// Round up so entries from the final second are included
+	query.Set("until", until.UTC().Add(time.Second).Format(time.RFC3339))
+
+	return strings.TrimRight(baseURL, "/") + "/?" + query.Encode()
+}
+
+// validateTemplates parses the rule's templates so mistakes are reported
+// when rules are loaded rather than when an alert fires.
+func (r AlertRule) validateTemplates() error {
+	if r.SubjectTemplate != "" {
+		if _, err := texttemplate.New("subject").Funcs(templateFuncs).Parse(r.SubjectTemplate); err != nil {
+			return fmt.Errorf("subject_template: %w", err)
+		}
+	}
+	if r.BodyTemplate != "" {
+		if _, err := texttemplate.New("body").Funcs(templateFuncs).Parse(r.BodyTemplate); err != nil {
+			return fmt.Errorf("body_template: %w", err)
+		}
+	}
+	if r.HTMLBodyTemplate != "" {
+		if _, err := htmltemplate.New("html_body").Funcs(templateFuncs).Parse(r.HTMLBodyTemplate); err != nil {
+			return fmt.Errorf("html_body_template: %w", err)
+		}
+	}
+	return nil
+}
+
+// renderAlert produces the email subject and bodies for a rule, using the
+// rule's templates where set and the built-in format otherwise. htmlBody is
+// empty unless the rule has an HTML template.
+func renderAlert(data TemplateData) (subject, textBody, htmlBody string, err error) {
+	rule := data.Rule
+
+	subject = defaultAlertSubject(data)
+	if rule.SubjectTemplate != "" {
+		if subject, err = renderText("subject", rule.SubjectTemplate, data); err != nil {
+			return "", "", "", fmt.Errorf("subject_template: %w", err)
+		}
+		// Email subjects must be a single line
+		subject = strings.Join(strings.Fields(subject), " ")
+	}
+
+	textBody = defaultAlertBody(data)
+	if rule.BodyTemplate != "" {
+		if textBody, err = renderText("body", rule.BodyTemplate, data); err != nil {
+			return "", "", "", fmt.Errorf("body_template: %w", err)
+		}
+	}
+
+	if rule.HTMLBodyTemplate != "" {
+		tmpl, err := htmltemplate.New("html_body").Funcs(templateFuncs).Parse(rule.HTMLBodyTemplate)
+		if err != nil {
+			return "", "", "", fmt.Errorf("html_body_template: %w", err)
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("html_body_template: %w", err)
+		}
+		htmlBody = buf.String()
+	}
+
+	return subject, textBody, htmlBody, nil
+}
+
+func renderText(name, text string, data TemplateData) (string, error) {
+	tmpl, err := texttemplate.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// prefixSubject prepends the rule's subject_prefix, if any. The prefix is
+// applied to templated and default subjects alike.
+func (r AlertRule) prefixSubject(subject string) string {
+	prefix := strings.Join(strings.Fields(r.SubjectPrefix), " ")
+	if prefix == "" {
+		return subject
+	}
+	return prefix + " " + subject
+}
+
+func defaultAlertSubject(data TemplateData) string {
+	if data.Rule.GroupBy != "" {
+		return fmt.Sprintf("[TinyTail Alert] %s (%d matches across %d %s values in %s)",
+			truncateString(data.Rule.displayPattern(), 50), data.Count, len(data.Groups), data.Rule.GroupBy, data.Window)
+	}
+	return fmt.Sprintf("[TinyTail Alert] %s (%d matches in %s)",
+		truncateString(data.Rule.displayPattern(), 50), data.Count, data.Window)
+}
+
+func defaultAlertBody(data TemplateData) string {
+	var body strings.Builder
+	if data.Rule.isComposite() {
+		body.WriteString(fmt.Sprintf("Conditions met: %s\n", data.Rule.displayPattern()))
+		body.WriteString(fmt.Sprintf("Found %d matching logs\n", data.Count))
+	} else {
+		body.WriteString(fmt.Sprintf("Found %d matches for pattern: %s\n", data.Count, data.Rule.Pattern))
+	}
+	body.WriteString(fmt.Sprintf("Time window: %s\n", data.Window))
+	if data.Link != "" {
+		body.WriteString(fmt.Sprintf("View in TinyTail: %s\n", data.Link))
+	}
+	body.WriteString("\n")
+
+	if data.Rule.GroupBy != "" {
+		writeGroupedBody(&body, data)
+		return body.String()
+	}
+
+	body.WriteString("Matching logs:\n")
+	body.WriteString(strings.Repeat("=", 80) + "\n\n")
+
+	for _, entry := range data.Matches {
+		body.WriteString(fmt.Sprintf("[%s] [%s] [%s]\n",
+			entry.Timestamp.Format("2006-01-02 15:04:05"),
+			entry.Level,
+			entry.Source))
+		body.WriteString(fmt.Sprintf("%s\n", entry.Message))
+		body.WriteString(strings.Repeat("#", 80) + "\n\n")
+	}
+
+	if data.Remaining > 0 {
+		body.WriteString(fmt.Sprintf("... and %d more matches (showing first %d)\n",
+			data.Remaining, len(data.Matches)))
+		if data.Attachment != "" && data.AttachmentCapped {
+			body.WriteString(fmt.Sprintf("%d matches are attached as %s, as attachments are capped at %d matches and %d MB\n",
+				data.Attached, data.Attachment, maxAttachedMatches, maxAttachmentBytes>>20))
+		} else if data.Attachment != "" {
+			body.WriteString(fmt.Sprintf("All %d matches are attached as %s\n", data.Count, data.Attachment))
+		}
+		body.WriteString("\n")
+	}
+
+	body.WriteString(strings.Repeat("=", 80) + "\n")
+	body.WriteString(fmt.Sprintf("\nAutomated alert from TinyTail | %s\n", data.GeneratedAt.Format(time.RFC3339)))
+
+	return body.String()
+}
+
+func writeGroupedBody(body *strings.Builder, data TemplateData) {
+	body.WriteString(fmt.Sprintf("Matches by %s (%d distinct):\n", data.Rule.GroupBy, len(data.Groups)))
+	body.WriteString(strings.Repeat("=", 80) + "\n\n")
+
+	shown := data.Groups
+	if len(shown) > maxGroupsInEmail {
+		shown = shown[:maxGroupsInEmail]
+	}
+
+	for _, group := range shown {
+		body.WriteString(fmt.Sprintf("%s: %d matches (%s - %s)\n",
+			group.Key, group.Count,
+			group.First.Format("2006-01-02 15:04:05"),
+			group.Last.Format("15:04:05")))
+		body.WriteString(fmt.Sprintf("Latest: [%s] [%s] %s\n",
+			group.Sample.Level, group.Sample.Source, truncateString(group.Sample.Message, 500)))
+		body.WriteString(strings.Repeat("#", 80) + "\n\n")
+	}
+
+	if len(data.Groups) > len(shown) {
+		body.WriteString(fmt.Sprintf("... and %d more groups (showing largest %d)\n\n",
+			len(data.Groups)-len(shown), len(shown)))
+	}
+
+	body.WriteString(strings.Repeat("=", 80) + "\n")
+	body.WriteString(fmt.Sprintf("\nAutomated alert from TinyTail | %s\n", data.GeneratedAt.Format(time.RFC3339)))
+}
@@ -0,0 +1,136 @@
+// Package appevents stores the custom events applications put on
+// EventBridge, such as "order placed" or "payment failed", as log entries,
+// so business events show up beside the logs of the services that sent
+// them. Events whose source starts with a configured prefix are stored;
+// everything else on the bus is left to the alert trigger.
+package appevents
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// reservedSources are the sources of the events that trigger TinyTail's own
+// work, which a prefix must not claim
+var reservedSources = []string{"aws.events", "tinytail.schedule"}
+
+// Config says which events are application events
+type Config struct {
+	// Prefixes are the event sources stored, matched by prefix, such as
+	// "com.acme." for com.acme.orders; empty disables
+	Prefixes []string
+
+	// Env is the environment entries are stored in; empty is the default
+	Env string
+}
+
+// ConfigFromEnv reads TINYTAIL_APP_EVENT_SOURCES, a comma-separated list of
+// source prefixes, and TINYTAIL_APP_EVENTS_ENV
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Env: os.Getenv("TINYTAIL_APP_EVENTS_ENV")}
+	for _, prefix := range strings.Split(os.Getenv("TINYTAIL_APP_EVENT_SOURCES"), ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		for _, reserved := range reservedSources {
+			if strings.HasPrefix(reserved, prefix) {
+				return cfg, fmt.Errorf("TINYTAIL_APP_EVENT_SOURCES: %q would match TinyTail's own %s events", prefix, reserved)
+			}
+		}
+		cfg.Prefixes = append(cfg.Prefixes, prefix)
+	}
+	return cfg, nil
+}
+
+// Enabled reports whether any events are stored
+func (c Config) Enabled() bool {
+	return len(c.Prefixes) > 0
+}
+
+// Matches reports whether events from the source are stored
+func (c Config) Matches(source string) bool {
+	return slices.ContainsFunc(c.Prefixes, func(prefix string) bool {
+		return strings.HasPrefix(source, prefix)
+	})
+}
+
+// Entry turns an event into an entry. Its source is the event's source and
+// its logger the detail type. The detail's message (or msg), level,
+// request_id (or correlation_id) fields fill those fields, with the detail
+// type as the message and the event ID as the request ID if there are
+// none; every other detail field is appended to the message as a key=value
+// field, nested ones by their dotted path. EventBridge may deliver an event
+// more than once, so the event ID is the entry's dedup ID.
+func Entry(event events.CloudWatchEvent) store.LogEntry {
+	var detail map[string]any
+	if err := json.Unmarshal(event.Detail, &detail); err != nil || detail == nil {
+		detail = map[string]any{}
+	}
+	take := func(names ...string) string {
+		for _, name := range names {
+			if value, ok := detail[name].(string); ok {
+				delete(detail, name)
+				return value
+			}
+		}
+		return ""
+	}
+
+	entry := store.LogEntry{
+		Message:   cmp.Or(take("message", "msg"), event.DetailType),
+		Level:     cmp.Or(take("level", "severity"), "INFO"),
+		RequestID: cmp.Or(take("request_id", "correlation_id"), event.ID),
+		Source:    event.Source,
+		Logger:    event.DetailType,
+		Timestamp: event.Time,
+		DedupID:   event.ID,
+	}
+
+	fields := map[string]string{}
+	flatten(fields, "", detail)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var message strings.Builder
+	message.WriteString(entry.Message)
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&message, " %s=%s", name, value)
+	}
+	entry.Message = message.String()
+	return entry
+}
+
+// flatten collects an object's fields by their dotted path. Arrays are kept
+// as JSON.
+func flatten(fields map[string]string, prefix string, object map[string]any) {
+	for name, value := range object {
+		path := prefix + name
+		switch value := value.(type) {
+		case map[string]any:
+			flatten(fields, path+".", value)
+		case string:
+			fields[path] = value
+		case nil:
+			fields[path] = "null"
+		default:
+			encoded, _ := json.Marshal(value)
+			fields[path] = string(encoded)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package awsapi calls the few AWS APIs TinyTail needs that it has no SDK
+// module for, such as CloudWatch Logs, Lambda and EventBridge. Each would
+// be a whole dependency for a handful of calls, so requests are signed with
+// the SDK's SigV4 signer and sent directly.
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// maxResponseBytes bounds how much of a response is read
+const maxResponseBytes = 6 << 20
+
+// Client calls one AWS service with the configured credentials and region
+type Client struct {
+	config   aws.Config
+	service  string
+	endpoint string
+	client   *http.Client
+	signer   *v4.Signer
+}
+
+// New creates a client for a service's regional endpoint, or for endpoint
+// if it isn't empty. The service is its signing name, e.g. "logs".
+func New(config aws.Config, service, endpoint string, timeout time.Duration) *Client {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, config.Region)
+	}
+	return &Client{
+		config:   config,
+		service:  service,
+		endpoint: strings.TrimRight(endpoint, "/"),
+		client:   &http.Client{Timeout: timeout},
+		signer:   v4.NewSigner(),
+	}
+}
+
+// Error is an error response from a service. Type is the exception's name
+// without its namespace, e.g. ResourceNotFoundException.
+type Error struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Type, e.Status, e.Message)
+}
+
+// JSON makes a call in the AWS JSON 1.1 protocol, where target names the
+// operation, e.g. "Logs_20140328.PutLogEvents". The response body, if
+// any, is decoded into output unless it is nil.
+func (c *Client) JSON(ctx context.Context, target string, input, output any) error {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	body, _, err := c.do(ctx, http.MethodPost, "/", map[string]string{
+		"Content-Type": "application/x-amz-json-1.1",
+		"X-Amz-Target": target,
+	}, payload)
+	if err != nil || output == nil || len(body) == 0 {
+		return err
+	}
+	return json.Unmarshal(body, output)
+}
+
+// REST makes a call in the REST-JSON protocol: the operation is the method
+// and path, and input, if not nil, is sent as the JSON body. The response
+// body is returned as it is, with the response headers, for APIs like
+// Lambda's Invoke that return more than JSON.
+func (c *Client) REST(ctx context.Context, method, path string, input any) ([]byte, http.Header, error) {
+	var payload []byte
+	if input != nil {
+		var err error
+		if payload, err = json.Marshal(input); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c.do(ctx, method, path, map[string]string{"Content-Type": "application/json"}, payload)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, headers map[string]string, payload []byte) ([]byte, http.Header, error) {
+	credentials, err := c.config.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	hash := sha256.Sum256(payload)
+	if err := c.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(hash[:]), c.service, c.config.Region, time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, resp.Header, responseError(resp, body)
+	}
+	return body, resp.Header, nil
+}
+
+// responseError reads an error response. JSON protocol services name the
+// exception in the body; REST-JSON ones in a header, and spell the message
+// field either way.
+func responseError(resp *http.Response, body []byte) *Error {
+	// Field names match regardless of case, so Message is read either way
+	var failure struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &failure)
+
+	errType := failure.Type
+	if header := resp.Header.Get("X-Amzn-Errortype"); header != "" {
+		errType, _, _ = strings.Cut(header, ":")
+	}
+	// Types come qualified, e.g. com.amazonaws.logs#ResourceNotFoundException
+	errType = errType[strings.LastIndex(errType, "#")+1:]
+
+	return &Error{Status: resp.StatusCode, Type: errType, Message: failure.Message}
+}
@@ -0,0 +1,353 @@
+// Package cloudtrail stores an account's CloudTrail management events as
+// log entries, so TinyTail can double as a viewer for its audit trail.
+// Events arrive one at a time from EventBridge, or as the log files
+// CloudTrail delivers to S3. Who did what, from where, is kept as key=value
+// fields, and actions worth an alert are marked sensitive=<category> for
+// the alert rule templates to match.
+package cloudtrail
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Source is the source of every CloudTrail entry
+const Source = "cloudtrail"
+
+// Config says whether CloudTrail events are accepted, and which are kept
+type Config struct {
+	Enabled bool
+
+	// Env is the environment entries are stored in; empty is the default
+	Env string
+
+	// ReadOnly keeps read-only calls (Describe*, Get*, List*) too; by
+	// default only sensitive ones are
+	ReadOnly bool
+
+	// Ignore lists event names never kept, with * matching anything
+	Ignore []string
+}
+
+// ConfigFromEnv reads TINYTAIL_CLOUDTRAIL ("true" to accept events),
+// TINYTAIL_CLOUDTRAIL_ENV, TINYTAIL_CLOUDTRAIL_READ_ONLY and
+// TINYTAIL_CLOUDTRAIL_IGNORE, a comma-separated list of event names such
+// as "AssumeRole,Decrypt,GenerateDataKey*".
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Env: os.Getenv("TINYTAIL_CLOUDTRAIL_ENV")}
+	var err error
+	if cfg.Enabled, err = envBool("TINYTAIL_CLOUDTRAIL"); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadOnly, err = envBool("TINYTAIL_CLOUDTRAIL_READ_ONLY"); err != nil {
+		return cfg, err
+	}
+	for _, pattern := range strings.Split(os.Getenv("TINYTAIL_CLOUDTRAIL_IGNORE"), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("TINYTAIL_CLOUDTRAIL_IGNORE: invalid pattern %q", pattern)
+		}
+		cfg.Ignore = append(cfg.Ignore, pattern)
+	}
+	return cfg, nil
+}
+
+func envBool(name string) (bool, error) {
+	switch value := os.Getenv(name); value {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s must be \"true\" or \"false\", got %q", name, value)
+	}
+}
+
+// Event is the part of a CloudTrail record TinyTail keeps
+type Event struct {
+	EventID         string    `json:"eventID"`
+	EventTime       time.Time `json:"eventTime"`
+	EventSource     string    `json:"eventSource"` // e.g. iam.amazonaws.com
+	EventName       string    `json:"eventName"`
+	EventType       string    `json:"eventType"`
+	EventCategory   string    `json:"eventCategory"` // Management, Data or Insight
+	ManagementEvent *bool     `json:"managementEvent"`
+	ReadOnly        bool      `json:"readOnly"`
+	AWSRegion       string    `json:"awsRegion"`
+	SourceIPAddress string    `json:"sourceIPAddress"`
+	RequestID       string    `json:"requestID"`
+	ErrorCode       string    `json:"errorCode"`
+	ErrorMessage    string    `json:"errorMessage"`
+	AccountID       string    `json:"recipientAccountId"`
+	UserIdentity    Identity  `json:"userIdentity"`
+
+	ResponseElements    json.RawMessage `json:"responseElements"`
+	AdditionalEventData json.RawMessage `json:"additionalEventData"`
+}
+
+// Identity is who made a call
+type Identity struct {
+	Type           string `json:"type"` // Root, IAMUser, AssumedRole, AWSService, ...
+	PrincipalID    string `json:"principalId"`
+	ARN            string `json:"arn"`
+	AccountID      string `json:"accountId"`
+	UserName       string `json:"userName"`
+	InvokedBy      string `json:"invokedBy"`
+	SessionContext struct {
+		SessionIssuer struct {
+			UserName string `json:"userName"`
+		} `json:"sessionIssuer"`
+	} `json:"sessionContext"`
+}
+
+// String names the caller: "root", the user name, role/session for an
+// assumed role, or the service acting on the account's behalf
+func (id Identity) String() string {
+	switch id.Type {
+	case "Root":
+		return "root"
+	case "IAMUser":
+		return cmp.Or(id.UserName, id.ARN)
+	case "AssumedRole":
+		session := id.ARN[strings.LastIndex(id.ARN, "/")+1:]
+		if role := id.SessionContext.SessionIssuer.UserName; role != "" {
+			return role + "/" + session
+		}
+		return cmp.Or(id.ARN, id.PrincipalID)
+	}
+	return cmp.Or(id.UserName, id.ARN, id.InvokedBy, id.PrincipalID, "unknown")
+}
+
+// Category is a kind of sensitive action, marked on entries as
+// sensitive=<name>. The list follows the CIS AWS Foundations Benchmark's
+// monitoring recommendations.
+type Category struct {
+	Name    string
+	matches func(e *Event) bool
+}
+
+// Categories are checked in order; an event is marked with the first it
+// belongs to
+var Categories = []Category{
+	// Failed console sign-ins
+	{"console-login-failure", func(e *Event) bool {
+		return e.EventName == "ConsoleLogin" && e.consoleLogin() == "Failure"
+	}},
+	// Console sign-ins without MFA
+	{"console-login-without-mfa", func(e *Event) bool {
+		return e.EventName == "ConsoleLogin" && e.consoleLogin() == "Success" && e.mfaUsed() == "No"
+	}},
+	// Calls made with the account's root user
+	{"root-activity", func(e *Event) bool {
+		return e.UserIdentity.Type == "Root" && e.UserIdentity.InvokedBy == "" && e.EventType != "AwsServiceEvent"
+	}},
+	// CloudTrail and AWS Config being stopped or reconfigured
+	{"trail-change", named(
+		"cloudtrail.amazonaws.com", "StopLogging", "DeleteTrail", "UpdateTrail", "PutEventSelectors",
+		"config.amazonaws.com", "StopConfigurationRecorder", "DeleteConfigurationRecorder", "DeleteDeliveryChannel")},
+	// Changes to IAM users, roles, groups, policies and keys
+	{"iam-change", func(e *Event) bool {
+		return e.EventSource == "iam.amazonaws.com" && !e.ReadOnly && e.ErrorCode == ""
+	}},
+	// KMS keys disabled or scheduled for deletion
+	{"key-deletion", named(
+		"kms.amazonaws.com", "DisableKey", "ScheduleKeyDeletion")},
+	// S3 bucket policies, ACLs and public access blocks changed
+	{"bucket-policy-change", named(
+		"s3.amazonaws.com", "PutBucketPolicy", "DeleteBucketPolicy", "PutBucketAcl",
+		"PutBucketPublicAccessBlock", "DeleteBucketPublicAccessBlock",
+		"PutAccountPublicAccessBlock", "DeleteAccountPublicAccessBlock")},
+	// Security groups, network ACLs and internet gateways changed
+	{"network-change", named(
+		"ec2.amazonaws.com", "AuthorizeSecurityGroupIngress", "AuthorizeSecurityGroupEgress",
+		"RevokeSecurityGroupIngress", "RevokeSecurityGroupEgress", "CreateSecurityGroup", "DeleteSecurityGroup",
+		"CreateNetworkAclEntry", "ReplaceNetworkAclEntry", "DeleteNetworkAclEntry",
+		"CreateInternetGateway", "AttachInternetGateway", "DetachInternetGateway", "DeleteInternetGateway")},
+	// Calls refused for lack of permission
+	{"access-denied", func(e *Event) bool {
+		return strings.Contains(e.ErrorCode, "AccessDenied") || strings.Contains(e.ErrorCode, "UnauthorizedOperation")
+	}},
+}
+
+// named matches successful calls to the listed actions, each list headed by
+// the service they belong to
+func named(list ...string) func(e *Event) bool {
+	actions := map[string]bool{}
+	service := ""
+	for _, name := range list {
+		if strings.HasSuffix(name, ".amazonaws.com") {
+			service = name
+			continue
+		}
+		actions[service+" "+name] = true
+	}
+	return func(e *Event) bool {
+		return e.ErrorCode == "" && actions[e.EventSource+" "+e.EventName]
+	}
+}
+
+// consoleLogin is a ConsoleLogin event's outcome, Success or Failure
+func (e *Event) consoleLogin() string {
+	var response struct {
+		ConsoleLogin string `json:"ConsoleLogin"`
+	}
+	_ = json.Unmarshal(e.ResponseElements, &response)
+	return response.ConsoleLogin
+}
+
+// mfaUsed is a ConsoleLogin event's "Yes" or "No"
+func (e *Event) mfaUsed() string {
+	var data struct {
+		MFAUsed string `json:"MFAUsed"`
+	}
+	_ = json.Unmarshal(e.AdditionalEventData, &data)
+	return data.MFAUsed
+}
+
+// Sensitive returns the name of the event's category, or "" if it is an
+// ordinary call
+func (e *Event) Sensitive() string {
+	for _, category := range Categories {
+		if category.matches(e) {
+			return category.Name
+		}
+	}
+	return ""
+}
+
+// Keep reports whether the event is stored. Data and Insights events never
+// are, nor ignored names; read-only calls only when configured or when
+// they are sensitive.
+func (c Config) Keep(e *Event) bool {
+	if e.EventCategory != "" && e.EventCategory != "Management" || e.ManagementEvent != nil && !*e.ManagementEvent {
+		return false
+	}
+	if slices.ContainsFunc(c.Ignore, func(pattern string) bool {
+		matched, _ := path.Match(pattern, e.EventName)
+		return matched
+	}) {
+		return false
+	}
+	return !e.ReadOnly || c.ReadOnly || e.Sensitive() != ""
+}
+
+// Entries returns the entries of the events that are kept
+func (c Config) Entries(trail []Event) []store.LogEntry {
+	var entries []store.LogEntry
+	for i := range trail {
+		if c.Keep(&trail[i]) {
+			entries = append(entries, trail[i].Entry())
+		}
+	}
+	return entries
+}
+
+// Entry turns the event into an entry: "<action> by <caller>" followed by
+// its fields, logged by the service that was called. Sensitive actions and
+// failed calls are warnings.
+func (e *Event) Entry() store.LogEntry {
+	sensitive := e.Sensitive()
+	fields := map[string]string{
+		"event":         e.EventName,
+		"user":          e.UserIdentity.String(),
+		"user_type":     e.UserIdentity.Type,
+		"account":       cmp.Or(e.AccountID, e.UserIdentity.AccountID),
+		"region":        e.AWSRegion,
+		"source_ip":     e.SourceIPAddress,
+		"error_code":    e.ErrorCode,
+		"error_message": e.ErrorMessage,
+		"sensitive":     sensitive,
+		"event_id":      e.EventID,
+	}
+	if e.EventName == "ConsoleLogin" {
+		fields["login"] = e.consoleLogin()
+		fields["mfa"] = e.mfaUsed()
+	}
+
+	level := "INFO"
+	if sensitive != "" || e.ErrorCode != "" {
+		level = "WARN"
+	}
+	return store.LogEntry{
+		Timestamp: e.EventTime,
+		Level:     level,
+		Source:    Source,
+		Logger:    e.EventSource,
+		RequestID: cmp.Or(e.RequestID, e.EventID),
+		Message:   fmt.Sprintf("%s by %s%s", e.EventName, e.UserIdentity, formatFields(fields)),
+	}
+}
+
+// formatFields writes the non-empty fields as sorted key=value pairs,
+// quoting values with spaces
+func formatFields(fields map[string]string) string {
+	names := make([]string, 0, len(fields))
+	for name, value := range fields {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", name, value)
+	}
+	return b.String()
+}
+
+// Files reads the log files CloudTrail delivers to S3
+type Files struct {
+	client *s3.Client
+}
+
+func NewFiles(client *s3.Client) *Files {
+	return &Files{client: client}
+}
+
+// IsLogFile reports whether an object key is a CloudTrail log file, as
+// opposed to a digest or Insights file delivered to the same bucket
+func IsLogFile(key string) bool {
+	return strings.Contains(key, "/CloudTrail/") && strings.HasSuffix(key, ".json.gz")
+}
+
+// Read returns the events in a log file
+func (f *Files) Read(ctx context.Context, bucket, key string) ([]Event, error) {
+	output, err := f.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	zr, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s is not gzipped: %w", bucket, key, err)
+	}
+	var file struct {
+		Records []Event `json:"Records"`
+	}
+	if err := json.NewDecoder(zr).Decode(&file); err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+	}
+	return file.Records, nil
+}
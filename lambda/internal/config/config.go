@@ -0,0 +1,324 @@
+// Package config loads and validates TinyTail's startup configuration.
+//
+// Settings are TINYTAIL_* environment variables. They can also come from a
+// JSON file (TINYTAIL_CONFIG_FILE) or SSM parameters under a path
+// (TINYTAIL_CONFIG_SSM_PATH); the environment wins where both set a value.
+// Every setting is checked before anything starts, and all problems are
+// reported together.
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/tinytail/tinytail/internal/alerts"
+	"github.com/tinytail/tinytail/internal/appevents"
+	"github.com/tinytail/tinytail/internal/cloudtrail"
+	"github.com/tinytail/tinytail/internal/dlq"
+	"github.com/tinytail/tinytail/internal/forwarding"
+	"github.com/tinytail/tinytail/internal/handler"
+	"github.com/tinytail/tinytail/internal/logfiles"
+	"github.com/tinytail/tinytail/internal/logging"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Config is everything the function needs to start
+type Config struct {
+	Tables Tables
+
+	// DynamoDBEndpoint overrides the DynamoDB endpoint, e.g. DynamoDB Local
+	DynamoDBEndpoint string
+
+	// Where alert rules are loaded from
+	AlertRules alerts.RulesSource
+
+	SessionLifetime store.SessionLifetime
+	Handler         handler.Config
+
+	// MaxMessageSize is the longest message stored as one entry; longer
+	// ones are split
+	MaxMessageSize int
+
+	// Tracing sends X-Ray subsegments for handlers and AWS calls
+	Tracing bool
+
+	LogLevel slog.Level
+
+	// SelfIngest stores TinyTail's own warnings and errors in the log table
+	SelfIngest bool
+
+	// IngestDLQ queues entries that fail to store; an empty URL disables it
+	IngestDLQ dlq.Config
+
+	// Forwarding queues deliveries to forwarding rules' endpoints that keep
+	// failing; an empty URL disables the queue
+	Forwarding forwarding.Config
+
+	// CloudTrail says whether CloudTrail events are stored, and which
+	CloudTrail cloudtrail.Config
+
+	// KinesisEnv is the environment entries from Kinesis streams are
+	// stored in
+	KinesisEnv string
+
+	// LogFiles names the bucket whose new objects are log files to store;
+	// an empty bucket disables it
+	LogFiles logfiles.Config
+
+	// AppEvents says which custom EventBridge events are stored as entries
+	AppEvents appevents.Config
+
+	// SkipStartupChecks turns off the cold start checks of the tables and
+	// SES sender
+	SkipStartupChecks bool
+}
+
+// Tables names the DynamoDB tables
+type Tables = store.TableNames
+
+// TablesFromEnv reads the table names, which default to those created by
+// infrastructure/template.yaml, and the logs tables of any other
+// environments in TINYTAIL_ENVIRONMENTS
+func TablesFromEnv() (Tables, error) {
+	tables := Tables{
+		Logs:     envOr("TINYTAIL_TABLE_NAME", "TinyTailLogs"),
+		Sessions: envOr("TINYTAIL_SESSIONS_TABLE_NAME", "TinyTailSessions"),
+		Users:    envOr("TINYTAIL_USERS_TABLE_NAME", "TinyTailUsers"),
+		APIKeys:  envOr("TINYTAIL_API_KEYS_TABLE_NAME", "TinyTailAPIKeys"),
+		Alerts:   envOr("TINYTAIL_ALERTS_TABLE_NAME", "TinyTailAlerts"),
+	}
+	var err error
+	tables.EnvironmentLogs, err = store.ParseEnvironments(os.Getenv("TINYTAIL_ENVIRONMENTS"), tables.Logs)
+	if err != nil {
+		return tables, fmt.Errorf("TINYTAIL_ENVIRONMENTS: %w", err)
+	}
+	return tables, nil
+}
+
+// Error lists every invalid or missing setting found at startup
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// Load reads the configuration from its sources and validates it. The AWS
+// config is used for SSM and for clients the configuration refers to. The
+// error, if any, is an *Error.
+func Load(ctx context.Context, awsConfig aws.Config) (*Config, error) {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	prefixed := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	// File and SSM settings are exported into the environment so code that
+	// reads settings when it runs sees them too
+	check(applySources(ctx, awsConfig))
+
+	cfg := &Config{
+		DynamoDBEndpoint: os.Getenv("TINYTAIL_DYNAMODB_ENDPOINT"),
+	}
+	var err error
+	cfg.Tables, err = TablesFromEnv()
+	check(err)
+	h := &cfg.Handler
+
+	// Private deployments can rely on IAM alone: no sign-in, and producers
+	// may ingest with IAM-signed requests instead of a secret
+	h.NoAuth, err = envBool("TINYTAIL_NO_AUTH")
+	check(err)
+
+	// Secrets are configured as SHA-256 digests; plaintext is still accepted
+	// from deployments that predate hashing
+	h.IngestSecrets, err = handler.IngestSecretsFromEnv()
+	check(err)
+	if err == nil && len(h.IngestSecrets) == 0 && !h.NoAuth {
+		problems = append(problems, "TINYTAIL_INGEST_SECRET_SHA256 or TINYTAIL_INGEST_SECRETS is required")
+	}
+	for _, secret := range h.IngestSecrets {
+		if _, ok := cfg.Tables.EnvironmentLogs[secret.Env]; secret.Env != "" && secret.Env != store.DefaultEnvironment && !ok {
+			problems = append(problems, fmt.Sprintf("TINYTAIL_INGEST_SECRETS %s: environment %q is not in TINYTAIL_ENVIRONMENTS", secret.ID, secret.Env))
+		}
+	}
+
+	// The shared UI password only signs in as the bootstrap admin until the
+	// first user account is created
+	h.UIPassword, err = handler.CredentialFromEnv("TINYTAIL_UI_PASSWORD", "TINYTAIL_UI_PASSWORD_SHA256")
+	check(err)
+
+	h.IngestAllowlist, err = handler.ParseAllowlist(os.Getenv("TINYTAIL_INGEST_ALLOWED_CIDRS"))
+	prefixed("TINYTAIL_INGEST_ALLOWED_CIDRS", err)
+	h.UIAllowlist, err = handler.ParseAllowlist(os.Getenv("TINYTAIL_UI_ALLOWED_CIDRS"))
+	prefixed("TINYTAIL_UI_ALLOWED_CIDRS", err)
+	h.IngestIAMPrincipals, err = handler.ParseIAMPrincipals(os.Getenv("TINYTAIL_INGEST_IAM_PRINCIPALS"))
+	prefixed("TINYTAIL_INGEST_IAM_PRINCIPALS", err)
+
+	cfg.SessionLifetime, err = store.SessionLifetimeFromEnv()
+	check(err)
+	cfg.MaxMessageSize, err = store.MaxMessageSizeFromEnv()
+	check(err)
+	h.IngestSignature, err = handler.SignatureConfigFromEnv()
+	check(err)
+	h.Vector, err = handler.VectorMappingFromEnv()
+	check(err)
+	h.IngestRateLimit, err = handler.RateLimitConfigFromEnv()
+	check(err)
+	h.SampleRates, err = handler.SampleRatesFromEnv()
+	check(err)
+	h.EntryRules, err = handler.EntryRulesFromEnv()
+	check(err)
+	h.Levels, err = handler.LevelMapFromEnv()
+	check(err)
+	h.Timestamps, err = handler.TimestampRulesFromEnv()
+	check(err)
+	for id := range h.Vector.BySecret {
+		if !slices.ContainsFunc(h.IngestSecrets, func(secret handler.IngestSecret) bool { return secret.ID == id }) {
+			problems = append(problems, fmt.Sprintf("TINYTAIL_VECTOR_FIELDS: no ingest secret has the id %q", id))
+		}
+	}
+	h.SessionTokens, err = handler.SessionTokensFromEnv()
+	check(err)
+	h.PasswordMaxAge, err = handler.PasswordMaxAgeFromEnv()
+	check(err)
+	h.LoginLinks, err = handler.LoginLinksFromEnv()
+	check(err)
+	h.FeedTokens, err = handler.FeedTokensFromEnv()
+	check(err)
+	h.Authorizer, err = handler.AuthorizerConfigFromEnv()
+	check(err)
+	h.RequestTimeout, err = handler.RequestTimeoutFromEnv()
+	check(err)
+
+	h.ContentSecurityPolicy = handler.ContentSecurityPolicyFromEnv()
+	h.ALBHealthCheckPath = handler.ALBHealthCheckPathFromEnv()
+	h.PublicBaseURL = os.Getenv("TINYTAIL_BASE_URL")
+
+	h.SingleSession, err = envBool("TINYTAIL_SINGLE_SESSION")
+	check(err)
+	h.LoginNotifications, err = envBool("TINYTAIL_LOGIN_NOTIFICATIONS")
+	check(err)
+	h.GzipResponses, err = envBool("TINYTAIL_GZIP_RESPONSES")
+	check(err)
+	cfg.Tracing, err = envBool("TINYTAIL_XRAY")
+	check(err)
+	cfg.LogLevel, err = logging.LevelFromEnv()
+	check(err)
+	cfg.SelfIngest, err = envBool("TINYTAIL_SELF_INGEST")
+	check(err)
+	cfg.IngestDLQ, err = dlq.ConfigFromEnv()
+	check(err)
+	cfg.Forwarding, err = forwarding.ConfigFromEnv()
+	check(err)
+	cfg.CloudTrail, err = cloudtrail.ConfigFromEnv()
+	check(err)
+	if _, ok := cfg.Tables.EnvironmentLogs[cfg.CloudTrail.Env]; cfg.CloudTrail.Env != "" && cfg.CloudTrail.Env != store.DefaultEnvironment && !ok {
+		problems = append(problems, fmt.Sprintf("TINYTAIL_CLOUDTRAIL_ENV: environment %q is not in TINYTAIL_ENVIRONMENTS", cfg.CloudTrail.Env))
+	}
+	cfg.KinesisEnv = os.Getenv("TINYTAIL_KINESIS_ENV")
+	if _, ok := cfg.Tables.EnvironmentLogs[cfg.KinesisEnv]; cfg.KinesisEnv != "" && cfg.KinesisEnv != store.DefaultEnvironment && !ok {
+		problems = append(problems, fmt.Sprintf("TINYTAIL_KINESIS_ENV: environment %q is not in TINYTAIL_ENVIRONMENTS", cfg.KinesisEnv))
+	}
+	cfg.LogFiles = logfiles.ConfigFromEnv()
+	if _, ok := cfg.Tables.EnvironmentLogs[cfg.LogFiles.Env]; cfg.LogFiles.Env != "" && cfg.LogFiles.Env != store.DefaultEnvironment && !ok {
+		problems = append(problems, fmt.Sprintf("TINYTAIL_LOG_BUCKET_ENV: environment %q is not in TINYTAIL_ENVIRONMENTS", cfg.LogFiles.Env))
+	}
+	cfg.AppEvents, err = appevents.ConfigFromEnv()
+	check(err)
+	if _, ok := cfg.Tables.EnvironmentLogs[cfg.AppEvents.Env]; cfg.AppEvents.Env != "" && cfg.AppEvents.Env != store.DefaultEnvironment && !ok {
+		problems = append(problems, fmt.Sprintf("TINYTAIL_APP_EVENTS_ENV: environment %q is not in TINYTAIL_ENVIRONMENTS", cfg.AppEvents.Env))
+	}
+	cfg.SkipStartupChecks, err = envBool("TINYTAIL_SKIP_STARTUP_CHECKS")
+	check(err)
+
+	// Alert settings are read as alerts are sent, but mistakes in them
+	// should still stop the function from starting
+	cfg.AlertRules, err = alerts.NewRulesSource(os.Getenv("TINYTAIL_ALERT_RULES_SOURCE"), awsConfig)
+	prefixed("TINYTAIL_ALERT_RULES_SOURCE", err)
+	check(envInt("TINYTAIL_ALERT_MAX_PER_HOUR", false))
+	check(envInt("TINYTAIL_ALERT_RULES_RELOAD_SECONDS", true))
+	check(envEmail("TINYTAIL_ALERT_FROM_EMAIL"))
+	check(envEmail("TINYTAIL_SELF_MONITOR_EMAIL"))
+	check(envEmail("TINYTAIL_DIGEST_EMAIL"))
+	check(envURL("TINYTAIL_BASE_URL"))
+	check(envURL("TINYTAIL_DYNAMODB_ENDPOINT"))
+	check(envURL("TINYTAIL_INGEST_DLQ_URL"))
+	check(envURL("TINYTAIL_FORWARD_DLQ_URL"))
+
+	if len(problems) > 0 {
+		return nil, &Error{Problems: problems}
+	}
+	return cfg, nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envBool reads an optional "true" or "false" setting
+func envBool(name string) (bool, error) {
+	switch value := os.Getenv(name); value {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s must be \"true\" or \"false\", got %q", name, value)
+	}
+}
+
+// envInt checks that an optional setting is a whole number
+func envInt(name string, nonNegative bool) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || (nonNegative && n < 0) {
+		return fmt.Errorf("%s must be a whole number, got %q", name, value)
+	}
+	return nil
+}
+
+// envEmail checks that an optional setting looks like an email address
+func envEmail(name string) error {
+	value := os.Getenv(name)
+	if value != "" && !strings.Contains(value, "@") {
+		return fmt.Errorf("%s must be an email address, got %q", name, value)
+	}
+	return nil
+}
+
+// envURL checks that an optional setting is an absolute http(s) URL
+func envURL(name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, got %q", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// applySources exports settings from TINYTAIL_CONFIG_FILE and
+// TINYTAIL_CONFIG_SSM_PATH into the environment, leaving variables that are
+// already set alone. SSM settings take precedence over the file.
+func applySources(ctx context.Context, awsConfig aws.Config) error {
+	settings := map[string]string{}
+
+	if file := os.Getenv("TINYTAIL_CONFIG_FILE"); file != "" {
+		fromFile, err := readFile(file)
+		if err != nil {
+			return fmt.Errorf("TINYTAIL_CONFIG_FILE: %w", err)
+		}
+		for name, value := range fromFile {
+			settings[name] = value
+		}
+	}
+
+	if ssmPath := os.Getenv("TINYTAIL_CONFIG_SSM_PATH"); ssmPath != "" {
+		fromSSM, err := readSSM(ctx, ssm.NewFromConfig(awsConfig), ssmPath)
+		if err != nil {
+			return fmt.Errorf("TINYTAIL_CONFIG_SSM_PATH: %w", err)
+		}
+		for name, value := range fromSSM {
+			settings[name] = value
+		}
+	}
+
+	for name, value := range settings {
+		if !strings.HasPrefix(name, "TINYTAIL_") {
+			return fmt.Errorf("setting %q from a config source must start with TINYTAIL_", name)
+		}
+		if _, set := os.LookupEnv(name); !set {
+			os.Setenv(name, value)
+		}
+	}
+	return nil
+}
+
+// readFile reads a JSON object of setting names to values. Numbers and
+// booleans are accepted as well as strings.
+func readFile(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case string:
+			settings[name] = v
+		case float64, bool:
+			settings[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", file, name)
+		}
+	}
+	return settings, nil
+}
+
+// readSSM reads every parameter under the path, named by the last segment:
+// /tinytail/prod/TINYTAIL_ALERT_FROM_EMAIL sets TINYTAIL_ALERT_FROM_EMAIL.
+// SecureString parameters are decrypted.
+func readSSM(ctx context.Context, client *ssm.Client, ssmPath string) (map[string]string, error) {
+	settings := map[string]string{}
+	paginator := ssm.NewGetParametersByPathPaginator(client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(ssmPath),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read parameters under %s: %w", ssmPath, err)
+		}
+		for _, parameter := range page.Parameters {
+			settings[path.Base(aws.ToString(parameter.Name))] = aws.ToString(parameter.Value)
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,147 @@
+// Package dlq keeps log entries that couldn't be stored, typically because
+// DynamoDB was throttling, in an SQS queue so they can be stored later
+// instead of being lost.
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// DefaultMaxAttempts is how many times a queued entry is tried before it is
+// dropped, unless TINYTAIL_INGEST_DLQ_MAX_ATTEMPTS says otherwise
+const DefaultMaxAttempts = 5
+
+// Config locates the queue
+type Config struct {
+	URL         string
+	MaxAttempts int
+}
+
+// ConfigFromEnv reads TINYTAIL_INGEST_DLQ_URL and
+// TINYTAIL_INGEST_DLQ_MAX_ATTEMPTS. An empty URL means no queue: entries
+// that fail to store are rejected with a 500 as before.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{URL: os.Getenv("TINYTAIL_INGEST_DLQ_URL"), MaxAttempts: DefaultMaxAttempts}
+	if value := os.Getenv("TINYTAIL_INGEST_DLQ_MAX_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("TINYTAIL_INGEST_DLQ_MAX_ATTEMPTS must be a positive whole number, got %q", value)
+		}
+		cfg.MaxAttempts = n
+	}
+	return cfg, nil
+}
+
+// Queue sends failed entries to the dead-letter queue and stores them again
+// when the queue delivers them back to the function
+type Queue struct {
+	client *sqs.Client
+	config Config
+}
+
+func NewQueue(client *sqs.Client, config Config) *Queue {
+	return &Queue{client: client, config: config}
+}
+
+// message is the body of a queued entry
+type message struct {
+	Env      string         `json:"env,omitempty"`
+	Entry    store.LogEntry `json:"entry"`
+	Reason   string         `json:"reason"`
+	QueuedAt time.Time      `json:"queued_at"`
+
+	// StableID is the entry's, which isn't part of its JSON, so storing it
+	// overwrites any copy its batch managed to write before failing
+	StableID string `json:"stable_id,omitempty"`
+}
+
+// Send queues an entry that failed to store in the named environment, with
+// the error that stopped it
+func (q *Queue) Send(ctx context.Context, env string, entry *store.LogEntry, cause error) error {
+	body, err := json.Marshal(message{Env: env, Entry: *entry, Reason: cause.Error(), QueuedAt: time.Now(), StableID: entry.StableID})
+	if err != nil {
+		return err
+	}
+	_, err = q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.config.URL),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
+
+// IsSource reports whether an SQS event source ARN is this queue. The ARN
+// ends with the queue name, as the URL does.
+func (q *Queue) IsSource(arn string) bool {
+	name := q.config.URL[strings.LastIndex(q.config.URL, "/")+1:]
+	return name != "" && strings.HasSuffix(arn, ":"+name)
+}
+
+// Reprocess stores the entries in a batch of queue messages. Messages that
+// fail again are reported back so SQS redelivers them after the visibility
+// timeout; once one has been tried MaxAttempts times it is dropped, logged
+// in full and counted so self-monitoring can report it.
+func (q *Queue) Reprocess(ctx context.Context, event events.SQSEvent, environments *store.Environments, health *store.HealthCounters) events.SQSEventResponse {
+	var response events.SQSEventResponse
+	stored, dropped := 0, 0
+
+	for _, record := range event.Records {
+		var queued message
+		if err := json.Unmarshal([]byte(record.Body), &queued); err != nil {
+			// Retrying won't make it readable
+			slog.ErrorContext(ctx, "Dropping unreadable dead-letter message", "message_id", record.MessageId, "error", err)
+			health.Add(store.CounterIngestDropped, 1)
+			dropped++
+			continue
+		}
+
+		logs, ok := environments.Get(queued.Env)
+		if !ok {
+			// The environment was removed from the configuration since
+			slog.ErrorContext(ctx, "Dropping dead-letter log entry for an unknown environment",
+				"message_id", record.MessageId, "env", queued.Env, "entry", queued.Entry)
+			health.Add(store.CounterIngestDropped, 1)
+			dropped++
+			continue
+		}
+
+		queued.Entry.StableID = queued.StableID
+		err := logs.StoreLogEntry(ctx, &queued.Entry)
+		if err == nil {
+			stored++
+			continue
+		}
+		if store.IsThrottle(err) {
+			health.Add(store.CounterDynamoDBThrottles, 1)
+		}
+
+		attempts, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+		if attempts >= q.config.MaxAttempts {
+			slog.ErrorContext(ctx, "Dropping dead-letter log entry after repeated failures",
+				"message_id", record.MessageId, "env", queued.Env, "attempts", attempts, "queued_at", queued.QueuedAt,
+				"first_error", queued.Reason, "error", err, "entry", queued.Entry)
+			health.Add(store.CounterIngestDropped, 1)
+			dropped++
+			continue
+		}
+
+		slog.WarnContext(ctx, "Failed to store dead-letter log entry, will retry",
+			"message_id", record.MessageId, "attempts", attempts, "error", err)
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+	}
+
+	slog.InfoContext(ctx, "Reprocessed dead-letter log entries", "stored", stored,
+		"retrying", len(response.BatchItemFailures), "dropped", dropped)
+	return response
+}
@@ -0,0 +1,304 @@
+// Package doctor checks a deployment for the mistakes that otherwise only
+// show up as failures at runtime: tables with the wrong keys, index or
+// TTL, a stream not wired to the function, an unverified SES sender,
+// missing IAM permissions and missing schedules. Each check reports what it
+// found and how to fix it.
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesTypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/tinytail/tinytail/internal/awsapi"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// BootstrapFix is the fix for any table problem bootstrap can repair
+const BootstrapFix = "run `tinytail-admin bootstrap` or deploy infrastructure/template.yaml"
+
+// Result is the outcome of one check. Fix says what to do when it failed.
+type Result struct {
+	Check  string `json:"check"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+func pass(check, detail string) Result {
+	return Result{Check: check, OK: true, Detail: detail}
+}
+
+func fail(check, detail, fix string) Result {
+	return Result{Check: check, Detail: detail, Fix: fix}
+}
+
+// Function is what the Lambda API says about the deployed function
+type Function struct {
+	Name        string
+	ARN         string
+	Role        string
+	Environment map[string]string
+}
+
+// GetFunction looks up the function by name
+func GetFunction(ctx context.Context, lambda *awsapi.Client, name string) (*Function, error) {
+	body, _, err := lambda.REST(ctx, http.MethodGet, "/2015-03-31/functions/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	var output struct {
+		Configuration struct {
+			FunctionName string
+			FunctionArn  string
+			Role         string
+			Environment  struct {
+				Variables map[string]string
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &output); err != nil {
+		return nil, fmt.Errorf("failed to read function %s: %w", name, err)
+	}
+	c := output.Configuration
+	return &Function{Name: c.FunctionName, ARN: c.FunctionArn, Role: c.Role, Environment: c.Environment.Variables}, nil
+}
+
+// Tables compares each table with the schema TinyTail expects. No-auth
+// deployments don't need the sessions table.
+func Tables(ctx context.Context, db *dynamodb.Client, tables store.TableNames, noAuth bool) []Result {
+	var results []Result
+	for _, schema := range store.Schemas(tables) {
+		if noAuth && schema.Name == tables.Sessions {
+			continue
+		}
+		check := "table " + schema.Name
+		problems, err := store.CheckSchema(ctx, db, schema)
+		if err != nil {
+			results = append(results, fail(check, err.Error(), "grant dynamodb:DescribeTable and dynamodb:DescribeTimeToLive to whoever runs doctor"))
+			continue
+		}
+		if len(problems) == 0 {
+			results = append(results, pass(check, "keys, index, stream and TTL as expected"))
+			continue
+		}
+		for _, problem := range problems {
+			results = append(results, fail(check, problem, TableFix(tables, schema.Name, problem)))
+		}
+	}
+	return results
+}
+
+// TableFix suggests how to fix a table problem found by store.CheckSchema
+func TableFix(tables store.TableNames, table, problem string) string {
+	switch {
+	case strings.HasSuffix(problem, "does not exist"):
+		variable := map[string]string{
+			tables.Logs:     "TINYTAIL_TABLE_NAME",
+			tables.Sessions: "TINYTAIL_SESSIONS_TABLE_NAME",
+			tables.Users:    "TINYTAIL_USERS_TABLE_NAME",
+			tables.APIKeys:  "TINYTAIL_API_KEYS_TABLE_NAME",
+			tables.Alerts:   "TINYTAIL_ALERTS_TABLE_NAME",
+		}[table]
+		if variable == "" {
+			variable = "TINYTAIL_ENVIRONMENTS"
+		}
+		return fmt.Sprintf("check %s and the region, then %s", variable, BootstrapFix)
+	case strings.Contains(problem, "must be recreated"):
+		return "the key schema can't be changed in place; recreate the table with `tinytail-admin bootstrap` after moving its data"
+	default:
+		return BootstrapFix
+	}
+}
+
+// Stream checks that the logs table's stream invokes the function, which
+// realtime alerts and forwarding depend on
+func Stream(ctx context.Context, db *dynamodb.Client, lambda *awsapi.Client, function *Function, logsTable string) []Result {
+	check := "stream " + logsTable + " → " + function.Name
+	described, err := db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(logsTable)})
+	if err != nil {
+		return []Result{fail(check, fmt.Sprintf("failed to describe table %s: %v", logsTable, err), "see the table checks")}
+	}
+	streamARN := aws.ToString(described.Table.LatestStreamArn)
+	if streamARN == "" {
+		return []Result{fail(check, "the logs table has no stream", BootstrapFix)}
+	}
+
+	query := url.Values{"EventSourceArn": {streamARN}, "FunctionName": {function.ARN}}
+	body, _, err := lambda.REST(ctx, http.MethodGet, "/2015-03-31/event-source-mappings/?"+query.Encode(), nil)
+	if err != nil {
+		return []Result{fail(check, fmt.Sprintf("failed to list event source mappings: %v", err), "grant lambda:ListEventSourceMappings to whoever runs doctor")}
+	}
+	var output struct {
+		EventSourceMappings []struct {
+			UUID                  string
+			State                 string
+			StateTransitionReason string
+			LastProcessingResult  string
+		}
+	}
+	if err := json.Unmarshal(body, &output); err != nil {
+		return []Result{fail(check, fmt.Sprintf("failed to read event source mappings: %v", err), "")}
+	}
+
+	createFix := fmt.Sprintf("deploy infrastructure/template.yaml, or run `aws lambda create-event-source-mapping --function-name %s --event-source-arn %s --starting-position LATEST`", function.Name, streamARN)
+	if len(output.EventSourceMappings) == 0 {
+		return []Result{fail(check, "nothing reads the stream, so realtime alerts and forwarding never run", createFix)}
+	}
+	mapping := output.EventSourceMappings[0]
+	switch {
+	case mapping.State != "Enabled":
+		return []Result{fail(check, fmt.Sprintf("the event source mapping is %s: %s", mapping.State, mapping.StateTransitionReason),
+			fmt.Sprintf("run `aws lambda update-event-source-mapping --uuid %s --enabled`", mapping.UUID))}
+	case strings.HasPrefix(mapping.LastProcessingResult, "PROBLEM"):
+		return []Result{fail(check, "the last batch failed: "+mapping.LastProcessingResult,
+			"the function's role needs the stream read permissions in AWSLambdaDynamoDBExecutionRole")}
+	}
+	return []Result{pass(check, "enabled, last result: "+mapping.LastProcessingResult)}
+}
+
+// Sender checks that SES can send alert and account email from the
+// configured address
+func Sender(ctx context.Context, ses *sesv2.Client, from string) []Result {
+	var results []Result
+
+	account, err := ses.GetAccount(ctx, &sesv2.GetAccountInput{})
+	switch {
+	case err != nil:
+		results = append(results, fail("SES account", fmt.Sprintf("failed to read the SES account: %v", err), "grant ses:GetAccount to whoever runs doctor"))
+	case !account.SendingEnabled:
+		results = append(results, fail("SES account", "sending is paused for this account in this region", "see the SES console's account dashboard for why"))
+	case !account.ProductionAccessEnabled:
+		results = append(results, fail("SES account", "the account is in the SES sandbox, so email only reaches verified addresses",
+			"verify each recipient with `aws sesv2 create-email-identity`, or request production access in the SES console"))
+	default:
+		results = append(results, pass("SES account", "sending enabled, out of the sandbox"))
+	}
+
+	check := "SES sender"
+	if from == "" {
+		return append(results, pass(check, "TINYTAIL_ALERT_FROM_EMAIL is not set; each alert is sent from its recipient, which must be verified"))
+	}
+	check += " " + from
+	problem, err := SenderProblem(ctx, ses, from)
+	switch {
+	case err != nil:
+		results = append(results, fail(check, err.Error(), "grant ses:GetEmailIdentity to whoever runs doctor"))
+	case problem != "":
+		results = append(results, fail(check, problem,
+			fmt.Sprintf("verify it with `aws sesv2 create-email-identity --email-identity %s` and follow the link SES sends, or change ALERT_FROM_EMAIL", from)))
+	default:
+		results = append(results, pass(check, "verified"))
+	}
+	return results
+}
+
+// SenderProblem returns why from can't send, or "" if it can. The address
+// is verified if either it or its domain is a verified identity.
+func SenderProblem(ctx context.Context, ses *sesv2.Client, from string) (string, error) {
+	identities := []string{from}
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		identities = append(identities, from[at+1:])
+	}
+	for _, identity := range identities {
+		output, err := ses.GetEmailIdentity(ctx, &sesv2.GetEmailIdentityInput{EmailIdentity: aws.String(identity)})
+		var notFound *sesTypes.NotFoundException
+		if errors.As(err, &notFound) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to look up SES identity %s: %w", identity, err)
+		}
+		if output.VerifiedForSendingStatus {
+			return "", nil
+		}
+		return fmt.Sprintf("SES identity %s is not verified yet", identity), nil
+	}
+	return fmt.Sprintf("%s is not an SES identity", from), nil
+}
+
+// schedule is one of the EventBridge schedules template.yaml creates,
+// told apart by the action in its input
+type schedule struct {
+	action      string
+	description string
+	required    bool
+}
+
+// Schedules checks that EventBridge invokes the function for scheduled
+// alert evaluation and maintenance, and for the digest if it is configured
+func Schedules(ctx context.Context, events *awsapi.Client, function *Function) []Result {
+	expected := []schedule{
+		{action: "", description: "alert evaluation", required: true},
+		{action: "maintenance", description: "maintenance", required: true},
+		{action: "digest", description: "daily digest", required: function.Environment["TINYTAIL_DIGEST_EMAIL"] != ""},
+	}
+
+	var names struct{ RuleNames []string }
+	err := events.JSON(ctx, "AWSEvents.ListRuleNamesByTarget", map[string]string{"TargetArn": function.ARN}, &names)
+	if err != nil {
+		return []Result{fail("schedules", fmt.Sprintf("failed to list EventBridge rules: %v", err),
+			"grant events:ListRuleNamesByTarget, events:DescribeRule and events:ListTargetsByRule to whoever runs doctor")}
+	}
+
+	// Each rule's state and schedule, by the action its input asks for
+	type found struct {
+		rule, state, expression string
+	}
+	byAction := map[string]found{}
+	for _, name := range names.RuleNames {
+		var rule struct {
+			State              string
+			ScheduleExpression string
+		}
+		if err := events.JSON(ctx, "AWSEvents.DescribeRule", map[string]string{"Name": name}, &rule); err != nil {
+			return []Result{fail("schedules", fmt.Sprintf("failed to describe rule %s: %v", name, err), "grant events:DescribeRule to whoever runs doctor")}
+		}
+		if rule.ScheduleExpression == "" {
+			continue // Not a schedule, e.g. an event pattern someone added
+		}
+		var targets struct {
+			Targets []struct{ Arn, Input string }
+		}
+		if err := events.JSON(ctx, "AWSEvents.ListTargetsByRule", map[string]string{"Rule": name}, &targets); err != nil {
+			return []Result{fail("schedules", fmt.Sprintf("failed to list targets of rule %s: %v", name, err), "grant events:ListTargetsByRule to whoever runs doctor")}
+		}
+		for _, target := range targets.Targets {
+			if target.Arn != function.ARN {
+				continue
+			}
+			var input struct {
+				Detail struct {
+					Action string `json:"action"`
+				} `json:"detail"`
+			}
+			_ = json.Unmarshal([]byte(target.Input), &input)
+			byAction[input.Detail.Action] = found{rule: name, state: rule.State, expression: rule.ScheduleExpression}
+		}
+	}
+
+	var results []Result
+	for _, want := range expected {
+		check := "schedule: " + want.description
+		got, ok := byAction[want.action]
+		switch {
+		case !ok && want.required:
+			results = append(results, fail(check, "no EventBridge schedule invokes the function for it", "deploy infrastructure/template.yaml, which creates the schedules"))
+		case !ok:
+			results = append(results, pass(check, "not configured"))
+		case got.state != "ENABLED" && want.required:
+			results = append(results, fail(check, fmt.Sprintf("rule %s is %s", got.rule, got.state), fmt.Sprintf("run `aws events enable-rule --name %s`", got.rule)))
+		default:
+			results = append(results, pass(check, fmt.Sprintf("rule %s, %s, %s", got.rule, got.expression, got.state)))
+		}
+	}
+	return results
+}
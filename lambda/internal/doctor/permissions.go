@@ -0,0 +1,188 @@
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesTypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/tinytail/tinytail/internal/awsapi"
+	"github.com/tinytail/tinytail/internal/config"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// probeKey is the key of the item the permission checks ask for. It never
+// exists, so conditional writes to it fail their condition without
+// changing anything.
+const probeKey = "tinytail-doctor-probe"
+
+// permissionFix is the fix for any permission the function's role lacks
+const permissionFix = "deploy infrastructure/template.yaml, or add the action to the function's role"
+
+// Permissions makes a harmless call with each action the function uses,
+// reporting those its credentials are denied. It runs inside the function,
+// so it checks the function's own role. Writes are conditional on the
+// probe item existing, so they are checked without writing anything.
+func Permissions(ctx context.Context, awsConfig aws.Config, db *dynamodb.Client, cfg *config.Config) []Result {
+	var results []Result
+	for _, schema := range store.Schemas(cfg.Tables) {
+		if cfg.Handler.NoAuth && schema.Name == cfg.Tables.Sessions {
+			continue
+		}
+		results = append(results, tablePermissions(ctx, db, schema)...)
+	}
+
+	for _, queue := range []string{cfg.IngestDLQ.URL, cfg.Forwarding.URL} {
+		if queue == "" {
+			continue
+		}
+		_, err := sqs.NewFromConfig(awsConfig).GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queue),
+			AttributeNames: []sqsTypes.QueueAttributeName{sqsTypes.QueueAttributeNameApproximateNumberOfMessages},
+		})
+		results = append(results, permission("sqs:GetQueueAttributes on "+queue[strings.LastIndex(queue, "/")+1:], err))
+	}
+
+	if from := os.Getenv("TINYTAIL_ALERT_FROM_EMAIL"); from != "" {
+		_, err := sesv2.NewFromConfig(awsConfig).GetEmailIdentity(ctx, &sesv2.GetEmailIdentityInput{EmailIdentity: aws.String(from)})
+		var notFound *sesTypes.NotFoundException
+		if errors.As(err, &notFound) {
+			err = nil // Allowed to look; the sender check reports the rest
+		}
+		results = append(results, permission("ses:GetEmailIdentity", err))
+	}
+	return results
+}
+
+// tablePermissions checks every DynamoDB action TinyTail uses on a table
+func tablePermissions(ctx context.Context, db *dynamodb.Client, schema store.TableSchema) []Result {
+	key := map[string]types.AttributeValue{schema.HashKey: &types.AttributeValueMemberS{Value: probeKey}}
+	if schema.RangeKey != "" {
+		key[schema.RangeKey] = &types.AttributeValueMemberS{Value: probeKey}
+	}
+	table := aws.String(schema.Name)
+	exists := aws.String("attribute_exists(#key)")
+	names := map[string]string{"#key": schema.HashKey}
+	keyEquals := aws.String("#key = :key")
+	keyValue := map[string]types.AttributeValue{":key": &types.AttributeValueMemberS{Value: probeKey}}
+
+	check := func(action string, call func() error) Result {
+		err := call()
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			err = nil // Allowed, and nothing was written
+		}
+		return permission(fmt.Sprintf("dynamodb:%s on %s", action, schema.Name), err)
+	}
+
+	results := []Result{
+		check("GetItem", func() error {
+			_, err := db.GetItem(ctx, &dynamodb.GetItemInput{TableName: table, Key: key})
+			return err
+		}),
+		check("BatchGetItem", func() error {
+			_, err := db.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{schema.Name: {Keys: []map[string]types.AttributeValue{key}}},
+			})
+			return err
+		}),
+		check("Query", func() error {
+			_, err := db.Query(ctx, &dynamodb.QueryInput{TableName: table, KeyConditionExpression: keyEquals,
+				ExpressionAttributeNames: names, ExpressionAttributeValues: keyValue, Limit: aws.Int32(1)})
+			return err
+		}),
+		check("Scan", func() error {
+			_, err := db.Scan(ctx, &dynamodb.ScanInput{TableName: table, Limit: aws.Int32(1)})
+			return err
+		}),
+		check("PutItem", func() error {
+			_, err := db.PutItem(ctx, &dynamodb.PutItemInput{TableName: table, Item: key,
+				ConditionExpression: exists, ExpressionAttributeNames: names})
+			return err
+		}),
+		check("UpdateItem", func() error {
+			_, err := db.UpdateItem(ctx, &dynamodb.UpdateItemInput{TableName: table, Key: key,
+				UpdateExpression: aws.String("REMOVE doctor_probe"), ConditionExpression: exists, ExpressionAttributeNames: names})
+			return err
+		}),
+		check("DeleteItem", func() error {
+			_, err := db.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: table, Key: key,
+				ConditionExpression: exists, ExpressionAttributeNames: names})
+			return err
+		}),
+		// Deleting an item that doesn't exist changes nothing
+		check("BatchWriteItem", func() error {
+			_, err := db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{schema.Name: {{DeleteRequest: &types.DeleteRequest{Key: key}}}},
+			})
+			return err
+		}),
+		check("DescribeTable", func() error {
+			_, err := db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: table})
+			return err
+		}),
+	}
+
+	if schema.TTLAttribute != "" {
+		results = append(results, check("DescribeTimeToLive", func() error {
+			_, err := db.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: table})
+			return err
+		}))
+	}
+	for _, index := range schema.Indexes {
+		indexNames := map[string]string{"#key": index.HashKey}
+		results = append(results, check("Query ("+index.Name+")", func() error {
+			_, err := db.Query(ctx, &dynamodb.QueryInput{TableName: table, IndexName: aws.String(index.Name), KeyConditionExpression: keyEquals,
+				ExpressionAttributeNames: indexNames, ExpressionAttributeValues: keyValue, Limit: aws.Int32(1)})
+			return err
+		}))
+	}
+	return results
+}
+
+// permission turns the outcome of a dry-run call into a result. Only a
+// denial fails the check; other errors are reported, since they mean the
+// permission couldn't be checked.
+func permission(check string, err error) Result {
+	var apiErr smithy.APIError
+	switch {
+	case err == nil:
+		return pass(check, "allowed")
+	case errors.As(err, &apiErr) && strings.Contains(apiErr.ErrorCode(), "AccessDenied"):
+		return fail(check, "denied: "+apiErr.ErrorMessage(), permissionFix)
+	default:
+		return fail(check, "could not check: "+err.Error(), "")
+	}
+}
+
+// RemotePermissions invokes the deployed function to run Permissions with
+// its own role
+func RemotePermissions(ctx context.Context, lambda *awsapi.Client, function *Function) []Result {
+	check := "invoke " + function.Name
+	body, header, err := lambda.REST(ctx, http.MethodPost, "/2015-03-31/functions/"+url.PathEscape(function.Name)+"/invocations",
+		map[string]string{"action": "doctor"})
+	if err != nil {
+		return []Result{fail(check, err.Error(), "grant lambda:InvokeFunction to whoever runs doctor")}
+	}
+	if header.Get("X-Amz-Function-Error") != "" {
+		return []Result{fail(check, "the function failed: "+string(body), "see the function's logs")}
+	}
+
+	var results []Result
+	if err := json.Unmarshal(body, &results); err != nil || len(results) == 0 {
+		return []Result{fail(check, "the function did not run the checks", "deploy the current version of TinyTail")}
+	}
+	return results
+}
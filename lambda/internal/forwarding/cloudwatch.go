@@ -0,0 +1,168 @@
+package forwarding
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/tinytail/tinytail/internal/awsapi"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// CloudWatch Logs limits on what one PutLogEvents call takes: each event
+// counts its message plus 26 bytes towards the batch size
+const (
+	maxLogEventBatchBytes = 1 << 20
+	maxLogEventBatchCount = 10000
+	logEventOverhead      = 26
+)
+
+// maxLogEventMessage leaves room within an event's 256KB for the entry's
+// other fields; longer messages are cut short
+const maxLogEventMessage = 200 * 1024
+
+// LogGroupPattern is what CloudWatch Logs accepts as a log group name
+var LogGroupPattern = regexp.MustCompile(`^[\.\-_/#A-Za-z0-9]{1,512}$`)
+
+// logStreamUnsafe matches the characters log stream names can't contain
+var logStreamUnsafe = regexp.MustCompile(`[:*]`)
+
+// errLogStreamMissing is returned by putLogEvents when the stream needs
+// creating first
+var errLogStreamMissing = errors.New("log stream does not exist")
+
+// CloudWatchLogs writes entries to log groups, calling the CloudWatch Logs
+// API with the function's credentials
+type CloudWatchLogs struct {
+	api *awsapi.Client
+}
+
+// NewCloudWatchLogs creates a writer for the configured region's endpoint
+func NewCloudWatchLogs(config aws.Config) *CloudWatchLogs {
+	return &CloudWatchLogs{api: awsapi.New(config, "logs", "", deliveryTimeout)}
+}
+
+// logEvent is one CloudWatch Logs event: the entry as JSON, so metric
+// filters and Contributor Insights can pick out its fields, e.g.
+// { $.level = "ERROR" }
+type logEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// Put writes entries to a log group, in one log stream per source. A stream
+// is created the first time it's written to; the group must already exist.
+// Entries CloudWatch Logs refuses for their age are logged and skipped.
+func (c *CloudWatchLogs) Put(ctx context.Context, group string, entries []store.LogEntry) error {
+	streams := map[string][]logEvent{}
+	for _, entry := range entries {
+		event, err := newLogEvent(entry)
+		if err != nil {
+			return err
+		}
+		stream := logStreamName(entry.Source)
+		streams[stream] = append(streams[stream], event)
+	}
+
+	for stream, events := range streams {
+		// Events in a call must be in time order
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp < events[j].Timestamp })
+		for len(events) > 0 {
+			n, size := 0, 0
+			for n < len(events) && n < maxLogEventBatchCount && size+len(events[n].Message)+logEventOverhead <= maxLogEventBatchBytes {
+				size += len(events[n].Message) + logEventOverhead
+				n++
+			}
+			if err := c.putCreatingStream(ctx, group, stream, events[:n]); err != nil {
+				return fmt.Errorf("log group %s: %w", group, err)
+			}
+			events = events[n:]
+		}
+	}
+	return nil
+}
+
+func newLogEvent(entry store.LogEntry) (logEvent, error) {
+	if len(entry.Message) > maxLogEventMessage {
+		entry.Message = strings.ToValidUTF8(entry.Message[:maxLogEventMessage], "") + " [truncated]"
+	}
+	entry.Cursor = ""
+	message, err := json.Marshal(entry)
+	if err != nil {
+		return logEvent{}, err
+	}
+	timestamp := entry.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return logEvent{Timestamp: timestamp.UnixMilli(), Message: string(message)}, nil
+}
+
+// logStreamName names the stream for a source
+func logStreamName(source string) string {
+	if source == "" {
+		source = "unknown"
+	}
+	name := logStreamUnsafe.ReplaceAllString(source, "_")
+	if len(name) > 512 {
+		name = name[:512]
+	}
+	return name
+}
+
+func (c *CloudWatchLogs) putCreatingStream(ctx context.Context, group, stream string, events []logEvent) error {
+	err := c.putLogEvents(ctx, group, stream, events)
+	if !errors.Is(err, errLogStreamMissing) {
+		return err
+	}
+	err = c.api.JSON(ctx, "Logs_20140328.CreateLogStream", map[string]string{"logGroupName": group, "logStreamName": stream}, nil)
+	var apiErr *awsapi.Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Type == "ResourceAlreadyExistsException") {
+		return err
+	}
+	return c.putLogEvents(ctx, group, stream, events)
+}
+
+func (c *CloudWatchLogs) putLogEvents(ctx context.Context, group, stream string, events []logEvent) error {
+	var result struct {
+		Rejected *struct {
+			TooNewLogEventStartIndex *int `json:"tooNewLogEventStartIndex"`
+			TooOldLogEventEndIndex   *int `json:"tooOldLogEventEndIndex"`
+			ExpiredLogEventEndIndex  *int `json:"expiredLogEventEndIndex"`
+		} `json:"rejectedLogEventsInfo"`
+	}
+	err := c.api.JSON(ctx, "Logs_20140328.PutLogEvents", map[string]any{
+		"logGroupName":  group,
+		"logStreamName": stream,
+		"logEvents":     events,
+	}, &result)
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.Type == "ResourceNotFoundException" && strings.Contains(apiErr.Message, "stream") {
+		return errLogStreamMissing
+	}
+	if err != nil {
+		return err
+	}
+
+	if result.Rejected != nil {
+		args := []any{"log_group", group, "log_stream", stream}
+		for name, index := range map[string]*int{
+			"too_new_from": result.Rejected.TooNewLogEventStartIndex,
+			"too_old_to":   result.Rejected.TooOldLogEventEndIndex,
+			"expired_to":   result.Rejected.ExpiredLogEventEndIndex,
+		} {
+			if index != nil {
+				args = append(args, name, *index)
+			}
+		}
+		slog.WarnContext(ctx, "CloudWatch Logs rejected forwarded entries for their timestamps", args...)
+	}
+	return nil
+}
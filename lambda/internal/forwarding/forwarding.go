@@ -0,0 +1,366 @@
+// Package forwarding relays new log entries to external HTTP endpoints,
+// such as a SIEM, or to CloudWatch Logs groups as they arrive on the logs
+// table's stream. Each forwarding rule picks the entries it wants; a
+// delivery that keeps failing can wait in an SQS queue for another attempt
+// instead of being lost.
+package forwarding
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/tinytail/tinytail/internal/logging"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// DefaultMaxAttempts is how many times a queued delivery is tried before it
+// is dropped, unless TINYTAIL_FORWARD_DLQ_MAX_ATTEMPTS says otherwise
+const DefaultMaxAttempts = 5
+
+// SignatureHeader carries the HMAC-SHA256 of each delivery, in the same
+// t=<unix seconds>,v1=<hex> format TinyTail accepts on signed ingest
+const SignatureHeader = "X-TinyTail-Signature"
+
+// retryDelays are the pauses between attempts at a delivery while the
+// stream batch is being handled; after the last one it is queued
+var retryDelays = []time.Duration{500 * time.Millisecond, 2 * time.Second}
+
+// deliveryTimeout bounds each request to an endpoint
+const deliveryTimeout = 5 * time.Second
+
+// rulesReload is how long rules are cached between stream batches, so
+// changes take up to this long to reach every instance
+const rulesReload = time.Minute
+
+// Config locates the retry queue
+type Config struct {
+	URL         string
+	MaxAttempts int
+}
+
+// ConfigFromEnv reads TINYTAIL_FORWARD_DLQ_URL and
+// TINYTAIL_FORWARD_DLQ_MAX_ATTEMPTS. An empty URL means no queue:
+// deliveries that still fail after the immediate retries are dropped.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{URL: os.Getenv("TINYTAIL_FORWARD_DLQ_URL"), MaxAttempts: DefaultMaxAttempts}
+	if value := os.Getenv("TINYTAIL_FORWARD_DLQ_MAX_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("TINYTAIL_FORWARD_DLQ_MAX_ATTEMPTS must be a positive whole number, got %q", value)
+		}
+		cfg.MaxAttempts = n
+	}
+	return cfg, nil
+}
+
+// Forwarder delivers entries to the endpoints of the rules they match. A
+// nil Forwarder forwards nothing.
+type Forwarder struct {
+	rules  *store.ForwardingRuleStore
+	client *http.Client
+	logs   *CloudWatchLogs
+	queue  *sqs.Client
+	config Config
+	health *store.HealthCounters
+
+	mu       sync.Mutex
+	cached   []store.ForwardingRule
+	loadedAt time.Time
+}
+
+// NewForwarder creates a forwarder; queue may be nil when config has no URL
+func NewForwarder(rules *store.ForwardingRuleStore, logs *CloudWatchLogs, queue *sqs.Client, config Config, health *store.HealthCounters) *Forwarder {
+	return &Forwarder{
+		rules:  rules,
+		client: &http.Client{Timeout: deliveryTimeout},
+		logs:   logs,
+		queue:  queue,
+		config: config,
+		health: health,
+	}
+}
+
+// Delivery is the JSON body POSTed to a rule's endpoint, and what's queued
+// for either kind of rule
+type Delivery struct {
+	RuleID  string           `json:"rule_id"`
+	Rule    string           `json:"rule"`
+	Entries []store.LogEntry `json:"entries"`
+}
+
+// queued is the body of a queued delivery
+type queued struct {
+	Delivery
+	Reason   string    `json:"reason"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// Forward sends each rule's matching entries to its endpoint, one request
+// per rule, all rules at once. A delivery that fails is retried briefly and
+// then queued. Nothing is returned: a failed stream batch would be handed
+// back whole, forwarding the entries again and re-running realtime alerts.
+// TinyTail's own entries are never forwarded, so an endpoint that is down
+// can't keep producing entries about itself.
+func (f *Forwarder) Forward(ctx context.Context, entries []store.LogEntry) {
+	if f == nil || len(entries) == 0 {
+		return
+	}
+	rules, err := f.loadRules(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load forwarding rules; entries were not forwarded", "entries", len(entries), "error", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range rules {
+		rule := &rules[i]
+		delivery := Delivery{RuleID: rule.ID, Rule: rule.Name}
+		for _, entry := range entries {
+			if entry.Source != logging.SelfIngestSource && rule.Matches(entry) {
+				delivery.Entries = append(delivery.Entries, entry)
+			}
+		}
+		if len(delivery.Entries) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.forward(ctx, rule, delivery)
+		}()
+	}
+	wg.Wait()
+}
+
+// forward delivers to one rule's endpoint, queueing the delivery if the
+// retries fail too
+func (f *Forwarder) forward(ctx context.Context, rule *store.ForwardingRule, delivery Delivery) {
+	err := f.deliver(ctx, rule, delivery)
+	for _, delay := range retryDelays {
+		if err == nil || !hasTimeFor(ctx, delay) {
+			break
+		}
+		time.Sleep(delay)
+		err = f.deliver(ctx, rule, delivery)
+	}
+	if err == nil {
+		f.count(rule, "delivered", len(delivery.Entries))
+		return
+	}
+
+	if f.queue == nil {
+		slog.ErrorContext(ctx, "Dropping forwarded log entries after repeated failures",
+			"rule_id", rule.ID, "destination", destination(rule), "entries", len(delivery.Entries), "error", err)
+		f.drop(rule.ID, len(delivery.Entries))
+		return
+	}
+	if queueErr := f.enqueue(ctx, delivery, err); queueErr != nil {
+		slog.ErrorContext(ctx, "Dropping forwarded log entries that could not be queued",
+			"rule_id", rule.ID, "destination", destination(rule), "entries", len(delivery.Entries), "error", err, "queue_error", queueErr)
+		f.drop(rule.ID, len(delivery.Entries))
+		return
+	}
+	slog.WarnContext(ctx, "Failed to forward log entries, queued for retry",
+		"rule_id", rule.ID, "destination", destination(rule), "entries", len(delivery.Entries), "error", err)
+	f.count(rule, "queued", len(delivery.Entries))
+}
+
+// hasTimeFor reports whether there's time to wait before another attempt
+// and still finish it before ctx's deadline
+func hasTimeFor(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > delay+deliveryTimeout+store.TimeBudgetReserve
+}
+
+// deliver writes a delivery to the rule's log group, or POSTs it to the
+// rule's endpoint signed with the rule's secret. Any response other than
+// 2xx is a failure.
+func (f *Forwarder) deliver(ctx context.Context, rule *store.ForwardingRule, delivery Delivery) error {
+	if rule.LogGroup != "" {
+		return f.logs.Put(ctx, rule.LogGroup, delivery.Entries)
+	}
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rule.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range rule.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TinyTail-Forwarder")
+	req.Header.Set(SignatureHeader, Sign(rule.Secret, body, time.Now()))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(snippet)))
+	}
+	return nil
+}
+
+// Sign returns the signature header value for a delivery body: the
+// HMAC-SHA256, keyed with the secret, of "<unix seconds>.<body>"
+func Sign(secret string, body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *Forwarder) enqueue(ctx context.Context, delivery Delivery, cause error) error {
+	body, err := json.Marshal(queued{Delivery: delivery, Reason: cause.Error(), QueuedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = f.queue.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(f.config.URL),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
+
+// IsSource reports whether an SQS event source ARN is the retry queue. The
+// ARN ends with the queue name, as the URL does.
+func (f *Forwarder) IsSource(arn string) bool {
+	if f == nil || f.queue == nil {
+		return false
+	}
+	name := f.config.URL[strings.LastIndex(f.config.URL, "/")+1:]
+	return name != "" && strings.HasSuffix(arn, ":"+name)
+}
+
+// Redeliver tries queued deliveries again. Those that fail are reported
+// back so SQS redelivers them after the visibility timeout; once one has
+// been tried MaxAttempts times, or its rule has been deleted, it is
+// dropped, logged in full and counted so self-monitoring can report it.
+func (f *Forwarder) Redeliver(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+	var response events.SQSEventResponse
+	delivered, dropped := 0, 0
+
+	rules, err := f.loadRules(ctx)
+	if err != nil {
+		// Every message comes back later, when the rules can be read
+		slog.ErrorContext(ctx, "Failed to load forwarding rules for queued deliveries", "error", err)
+		for _, record := range event.Records {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+		return response
+	}
+
+	for _, record := range event.Records {
+		var message queued
+		if err := json.Unmarshal([]byte(record.Body), &message); err != nil {
+			// Retrying won't make it readable
+			slog.ErrorContext(ctx, "Dropping unreadable forwarding queue message", "message_id", record.MessageId, "error", err)
+			f.drop("", 1)
+			dropped++
+			continue
+		}
+
+		rule := findRule(rules, message.RuleID)
+		if rule == nil {
+			slog.ErrorContext(ctx, "Dropping queued log entries for a deleted forwarding rule",
+				"message_id", record.MessageId, "rule_id", message.RuleID, "entries", message.Entries)
+			f.drop(message.RuleID, len(message.Entries))
+			dropped++
+			continue
+		}
+
+		err := f.deliver(ctx, rule, message.Delivery)
+		if err == nil {
+			f.count(rule, "delivered", len(message.Entries))
+			delivered++
+			continue
+		}
+
+		attempts, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+		if attempts >= f.config.MaxAttempts {
+			slog.ErrorContext(ctx, "Dropping queued log entries after repeated forwarding failures",
+				"message_id", record.MessageId, "rule_id", rule.ID, "destination", destination(rule), "attempts", attempts,
+				"queued_at", message.QueuedAt, "first_error", message.Reason, "error", err, "entries", message.Entries)
+			f.drop(rule.ID, len(message.Entries))
+			dropped++
+			continue
+		}
+
+		slog.WarnContext(ctx, "Failed to forward queued log entries, will retry",
+			"message_id", record.MessageId, "rule_id", rule.ID, "attempts", attempts, "error", err)
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+	}
+
+	slog.InfoContext(ctx, "Retried queued forwarding deliveries", "delivered", delivered,
+		"retrying", len(response.BatchItemFailures), "dropped", dropped)
+	return response
+}
+
+// destination describes where a rule sends entries, for logs
+func destination(rule *store.ForwardingRule) string {
+	if rule.LogGroup != "" {
+		return "log-group:" + rule.LogGroup
+	}
+	return rule.URL
+}
+
+func findRule(rules []store.ForwardingRule, id string) *store.ForwardingRule {
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// loadRules returns the rules, reading them again once the cached copy is
+// older than rulesReload
+func (f *Forwarder) loadRules(ctx context.Context) ([]store.ForwardingRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cached != nil && time.Since(f.loadedAt) < rulesReload {
+		return f.cached, nil
+	}
+	rules, err := f.rules.ForwardingRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.cached, f.loadedAt = rules, time.Now()
+	return rules, nil
+}
+
+// count adds forwarded entries to the rollup for the rule and outcome
+func (f *Forwarder) count(rule *store.ForwardingRule, outcome string, n int) {
+	f.health.AddRollup(store.RollupSeries(store.RollupForwardedEntries, "rule", rule.ID, "outcome", outcome), float64(n))
+}
+
+// drop counts entries given up on, for the rollup and self-monitoring
+func (f *Forwarder) drop(ruleID string, n int) {
+	f.health.Add(store.CounterForwardDropped, n)
+	if ruleID != "" {
+		f.health.AddRollup(store.RollupSeries(store.RollupForwardedEntries, "rule", ruleID, "outcome", "dropped"), float64(n))
+	}
+}
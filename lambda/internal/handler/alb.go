@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DefaultALBHealthCheckPath is where target group health checks are answered
+// unless TINYTAIL_ALB_HEALTH_CHECK_PATH says otherwise
+const DefaultALBHealthCheckPath = "/health"
+
+// ALBHealthCheckPathFromEnv returns the path ALB health checks use
+func ALBHealthCheckPathFromEnv() string {
+	if path := os.Getenv("TINYTAIL_ALB_HEALTH_CHECK_PATH"); path != "" {
+		return path
+	}
+	return DefaultALBHealthCheckPath
+}
+
+// HandleALB serves requests from an Application Load Balancer target group
+// by translating them to and from the API Gateway shape. Target groups with
+// multi-value headers enabled send (and expect back) only the multi-value
+// fields; others send single values and can only set one cookie.
+func (h *Handler) HandleALB(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
+	multiValue := request.MultiValueHeaders != nil || request.MultiValueQueryStringParameters != nil
+
+	// Health checks come from the load balancer itself, so they skip the
+	// allowlists and need no credentials
+	if request.Path == h.config.ALBHealthCheckPath {
+		response, _ := jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+		return albResponse(response, multiValue), nil
+	}
+
+	response, err := h.Handle(ctx, restRequestFromALB(request))
+	return albResponse(response, multiValue), err
+}
+
+// restRequestFromALB maps an ALB request onto the REST API request shape.
+// ALB passes query parameters still URL-encoded and has no source IP field:
+// the client address is the last X-Forwarded-For entry, added by the load
+// balancer.
+func restRequestFromALB(request events.ALBTargetGroupRequest) events.APIGatewayProxyRequest {
+	headers := request.Headers
+	multiHeaders := request.MultiValueHeaders
+	if multiHeaders != nil {
+		headers = make(map[string]string, len(multiHeaders))
+		for name, values := range multiHeaders {
+			if len(values) == 0 {
+				continue
+			}
+			separator := ", "
+			if strings.EqualFold(name, "cookie") {
+				separator = "; "
+			}
+			headers[name] = strings.Join(values, separator)
+		}
+	} else {
+		multiHeaders = make(map[string][]string, len(headers))
+		for name, value := range headers {
+			multiHeaders[name] = []string{value}
+		}
+	}
+
+	multiQuery := map[string][]string{}
+	for name, values := range request.MultiValueQueryStringParameters {
+		for _, value := range values {
+			multiQuery[albUnescape(name)] = append(multiQuery[albUnescape(name)], albUnescape(value))
+		}
+	}
+	if request.MultiValueQueryStringParameters == nil {
+		for name, value := range request.QueryStringParameters {
+			multiQuery[albUnescape(name)] = []string{albUnescape(value)}
+		}
+	}
+	var query map[string]string
+	if len(multiQuery) > 0 {
+		query = make(map[string]string, len(multiQuery))
+		for name, values := range multiQuery {
+			query[name] = values[len(values)-1]
+		}
+	} else {
+		multiQuery = nil
+	}
+
+	sourceIP := ""
+	if forwarded := headers["x-forwarded-for"]; forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		sourceIP = strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	return events.APIGatewayProxyRequest{
+		Path:                            request.Path,
+		HTTPMethod:                      request.HTTPMethod,
+		Headers:                         headers,
+		MultiValueHeaders:               multiHeaders,
+		QueryStringParameters:           query,
+		MultiValueQueryStringParameters: multiQuery,
+		Body:                            request.Body,
+		IsBase64Encoded:                 request.IsBase64Encoded,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			HTTPMethod: request.HTTPMethod,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  sourceIP,
+				UserAgent: headers["user-agent"],
+			},
+		},
+	}
+}
+
+func albUnescape(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// albResponse converts a REST API response for the load balancer, in the
+// header mode the target group uses. Without multi-value headers only one
+// Set-Cookie can be sent; the first is kept, since that is the session
+// cookie when signing in.
+func albResponse(response events.APIGatewayProxyResponse, multiValue bool) events.ALBTargetGroupResponse {
+	converted := events.ALBTargetGroupResponse{
+		StatusCode:        response.StatusCode,
+		StatusDescription: fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+		Body:              response.Body,
+		IsBase64Encoded:   response.IsBase64Encoded,
+	}
+
+	headers := map[string][]string{}
+	for name, value := range response.Headers {
+		headers[name] = append(headers[name], value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		headers[name] = append(headers[name], values...)
+	}
+
+	if multiValue {
+		converted.MultiValueHeaders = headers
+		return converted
+	}
+	converted.Headers = make(map[string]string, len(headers))
+	for name, values := range headers {
+		if strings.EqualFold(name, "Set-Cookie") {
+			converted.Headers[name] = values[0]
+			continue
+		}
+		converted.Headers[name] = strings.Join(values, ", ")
+	}
+	return converted
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Allowlist restricts requests to a set of source CIDR ranges. An empty
+// Allowlist allows every address.
+type Allowlist []netip.Prefix
+
+// ParseAllowlist parses a comma-separated list of CIDRs or single addresses,
+// e.g. "10.0.0.0/16, 203.0.113.7".
+func ParseAllowlist(value string) (Allowlist, error) {
+	var list Allowlist
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+			}
+			list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		list = append(list, prefix.Masked())
+	}
+	return list, nil
+}
+
+// Allows reports whether the source IP falls in one of the ranges.
+// Unparseable addresses are rejected unless the list is empty.
+func (l Allowlist) Allows(sourceIP string) bool {
+	if len(l) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(sourceIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// requireRole wraps handlers that need at least the given role, accepting
+// either a session cookie or an API key in an Authorization: Bearer header
+func (h *Handler) requireRole(ctx context.Context, request events.APIGatewayProxyRequest, role string, handler func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	checked := func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if session := currentSession(ctx); session == nil || !store.RoleAllows(session.Role, role) {
+			return jsonResponse(http.StatusForbidden, map[string]string{"error": fmt.Sprintf("Requires the %s role", role)})
+		}
+		return handler(ctx, request)
+	}
+
+	authHeader := request.Headers["authorization"]
+	if authHeader == "" {
+		authHeader = request.Headers["Authorization"]
+	}
+
+	// With an authorizer in front, the Authorization header carries its
+	// token rather than an API key
+	token, hasBearer := strings.CutPrefix(authHeader, "Bearer ")
+	if !hasBearer || (h.config.Authorizer.Enabled && authorizerClaims(request) != nil) {
+		return h.requireAuth(ctx, request, checked)
+	}
+
+	key, err := h.apiKeyStore.ValidateAPIKey(ctx, token)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to validate API key", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to validate API key"})
+	}
+	if key == nil {
+		recordAuthFailure(ctx, authMethodAPIKey)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Invalid API key"})
+	}
+
+	session := &store.Session{Username: "api-key:" + key.KeyID, Role: key.Role}
+	return checked(withSession(ctx, session), request)
+}
+
+func (h *Handler) listAPIKeys(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	keys, err := h.apiKeyStore.ListAPIKeys(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list API keys", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list API keys"})
+	}
+
+	// Ingest keys are listed on their own
+	apiKeys := []store.APIKey{}
+	for _, key := range keys {
+		if key.Role != store.RoleIngest {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	return jsonResponse(http.StatusOK, apiKeys)
+}
+
+func (h *Handler) createAPIKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var createReq struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &createReq); err != nil || strings.TrimSpace(createReq.Name) == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "name is required"})
+	}
+
+	role := createReq.Role
+	if role == "" {
+		role = store.RoleReadOnly
+	}
+	if !store.ValidRole(role) {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": invalidRoleMessage})
+	}
+
+	key, fullKey, err := h.apiKeyStore.CreateAPIKey(ctx, strings.TrimSpace(createReq.Name), role, currentSession(ctx).Username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create API key", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create API key"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditAPIKeyCreate, Target: key.KeyID, Detail: key.Name + " (" + key.Role + ")"})
+
+	// The full key is only ever returned here
+	return jsonResponse(http.StatusCreated, struct {
+		*store.APIKey
+		Key string `json:"key"`
+	}{key, fullKey})
+}
+
+func (h *Handler) revokeAPIKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var revokeReq struct {
+		KeyID string `json:"key_id"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &revokeReq); err != nil || revokeReq.KeyID == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "key_id is required"})
+	}
+
+	err := h.apiKeyStore.RevokeAPIKey(ctx, revokeReq.KeyID)
+	if errors.Is(err, store.ErrAPIKeyNotFound) {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "API key not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to revoke API key", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke API key"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditAPIKeyRevoke, Target: revokeReq.KeyID})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"key_id": revokeReq.KeyID, "revoked": true})
+}
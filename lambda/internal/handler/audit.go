@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// audit records an action in the audit log. The actor defaults to the
+// signed-in user. A failure to record is logged but never fails the request.
+func (h *Handler) audit(ctx context.Context, request events.APIGatewayProxyRequest, event store.AuditEvent) {
+	if event.Actor == "" {
+		if session := currentSession(ctx); session != nil {
+			event.Actor = session.Username
+		}
+	}
+	event.SourceIP = request.RequestContext.Identity.SourceIP
+
+	// Every rejected sign-in is audited, so it is counted here too
+	if event.Action == store.AuditLoginFailed || event.Action == store.AuditPasswordChangeFailed {
+		recordAuthFailure(ctx, authMethodLogin)
+	}
+
+	if err := h.auditStore.Record(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit event", "action", event.Action, "actor", event.Actor, "error", err)
+		h.recordStoreError(err)
+	}
+}
+
+// listAuditEvents returns audit events, newest first. Optional query
+// parameters: actor, action, since and until (RFC3339), before (cursor from a
+// previous page) and limit.
+func (h *Handler) listAuditEvents(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	params := request.QueryStringParameters
+	filter := store.AuditFilter{
+		Actor:  params["actor"],
+		Action: params["action"],
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := params[name]; value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid %s format. Use RFC3339", name)})
+			}
+			*dst = parsed
+		}
+	}
+
+	limit := 100
+	if limitStr := params["limit"]; limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+		limit = parsed
+	}
+
+	auditEvents, nextCursor, err := h.auditStore.ListAuditEvents(ctx, filter, params["before"], limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list audit events", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list audit events"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditAuditLogRead})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{
+		"events":      auditEvents,
+		"next_cursor": nextCursor,
+	})
+}
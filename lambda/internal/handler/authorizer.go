@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// errAuthorizerDenied is returned for authorizer identities that map to no
+// role, or to a disabled TinyTail user.
+var errAuthorizerDenied = errors.New("authorizer identity not allowed")
+
+// AuthorizerConfig controls trusting identities verified by an API Gateway
+// authorizer (Cognito user pool or Lambda authorizer) in place of a TinyTail
+// session.
+type AuthorizerConfig struct {
+	Enabled bool
+
+	UsernameClaim string // Claim holding the TinyTail username
+	GroupsClaim   string // Claim holding the caller's groups
+
+	// GroupRoles maps groups to roles; the most privileged match wins.
+	// DefaultRole applies when no group matches, and empty denies access.
+	GroupRoles  map[string]string
+	DefaultRole string
+}
+
+// AuthorizerConfigFromEnv reads TINYTAIL_TRUST_AUTHORIZER and, when it is
+// "true", the claim names and the group-to-role mapping
+// (TINYTAIL_AUTHORIZER_GROUP_ROLES, e.g. "ops=admin,dev=read-write").
+func AuthorizerConfigFromEnv() (AuthorizerConfig, error) {
+	config := AuthorizerConfig{
+		Enabled:       os.Getenv("TINYTAIL_TRUST_AUTHORIZER") == "true",
+		UsernameClaim: os.Getenv("TINYTAIL_AUTHORIZER_USERNAME_CLAIM"),
+		GroupsClaim:   os.Getenv("TINYTAIL_AUTHORIZER_GROUPS_CLAIM"),
+		GroupRoles:    map[string]string{},
+		DefaultRole:   os.Getenv("TINYTAIL_AUTHORIZER_DEFAULT_ROLE"),
+	}
+	if !config.Enabled {
+		return config, nil
+	}
+
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "email"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "cognito:groups"
+	}
+	if config.DefaultRole != "" && !store.ValidRole(config.DefaultRole) {
+		return config, fmt.Errorf("TINYTAIL_AUTHORIZER_DEFAULT_ROLE: unknown role %q", config.DefaultRole)
+	}
+
+	for _, mapping := range strings.Split(os.Getenv("TINYTAIL_AUTHORIZER_GROUP_ROLES"), ",") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(mapping, "=")
+		if !ok || strings.TrimSpace(group) == "" || !store.ValidRole(strings.TrimSpace(role)) {
+			return config, fmt.Errorf("TINYTAIL_AUTHORIZER_GROUP_ROLES: invalid mapping %q (want group=role)", mapping)
+		}
+		config.GroupRoles[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+
+	return config, nil
+}
+
+// authorizerClaims returns the claims API Gateway passed along from its
+// authorizer, or nil if the request wasn't authorized by one. Cognito
+// authorizers nest them under "claims"; Lambda authorizers put their context
+// at the top level next to principalId.
+func authorizerClaims(request events.APIGatewayProxyRequest) map[string]interface{} {
+	authorizer := request.RequestContext.Authorizer
+	if len(authorizer) == 0 {
+		return nil
+	}
+	if claims, ok := authorizer["claims"].(map[string]interface{}); ok {
+		return claims
+	}
+	return authorizer
+}
+
+// authorizerSession builds a session for an identity verified by an API
+// Gateway authorizer. It returns nil when trusting authorizers is disabled
+// or the request carries no claims. A TinyTail user with the same username
+// keeps their own role and can be disabled as usual; anyone else gets the
+// role mapped from their groups.
+func (h *Handler) authorizerSession(ctx context.Context, request events.APIGatewayProxyRequest) (*store.Session, error) {
+	if !h.config.Authorizer.Enabled {
+		return nil, nil
+	}
+	claims := authorizerClaims(request)
+	if claims == nil {
+		return nil, nil
+	}
+
+	username := claimString(claims[h.config.Authorizer.UsernameClaim])
+	if username == "" {
+		username = claimString(request.RequestContext.Authorizer["principalId"])
+	}
+	if username == "" {
+		return nil, nil
+	}
+
+	user, err := h.userStore.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		if user.Disabled {
+			return nil, errAuthorizerDenied
+		}
+		return &store.Session{Username: user.Username, Role: user.Role}, nil
+	}
+
+	role := h.config.Authorizer.DefaultRole
+	for _, group := range claimList(claims[h.config.Authorizer.GroupsClaim]) {
+		if mapped, ok := h.config.Authorizer.GroupRoles[group]; ok && (role == "" || store.RoleAllows(mapped, role)) {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return nil, errAuthorizerDenied
+	}
+
+	return &store.Session{Username: username, Role: role}, nil
+}
+
+func claimString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(value))
+}
+
+// claimList reads a multi-valued claim. API Gateway flattens Cognito group
+// lists to strings such as "[ops dev]" or "ops,dev".
+func claimList(value interface{}) []string {
+	if items, ok := value.([]interface{}); ok {
+		var list []string
+		for _, item := range items {
+			list = append(list, claimString(item))
+		}
+		return list
+	}
+
+	s := strings.Trim(claimString(value), "[]")
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Credential is a shared secret held only as its SHA-256 digest, so the
+// plaintext never has to be configured on the function.
+type Credential struct {
+	digest []byte
+
+	// signingKey checks signed ingest requests (see store.IngestSigningKey);
+	// nil if the credential can't sign
+	signingKey []byte
+}
+
+// NewCredential parses a hex-encoded SHA-256 digest.
+func NewCredential(hexDigest string) (*Credential, error) {
+	digest, err := hex.DecodeString(strings.TrimSpace(hexDigest))
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("not a hex-encoded SHA-256 digest")
+	}
+	return &Credential{digest: digest}, nil
+}
+
+// CredentialFromEnv reads a credential from hashVar (hex SHA-256 of the
+// secret), falling back to the plaintext plainVar for older deployments.
+// It returns nil if neither is set.
+func CredentialFromEnv(plainVar, hashVar string) (*Credential, error) {
+	if hexDigest := os.Getenv(hashVar); hexDigest != "" {
+		credential, err := NewCredential(hexDigest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hashVar, err)
+		}
+		return credential, nil
+	}
+
+	if plain := os.Getenv(plainVar); plain != "" {
+		sum := sha256.Sum256([]byte(plain))
+		return &Credential{digest: sum[:], signingKey: store.IngestSigningKey(plain)}, nil
+	}
+
+	return nil, nil
+}
+
+// setSigningKey parses the hex-encoded key the credential's ingest requests
+// are signed with
+func (c *Credential) setSigningKey(hexKey string) error {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil || len(key) != sha256.Size {
+		return fmt.Errorf("not a hex-encoded signing key")
+	}
+	c.signingKey = key
+	return nil
+}
+
+// Matches reports whether candidate is the secret. Digests are compared in
+// constant time so response timing doesn't leak how much of a guess was
+// right. A nil Credential matches nothing.
+func (c *Credential) Matches(candidate string) bool {
+	if c == nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(candidate))
+	return subtle.ConstantTimeCompare(sum[:], c.digest) == 1
+}
+
+// DefaultIngestSecretID identifies the secret configured through
+// TINYTAIL_INGEST_SECRET_SHA256.
+const DefaultIngestSecretID = "default"
+
+// IngestSecret is one of the bearer tokens accepted for ingestion. Producers
+// can be moved to a new secret one at a time, and a leaked secret removed
+// without touching the others.
+type IngestSecret struct {
+	ID         string
+	Credential *Credential
+	Expires    time.Time // Zero means no expiry
+
+	// Env is the environment its entries are stored in; empty is the default
+	Env string
+
+	// Label is an ingest key's name, stamped on the entries sent with it;
+	// configured secrets have none
+	Label string
+}
+
+// IngestSecrets is the set of accepted ingest secrets.
+type IngestSecrets []IngestSecret
+
+// IngestSecretsFromEnv reads the default ingest secret (see
+// CredentialFromEnv) and any additional ones from TINYTAIL_INGEST_SECRETS,
+// a JSON array of {"id", "sha256", "signing_key", "expires", "env"} objects
+// with expires in RFC3339 and optional. Without env, entries go to the
+// default environment. A secret configured by its digest can only sign
+// requests with its signing_key, or TINYTAIL_INGEST_SIGNING_KEY for the
+// default secret.
+func IngestSecretsFromEnv() (IngestSecrets, error) {
+	var secrets IngestSecrets
+
+	credential, err := CredentialFromEnv("TINYTAIL_INGEST_SECRET", "TINYTAIL_INGEST_SECRET_SHA256")
+	if err != nil {
+		return nil, err
+	}
+	if credential != nil {
+		if signingKey := os.Getenv("TINYTAIL_INGEST_SIGNING_KEY"); signingKey != "" {
+			if err := credential.setSigningKey(signingKey); err != nil {
+				return nil, fmt.Errorf("TINYTAIL_INGEST_SIGNING_KEY: %w", err)
+			}
+		}
+		secrets = append(secrets, IngestSecret{ID: DefaultIngestSecretID, Credential: credential})
+	}
+
+	raw := strings.TrimSpace(os.Getenv("TINYTAIL_INGEST_SECRETS"))
+	if raw == "" {
+		return secrets, nil
+	}
+
+	var configured []struct {
+		ID         string `json:"id"`
+		SHA256     string `json:"sha256"`
+		SigningKey string `json:"signing_key"`
+		Expires    string `json:"expires"`
+		Env        string `json:"env"`
+	}
+	if err := json.Unmarshal([]byte(raw), &configured); err != nil {
+		return nil, fmt.Errorf("TINYTAIL_INGEST_SECRETS: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for _, s := range secrets {
+		seen[s.ID] = true
+	}
+	for _, c := range configured {
+		if c.ID == "" || seen[c.ID] {
+			return nil, fmt.Errorf("TINYTAIL_INGEST_SECRETS: every secret needs a unique id (got %q)", c.ID)
+		}
+		seen[c.ID] = true
+
+		credential, err := NewCredential(c.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("TINYTAIL_INGEST_SECRETS %s: %w", c.ID, err)
+		}
+		if c.SigningKey != "" {
+			if err := credential.setSigningKey(c.SigningKey); err != nil {
+				return nil, fmt.Errorf("TINYTAIL_INGEST_SECRETS %s: %w", c.ID, err)
+			}
+		}
+
+		secret := IngestSecret{ID: c.ID, Credential: credential, Env: c.Env}
+		if c.Expires != "" {
+			if secret.Expires, err = time.Parse(time.RFC3339, c.Expires); err != nil {
+				return nil, fmt.Errorf("TINYTAIL_INGEST_SECRETS %s: invalid expires: %w", c.ID, err)
+			}
+		}
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+// Match returns the secret the token belongs to, or nil. Every secret is
+// checked so the time taken doesn't depend on which one matched. Expired
+// secrets are still returned; callers check Expired.
+func (s IngestSecrets) Match(token string) *IngestSecret {
+	var matched *IngestSecret
+	for i := range s {
+		if s[i].Credential.Matches(token) && matched == nil {
+			matched = &s[i]
+		}
+	}
+	return matched
+}
+
+// Expired reports whether the secret has passed its expiry time.
+func (s *IngestSecret) Expired(now time.Time) bool {
+	return !s.Expires.IsZero() && now.After(s.Expires)
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// dropRulesReload is how long a container keeps the drop rules it read, so
+// changes take up to this long to reach every container
+const dropRulesReload = time.Minute
+
+// dropRuleCache holds the drop rules between ingest requests, so checking
+// them doesn't cost a read per request
+type dropRuleCache struct {
+	mu       sync.Mutex
+	cached   []store.DropRule
+	loadedAt time.Time
+}
+
+// forget makes the next request read the rules again, so a change made in
+// this container applies here at once
+func (c *dropRuleCache) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cached = nil
+}
+
+// loadDropRules returns the drop rules, reading them again once the cached
+// copy is older than dropRulesReload. If they can't be read, entries are
+// kept: the last rules read go on being used, or none.
+func (h *Handler) loadDropRules(ctx context.Context) []store.DropRule {
+	if h.dropRules == nil {
+		return nil
+	}
+	c := &h.dropRuleCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached != nil && time.Since(c.loadedAt) < dropRulesReload {
+		return c.cached
+	}
+	rules, err := h.dropRules.DropRules(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read drop rules", "error", err)
+		h.recordStoreError(err)
+		return c.cached
+	}
+	c.cached, c.loadedAt = rules, time.Now()
+	return rules
+}
+
+// dropTally counts the entries each drop rule drops during a request
+type dropTally map[string]int
+
+// drops reports whether one of the rules drops the entry, counting it
+// against the first that does
+func (t dropTally) drops(rules []store.DropRule, entry *store.LogEntry) bool {
+	for i := range rules {
+		if rules[i].Matches(*entry) {
+			t[rules[i].ID]++
+			return true
+		}
+	}
+	return false
+}
+
+// total is how many entries were dropped
+func (t dropTally) total() int {
+	total := 0
+	for _, n := range t {
+		total += n
+	}
+	return total
+}
+
+// recordDropped adds the dropped entries to the rollups, by rule, and to the
+// DroppedEntries metric
+func (h *Handler) recordDropped(tally dropTally) {
+	for id, n := range tally {
+		h.health.AddRollup(store.RollupSeries(store.RollupDroppedEntries, "rule", id), float64(n))
+	}
+	total := tally.total()
+	if total == 0 {
+		return
+	}
+	metrics.Emit(nil,
+		metrics.Metric{Name: "DroppedEntries", Unit: metrics.Count, Value: float64(total)})
+}
+
+// dropRulesUnavailable answers drop rule requests when there's nowhere to
+// keep the rules
+func dropRulesUnavailable() (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusServiceUnavailable, map[string]string{"error": "Drop rules are kept in the alerts table, which does not exist"})
+}
+
+func (h *Handler) listDropRules(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.dropRules == nil {
+		return dropRulesUnavailable()
+	}
+	rules, err := h.dropRules.DropRules(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list drop rules", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list drop rules"})
+	}
+
+	// The totals are a nice-to-have; the rules are listed without them if
+	// the rollups can't be read
+	totals, err := h.health.Rollups(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read dropped entry totals", "error", err)
+	}
+	type listedRule struct {
+		store.DropRule
+		Dropped float64 `json:"dropped"`
+	}
+	listed := make([]listedRule, len(rules))
+	for i, rule := range rules {
+		listed[i] = listedRule{rule, totals[store.RollupSeries(store.RollupDroppedEntries, "rule", rule.ID)]}
+	}
+
+	return jsonResponse(http.StatusOK, listed)
+}
+
+func (h *Handler) createDropRule(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.dropRules == nil {
+		return dropRulesUnavailable()
+	}
+	var createReq struct {
+		Name    string   `json:"name"`
+		Levels  []string `json:"levels"`
+		Sources []string `json:"sources"`
+		Pattern string   `json:"pattern"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &createReq); err != nil || strings.TrimSpace(createReq.Name) == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "name is required"})
+	}
+	// A rule without filters would drop everything
+	if len(createReq.Levels) == 0 && len(createReq.Sources) == 0 && createReq.Pattern == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "give at least one of levels, sources or pattern"})
+	}
+
+	rule := &store.DropRule{
+		Name:      strings.TrimSpace(createReq.Name),
+		Levels:    createReq.Levels,
+		Sources:   createReq.Sources,
+		Pattern:   createReq.Pattern,
+		CreatedBy: currentSession(ctx).Username,
+	}
+	if err := h.dropRules.CreateDropRule(ctx, rule); err != nil {
+		slog.ErrorContext(ctx, "Failed to create drop rule", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create drop rule"})
+	}
+	h.dropRuleCache.forget()
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditDropRuleCreate, Target: rule.ID, Detail: rule.Name})
+
+	return jsonResponse(http.StatusCreated, rule)
+}
+
+func (h *Handler) deleteDropRule(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.dropRules == nil {
+		return dropRulesUnavailable()
+	}
+	var deleteReq struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &deleteReq); err != nil || deleteReq.ID == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "id is required"})
+	}
+
+	err := h.dropRules.DeleteDropRule(ctx, deleteReq.ID)
+	if errors.Is(err, store.ErrDropRuleNotFound) {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Drop rule not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to delete drop rule", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to delete drop rule"})
+	}
+	h.dropRuleCache.forget()
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditDropRuleDelete, Target: deleteReq.ID})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"id": deleteReq.ID, "deleted": true})
+}
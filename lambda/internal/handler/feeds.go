@@ -0,0 +1,330 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// DefaultFeedTokenTTL is how long a feed URL works before a new one is
+// needed
+const DefaultFeedTokenTTL = 90 * 24 * time.Hour
+
+// The errors feed covers this much time, with at most this many entries
+// and alerts each
+const (
+	feedPeriod     = 24 * time.Hour
+	feedMaxEntries = 50
+)
+
+// FeedTokens signs the tokens in feed URLs. Feed readers can't sign in,
+// so the URL itself carries the credential; rotating the key invalidates
+// every feed URL at once.
+type FeedTokens struct {
+	key []byte
+	ttl time.Duration
+}
+
+type feedTokenClaims struct {
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+// FeedTokensFromEnv returns nil, turning feeds off, unless TINYTAIL_FEED_KEY
+// is set (hex, at least 32 bytes). TINYTAIL_FEED_TOKEN_DAYS sets how long
+// feed URLs last.
+func FeedTokensFromEnv() (*FeedTokens, error) {
+	raw := os.Getenv("TINYTAIL_FEED_KEY")
+	if raw == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(raw)
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("TINYTAIL_FEED_KEY must be at least 32 hex-encoded bytes")
+	}
+
+	ttl := DefaultFeedTokenTTL
+	if raw := os.Getenv("TINYTAIL_FEED_TOKEN_DAYS"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days <= 0 || days > 365 {
+			return nil, fmt.Errorf("TINYTAIL_FEED_TOKEN_DAYS must be between 1 and 365, got %q", raw)
+		}
+		ttl = time.Duration(days) * 24 * time.Hour
+	}
+
+	return &FeedTokens{key: key, ttl: ttl}, nil
+}
+
+// Issue returns a signed token for the user and when it expires
+func (f *FeedTokens) Issue(username string, now time.Time) (string, time.Time, error) {
+	expires := now.Add(f.ttl)
+	payload, err := json.Marshal(feedTokenClaims{Subject: username, Expires: expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to encode feed token claims: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + f.sign(encoded), expires, nil
+}
+
+// Verify returns the claims of a genuine, unexpired token, or nil
+func (f *FeedTokens) Verify(token string, now time.Time) *feedTokenClaims {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(f.sign(payload))) {
+		return nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	var claims feedTokenClaims
+	if err := json.Unmarshal(decoded, &claims); err != nil || claims.Subject == "" || now.Unix() >= claims.Expires {
+		return nil
+	}
+	return &claims
+}
+
+// sign is keyed separately from anything else so a feed token can't be
+// passed off as another kind of token
+func (f *FeedTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte("feed." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// createFeedToken returns the signed-in user's errors feed URL. Feeds
+// belong to user accounts, so disabling the account stops its feeds.
+func (h *Handler) createFeedToken(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.config.FeedTokens == nil {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Feeds are not enabled"})
+	}
+
+	username := currentSession(ctx).Username
+	user, err := h.userStore.GetUser(ctx, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create feed URL"})
+	}
+	if user == nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Feed URLs are only available to user accounts"})
+	}
+
+	token, expires, err := h.config.FeedTokens.Issue(user.Username, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to issue feed token", "error", err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create feed URL"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditFeedTokenCreate, Target: "errors.atom"})
+
+	return jsonResponse(http.StatusCreated, map[string]interface{}{
+		"url":        h.publicBaseURL(request) + "/feeds/errors.atom?token=" + url.QueryEscape(token),
+		"expires_at": expires.UTC(),
+	})
+}
+
+// Atom feed elements, as much of RFC 4287 as the errors feed uses
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID       string       `xml:"id"`
+	Title    string       `xml:"title"`
+	Updated  string       `xml:"updated"`
+	Category atomCategory `xml:"category"`
+	Link     *atomLink    `xml:"link,omitempty"`
+	Content  atomContent  `xml:"content"`
+
+	at time.Time
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// serveErrorsFeed answers feed readers with the default environment's
+// ERROR entries and the alerts sent over the last day, newest first. The
+// token in the URL stands in for a session; it is checked against the
+// user account it was issued to on every fetch.
+func (h *Handler) serveErrorsFeed(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.config.FeedTokens == nil {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Feeds are not enabled"})
+	}
+
+	claims := h.config.FeedTokens.Verify(request.QueryStringParameters["token"], time.Now())
+	if claims == nil {
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired feed token"})
+	}
+	user, err := h.userStore.GetUser(ctx, claims.Subject)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to read feed"})
+	}
+	if user == nil || user.Disabled {
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired feed token"})
+	}
+
+	now := time.Now()
+	base := h.publicBaseURL(request)
+	var entries []atomEntry
+
+	found := 0
+	err = h.logStore.EachLogNewestFirst(ctx, now.Add(-feedPeriod), now, func(entry store.LogEntry) bool {
+		if nearDeadline(ctx) {
+			slog.WarnContext(ctx, "Ran out of time reading logs for the errors feed", "read_to", entry.Timestamp)
+			return false
+		}
+		if !strings.EqualFold(entry.Level, "ERROR") {
+			return true
+		}
+		entries = append(entries, errorFeedEntry(base, entry))
+		found++
+		return found < feedMaxEntries
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read logs for the errors feed", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to read feed"})
+	}
+
+	alerts, err := h.alertHistory.Recent(ctx, now.Add(-feedPeriod))
+	if err != nil {
+		// The entries are still worth showing
+		slog.WarnContext(ctx, "Failed to read alert history for the errors feed", "error", err)
+		h.recordStoreError(err)
+	}
+	for _, alert := range alerts {
+		entries = append(entries, alertFeedEntry(base, alert))
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at.After(entries[j].at) })
+	updated := now
+	if len(entries) > 0 {
+		updated = entries[0].at
+	}
+
+	feed := atomFeed{
+		ID:      base + "/feeds/errors.atom",
+		Title:   "TinyTail errors",
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "TinyTail"},
+		Links:   []atomLink{{Href: base + "/"}},
+		Entries: entries,
+	}
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode errors feed", "error", err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to read feed"})
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":  "application/atom+xml; charset=utf-8",
+			"Cache-Control": "private, max-age=60",
+		},
+		Body: xml.Header + string(body),
+	}, nil
+}
+
+// errorFeedEntry describes an ERROR entry, linking to the minute around it
+// in the UI
+func errorFeedEntry(base string, entry store.LogEntry) atomEntry {
+	sum := sha256.Sum256([]byte(entry.Timestamp.Format(time.RFC3339Nano) + "\x00" + entry.Source + "\x00" + entry.Message))
+	title, _, _ := strings.Cut(entry.Message, "\n")
+	if entry.Source != "" {
+		title = entry.Source + ": " + title
+	}
+
+	content := entry.Message
+	if entry.RequestID != "" {
+		content += "\n\nrequest_id: " + entry.RequestID
+	}
+
+	return atomEntry{
+		ID:       "urn:tinytail:log:" + hex.EncodeToString(sum[:16]),
+		Title:    truncateFeedTitle(title),
+		Updated:  entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		Category: atomCategory{Term: "error"},
+		Link:     feedLink(base, entry.RequestID, entry.Timestamp.Add(-30*time.Second), entry.Timestamp.Add(30*time.Second)),
+		Content:  atomContent{Type: "text", Text: content},
+		at:       entry.Timestamp,
+	}
+}
+
+// alertFeedEntry describes a sent alert, linking to the entries it counted
+func alertFeedEntry(base string, alert store.FiredAlert) atomEntry {
+	title := fmt.Sprintf("Alert %s: %d matches in %s", alert.RuleID, alert.Matches, alert.Window)
+	content := fmt.Sprintf("%d entries matched %q between %s and %s.",
+		alert.Matches, alert.Pattern, alert.Since.UTC().Format(time.RFC3339), alert.FiredAt.UTC().Format(time.RFC3339))
+
+	return atomEntry{
+		ID:       fmt.Sprintf("urn:tinytail:alert:%s:%d", url.PathEscape(alert.RuleID), alert.FiredAt.UnixNano()),
+		Title:    truncateFeedTitle(title),
+		Updated:  alert.FiredAt.UTC().Format(time.RFC3339Nano),
+		Category: atomCategory{Term: "alert"},
+		Link:     feedLink(base, alert.Pattern, alert.Since, alert.FiredAt),
+		Content:  atomContent{Type: "text", Text: content},
+		at:       alert.FiredAt,
+	}
+}
+
+// feedLink opens the UI on a search over a time range, as alert emails do
+func feedLink(base, pattern string, since, until time.Time) *atomLink {
+	query := url.Values{}
+	if pattern != "" {
+		query.Set("q", pattern)
+	}
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	// Round up so entries from the final second are included
+	query.Set("until", until.UTC().Add(time.Second).Format(time.RFC3339))
+	return &atomLink{Href: base + "/?" + query.Encode()}
+}
+
+func truncateFeedTitle(title string) string {
+	if len(title) <= 120 {
+		return title
+	}
+	return strings.ToValidUTF8(title[:117], "") + "..."
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Amazon Data Firehose delivers to an HTTP endpoint by posting each buffer
+// of records as {"requestId", "timestamp", "records": [{"data": base64}]},
+// with the endpoint's access key in X-Amz-Firehose-Access-Key. It counts
+// the delivery done only on a 200 echoing the request's ID, and otherwise
+// retries until its retry duration runs out and backs the records up to
+// S3.
+
+// firehoseRequest is the body of a delivery
+type firehoseRequest struct {
+	RequestID string `json:"requestId"`
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+	Records   []struct {
+		Data string `json:"data"`
+	} `json:"records"`
+}
+
+// ingestFirehose stores the records of a Firehose delivery. Each record is
+// read as RecordEntries does, so a stream may carry entries as JSON lines,
+// plain text, or a CloudWatch Logs subscription's batches. A delivery can
+// hold thousands of entries, so they're written in batches. Firehose sends
+// the whole delivery again, with the same request ID, if any of it fails,
+// so the entries are stabilized by it and a retry overwrites what the
+// first attempt stored.
+func (h *Handler) ingestFirehose(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var delivery firehoseRequest
+	err := json.Unmarshal([]byte(request.Body), &delivery)
+	requestID := cmp.Or(delivery.RequestID, requestHeader(request, "X-Amz-Firehose-Request-Id"))
+	if err != nil {
+		return firehoseResponse(http.StatusBadRequest, requestID, "Invalid JSON")
+	}
+
+	secret := h.authenticateFirehose(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodFirehose)
+		return firehoseResponse(http.StatusUnauthorized, requestID, "Unauthorized")
+	}
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(secret.Env)
+	if !ok {
+		return firehoseResponse(http.StatusBadRequest, requestID, fmt.Sprintf("Unknown environment %q", secret.Env))
+	}
+
+	// The destination's common attributes may name the source
+	var attributes struct {
+		CommonAttributes map[string]string `json:"commonAttributes"`
+	}
+	_ = json.Unmarshal([]byte(requestHeader(request, "X-Amz-Firehose-Common-Attributes")), &attributes)
+	source := cmp.Or(attributes.CommonAttributes["source"], "firehose")
+
+	var entries []store.LogEntry
+	for i, record := range delivery.Records {
+		data, err := base64.StdEncoding.DecodeString(record.Data)
+		if err != nil {
+			return firehoseResponse(http.StatusBadRequest, requestID, fmt.Sprintf("Record %d is not base64", i))
+		}
+		found, err := RecordEntries(data, source)
+		if err != nil {
+			return firehoseResponse(http.StatusBadRequest, requestID, fmt.Sprintf("Record %d: %v", i, err))
+		}
+		entries = append(entries, found...)
+	}
+	secret.stamp(entries)
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		response, err := firehoseResponse(http.StatusTooManyRequests, requestID, "Rate limit exceeded")
+		return withRetryAfter(response, wait), err
+	}
+
+	if requestID != "" {
+		if err := h.stabilize(ctx, logStore, secret.Env, secret, "firehose/"+requestID, entries); err != nil {
+			slog.ErrorContext(ctx, "Failed to record Firehose delivery", "error", err)
+			return firehoseResponse(http.StatusInternalServerError, requestID, "Failed to store log")
+		}
+	}
+	if err := h.IngestBatch(ctx, secret.Env, entries); err != nil {
+		slog.ErrorContext(ctx, "Failed to store Firehose delivery", "error", err)
+		return firehoseResponse(http.StatusInternalServerError, requestID, "Failed to store log")
+	}
+	if len(entries) > 0 {
+		recordIngest(len(entries), len(request.Body))
+	}
+	return firehoseResponse(http.StatusOK, requestID, "")
+}
+
+// firehoseResponse answers as Firehose requires: the request's ID and the
+// time, with an error message unless the records were stored
+func firehoseResponse(status int, requestID, errorMessage string) (events.APIGatewayProxyResponse, error) {
+	body := map[string]any{"requestId": requestID, "timestamp": time.Now().UnixMilli()}
+	if errorMessage != "" {
+		body["errorMessage"] = errorMessage
+	}
+	return jsonResponse(status, body)
+}
+
+// authenticateFirehose returns the ingest secret or key configured as the
+// destination's access key, or nil. Firehose can't sign requests, so
+// nothing is accepted when signatures are required.
+func (h *Handler) authenticateFirehose(ctx context.Context, request events.APIGatewayProxyRequest) *IngestSecret {
+	if h.config.IngestSignature.Required {
+		slog.WarnContext(ctx, "Rejected Firehose request because ingest signatures are required")
+		return nil
+	}
+	key := requestHeader(request, "X-Amz-Firehose-Access-Key")
+	if key == "" {
+		return nil
+	}
+
+	secret := h.matchIngestSecret(ctx, key)
+	if secret == nil {
+		return nil
+	}
+	if secret.Expired(time.Now()) {
+		slog.WarnContext(ctx, "Rejected Firehose request using an expired secret", "secret_id", secret.ID)
+		return nil
+	}
+	return secret
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// FireLens routes an ECS task's container output through Fluent Bit, whose
+// http output posts each chunk of records as a JSON array (or, with
+// format json_lines or json_stream, one record after another). Records
+// carry the line as "log" and its stream as "source", plus the task's
+// metadata: ecs_cluster, ecs_task_arn, ecs_task_definition, container_name
+// and container_id.
+
+// firelensMetadata are the record keys FireLens adds, kept as fields under
+// shorter names
+var firelensMetadata = map[string]string{
+	"ecs_cluster":         "cluster",
+	"ecs_task_arn":        "task",
+	"ecs_task_definition": "task_definition",
+	"container_name":      "container",
+	"source":              "stream",
+}
+
+// firelensLevel finds a level written as a word in a line
+var firelensLevel = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL)\b`)
+
+// ingestFireLens stores the records Fluent Bit posts from a FireLens log
+// router. It authenticates like /logs/ingest; there is no batch limit, as
+// Fluent Bit can't split a chunk.
+func (h *Handler) ingestFireLens(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(secret.Env)
+	if !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", secret.Env)})
+	}
+	records, err := parseFireLensRecords(request.Body)
+	if err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	source := request.QueryStringParameters["source"]
+	entries := make([]store.LogEntry, len(records))
+	for i, record := range records {
+		entries[i] = fireLensEntry(record, source)
+	}
+	secret.stamp(entries)
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	queued, stored, err := h.storeEntries(ctx, logStore, secret.Env, entries)
+	if err != nil {
+		return jsonResponse(http.StatusInternalServerError, map[string]any{"error": "Failed to store log", "stored": stored})
+	}
+	recordIngest(len(entries), len(request.Body))
+
+	if queued > 0 {
+		return jsonResponse(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// parseFireLensRecords reads a JSON array of records, or records one after
+// another, whether one per line or not
+func parseFireLensRecords(body string) ([]map[string]any, error) {
+	var records []map[string]any
+	if body = strings.TrimSpace(body); strings.HasPrefix(body, "[") {
+		err := json.Unmarshal([]byte(body), &records)
+		return records, err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	for {
+		var record map[string]any
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+}
+
+// fireLensEntry turns a record into an entry. The source is the container
+// name, unless the request names one, and the logger the task definition's
+// family. The cluster, task, container and stream, and any keys a Fluent
+// Bit parser added, are appended to the message as key=value fields. A line
+// that is itself a JSON object, as structured loggers write, is read as if
+// a parser had added its keys.
+func fireLensEntry(record map[string]any, source string) store.LogEntry {
+	timestamp := fireLensTime(record["date"])
+	if line, ok := record["log"].(string); ok && strings.HasPrefix(strings.TrimSpace(line), "{") {
+		var logged map[string]any
+		if err := json.Unmarshal([]byte(line), &logged); err == nil && logged != nil {
+			delete(record, "log")
+			for _, name := range []string{"timestamp", "time", "ts"} {
+				if t := fireLensTime(logged[name]); !t.IsZero() {
+					timestamp = t
+					delete(logged, name)
+					break
+				}
+			}
+			for key, value := range logged {
+				// The task's metadata is FireLens's to say
+				if _, ok := record[key]; !ok {
+					record[key] = value
+				}
+			}
+		}
+	}
+
+	text := func(name string) string {
+		value, ok := record[name]
+		if !ok {
+			return ""
+		}
+		delete(record, name)
+		if s, ok := value.(string); ok {
+			return s
+		}
+		return fmt.Sprint(value)
+	}
+
+	entry := store.LogEntry{
+		Message:   strings.TrimRight(cmp.Or(text("log"), text("message"), text("msg")), "\r\n"),
+		Level:     text("level"),
+		RequestID: cmp.Or(text("request_id"), text("trace_id")),
+		Timestamp: timestamp,
+	}
+	delete(record, "date")
+	delete(record, "container_id")
+
+	fields := map[string]string{}
+	for key, name := range firelensMetadata {
+		if value := text(key); value != "" {
+			fields[name] = value
+		}
+	}
+	// Standard output is the usual case, so only stderr is marked
+	if fields["stream"] == "stdout" {
+		delete(fields, "stream")
+	}
+	// ARNs are long and say little more than their last part
+	if cluster, ok := fields["cluster"]; ok {
+		fields["cluster"] = cluster[strings.LastIndex(cluster, "/")+1:]
+	}
+	if task, ok := fields["task"]; ok {
+		fields["task"] = task[strings.LastIndex(task, "/")+1:]
+	}
+	family, _, _ := strings.Cut(fields["task_definition"], ":")
+
+	entry.Source = cmp.Or(source, fields["container"], family, "firelens")
+	entry.Logger = cmp.Or(text("logger"), family)
+	entry.Level = lineLevel(entry.Level, entry.Message)
+
+	// Whatever a parser left in the record is kept too
+	for key, value := range record {
+		if s, ok := value.(string); ok {
+			fields[key] = s
+		} else if encoded, err := json.Marshal(value); err == nil {
+			fields[key] = string(encoded)
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var message strings.Builder
+	message.WriteString(entry.Message)
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&message, " %s=%s", name, value)
+	}
+	entry.Message = strings.TrimPrefix(message.String(), " ")
+	return entry
+}
+
+// lineLevel normalizes a record's level, or without one finds the first
+// level named in its message
+func lineLevel(level, message string) string {
+	if level == "" {
+		level = firelensLevel.FindString(message)
+	}
+	switch level = strings.ToUpper(level); level {
+	case "WARNING":
+		return "WARN"
+	case "CRITICAL":
+		return "FATAL"
+	}
+	return level
+}
+
+// fireLensTime reads Fluent Bit's date key: Unix seconds with a fraction by
+// default, Unix milliseconds with json_date_format epoch_ms, or a string
+// with iso8601 or java_sql_timestamp, which is UTC
+func fireLensTime(value any) time.Time {
+	switch date := value.(type) {
+	case float64:
+		// Seconds won't reach 1e11 until the year 5138
+		if date >= 1e11 {
+			return time.UnixMilli(int64(date))
+		}
+		seconds, fraction := math.Modf(date)
+		return time.Unix(int64(seconds), int64(fraction*1e9))
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, date); err == nil {
+			return t
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05.999999999", date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/forwarding"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// forwardingUnavailable answers forwarding rule requests when there's
+// nowhere to keep the rules
+func forwardingUnavailable() (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusServiceUnavailable, map[string]string{"error": "Forwarding rules are kept in the alerts table, which does not exist"})
+}
+
+func (h *Handler) listForwardingRules(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.forwardingRules == nil {
+		return forwardingUnavailable()
+	}
+	rules, err := h.forwardingRules.ForwardingRules(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list forwarding rules", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list forwarding rules"})
+	}
+
+	return jsonResponse(http.StatusOK, rules)
+}
+
+func (h *Handler) createForwardingRule(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.forwardingRules == nil {
+		return forwardingUnavailable()
+	}
+	var createReq struct {
+		Name     string            `json:"name"`
+		URL      string            `json:"url"`
+		LogGroup string            `json:"log_group"`
+		Levels   []string          `json:"levels"`
+		Sources  []string          `json:"sources"`
+		Pattern  string            `json:"pattern"`
+		Headers  map[string]string `json:"headers"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &createReq); err != nil || strings.TrimSpace(createReq.Name) == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "name is required"})
+	}
+	// Each rule sends to one place: an HTTP endpoint or a log group
+	destination := createReq.LogGroup
+	switch {
+	case (createReq.URL == "") == (createReq.LogGroup == ""):
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "give either url or log_group"})
+	case createReq.LogGroup != "":
+		if !forwarding.LogGroupPattern.MatchString(createReq.LogGroup) {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "log_group is not a valid log group name"})
+		}
+	default:
+		endpoint, err := url.Parse(createReq.URL)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "url must be an http or https URL"})
+		}
+		destination = endpoint.Host
+	}
+
+	rule := &store.ForwardingRule{
+		Name:      strings.TrimSpace(createReq.Name),
+		URL:       createReq.URL,
+		LogGroup:  createReq.LogGroup,
+		Levels:    createReq.Levels,
+		Sources:   createReq.Sources,
+		Pattern:   createReq.Pattern,
+		Headers:   createReq.Headers,
+		CreatedBy: currentSession(ctx).Username,
+	}
+	secret, err := h.forwardingRules.CreateForwardingRule(ctx, rule)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create forwarding rule", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create forwarding rule"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditForwardingRuleCreate, Target: rule.ID, Detail: rule.Name + " (" + destination + ")"})
+
+	// The signing secret is only ever returned here
+	return jsonResponse(http.StatusCreated, struct {
+		*store.ForwardingRule
+		Secret string `json:"secret"`
+	}{rule, secret})
+}
+
+func (h *Handler) deleteForwardingRule(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.forwardingRules == nil {
+		return forwardingUnavailable()
+	}
+	var deleteReq struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &deleteReq); err != nil || deleteReq.ID == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "id is required"})
+	}
+
+	err := h.forwardingRules.DeleteForwardingRule(ctx, deleteReq.ID)
+	if errors.Is(err, store.ErrForwardingRuleNotFound) {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Forwarding rule not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to delete forwarding rule", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to delete forwarding rule"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditForwardingRuleDelete, Target: deleteReq.ID})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"id": deleteReq.ID, "deleted": true})
+}
@@ -0,0 +1,359 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Grafana query target kinds
+const (
+	grafanaVolume  = "volume"  // Entries per interval
+	grafanaLevels  = "levels"  // Entries per interval, a series per level
+	grafanaSources = "sources" // Entries per interval, a series per source
+	grafanaLogs    = "logs"    // A table of the newest entries
+)
+
+// grafanaMaxRows is the most entries a table or annotation query returns
+const grafanaMaxRows = 1000
+
+// grafanaTarget is what a Grafana panel asks for: a kind, then filters
+// such as "levels env=staging source=web timeout". Filters are env=NAME,
+// level=LEVEL, source=SOURCE and words to search for, which match like
+// /logs/search.
+type grafanaTarget struct {
+	kind   string
+	env    string
+	level  string
+	source string
+	search string
+}
+
+// parseGrafanaTarget reads a target. Annotation queries have no kind.
+func parseGrafanaTarget(target string, withKind bool) (grafanaTarget, error) {
+	var t grafanaTarget
+	fields := strings.Fields(target)
+	if withKind {
+		if len(fields) == 0 {
+			return t, fmt.Errorf("target must start with %s, %s, %s or %s", grafanaVolume, grafanaLevels, grafanaSources, grafanaLogs)
+		}
+		t.kind, fields = fields[0], fields[1:]
+		switch t.kind {
+		case grafanaVolume, grafanaLevels, grafanaSources, grafanaLogs:
+		default:
+			return t, fmt.Errorf("unknown target %q; use %s, %s, %s or %s", t.kind, grafanaVolume, grafanaLevels, grafanaSources, grafanaLogs)
+		}
+	}
+
+	var words []string
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || !t.filter(key, value) {
+			words = append(words, field)
+		}
+	}
+	t.search = strings.ToLower(strings.Join(words, " "))
+	return t, nil
+}
+
+// filter sets a key=value filter, reporting whether the key is one
+func (t *grafanaTarget) filter(key, value string) bool {
+	switch key {
+	case "env":
+		t.env = value
+	case "level":
+		t.level = strings.ToUpper(value)
+	case "source":
+		t.source = value
+	default:
+		return false
+	}
+	return true
+}
+
+func (t grafanaTarget) matches(entry store.LogEntry) bool {
+	if t.level != "" && !strings.EqualFold(entry.Level, t.level) {
+		return false
+	}
+	if t.source != "" && entry.Source != t.source {
+		return false
+	}
+	if t.search == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(entry.Message), t.search) ||
+		strings.Contains(strings.ToLower(entry.Level), t.search) ||
+		strings.Contains(strings.ToLower(entry.Source), t.search)
+}
+
+// grafanaRange is the time range of a query or annotation request
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+func (r grafanaRange) valid() bool {
+	return !r.From.IsZero() && r.To.After(r.From)
+}
+
+// grafanaTimeSeries is a series in the SimpleJSON response; datapoints are
+// [value, Unix milliseconds] pairs
+type grafanaTimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]any         `json:"rows"`
+}
+
+// grafanaTest answers the data source's connection test
+func (h *Handler) grafanaTest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// grafanaSearch lists the target kinds for Grafana's query editor
+func (h *Handler) grafanaSearch(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusOK, []string{grafanaVolume, grafanaLevels, grafanaSources, grafanaLogs})
+}
+
+// grafanaQuery answers a panel's targets: counts per interval for the
+// volume kinds and a table of entries for logs. Ad hoc filters on env,
+// level and source apply to every target.
+func (h *Handler) grafanaQuery(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var query struct {
+		Range         grafanaRange `json:"range"`
+		IntervalMs    int64        `json:"intervalMs"`
+		MaxDataPoints int          `json:"maxDataPoints"`
+		Targets       []struct {
+			Target string `json:"target"`
+			RefID  string `json:"refId"`
+			Type   string `json:"type"`
+			Hide   bool   `json:"hide"`
+		} `json:"targets"`
+		AdhocFilters []struct {
+			Key      string `json:"key"`
+			Operator string `json:"operator"`
+			Value    string `json:"value"`
+		} `json:"adhocFilters"`
+	}
+	if err := json.Unmarshal([]byte(request.Body), &query); err != nil || !query.Range.valid() {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid query; expected a range and targets"})
+	}
+
+	step := time.Duration(query.IntervalMs) * time.Millisecond
+	if query.MaxDataPoints > 0 {
+		step = max(step, query.Range.To.Sub(query.Range.From)/time.Duration(query.MaxDataPoints))
+	}
+	step = max(step, time.Second)
+	rows := grafanaMaxRows
+	if query.MaxDataPoints > 0 {
+		rows = min(rows, query.MaxDataPoints)
+	}
+
+	results := []any{}
+	for _, target := range query.Targets {
+		if target.Hide {
+			continue
+		}
+		t, err := parseGrafanaTarget(target.Target, true)
+		if err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		for _, filter := range query.AdhocFilters {
+			if filter.Operator != "=" || !t.filter(filter.Key, filter.Value) {
+				return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unsupported ad hoc filter %s %s; use env, level or source with =", filter.Key, filter.Operator)})
+			}
+		}
+		if _, ok := h.environments.Get(t.env); !ok {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", t.env)})
+		}
+
+		if t.kind == grafanaLogs || target.Type == "table" {
+			table, err := h.grafanaLogTable(ctx, t, query.Range, rows)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to query logs for Grafana", "error", err)
+				h.recordStoreError(err)
+				return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs"})
+			}
+			table.RefID = target.RefID
+			results = append(results, table)
+			continue
+		}
+
+		series, err := h.grafanaVolume(ctx, t, target.Target, query.Range, step)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to count logs for Grafana", "error", err)
+			h.recordStoreError(err)
+			return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs"})
+		}
+		for _, s := range series {
+			results = append(results, s)
+		}
+	}
+	return jsonResponse(http.StatusOK, results)
+}
+
+// grafanaAnnotations marks the newest entries matching the annotation's
+// query, e.g. "level=ERROR source=deploy", on a panel's graph
+func (h *Handler) grafanaAnnotations(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var query struct {
+		Range      grafanaRange    `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	if err := json.Unmarshal([]byte(request.Body), &query); err != nil || !query.Range.valid() {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid annotation query; expected a range and an annotation"})
+	}
+	var annotation struct {
+		Query string `json:"query"`
+	}
+	_ = json.Unmarshal(query.Annotation, &annotation)
+
+	t, _ := parseGrafanaTarget(annotation.Query, false)
+	if _, ok := h.environments.Get(t.env); !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", t.env)})
+	}
+	entries, err := h.grafanaNewest(ctx, t, query.Range, grafanaMaxRows)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query logs for Grafana annotations", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs"})
+	}
+
+	annotations := make([]map[string]any, 0, len(entries))
+	for _, entry := range entries {
+		annotations = append(annotations, map[string]any{
+			"annotation": query.Annotation,
+			"time":       entry.Timestamp.UnixMilli(),
+			"title":      strings.TrimSpace(entry.Level + " " + entry.Source),
+			"text":       entry.Message,
+			"tags":       slices.DeleteFunc([]string{entry.Level, entry.Source}, func(s string) bool { return s == "" }),
+		})
+	}
+	return jsonResponse(http.StatusOK, annotations)
+}
+
+// eachGrafanaLog visits the target's matching entries in the range, oldest
+// first. Near the request's deadline it stops, returning the time it read
+// up to, so a long range gives a shorter answer rather than none.
+func (h *Handler) eachGrafanaLog(ctx context.Context, t grafanaTarget, r grafanaRange, visit func(store.LogEntry)) (time.Time, error) {
+	logStore, _ := h.environments.Get(t.env)
+	readTo := r.To
+	err := logStore.EachLog(ctx, r.From, r.To, func(entry store.LogEntry) bool {
+		if nearDeadline(ctx) {
+			readTo = entry.Timestamp
+			return false
+		}
+		if t.matches(entry) {
+			visit(entry)
+		}
+		return true
+	})
+	if readTo.Before(r.To) {
+		slog.WarnContext(ctx, "Ran out of time reading logs for Grafana", "from", r.From, "to", r.To, "read_to", readTo)
+	}
+	return readTo, err
+}
+
+// grafanaVolume counts the target's entries per step. Intervals after the
+// time read up to are left out rather than shown as zero.
+func (h *Handler) grafanaVolume(ctx context.Context, t grafanaTarget, name string, r grafanaRange, step time.Duration) ([]grafanaTimeSeries, error) {
+	start := r.From.Truncate(step)
+	counts := map[string]map[int64]float64{}
+	readTo, err := h.eachGrafanaLog(ctx, t, r, func(entry store.LogEntry) {
+		series := name
+		switch t.kind {
+		case grafanaLevels:
+			series = entry.Level
+		case grafanaSources:
+			series = entry.Source
+		}
+		if counts[series] == nil {
+			counts[series] = map[int64]float64{}
+		}
+		counts[series][int64(entry.Timestamp.Sub(start)/step)]++
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.kind == grafanaVolume && len(counts) == 0 {
+		counts[name] = map[int64]float64{}
+	}
+
+	// An interval the deadline cut short is left out too
+	buckets := int64(readTo.Sub(start) / step)
+	if !readTo.Before(r.To) {
+		buckets = int64((r.To.Sub(start) + step - 1) / step)
+	}
+	series := make([]grafanaTimeSeries, 0, len(counts))
+	for _, target := range slices.Sorted(maps.Keys(counts)) {
+		s := grafanaTimeSeries{Target: target, Datapoints: make([][2]float64, 0, buckets)}
+		for i := int64(0); i < buckets; i++ {
+			at := start.Add(time.Duration(i) * step)
+			s.Datapoints = append(s.Datapoints, [2]float64{counts[target][i], float64(at.UnixMilli())})
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// grafanaLogTable lists the target's newest entries
+func (h *Handler) grafanaLogTable(ctx context.Context, t grafanaTarget, r grafanaRange, limit int) (grafanaTable, error) {
+	entries, err := h.grafanaNewest(ctx, t, r, limit)
+	if err != nil {
+		return grafanaTable{}, err
+	}
+	table := grafanaTable{
+		Type: "table",
+		Columns: []grafanaColumn{
+			{Text: "Time", Type: "time"},
+			{Text: "Level", Type: "string"},
+			{Text: "Source", Type: "string"},
+			{Text: "Logger", Type: "string"},
+			{Text: "Message", Type: "string"},
+			{Text: "Request ID", Type: "string"},
+		},
+		Rows: make([][]any, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		table.Rows = append(table.Rows, []any{entry.Timestamp.UnixMilli(), entry.Level, entry.Source, entry.Logger, entry.Message, entry.RequestID})
+	}
+	return table, nil
+}
+
+// grafanaNewest returns up to limit of the target's newest entries in the
+// range, newest first
+func (h *Handler) grafanaNewest(ctx context.Context, t grafanaTarget, r grafanaRange, limit int) ([]store.LogEntry, error) {
+	var entries []store.LogEntry
+	_, err := h.eachGrafanaLog(ctx, t, r, func(entry store.LogEntry) {
+		entries = append(entries, entry)
+		if len(entries) >= 2*limit {
+			entries = slices.Clone(entries[len(entries)-limit:])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	slices.Reverse(entries)
+	return entries, nil
+}
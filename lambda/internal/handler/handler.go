@@ -1,16 +1,25 @@
 package handler
 
 import (
+	"cmp"
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/alerts"
+	"github.com/tinytail/tinytail/internal/dlq"
+	"github.com/tinytail/tinytail/internal/logging"
 	"github.com/tinytail/tinytail/internal/store"
 )
 
@@ -20,26 +29,235 @@ var indexHTML string
 //go:embed ui/login.html
 var loginHTML string
 
+//go:embed ui/revoke.html
+var revokeHTML string
+
 //go:embed ui/js/*
 var jsFiles embed.FS
 
+// Config holds the handler's access settings, read from the environment
+// at startup.
+type Config struct {
+	IngestSecrets IngestSecrets
+	UIPassword    *Credential // Bootstrap admin password, nil disables it
+
+	// Source IP restrictions; empty allows all addresses
+	IngestAllowlist Allowlist
+	UIAllowlist     Allowlist
+
+	// Callers allowed to ingest with IAM-signed requests; empty allows any
+	// caller API Gateway authorizes
+	IngestIAMPrincipals IAMPrincipals
+
+	// Trusting identities from an API Gateway authorizer
+	Authorizer AuthorizerConfig
+
+	// Verifying X-TinyTail-Signature on ingest requests
+	IngestSignature SignatureConfig
+
+	// Reading entries from the events Vector's http sink posts
+	Vector VectorMapping
+
+	// Capping how fast each producer may send entries
+	IngestRateLimit RateLimitConfig
+
+	// Share of the entries stored at each sampled level
+	SampleRates SampleRates
+
+	// Checks made of entries sent to /logs/ingest and by invocation
+	EntryRules EntryRules
+
+	// Levels entries are stored with, by the level sent
+	Levels LevelMap
+
+	// The range of timestamps entries are stored with
+	Timestamps TimestampRules
+
+	// Access tokens for JWT session mode; nil checks the session in
+	// DynamoDB on every request
+	SessionTokens *SessionTokens
+
+	// Content-Security-Policy sent with HTML pages
+	ContentSecurityPolicy string
+
+	// SingleSession signs a user out everywhere else when they sign in
+	SingleSession bool
+
+	// PasswordMaxAge forces a password change at sign-in once a password
+	// is this old; zero disables it
+	PasswordMaxAge time.Duration
+
+	// One-time sign-in links sent by email; nil disables them
+	LoginLinks *LoginLinks
+
+	// Signed URLs for the errors feed; nil disables feeds
+	FeedTokens *FeedTokens
+
+	// LoginNotifications emails users who sign in from a new device
+	LoginNotifications bool
+
+	// PublicBaseURL is the externally reachable UI address used in emailed
+	// links; empty uses the address requests arrive on
+	PublicBaseURL string
+
+	// ALBHealthCheckPath answers Application Load Balancer health checks
+	ALBHealthCheckPath string
+
+	// RequestTimeout bounds each request so long reads can stop and answer
+	// with what they found before API Gateway gives up; zero leaves only
+	// the function's own timeout
+	RequestTimeout time.Duration
+
+	// GzipResponses compresses large log responses for clients that
+	// accept it
+	GzipResponses bool
+
+	// NoAuth replaces sign-in with API Gateway IAM authorization, for
+	// private deployments: every IAM-authorized caller is an admin and no
+	// sessions are kept
+	NoAuth bool
+}
+
 type Handler struct {
+	// logStore is the default environment's; log reads and ingest pick
+	// theirs from environments
 	logStore     *store.LogStore
+	environments *store.Environments
 	sessionStore *store.SessionStore
-	ingestSecret string
-	uiPassword   string
+	userStore    *store.UserStore
+	apiKeyStore  *store.APIKeyStore
+	auditStore   *store.AuditStore
+	health       *store.HealthCounters
+	mailer       *alerts.Mailer
+	config       Config
+
+	// ingestQueue keeps entries that fail to store for another attempt;
+	// nil when no dead-letter queue is configured
+	ingestQueue *dlq.Queue
+
+	// forwardingRules lives in the alerts table; nil when that's missing
+	forwardingRules *store.ForwardingRuleStore
+
+	// dropRules lives in the alerts table too; nil when that's missing,
+	// which drops nothing
+	dropRules     *store.DropRuleStore
+	dropRuleCache dropRuleCache
+
+	// heartbeats records when sources last said they were alive; nil when
+	// the alerts table is missing
+	heartbeats *store.HeartbeatStore
+
+	// alertHistory lists sent alerts for the errors feed; nil when the
+	// alerts table is missing
+	alertHistory *store.AlertHistory
+
+	// ingestKeys remembers the ingest keys producers have presented
+	ingestKeys ingestKeyCache
+
+	// volumeSources is the sources stored entries are counted by
+	volumeSources volumeSources
+
+	// ingestLimiter holds each producer's share of IngestRateLimit
+	ingestLimiter rateLimiter
+
+	router *router
 }
 
-func NewHandler(logStore *store.LogStore, sessionStore *store.SessionStore, ingestSecret, uiPassword string) *Handler {
-	return &Handler{
+func NewHandler(environments *store.Environments, sessionStore *store.SessionStore, userStore *store.UserStore, apiKeyStore *store.APIKeyStore, auditStore *store.AuditStore, health *store.HealthCounters, mailer *alerts.Mailer, ingestQueue *dlq.Queue, forwardingRules *store.ForwardingRuleStore, dropRules *store.DropRuleStore, heartbeats *store.HeartbeatStore, alertHistory *store.AlertHistory, config Config) *Handler {
+	logStore, _ := environments.Get(store.DefaultEnvironment)
+	h := &Handler{
 		logStore:     logStore,
+		environments: environments,
 		sessionStore: sessionStore,
-		ingestSecret: ingestSecret,
-		uiPassword:   uiPassword,
+		userStore:    userStore,
+		apiKeyStore:  apiKeyStore,
+		auditStore:   auditStore,
+		health:       health,
+		mailer:       mailer,
+		config:       config,
+		ingestQueue:  ingestQueue,
+
+		forwardingRules: forwardingRules,
+		dropRules:       dropRules,
+		heartbeats:      heartbeats,
+		alertHistory:    alertHistory,
 	}
+	h.router = h.routes()
+	return h
+}
+
+// recordStoreError counts DynamoDB throttling for self-monitoring
+func (h *Handler) recordStoreError(err error) {
+	if store.IsThrottle(err) {
+		h.health.Add(store.CounterDynamoDBThrottles, 1)
+	}
+}
+
+// nearDeadline reports whether a request is too close to its deadline to
+// read another page of logs, for reads that answer with what they have
+func nearDeadline(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < store.TimeBudgetReserve
+}
+
+// DefaultRequestTimeout leaves time to answer within API Gateway's 29
+// second integration timeout
+const DefaultRequestTimeout = 25 * time.Second
+
+// RequestTimeoutFromEnv reads TINYTAIL_REQUEST_TIMEOUT_SECONDS, which
+// defaults to DefaultRequestTimeout. Zero turns the limit off.
+func RequestTimeoutFromEnv() (time.Duration, error) {
+	raw := os.Getenv("TINYTAIL_REQUEST_TIMEOUT_SECONDS")
+	if raw == "" {
+		return DefaultRequestTimeout, nil
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("TINYTAIL_REQUEST_TIMEOUT_SECONDS must be a whole number of seconds, got %q", raw)
+	}
+	return time.Duration(seconds) * time.Second, nil
 }
 
 func (h *Handler) Handle(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	start := time.Now()
+	// The earlier of this and the function's own deadline applies
+	if h.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.config.RequestTimeout)
+		defer cancel()
+	}
+	ctx = logging.With(ctx,
+		"request_id", request.RequestContext.RequestID,
+		"route", request.HTTPMethod+" "+request.Path)
+	summary := &requestSummary{}
+	ctx = context.WithValue(ctx, requestSummaryKey{}, summary)
+
+	response, err := h.routeRecovered(ctx, request)
+
+	slog.InfoContext(ctx, "Request handled",
+		"status", response.StatusCode,
+		"session", summary.session,
+		"latency_ms", time.Since(start).Milliseconds())
+	return h.withSecurityHeaders(response), err
+}
+
+// routeRecovered is route with panics turned into a 500, so the caller gets
+// a JSON error naming the request instead of API Gateway's opaque one, and
+// the instance lives on to serve the next request
+func (h *Handler) routeRecovered(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			recordPanic(ctx, recovered)
+			response, err = jsonResponse(http.StatusInternalServerError, map[string]string{
+				"error":      "Internal server error",
+				"request_id": request.RequestContext.RequestID,
+			})
+		}
+	}()
+	return h.route(ctx, request)
+}
+
+func (h *Handler) route(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Normalize path by removing stage prefix if present
 	path := request.Path
 	if request.RequestContext.Stage != "" && request.RequestContext.Stage != "$default" {
@@ -47,39 +265,54 @@ func (h *Handler) Handle(ctx context.Context, request events.APIGatewayProxyRequ
 		path = strings.TrimPrefix(path, stagePrefix)
 	}
 
-	switch {
-	// Public routes - no auth required
-	case request.HTTPMethod == "GET" && path == "/login":
-		return h.serveLoginPage()
-	case request.HTTPMethod == "POST" && path == "/auth/login":
-		return h.handleLogin(ctx, request)
-	case request.HTTPMethod == "POST" && path == "/logs/ingest":
-		return h.ingestLogs(ctx, request)
-	case request.HTTPMethod == "GET" && strings.HasPrefix(path, "/js/"):
-		return h.serveStaticJS(path)
-
-	// Protected routes - require session
-	case request.HTTPMethod == "GET" && path == "/":
-		return h.requireAuth(ctx, request, h.serveIndex)
-	case request.HTTPMethod == "POST" && path == "/auth/logout":
-		return h.requireAuth(ctx, request, h.handleLogout)
-	case request.HTTPMethod == "GET" && path == "/logs/latest":
-		return h.requireAuth(ctx, request, h.getLatestLogs)
-	case request.HTTPMethod == "GET" && path == "/logs":
-		return h.requireAuth(ctx, request, h.getLogs)
-	case request.HTTPMethod == "GET" && path == "/logs/date":
-		return h.requireAuth(ctx, request, h.getLogsByDate)
-	case request.HTTPMethod == "GET" && path == "/logs/datetime":
-		return h.requireAuth(ctx, request, h.getLogsByDateTime)
-	case request.HTTPMethod == "GET" && path == "/logs/search":
-		return h.requireAuth(ctx, request, h.searchLogs)
-	default:
-		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Not found"})
+	// Enforce source IP allowlists before any other handling. Sentry SDKs
+	// post to /api/<project>/..., where their DSN says to, Loki clients to
+	// /loki/api/v1/push, and services send heartbeats to /heartbeat.
+	allowlist := h.config.UIAllowlist
+	if path == "/logs/ingest" || strings.HasPrefix(path, "/logs/ingest/") || strings.HasPrefix(path, "/api/") || path == "/loki/api/v1/push" || path == "/heartbeat" {
+		allowlist = h.config.IngestAllowlist
+	}
+	if !allowlist.Allows(request.RequestContext.Identity.SourceIP) {
+		slog.WarnContext(ctx, "Rejected request from a source IP not in the allowlist", "path", path, "source_ip", request.RequestContext.Identity.SourceIP)
+		return jsonResponse(http.StatusForbidden, map[string]string{"error": "Forbidden"})
 	}
+
+	return h.router.serve(ctx, request, path)
 }
 
 // requireAuth wraps protected handlers with session validation
 func (h *Handler) requireAuth(ctx context.Context, request events.APIGatewayProxyRequest, handler func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	// In no-auth mode API Gateway has already verified the IAM caller
+	if h.config.NoAuth {
+		callerARN := request.RequestContext.Identity.UserArn
+		if callerARN == "" {
+			slog.WarnContext(ctx, "Rejected request without an IAM caller in no-auth mode")
+			return jsonResponse(http.StatusForbidden, map[string]string{"error": "No-auth mode requires API Gateway IAM authorization"})
+		}
+		return handler(withSession(ctx, &store.Session{Username: callerARN, Role: store.RoleAdmin}), request)
+	}
+
+	// Identities verified by an API Gateway authorizer need no session
+	authorized, err := h.authorizerSession(ctx, request)
+	if errors.Is(err, errAuthorizerDenied) {
+		return jsonResponse(http.StatusForbidden, map[string]string{"error": "Your account has no access to TinyTail"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check authorizer identity", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to validate session"})
+	}
+	if authorized != nil {
+		return handler(withSession(ctx, authorized), request)
+	}
+
+	// In JWT mode a valid access token stands in for the session
+	if h.config.SessionTokens != nil {
+		if session := h.config.SessionTokens.Verify(getCookie(request, accessCookie), time.Now()); session != nil {
+			return handler(withSession(ctx, session), request)
+		}
+	}
+
 	// Extract session cookie
 	sessionID := h.getSessionFromCookie(request)
 	if sessionID == "" {
@@ -87,16 +320,64 @@ func (h *Handler) requireAuth(ctx context.Context, request events.APIGatewayProx
 	}
 
 	// Validate session in DynamoDB
-	valid, err := h.sessionStore.ValidateSession(ctx, sessionID)
-	if err != nil || !valid {
+	session, err := h.sessionStore.ValidateSession(ctx, sessionID)
+	if err != nil || session == nil {
+		return h.redirectToLogin(request)
+	}
+
+	// Disabled users lose access immediately, not when their session expires
+	active, err := h.sessionUserActive(ctx, session)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check session user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to validate session"})
+	}
+	if !active {
+		_ = h.sessionStore.DeleteSession(ctx, sessionID)
 		return h.redirectToLogin(request)
 	}
 
 	// Session valid, proceed to handler
-	return handler(ctx, request)
+	response, err := handler(withSession(ctx, session), request)
+	if err != nil || h.config.SessionTokens == nil || setsCookie(response, accessCookie) {
+		return response, err
+	}
+
+	// Refresh the access token so the next requests skip the session lookup
+	token, ttl, err := h.config.SessionTokens.Issue(session, time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to issue access token", "error", err)
+		return response, nil
+	}
+	return withCookie(response, accessTokenCookie(token, ttl, session.ShortLived)), nil
+}
+
+// setsCookie reports whether the response already sets the named cookie,
+// e.g. logout clearing it
+func setsCookie(response events.APIGatewayProxyResponse, name string) bool {
+	for _, cookie := range response.MultiValueHeaders["Set-Cookie"] {
+		if strings.HasPrefix(cookie, name+"=") {
+			return true
+		}
+	}
+	return strings.HasPrefix(response.Headers["Set-Cookie"], name+"=")
+}
+
+// withCookie adds a Set-Cookie header to a response, alongside any it
+// already sets
+func withCookie(response events.APIGatewayProxyResponse, cookie string) events.APIGatewayProxyResponse {
+	if response.MultiValueHeaders == nil {
+		response.MultiValueHeaders = map[string][]string{}
+	}
+	response.MultiValueHeaders["Set-Cookie"] = append(response.MultiValueHeaders["Set-Cookie"], cookie)
+	return response
 }
 
 func (h *Handler) getSessionFromCookie(request events.APIGatewayProxyRequest) string {
+	return getCookie(request, "session")
+}
+
+func getCookie(request events.APIGatewayProxyRequest, name string) string {
 	cookieHeader := request.Headers["cookie"]
 	if cookieHeader == "" {
 		cookieHeader = request.Headers["Cookie"]
@@ -105,8 +386,8 @@ func (h *Handler) getSessionFromCookie(request events.APIGatewayProxyRequest) st
 	cookies := strings.Split(cookieHeader, ";")
 	for _, cookie := range cookies {
 		cookie = strings.TrimSpace(cookie)
-		if strings.HasPrefix(cookie, "session=") {
-			return strings.TrimPrefix(cookie, "session=")
+		if strings.HasPrefix(cookie, name+"=") {
+			return strings.TrimPrefix(cookie, name+"=")
 		}
 	}
 	return ""
@@ -119,6 +400,15 @@ func (h *Handler) redirectToLogin(request events.APIGatewayProxyRequest) (events
 		loginPath = "/" + request.RequestContext.Stage + "/login"
 	}
 
+	// Carry page query parameters (e.g. alert deep links) through the login page
+	if request.HTTPMethod == "GET" && len(request.QueryStringParameters) > 0 {
+		query := url.Values{}
+		for key, value := range request.QueryStringParameters {
+			query.Set(key, value)
+		}
+		loginPath += "?" + query.Encode()
+	}
+
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusFound,
 		Headers: map[string]string{
@@ -127,16 +417,42 @@ func (h *Handler) redirectToLogin(request events.APIGatewayProxyRequest) (events
 	}, nil
 }
 
-func (h *Handler) serveLoginPage() (events.APIGatewayProxyResponse, error) {
+func (h *Handler) serveLoginPage(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
 		Headers: map[string]string{
 			"Content-Type": "text/html",
 		},
-		Body: loginHTML,
+		Body: strings.NewReplacer(
+			"{{SESSION_IDLE}}", describeDuration(h.sessionStore.IdleTimeout()),
+			"{{SESSION_SHORT}}", describeDuration(h.sessionStore.ShortLifetime()),
+			"{{LOGIN_LINKS}}", strconv.FormatBool(h.config.LoginLinks != nil),
+		).Replace(loginHTML),
 	}, nil
 }
 
+// describeDuration renders a session lifetime for people, e.g. "2 weeks"
+func describeDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+
+	day := 24 * time.Hour
+	switch {
+	case d%(7*day) == 0:
+		return plural(int(d/(7*day)), "week")
+	case d%day == 0:
+		return plural(int(d/day), "day")
+	case d%time.Hour == 0:
+		return plural(int(d/time.Hour), "hour")
+	default:
+		return plural(int(d/time.Minute), "minute")
+	}
+}
+
 func (h *Handler) serveIndex(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
@@ -147,10 +463,9 @@ func (h *Handler) serveIndex(ctx context.Context, request events.APIGatewayProxy
 	}, nil
 }
 
-func (h *Handler) serveStaticJS(path string) (events.APIGatewayProxyResponse, error) {
-	// Remove leading slash to match embedded path: /js/tailwind.js -> js/tailwind.js
-	filePath := strings.TrimPrefix(path, "/")
-	filePath = "ui/" + filePath
+func (h *Handler) serveStaticJS(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Match the embedded path: /js/tailwind.js -> ui/js/tailwind.js
+	filePath := "ui/js/" + pathParam(ctx, "file")
 
 	content, err := jsFiles.ReadFile(filePath)
 	if err != nil {
@@ -172,97 +487,487 @@ func (h *Handler) serveStaticJS(path string) (events.APIGatewayProxyResponse, er
 
 func (h *Handler) handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var loginReq struct {
+		Username string `json:"username"`
 		Password string `json:"password"`
+		Remember bool   `json:"remember"`
 	}
 
 	if err := json.Unmarshal([]byte(request.Body), &loginReq); err != nil {
 		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
 	}
 
-	// Validate password
-	if loginReq.Password != h.uiPassword {
-		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Invalid password"})
+	// Validate credentials
+	username := strings.TrimSpace(loginReq.Username)
+	user, err := h.authenticateUser(ctx, username, loginReq.Password)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to authenticate user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to sign in"})
+	}
+	if user == nil {
+		h.audit(ctx, request, store.AuditEvent{Actor: username, Action: store.AuditLoginFailed})
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Invalid username or password"})
+	}
+	if h.passwordExpired(user, time.Now()) {
+		h.audit(ctx, request, store.AuditEvent{Actor: user.Username, Action: store.AuditLoginFailed, Detail: "password expired"})
+		return jsonResponse(http.StatusForbidden, map[string]interface{}{
+			"error":            "Your password has expired. Choose a new one to sign in.",
+			"password_expired": true,
+		})
 	}
 
-	// Create session
+	return h.startSession(ctx, request, user, loginReq.Remember, "")
+}
+
+// startSession signs in a user whose identity has been checked, setting the
+// session cookie. method names how they signed in, if not by password.
+func (h *Handler) startSession(ctx context.Context, request events.APIGatewayProxyRequest, user *store.User, remember bool, method string) (events.APIGatewayProxyResponse, error) {
 	userAgent := request.Headers["user-agent"]
 	if userAgent == "" {
 		userAgent = request.Headers["User-Agent"]
 	}
 
-	sess, err := h.sessionStore.CreateSession(ctx, userAgent)
+	sess, err := h.sessionStore.CreateSession(ctx, user.Username, user.Role, userAgent, remember)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to create session: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to create session", "error", err)
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create session"})
 	}
 
-	// Set session cookie (2 weeks, HttpOnly, Secure, SameSite)
-	cookie := fmt.Sprintf("session=%s; Max-Age=%d; Path=/; HttpOnly; Secure; SameSite=Strict",
-		sess.SessionID, 14*24*60*60)
+	detail := user.Role
+	if method != "" {
+		detail += " via " + method
+	}
+	h.audit(ctx, request, store.AuditEvent{Actor: user.Username, Action: store.AuditLogin, Detail: detail})
 
-	return events.APIGatewayProxyResponse{
+	if h.config.SingleSession {
+		ended, err := h.sessionStore.DeleteUserSessions(ctx, user.Username, sess.SessionID)
+		if err != nil {
+			// The new session is valid; the old ones just live on for now
+			slog.ErrorContext(ctx, "Failed to end previous sessions", "user", user.Username, "error", err)
+			h.recordStoreError(err)
+		} else if ended > 0 {
+			slog.InfoContext(ctx, "Ended previous sessions", "user", user.Username, "count", ended)
+		}
+	}
+
+	h.notifyNewDevice(ctx, request, user, sess)
+
+	// Set session cookie (HttpOnly, Secure, SameSite). Remembered sessions
+	// last for the absolute session lifetime; others get a browser-session
+	// cookie. Expiry is enforced server-side either way.
+	cookie := fmt.Sprintf("session=%s; Path=/; HttpOnly; Secure; SameSite=Strict", sess.SessionID)
+	if remember {
+		cookie = fmt.Sprintf("session=%s; Max-Age=%d; Path=/; HttpOnly; Secure; SameSite=Strict",
+			sess.SessionID, int(h.sessionStore.MaxLifetime().Seconds()))
+	}
+
+	response := events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 			"Set-Cookie":   cookie,
 		},
 		Body: `{"success": true}`,
-	}, nil
+	}
+
+	if h.config.SessionTokens != nil {
+		token, ttl, err := h.config.SessionTokens.Issue(sess, time.Now())
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to issue access token", "error", err)
+		} else {
+			response = withCookie(response, accessTokenCookie(token, ttl, sess.ShortLived))
+		}
+	}
+
+	return response, nil
 }
 
 func (h *Handler) handleLogout(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	sessionID := h.getSessionFromCookie(request)
+	if sessionID == "" {
+		if session := currentSession(ctx); session != nil {
+			sessionID = session.SessionID
+		}
+	}
 	if sessionID != "" {
 		_ = h.sessionStore.DeleteSession(ctx, sessionID)
 	}
 
-	// Clear cookie
-	cookie := "session=; Max-Age=0; Path=/; HttpOnly; Secure; SameSite=Strict"
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditLogout})
 
-	return events.APIGatewayProxyResponse{
+	// Clear cookies
+	response := events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
-			"Set-Cookie":   cookie,
+			"Set-Cookie":   "session=; Max-Age=0; Path=/; HttpOnly; Secure; SameSite=Strict",
 		},
 		Body: `{"success": true}`,
-	}, nil
+	}
+	if h.config.SessionTokens != nil {
+		response = withCookie(response, accessCookie+"=; Max-Age=0; Path=/; HttpOnly; Secure; SameSite=Strict")
+	}
+	return response, nil
 }
 
 func (h *Handler) ingestLogs(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	authHeader := request.Headers["authorization"]
-	if authHeader == "" {
-		authHeader = request.Headers["Authorization"]
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
 	}
 
-	expectedAuth := "Bearer " + h.ingestSecret
-	if authHeader != expectedAuth {
-		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	return h.storeIngestedEntries(ctx, request, secret.Env, secret)
+}
+
+// authenticateIngest returns the ingest secret a request was made with, or
+// nil. A signed request is checked by its X-TinyTail-Signature header alone;
+// otherwise the bearer token is used, unless signatures are required.
+func (h *Handler) authenticateIngest(ctx context.Context, request events.APIGatewayProxyRequest) *IngestSecret {
+	now := time.Now()
+
+	var secret *IngestSecret
+	if header := requestHeader(request, SignatureHeader); header != "" {
+		matched, err := h.verifySignature(ctx, request, header, now)
+		if err != nil {
+			slog.WarnContext(ctx, "Rejected signed ingest request", "error", err)
+			return nil
+		}
+		secret = matched
+	} else {
+		if h.config.IngestSignature.Required {
+			return nil
+		}
+		token, hasBearer := strings.CutPrefix(requestHeader(request, "Authorization"), "Bearer ")
+		if !hasBearer {
+			return nil
+		}
+		if secret = h.matchIngestSecret(ctx, token); secret == nil {
+			return nil
+		}
 	}
 
-	var entry store.LogEntry
-	if err := json.Unmarshal([]byte(request.Body), &entry); err != nil {
-		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	if secret.Expired(now) {
+		slog.WarnContext(ctx, "Rejected ingest request using an expired secret", "secret_id", secret.ID)
+		return nil
 	}
+	return secret
+}
+
+// MaxIngestBatch is the most entries one ingest request may carry
+const MaxIngestBatch = 100
 
-	if entry.Timestamp.IsZero() {
-		entry.Timestamp = time.Now()
+// storeIngestedEntries stores the log entry in the body of an authenticated
+// ingest request in the named environment, stamped and rate limited by the
+// secret it was made with. The body may also be a JSON array of up to
+// MaxIngestBatch entries, which are stored in order, or plain text, which
+// is one entry's message.
+func (h *Handler) storeIngestedEntries(ctx context.Context, request events.APIGatewayProxyRequest, env string, secret *IngestSecret) (events.APIGatewayProxyResponse, error) {
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(env)
+	if !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", env)})
 	}
 
-	if entry.Level == "" {
-		entry.Level = "INFO"
+	var entries []store.LogEntry
+	if isPlainText(request) {
+		entry := plainTextEntry(request)
+		if entry.Message == "" {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Empty body"})
+		}
+		entries = []store.LogEntry{entry}
+	} else if body := strings.TrimSpace(request.Body); strings.HasPrefix(body, "[") {
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+		}
+		if len(entries) > MaxIngestBatch {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("At most %d entries may be sent at once", MaxIngestBatch)})
+		}
+	} else {
+		var entry store.LogEntry
+		if err := json.Unmarshal([]byte(request.Body), &entry); err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+		}
+		entries = []store.LogEntry{entry}
+	}
+	idempotent(env, secret, requestHeader(request, "Idempotency-Key"), entries)
+	secret.stamp(entries)
+	h.config.Levels.normalizeLevels(entries)
+	if wantsItemResults(request) {
+		return h.storeIngestedItems(ctx, request, logStore, env, secret, entries)
+	}
+	problems := h.config.EntryRules.check(entries)
+	problems = append(problems, h.config.Timestamps.check(entries, time.Now())...)
+	if len(problems) > 0 {
+		return invalidEntries(problems)
+	}
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		return ingestThrottled(wait)
 	}
 
-	if err := h.logStore.StoreLogEntry(ctx, &entry); err != nil {
-		// Log the actual error for debugging
-		fmt.Printf("ERROR: Failed to store log entry: %v\n", err)
-		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to store log"})
+	queued, stored, err := h.storeEntries(ctx, logStore, env, entries)
+	if err != nil {
+		// Entries before the failed one are stored, so the producer is
+		// told how many to skip on retry
+		return jsonResponse(http.StatusInternalServerError, map[string]any{"error": "Failed to store log", "stored": stored})
 	}
+	recordIngest(len(entries), len(request.Body))
 
+	if queued > 0 {
+		return jsonResponse(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
 	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// idempotent gives the entries of a request sent with an Idempotency-Key
+// header dedup IDs of the key and their position, so sending the same
+// request again stores nothing new. The IDs are scoped to the environment
+// and the secret or key the request was made with, so producers that
+// happen to pick the same key don't drop each other's entries. Entries
+// naming their own dedup_id keep it.
+func idempotent(env string, secret *IngestSecret, key string, entries []store.LogEntry) {
+	if key == "" {
+		return
+	}
+	scope := cmp.Or(env, store.DefaultEnvironment) + "/" + secret.ID + "/" + key
+	for i := range entries {
+		if entries[i].DedupID == "" {
+			entries[i].DedupID = scope + "/" + strconv.Itoa(i)
+		}
+	}
+}
+
+// stabilize prepares the entries of a batch that its source sends again
+// whole when any of it fails: each gets a stable ID of batchID and its
+// place, and those without a timestamp the time the batch first arrived,
+// so a retry overwrites the items already written instead of storing them
+// twice. Like Idempotency-Key IDs, batchID is scoped to the environment and
+// the secret or key the batch was sent with.
+func (h *Handler) stabilize(ctx context.Context, logStore *store.LogStore, env string, secret *IngestSecret, batchID string, entries []store.LogEntry) error {
+	batchID = cmp.Or(env, store.DefaultEnvironment) + "/" + secret.ID + "/" + batchID
+	untimed := false
+	for i := range entries {
+		entries[i].StableID = batchID + "/" + strconv.Itoa(i)
+		untimed = untimed || entries[i].Timestamp.IsZero()
+	}
+	if !untimed {
+		return nil
+	}
+
+	arrived, err := logStore.BatchTime(ctx, batchID, time.Now())
+	if err != nil {
+		h.recordStoreError(err)
+		return err
+	}
+	for i := range entries {
+		if entries[i].Timestamp.IsZero() {
+			entries[i].Timestamp = arrived
+		}
+	}
+	return nil
+}
+
+// isPlainText reports whether an ingest request's body is text/plain
+func isPlainText(request events.APIGatewayProxyRequest) bool {
+	mediaType, _, _ := mime.ParseMediaType(requestHeader(request, "Content-Type"))
+	return mediaType == "text/plain"
+}
+
+// plainTextEntry makes an entry of a text/plain body, taking its other
+// fields from the level, source, logger and request_id query parameters,
+// or else from X-TinyTail-Level, -Source, -Logger and -Request-ID headers
+func plainTextEntry(request events.APIGatewayProxyRequest) store.LogEntry {
+	field := func(param, header string) string {
+		return cmp.Or(request.QueryStringParameters[param], requestHeader(request, header))
+	}
+	return store.LogEntry{
+		Message:   strings.TrimRight(request.Body, "\r\n"),
+		Level:     strings.ToUpper(field("level", "X-TinyTail-Level")),
+		Source:    field("source", "X-TinyTail-Source"),
+		Logger:    field("logger", "X-TinyTail-Logger"),
+		RequestID: field("request_id", "X-TinyTail-Request-ID"),
+	}
+}
+
+// Ingest stores entries that arrived other than over HTTP, such as
+// CloudTrail events, as ingested entries are stored: failures are queued
+// when there is a dead-letter queue, and counted.
+func (h *Handler) Ingest(ctx context.Context, env string, entries []store.LogEntry) error {
+	logStore, ok := h.environments.Get(env)
+	if !ok {
+		return fmt.Errorf("unknown environment %q", env)
+	}
+	_, _, err := h.storeEntries(ctx, logStore, env, entries)
+	return err
+}
+
+// IngestBatch stores entries with batched writes, for sources such as
+// Kinesis streams that deliver many at once and retry failures themselves,
+// so nothing is queued. On an error, some entries may already be stored.
+func (h *Handler) IngestBatch(ctx context.Context, env string, entries []store.LogEntry) error {
+	logStore, ok := h.environments.Get(env)
+	if !ok {
+		return fmt.Errorf("unknown environment %q", env)
+	}
+	return h.writeBatch(ctx, logStore, env, h.batchEntries(ctx, entries))
+}
+
+// batchEntries returns the entries of a batch to store, filling in a
+// missing timestamp or level, normalizing levels, and leaving out those a
+// drop rule or sampling drops, or whose timestamps are out of range and not
+// clamped
+func (h *Handler) batchEntries(ctx context.Context, entries []store.LogEntry) []store.LogEntry {
+	rules := h.loadDropRules(ctx)
+	dropped := dropTally{}
+	outOfRange, sampledOut := 0, 0
+	kept := make([]store.LogEntry, 0, len(entries))
+	now := time.Now()
+	for i := range entries {
+		if entries[i].Timestamp.IsZero() {
+			entries[i].Timestamp = now
+		}
+		if h.config.Timestamps.apply(&entries[i], now) {
+			outOfRange++
+			if !h.config.Timestamps.Clamp {
+				continue
+			}
+		}
+		entries[i].Level = h.config.Levels.normalize(entries[i].Level)
+		if entries[i].Level == "" {
+			entries[i].Level = "INFO"
+		}
+		if dropped.drops(rules, &entries[i]) {
+			continue
+		}
+		if !h.config.SampleRates.sample(&entries[i]) {
+			sampledOut++
+			continue
+		}
+		kept = append(kept, entries[i])
+	}
+	h.recordDropped(dropped)
+	recordOutOfRange(outOfRange)
+	recordSampledOut(sampledOut)
+	return kept
+}
+
+// queueAll queues entries that failed to store with cause, reporting
+// whether every one was queued
+func (h *Handler) queueAll(ctx context.Context, env string, entries []store.LogEntry, cause error) bool {
+	for i := range entries {
+		if err := h.ingestQueue.Send(ctx, env, &entries[i], cause); err != nil {
+			slog.ErrorContext(ctx, "Failed to queue log entry", "error", err)
+			return false
+		}
+	}
+	return true
+}
+
+// writeBatch stores the entries batchEntries kept with batched writes
+func (h *Handler) writeBatch(ctx context.Context, logStore *store.LogStore, env string, kept []store.LogEntry) error {
+	if err := logStore.StoreLogEntries(ctx, kept); err != nil {
+		h.recordStoreError(err)
+		h.health.Add(store.CounterIngestErrors, 1)
+		return err
+	}
+	h.recordIngestedVolume(ctx, env, kept)
+	return nil
+}
+
+// storeEntries stores ingested entries in order, filling in a missing
+// timestamp or level, normalizing levels, and skipping those a drop rule
+// or sampling drops, or whose timestamps are out of range and not clamped.
+// An entry that fails to store is queued to be stored later, if there is an
+// ingest queue, and counted in queued. If one can be neither stored nor
+// queued, it stops there and returns the error, with stored saying how many
+// came before it.
+func (h *Handler) storeEntries(ctx context.Context, logStore *store.LogStore, env string, entries []store.LogEntry) (queued, stored int, err error) {
+	return h.storeEach(ctx, logStore, env, entries, nil)
+}
+
+// storeEach is storeEntries, also giving each entry it gets to its result
+// in results, if that isn't nil
+func (h *Handler) storeEach(ctx context.Context, logStore *store.LogStore, env string, entries []store.LogEntry, results []itemResult) (queued, stored int, err error) {
+	result := func(i int, r itemResult) {
+		if results != nil {
+			results[i] = r
+		}
+	}
+	rules := h.loadDropRules(ctx)
+	dropped := dropTally{}
+	sampledOut, outOfRange := 0, 0
+	var written []store.LogEntry
+	defer func() {
+		h.recordDropped(dropped)
+		recordSampledOut(sampledOut)
+		recordOutOfRange(outOfRange)
+		h.recordIngestedVolume(ctx, env, written)
+	}()
+
+	for i := range entries {
+		entry := &entries[i]
+		now := time.Now()
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = now
+		}
+		if h.config.Timestamps.apply(entry, now) {
+			outOfRange++
+			if !h.config.Timestamps.Clamp {
+				result(i, itemResult{Status: itemRejected, Error: "timestamp is out of range"})
+				continue
+			}
+		}
+
+		entry.Level = h.config.Levels.normalize(entry.Level)
+		if entry.Level == "" {
+			entry.Level = "INFO"
+		}
+		// Dropped entries are answered as if stored, but have no cursor
+		if dropped.drops(rules, entry) {
+			result(i, itemResult{Status: itemAccepted})
+			continue
+		}
+		if !h.config.SampleRates.sample(entry) {
+			sampledOut++
+			result(i, itemResult{Status: itemAccepted})
+			continue
+		}
+
+		err := logStore.StoreLogEntry(ctx, entry)
+		if err == nil {
+			written = append(written, *entry)
+			result(i, itemResult{Status: itemAccepted, Cursor: entry.Cursor})
+			continue
+		}
+		h.recordStoreError(err)
+
+		// The entry is accepted if it can be stored later from the queue
+		if h.ingestQueue != nil {
+			queueErr := h.ingestQueue.Send(ctx, env, entry, err)
+			if queueErr == nil {
+				slog.WarnContext(ctx, "Queued log entry that failed to store", "error", err)
+				queued++
+				result(i, itemResult{Status: itemAccepted, Queued: true})
+				continue
+			}
+			slog.ErrorContext(ctx, "Failed to queue log entry", "error", queueErr)
+		}
+
+		// Log the actual error for debugging
+		slog.ErrorContext(ctx, "Failed to store log entry", "error", err, "stored", i)
+		h.health.Add(store.CounterIngestErrors, 1)
+		return queued, i, err
+	}
+	return queued, len(entries), nil
+}
+
 func (h *Handler) getLatestLogs(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logStore, ok := h.environments.Get(request.QueryStringParameters["env"])
+	if !ok {
+		return unknownEnvironment(request)
+	}
 	limitStr := request.QueryStringParameters["limit"]
 
 	limit := 100
@@ -274,9 +979,10 @@ func (h *Handler) getLatestLogs(ctx context.Context, request events.APIGatewayPr
 		limit = parsedLimit
 	}
 
-	logs, err := h.logStore.GetLogs(ctx, limit, "", "")
+	logs, err := logStore.GetLogs(ctx, limit, "", "")
 	if err != nil {
-		fmt.Printf("ERROR: Failed to query latest logs: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to query latest logs", "error", err)
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs"})
 	}
 
@@ -284,6 +990,10 @@ func (h *Handler) getLatestLogs(ctx context.Context, request events.APIGatewayPr
 }
 
 func (h *Handler) getLogs(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logStore, ok := h.environments.Get(request.QueryStringParameters["env"])
+	if !ok {
+		return unknownEnvironment(request)
+	}
 	limitStr := request.QueryStringParameters["limit"]
 	afterCursor := request.QueryStringParameters["after"]
 	beforeCursor := request.QueryStringParameters["before"]
@@ -297,8 +1007,9 @@ func (h *Handler) getLogs(ctx context.Context, request events.APIGatewayProxyReq
 		limit = parsedLimit
 	}
 
-	logs, err := h.logStore.GetLogs(ctx, limit, afterCursor, beforeCursor)
+	logs, err := logStore.GetLogs(ctx, limit, afterCursor, beforeCursor)
 	if err != nil {
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Failed to query logs: %v", err)})
 	}
 
@@ -306,6 +1017,10 @@ func (h *Handler) getLogs(ctx context.Context, request events.APIGatewayProxyReq
 }
 
 func (h *Handler) getLogsByDate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logStore, ok := h.environments.Get(request.QueryStringParameters["env"])
+	if !ok {
+		return unknownEnvironment(request)
+	}
 	dateStr := request.QueryStringParameters["date"]
 	if dateStr == "" {
 		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Missing date parameter"})
@@ -323,15 +1038,17 @@ func (h *Handler) getLogsByDate(ctx context.Context, request events.APIGatewayPr
 		targetTime = targetTime.Add(12 * time.Hour)
 	}
 
-	logsBefore, err := h.logStore.GetLogsByTimeRange(ctx, targetTime.Add(-24*time.Hour), targetTime, 100)
+	logsBefore, err := logStore.GetLogsByTimeRange(ctx, targetTime.Add(-24*time.Hour), targetTime, 100)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to query logs before date: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to query logs before date", "error", err)
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs before date"})
 	}
 
-	logsAfter, err := h.logStore.GetLogsByTimeRange(ctx, targetTime, targetTime.Add(24*time.Hour), 100)
+	logsAfter, err := logStore.GetLogsByTimeRange(ctx, targetTime, targetTime.Add(24*time.Hour), 100)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to query logs after date: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to query logs after date", "error", err)
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs after date"})
 	}
 
@@ -341,6 +1058,10 @@ func (h *Handler) getLogsByDate(ctx context.Context, request events.APIGatewayPr
 }
 
 func (h *Handler) getLogsByDateTime(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logStore, ok := h.environments.Get(request.QueryStringParameters["env"])
+	if !ok {
+		return unknownEnvironment(request)
+	}
 	timestampStr := request.QueryStringParameters["timestamp"]
 	if timestampStr == "" {
 		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Missing timestamp parameter"})
@@ -352,19 +1073,21 @@ func (h *Handler) getLogsByDateTime(ctx context.Context, request events.APIGatew
 	}
 
 	// Convert target time to ULID cursor
-	targetCursor := h.logStore.TimeToCursor(targetTime)
+	targetCursor := logStore.TimeToCursor(targetTime)
 
 	// Get 100 logs before the target cursor (no time window - just the 100 logs before this cursor)
-	logsBefore, err := h.logStore.GetLogs(ctx, 100, "", targetCursor)
+	logsBefore, err := logStore.GetLogs(ctx, 100, "", targetCursor)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to query logs before datetime: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to query logs before datetime", "error", err)
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs before datetime"})
 	}
 
 	// Get 100 logs after the target cursor (no time window - just the 100 logs after this cursor)
-	logsAfter, err := h.logStore.GetLogs(ctx, 100, targetCursor, "")
+	logsAfter, err := logStore.GetLogs(ctx, 100, targetCursor, "")
 	if err != nil {
-		fmt.Printf("ERROR: Failed to query logs after datetime: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to query logs after datetime", "error", err)
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to query logs after datetime"})
 	}
 
@@ -375,20 +1098,93 @@ func (h *Handler) getLogsByDateTime(ctx context.Context, request events.APIGatew
 }
 
 func (h *Handler) searchLogs(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logStore, ok := h.environments.Get(request.QueryStringParameters["env"])
+	if !ok {
+		return unknownEnvironment(request)
+	}
 	query := request.QueryStringParameters["q"]
 	beforeCursor := request.QueryStringParameters["before"]
 
+	// Optional time bounds (RFC3339), used by alert deep links
+	var since time.Time
+	if sinceStr := request.QueryStringParameters["since"]; sinceStr != "" {
+		parsed, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid since format. Use RFC3339"})
+		}
+		since = parsed
+	}
+	if untilStr := request.QueryStringParameters["until"]; untilStr != "" && beforeCursor == "" {
+		until, err := time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid until format. Use RFC3339"})
+		}
+		beforeCursor = logStore.TimeToCursor(until)
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditSearch, Detail: query})
+
 	// Request 101 results - if we get 101, the client knows there are more
 	// Also returns continuation_cursor if batch limit reached without enough matches
-	response, err := h.logStore.SearchLogsWithoutTimeWindow(ctx, query, beforeCursor, 100)
+	response, err := logStore.SearchLogsWithoutTimeWindow(ctx, query, beforeCursor, 100)
 	if err != nil {
+		h.recordStoreError(err)
 		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Failed to search logs: %v", err)})
 	}
 
+	if !since.IsZero() {
+		inWindow := []store.LogEntry{}
+		for _, entry := range response.Logs {
+			if !entry.Timestamp.Before(since) {
+				inWindow = append(inWindow, entry)
+			}
+		}
+		// Anything dropped means the search walked past the window start
+		if len(inWindow) < len(response.Logs) {
+			response.ContinuationCursor = ""
+		}
+		response.Logs = inWindow
+	}
+
 	// Return response with logs and optional continuation cursor
 	return jsonResponse(http.StatusOK, response)
 }
 
+// unknownEnvironment rejects a read from an environment that isn't configured
+func unknownEnvironment(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", request.QueryStringParameters["env"])})
+}
+
+// listEnvironments returns the environment names for the UI's switcher
+func (h *Handler) listEnvironments(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusOK, map[string][]string{"environments": h.environments.Names()})
+}
+
+// previewAlertRule dry-runs a proposed alert rule over the past N hours
+// without saving it or sending email. Rules only watch the default
+// environment, so that's what it reads.
+func (h *Handler) previewAlertRule(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var previewReq struct {
+		Rule  alerts.AlertRule `json:"rule"`
+		Hours int              `json:"hours"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &previewReq); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	result, err := alerts.PreviewRule(ctx, h.logStore, previewReq.Rule, previewReq.Hours)
+	if errors.Is(err, alerts.ErrInvalidRule) {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Failed to preview rule: %v", err)})
+	}
+
+	return jsonResponse(http.StatusOK, result)
+}
+
 func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DefaultContentSecurityPolicy fits the embedded UI: scripts and styles are
+// served from /js, Alpine.js evaluates its directives, the Tailwind runtime
+// and the pages use inline script and style, and the favicon is a data URI.
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' 'unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// ContentSecurityPolicyFromEnv returns TINYTAIL_CONTENT_SECURITY_POLICY, or
+// the default policy if it isn't set
+func ContentSecurityPolicyFromEnv() string {
+	if policy := strings.TrimSpace(os.Getenv("TINYTAIL_CONTENT_SECURITY_POLICY")); policy != "" {
+		return policy
+	}
+	return DefaultContentSecurityPolicy
+}
+
+// withSecurityHeaders adds browser hardening headers to a response. Every
+// response gets HSTS, nosniff and a referrer policy; HTML pages also get the
+// content security policy and framing protection. Headers a handler set
+// itself are left alone.
+func (h *Handler) withSecurityHeaders(response events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	set := func(name, value string) {
+		if _, ok := response.Headers[name]; !ok {
+			response.Headers[name] = value
+		}
+	}
+
+	set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+	set("X-Content-Type-Options", "nosniff")
+	set("Referrer-Policy", "strict-origin-when-cross-origin")
+
+	if strings.HasPrefix(response.Headers["Content-Type"], "text/html") {
+		set("Content-Security-Policy", h.config.ContentSecurityPolicy)
+		set("X-Frame-Options", "DENY")
+	}
+
+	return response
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Services send heartbeats to POST /heartbeat on a schedule, whether or not
+// they have anything to log, so one that has stopped can be told apart from
+// one that's quiet. GET /heartbeats/stale lists the sources that have gone
+// silent.
+
+// defaultStaleAfter is how long a source may go without a heartbeat before
+// it's listed as stale, unless the query says otherwise
+const defaultStaleAfter = 15 * time.Minute
+
+// maxHeartbeatSource bounds source names, which become part of the alerts
+// table key of their heartbeat
+const maxHeartbeatSource = 256
+
+// heartbeatsUnavailable answers heartbeat requests when there's nowhere to
+// keep them
+func heartbeatsUnavailable() (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusServiceUnavailable, map[string]string{"error": "Heartbeats are kept in the alerts table, which does not exist"})
+}
+
+// postHeartbeat records that a source is alive. It's authenticated like
+// /logs/ingest, and the source is the body's "source", or else the label of
+// the ingest key it was sent with.
+func (h *Handler) postHeartbeat(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if h.heartbeats == nil {
+		return heartbeatsUnavailable()
+	}
+	if _, ok := h.environments.Get(secret.Env); !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", secret.Env)})
+	}
+
+	var beat struct {
+		Source string `json:"source"`
+	}
+	if body := strings.TrimSpace(request.Body); body != "" {
+		if err := json.Unmarshal([]byte(body), &beat); err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+		}
+	}
+	source := strings.TrimSpace(beat.Source)
+	if source == "" {
+		source = secret.Label
+	}
+	if source == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "source is required"})
+	}
+	if len(source) > maxHeartbeatSource {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("source must be at most %d bytes", maxHeartbeatSource)})
+	}
+	if wait := h.throttled(ctx, secret, 1); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	now := time.Now()
+	if err := h.heartbeats.Beat(ctx, secret.Env, source, now); err != nil {
+		slog.ErrorContext(ctx, "Failed to record heartbeat", "error", err, "source", source)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to record heartbeat"})
+	}
+
+	return jsonResponse(http.StatusOK, map[string]any{"source": source, "last_seen": now})
+}
+
+// listStaleSources lists the sources that haven't sent a heartbeat for
+// after (default 15m), longest silent first, optionally only those of env
+func (h *Handler) listStaleSources(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.heartbeats == nil {
+		return heartbeatsUnavailable()
+	}
+	after := defaultStaleAfter
+	if raw := request.QueryStringParameters["after"]; raw != "" {
+		parsed, err := parseAge(raw)
+		if err != nil || parsed <= 0 {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "after must be a duration such as 90s, 15m or 1d"})
+		}
+		after = parsed
+	}
+	env := request.QueryStringParameters["env"]
+	if env != "" {
+		if _, ok := h.environments.Get(env); !ok {
+			return unknownEnvironment(request)
+		}
+	}
+
+	heartbeats, err := h.heartbeats.Heartbeats(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list heartbeats", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list heartbeats"})
+	}
+
+	type staleSource struct {
+		store.Heartbeat
+		SilentSeconds int64 `json:"silent_seconds"`
+	}
+	now := time.Now()
+	stale := []staleSource{}
+	for _, heartbeat := range heartbeats {
+		silent := now.Sub(heartbeat.LastSeen)
+		if silent < after || (env != "" && heartbeat.Env != env) {
+			continue
+		}
+		stale = append(stale, staleSource{heartbeat, int64(silent / time.Second)})
+	}
+
+	return jsonResponse(http.StatusOK, map[string]any{"after_seconds": int64(after / time.Second), "sources": stale})
+}
+
+// forgetHeartbeat stops listing a retired source
+func (h *Handler) forgetHeartbeat(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.heartbeats == nil {
+		return heartbeatsUnavailable()
+	}
+	var forgetReq struct {
+		Source string `json:"source"`
+		Env    string `json:"env"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &forgetReq); err != nil || forgetReq.Source == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "source is required"})
+	}
+
+	if err := h.heartbeats.Forget(ctx, forgetReq.Env, forgetReq.Source); err != nil {
+		slog.ErrorContext(ctx, "Failed to forget heartbeat", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to forget heartbeat"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditHeartbeatForget, Target: forgetReq.Source, Detail: forgetReq.Env})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"source": forgetReq.Source, "deleted": true})
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// HandleHTTPAPI serves requests from an API Gateway HTTP API (payload
+// format 2.0) by translating them to and from the REST API shape the
+// routes are written against.
+func (h *Handler) HandleHTTPAPI(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	response, err := h.Handle(ctx, restRequestFromHTTPAPI(request))
+	return httpAPIResponse(response), err
+}
+
+// restRequestFromHTTPAPI maps an HTTP API request onto the REST API request
+// shape. The cookies array goes back into a Cookie header, and authorizer
+// results move to where REST API authorizers put them.
+func restRequestFromHTTPAPI(request events.APIGatewayV2HTTPRequest) events.APIGatewayProxyRequest {
+	headers := make(map[string]string, len(request.Headers)+1)
+	for name, value := range request.Headers {
+		headers[name] = value
+	}
+	if len(request.Cookies) > 0 {
+		headers["cookie"] = strings.Join(request.Cookies, "; ")
+	}
+
+	// HTTP APIs join repeated query parameters with commas; the raw query
+	// string keeps them apart
+	var query map[string]string
+	var multiQuery map[string][]string
+	if parsed, err := url.ParseQuery(request.RawQueryString); err == nil && len(parsed) > 0 {
+		query = make(map[string]string, len(parsed))
+		multiQuery = map[string][]string(parsed)
+		for name, values := range parsed {
+			query[name] = values[len(values)-1]
+		}
+	} else if len(request.QueryStringParameters) > 0 {
+		query = request.QueryStringParameters
+	}
+
+	proxyRequest := events.APIGatewayProxyRequest{
+		Resource:                        request.RouteKey,
+		Path:                            request.RawPath,
+		HTTPMethod:                      request.RequestContext.HTTP.Method,
+		Headers:                         headers,
+		QueryStringParameters:           query,
+		MultiValueQueryStringParameters: multiQuery,
+		PathParameters:                  request.PathParameters,
+		StageVariables:                  request.StageVariables,
+		Body:                            request.Body,
+		IsBase64Encoded:                 request.IsBase64Encoded,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			AccountID:  request.RequestContext.AccountID,
+			Stage:      request.RequestContext.Stage,
+			RequestID:  request.RequestContext.RequestID,
+			DomainName: request.RequestContext.DomainName,
+			APIID:      request.RequestContext.APIID,
+			HTTPMethod: request.RequestContext.HTTP.Method,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  request.RequestContext.HTTP.SourceIP,
+				UserAgent: request.RequestContext.HTTP.UserAgent,
+			},
+		},
+	}
+
+	if authorizer := request.RequestContext.Authorizer; authorizer != nil {
+		switch {
+		case authorizer.JWT != nil:
+			claims := make(map[string]interface{}, len(authorizer.JWT.Claims))
+			for name, value := range authorizer.JWT.Claims {
+				claims[name] = value
+			}
+			proxyRequest.RequestContext.Authorizer = map[string]interface{}{"claims": claims}
+		case authorizer.Lambda != nil:
+			proxyRequest.RequestContext.Authorizer = authorizer.Lambda
+		case authorizer.IAM != nil:
+			proxyRequest.RequestContext.Identity.UserArn = authorizer.IAM.UserARN
+			proxyRequest.RequestContext.Identity.AccountID = authorizer.IAM.AccountID
+			proxyRequest.RequestContext.Identity.Caller = authorizer.IAM.CallerID
+			proxyRequest.RequestContext.Identity.AccessKey = authorizer.IAM.AccessKey
+		}
+	}
+
+	return proxyRequest
+}
+
+// httpAPIResponse converts a REST API response for an HTTP API. Set-Cookie
+// headers go in the cookies array, which is the only way to set more than
+// one; other repeated headers are joined with commas.
+func httpAPIResponse(response events.APIGatewayProxyResponse) events.APIGatewayV2HTTPResponse {
+	converted := events.APIGatewayV2HTTPResponse{
+		StatusCode:      response.StatusCode,
+		Headers:         map[string]string{},
+		Body:            response.Body,
+		IsBase64Encoded: response.IsBase64Encoded,
+	}
+
+	add := func(name string, values ...string) {
+		if strings.EqualFold(name, "Set-Cookie") {
+			converted.Cookies = append(converted.Cookies, values...)
+			return
+		}
+		if existing, ok := converted.Headers[name]; ok {
+			values = append([]string{existing}, values...)
+		}
+		converted.Headers[name] = strings.Join(values, ", ")
+	}
+	for name, value := range response.Headers {
+		add(name, value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		add(name, values...)
+	}
+
+	return converted
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// IAMPrincipals restricts IAM-signed ingestion to callers whose ARN matches
+// one of the patterns. An empty IAMPrincipals allows any caller API Gateway
+// has authorized.
+type IAMPrincipals []*regexp.Regexp
+
+// ParseIAMPrincipals parses a comma-separated list of ARN patterns in which
+// "*" matches any run of characters, e.g.
+// "arn:aws:sts::123456789012:assumed-role/orders-*".
+func ParseIAMPrincipals(value string) (IAMPrincipals, error) {
+	var principals IAMPrincipals
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.HasPrefix(pattern, "arn:") {
+			return nil, fmt.Errorf("invalid principal %q: must be an ARN pattern", pattern)
+		}
+
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		principals = append(principals, regexp.MustCompile(expr))
+	}
+	return principals, nil
+}
+
+// Allows reports whether the caller ARN matches one of the patterns
+func (p IAMPrincipals) Allows(arn string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, re := range p {
+		if re.MatchString(arn) {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestLogsIAM accepts log entries from producers that sign requests with
+// their IAM credentials (SigV4). API Gateway verifies the signature and the
+// caller's execute-api:Invoke permission before the request gets here; the
+// caller ARN it passes along is then checked against the configured
+// principals.
+func (h *Handler) ingestLogsIAM(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	callerARN := request.RequestContext.Identity.UserArn
+	if callerARN == "" {
+		// The route isn't behind IAM authorization, so nothing verified the caller
+		slog.WarnContext(ctx, "Rejected IAM ingest request without a verified caller")
+		recordAuthFailure(ctx, authMethodIngestIAM)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if !h.config.IngestIAMPrincipals.Allows(callerARN) {
+		slog.WarnContext(ctx, "Rejected IAM ingest request from a principal that is not allowed", "caller", callerARN)
+		recordAuthFailure(ctx, authMethodIngestIAM)
+		return jsonResponse(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	}
+
+	// IAM callers have no secret to tie them to an environment, so they
+	// name it, and are rate limited by their ARN
+	env := request.QueryStringParameters["env"]
+	return h.storeIngestedEntries(ctx, request, env, &IngestSecret{ID: "iam:" + callerARN, Env: env})
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// fakeDynamoDB keeps the items written by PutItem and TransactWriteItems,
+// checking the conditions the log store uses, and answers everything else
+// with an empty response
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]any
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var input struct {
+		Item          map[string]any
+		TransactItems []struct {
+			Put struct {
+				Item                map[string]any
+				ConditionExpression string
+			}
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "PutItem":
+		f.items[itemKey(input.Item)] = input.Item
+	case "TransactWriteItems":
+		for _, action := range input.TransactItems {
+			if existing, ok := f.items[itemKey(action.Put.Item)]; ok && action.Put.ConditionExpression != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"__type":              "com.amazonaws.dynamodb.v20120810#TransactionCanceledException",
+					"message":             "Transaction cancelled",
+					"CancellationReasons": []map[string]any{{"Code": "ConditionalCheckFailed", "Item": existing}, {"Code": "None"}},
+				})
+				return
+			}
+		}
+		for _, action := range input.TransactItems {
+			f.items[itemKey(action.Put.Item)] = action.Put.Item
+		}
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+// itemKey is an item's primary key, as written in the request
+func itemKey(item map[string]any) string {
+	pk, _ := json.Marshal(item["pk"])
+	sk, _ := json.Marshal(item["timestamp_seq"])
+	return string(pk) + "/" + string(sk)
+}
+
+// logItems counts the stored log entries
+func (f *fakeDynamoDB) logItems() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, item := range f.items {
+		if pk, _ := item["pk"].(map[string]any); pk["S"] == store.PartitionKey {
+			n++
+		}
+	}
+	return n
+}
+
+func TestIdempotencyKeyWithoutTimestamp(t *testing.T) {
+	fake := &fakeDynamoDB{items: map[string]map[string]any{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := dynamodb.New(dynamodb.Options{
+		BaseEndpoint: aws.String(server.URL),
+		Region:       "us-east-2",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+	logStore := store.NewLogStore(client, "TinyTailLogs", store.DefaultMaxMessageSize)
+	h := NewHandler(store.NewEnvironments(logStore, nil), nil, nil, nil, nil, store.NewHealthCounters(client, "TinyTailAlerts"), nil, nil, nil, nil, nil, nil, Config{})
+
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Idempotency-Key": "upload-1"},
+		Body:    `[{"message": "first"}, {"message": "second"}]`,
+	}
+	secret := &IngestSecret{ID: DefaultIngestSecretID}
+	for attempt := 1; attempt <= 2; attempt++ {
+		response, err := h.storeIngestedEntries(context.Background(), request, "", secret)
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("attempt %d: got %d %v, want 200", attempt, response.StatusCode, err)
+		}
+		// A retry is given a different arrival time
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if n := fake.logItems(); n != 2 {
+		t.Errorf("stored %d log items, want 2", n)
+	}
+
+	// Another producer may pick the same key
+	other := &IngestSecret{ID: "other"}
+	if response, err := h.storeIngestedEntries(context.Background(), request, "", other); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("other producer: got %d %v, want 200", response.StatusCode, err)
+	}
+	if n := fake.logItems(); n != 4 {
+		t.Errorf("stored %d log items after another producer's request, want 4", n)
+	}
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Ingest keys are API keys with the ingest role, kept in the API keys
+// table, that producers send in place of an ingest secret. Each is created
+// for one service, so keys can be rotated and revoked independently, and
+// its name labels the entries sent with it.
+
+// ingestKeyTTL is how long a container trusts an ingest key it looked up,
+// so revoking or relabelling one takes up to this long to reach every
+// container
+const ingestKeyTTL = time.Minute
+
+// maxCachedIngestKeys bounds the cache, which also remembers tokens that
+// weren't keys so guessing can't make every request read the table
+const maxCachedIngestKeys = 1000
+
+// ingestKeyCache remembers ingest keys by the token presented, or by
+// "k=<key ID>" for keys that signed a request
+type ingestKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedIngestKey
+}
+
+// cachedIngestKey is a looked-up token: the key's secret, or nil if the
+// token isn't a valid ingest key
+type cachedIngestKey struct {
+	secret  *IngestSecret
+	expires time.Time
+}
+
+func (c *ingestKeyCache) get(token string, now time.Time) (*IngestSecret, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[token]
+	if !ok || now.After(cached.expires) {
+		return nil, false
+	}
+	return cached.secret, true
+}
+
+func (c *ingestKeyCache) put(token string, secret *IngestSecret, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxCachedIngestKeys {
+		c.entries = map[string]cachedIngestKey{}
+	}
+	c.entries[token] = cachedIngestKey{secret: secret, expires: now.Add(ingestKeyTTL)}
+}
+
+// forget drops a key changed in this container, so the change applies here
+// at once
+func (c *ingestKeyCache) forget(keyID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for token, cached := range c.entries {
+		if cached.secret != nil && cached.secret.ID == keyID {
+			delete(c.entries, token)
+		}
+	}
+}
+
+// matchIngestSecret returns the configured ingest secret or ingest key a
+// producer presented, or nil
+func (h *Handler) matchIngestSecret(ctx context.Context, token string) *IngestSecret {
+	if secret := h.config.IngestSecrets.Match(token); secret != nil {
+		return secret
+	}
+	if !strings.HasPrefix(token, store.APIKeyPrefix) {
+		return nil
+	}
+
+	now := time.Now()
+	if secret, ok := h.ingestKeys.get(token, now); ok {
+		return secret
+	}
+	key, err := h.apiKeyStore.ValidateAPIKey(ctx, token)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to validate ingest key", "error", err)
+		h.recordStoreError(err)
+		return nil
+	}
+	var secret *IngestSecret
+	if key != nil && key.Role == store.RoleIngest {
+		secret = &IngestSecret{ID: key.KeyID, Env: key.Env, Label: key.Name}
+	}
+	h.ingestKeys.put(token, secret, now)
+	return secret
+}
+
+// signingIngestKey returns the ingest key with the given ID, able to check
+// the requests signed with it, or nil if there's no such key or it was
+// created before keys could sign. Lookups are cached like those of keys
+// sent as bearer tokens.
+func (h *Handler) signingIngestKey(ctx context.Context, keyID string) *IngestSecret {
+	now := time.Now()
+	cacheKey := "k=" + keyID
+	if secret, ok := h.ingestKeys.get(cacheKey, now); ok {
+		return secret
+	}
+	key, err := h.apiKeyStore.IngestKey(ctx, keyID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to look up signing ingest key", "error", err)
+		h.recordStoreError(err)
+		return nil
+	}
+	var secret *IngestSecret
+	if key != nil && key.SigningKey != "" {
+		credential := &Credential{}
+		if err := credential.setSigningKey(key.SigningKey); err == nil {
+			secret = &IngestSecret{ID: key.KeyID, Credential: credential, Env: key.Env, Label: key.Name}
+		}
+	}
+	h.ingestKeys.put(cacheKey, secret, now)
+	return secret
+}
+
+// stamp marks entries sent with an ingest key: those without a source take
+// its label, and each gets an ingest_key=<label> field at the end of its
+// first line. Configured secrets leave entries as they are.
+func (s *IngestSecret) stamp(entries []store.LogEntry) {
+	if s == nil || s.Label == "" {
+		return
+	}
+	value := s.Label
+	if strings.ContainsAny(value, " \"=") {
+		value = strconv.Quote(value)
+	}
+	field := " ingest_key=" + value
+	for i := range entries {
+		if entries[i].Source == "" {
+			entries[i].Source = s.Label
+		}
+		first, rest, multiline := strings.Cut(entries[i].Message, "\n")
+		entries[i].Message = first + field
+		if multiline {
+			entries[i].Message += "\n" + rest
+		}
+	}
+}
+
+func (h *Handler) listIngestKeys(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	keys, err := h.apiKeyStore.ListAPIKeys(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list ingest keys", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list ingest keys"})
+	}
+
+	ingestKeys := []store.APIKey{}
+	for _, key := range keys {
+		if key.Role == store.RoleIngest {
+			ingestKeys = append(ingestKeys, key)
+		}
+	}
+	return jsonResponse(http.StatusOK, ingestKeys)
+}
+
+func (h *Handler) createIngestKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var createReq struct {
+		Name string `json:"name"`
+		Env  string `json:"env"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &createReq); err != nil || strings.TrimSpace(createReq.Name) == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "name is required"})
+	}
+	if _, ok := h.environments.Get(createReq.Env); !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", createReq.Env)})
+	}
+
+	key, fullKey, err := h.apiKeyStore.CreateIngestKey(ctx, strings.TrimSpace(createReq.Name), createReq.Env, currentSession(ctx).Username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create ingest key", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create ingest key"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditIngestKeyCreate, Target: key.KeyID, Detail: key.Name})
+
+	// The full key is only ever returned here
+	return jsonResponse(http.StatusCreated, struct {
+		*store.APIKey
+		Key string `json:"key"`
+	}{key, fullKey})
+}
+
+// labelIngestKey renames an ingest key, changing the label stamped on the
+// entries sent with it from then on
+func (h *Handler) labelIngestKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var labelReq struct {
+		KeyID string `json:"key_id"`
+		Name  string `json:"name"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &labelReq); err != nil || labelReq.KeyID == "" || strings.TrimSpace(labelReq.Name) == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "key_id and name are required"})
+	}
+	name := strings.TrimSpace(labelReq.Name)
+
+	err := h.apiKeyStore.RenameAPIKey(ctx, labelReq.KeyID, name)
+	if errors.Is(err, store.ErrAPIKeyNotFound) {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Ingest key not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to label ingest key", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to label ingest key"})
+	}
+	h.ingestKeys.forget(labelReq.KeyID)
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditIngestKeyLabel, Target: labelReq.KeyID, Detail: name})
+
+	return jsonResponse(http.StatusOK, map[string]string{"key_id": labelReq.KeyID, "name": name})
+}
+
+func (h *Handler) revokeIngestKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var revokeReq struct {
+		KeyID string `json:"key_id"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &revokeReq); err != nil || revokeReq.KeyID == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "key_id is required"})
+	}
+
+	err := h.apiKeyStore.RevokeAPIKey(ctx, revokeReq.KeyID)
+	if errors.Is(err, store.ErrAPIKeyNotFound) {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Ingest key not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to revoke ingest key", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke ingest key"})
+	}
+	h.ingestKeys.forget(revokeReq.KeyID)
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditIngestKeyRevoke, Target: revokeReq.KeyID})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"key_id": revokeReq.KeyID, "revoked": true})
+}
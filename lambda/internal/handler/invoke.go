@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// InvokeIngest is the payload other functions invoke TinyTail with to store
+// entries without going through API Gateway:
+// {"action": "ingest", "env": "staging", "source": "orders", "entries": [...]}.
+// Lambda has already checked the caller's lambda:InvokeFunction permission,
+// which is all the authentication there is.
+type InvokeIngest struct {
+	Action string `json:"action"`
+
+	// Env is the environment entries are stored in; empty is the default
+	Env string `json:"env"`
+
+	// Source is given to entries that don't name their own
+	Source string `json:"source"`
+
+	Entries []store.LogEntry `json:"entries"`
+}
+
+// InvokeIngestResult answers an ingest invocation: "ok", or "queued" when
+// some entries failed to store and wait in the dead-letter queue
+type InvokeIngestResult struct {
+	Status string `json:"status"`
+	Stored int    `json:"stored"`
+	Queued int    `json:"queued,omitempty"`
+}
+
+// HandleInvokeIngest stores the entries of an ingest invocation as
+// /logs/ingest stores a batch. Failing returns an error, which the invoker
+// sees as a function error and which makes Lambda retry an asynchronous
+// invocation; entries before the failed one are already stored, and the
+// error says how many.
+func (h *Handler) HandleInvokeIngest(ctx context.Context, payload InvokeIngest) (InvokeIngestResult, error) {
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(payload.Env)
+	if !ok {
+		return InvokeIngestResult{}, fmt.Errorf("unknown environment %q", payload.Env)
+	}
+	if len(payload.Entries) == 0 {
+		return InvokeIngestResult{}, errors.New("no entries to store")
+	}
+	if len(payload.Entries) > MaxIngestBatch {
+		return InvokeIngestResult{}, fmt.Errorf("at most %d entries may be sent at once", MaxIngestBatch)
+	}
+
+	bytes := 0
+	for i := range payload.Entries {
+		if payload.Entries[i].Source == "" {
+			payload.Entries[i].Source = payload.Source
+		}
+		bytes += len(payload.Entries[i].Message)
+	}
+	h.config.Levels.normalizeLevels(payload.Entries)
+	problems := h.config.EntryRules.check(payload.Entries)
+	problems = append(problems, h.config.Timestamps.check(payload.Entries, time.Now())...)
+	if len(problems) > 0 {
+		return InvokeIngestResult{}, invalidEntriesError(problems)
+	}
+
+	queued, stored, err := h.storeEntries(ctx, logStore, payload.Env, payload.Entries)
+	if err != nil {
+		return InvokeIngestResult{}, fmt.Errorf("failed to store log after %d entries: %w", stored, err)
+	}
+	recordIngest(len(payload.Entries), bytes)
+
+	result := InvokeIngestResult{Status: "ok", Stored: stored - queued, Queued: queued}
+	if queued > 0 {
+		result.Status = "queued"
+	}
+	return result, nil
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// A batch sent to /logs/ingest?items=true is answered entry by entry
+// instead of all or nothing: invalid entries are turned away without the
+// rest, and if storing fails partway, the entries after it are marked to be
+// sent again. Agents retry only those, rather than the whole batch.
+
+// The statuses of entries in an items response
+const (
+	// itemAccepted is an entry that was stored, queued, or dropped by a
+	// drop rule or sampling
+	itemAccepted = "accepted"
+
+	// itemRejected is an entry that was turned away and will be again
+	itemRejected = "rejected"
+
+	// itemRetryable is an entry that wasn't stored but may be if sent again
+	itemRetryable = "retryable"
+)
+
+// itemResult is what became of one entry of a batch
+type itemResult struct {
+	Status string `json:"status"`
+
+	// Cursor is where the entry was stored, for entries stored at once
+	Cursor string `json:"cursor,omitempty"`
+
+	// Queued is set for entries that will be stored from the ingest queue
+	Queued bool `json:"queued,omitempty"`
+
+	Errors []fieldError `json:"errors,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// wantsItemResults reports whether an ingest request asked to be answered
+// entry by entry
+func wantsItemResults(request events.APIGatewayProxyRequest) bool {
+	items, _ := strconv.ParseBool(request.QueryStringParameters["items"])
+	return items
+}
+
+// storeIngestedItems stores the valid entries of a request and answers with
+// what became of each: 200 if every entry was accepted, or else 207 with
+// the rejected and retryable entries marked
+func (h *Handler) storeIngestedItems(ctx context.Context, request events.APIGatewayProxyRequest, logStore *store.LogStore, env string, secret *IngestSecret, entries []store.LogEntry) (events.APIGatewayProxyResponse, error) {
+	results := make([]itemResult, len(entries))
+	problems := h.config.EntryRules.check(entries)
+	problems = append(problems, h.config.Timestamps.check(entries, time.Now())...)
+	for _, problem := range problems {
+		results[problem.Entry].Status = itemRejected
+		results[problem.Entry].Errors = append(results[problem.Entry].Errors, problem)
+	}
+
+	// positions maps the entries to store back to their place in the request
+	var valid []store.LogEntry
+	var positions []int
+	for i := range entries {
+		if results[i].Status != itemRejected {
+			valid = append(valid, entries[i])
+			positions = append(positions, i)
+		}
+	}
+	if wait := h.throttled(ctx, secret, len(valid)); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	stored := make([]itemResult, len(valid))
+	_, n, err := h.storeEach(ctx, logStore, env, valid, stored)
+	if err != nil {
+		for i := n; i < len(valid); i++ {
+			stored[i] = itemResult{Status: itemRetryable, Error: "Failed to store log"}
+		}
+	}
+	for i, position := range positions {
+		results[position] = stored[i]
+	}
+	recordIngest(n, len(request.Body))
+
+	counts := map[string]int{itemAccepted: 0, itemRejected: 0, itemRetryable: 0}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	status := http.StatusOK
+	if counts[itemAccepted] < len(results) {
+		status = http.StatusMultiStatus
+	}
+	return jsonResponse(status, map[string]any{
+		"accepted":  counts[itemAccepted],
+		"rejected":  counts[itemRejected],
+		"retryable": counts[itemRetryable],
+		"items":     results,
+	})
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+const (
+	// accessCookie holds the signed access token in JWT session mode
+	accessCookie = "access"
+
+	// DefaultAccessTokenTTL is how long an access token is accepted without
+	// checking the session in DynamoDB
+	DefaultAccessTokenTTL = 5 * time.Minute
+)
+
+// jwtHeader is the fixed, pre-encoded header of every token we issue
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// SessionTokens issues and verifies short-lived HS256 JWTs standing in for
+// a DynamoDB session. The session itself acts as the refresh token: when the
+// access token has expired, the session is checked and a new token issued.
+type SessionTokens struct {
+	key []byte
+	ttl time.Duration
+}
+
+type sessionClaims struct {
+	Subject    string `json:"sub"`
+	Role       string `json:"role"`
+	SessionID  string `json:"sid"`
+	IssuedAt   int64  `json:"iat"`
+	Expires    int64  `json:"exp"`
+	ShortLived bool   `json:"short,omitempty"`
+}
+
+// SessionTokensFromEnv returns nil unless TINYTAIL_SESSION_MODE is "jwt", in
+// which case TINYTAIL_SESSION_SIGNING_KEY (hex, at least 32 bytes) is
+// required and TINYTAIL_SESSION_TOKEN_MINUTES sets the access token lifetime.
+func SessionTokensFromEnv() (*SessionTokens, error) {
+	switch mode := os.Getenv("TINYTAIL_SESSION_MODE"); mode {
+	case "", "dynamodb":
+		return nil, nil
+	case "jwt":
+	default:
+		return nil, fmt.Errorf("TINYTAIL_SESSION_MODE must be \"dynamodb\" or \"jwt\", got %q", mode)
+	}
+
+	key, err := hex.DecodeString(os.Getenv("TINYTAIL_SESSION_SIGNING_KEY"))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("TINYTAIL_SESSION_SIGNING_KEY must be at least 32 hex-encoded bytes in jwt session mode")
+	}
+
+	ttl := DefaultAccessTokenTTL
+	if raw := os.Getenv("TINYTAIL_SESSION_TOKEN_MINUTES"); raw != "" {
+		minutes, err := strconv.Atoi(raw)
+		if err != nil || minutes <= 0 || minutes > 60 {
+			return nil, fmt.Errorf("TINYTAIL_SESSION_TOKEN_MINUTES must be between 1 and 60, got %q", raw)
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+
+	return &SessionTokens{key: key, ttl: ttl}, nil
+}
+
+// Issue signs an access token for the session. It expires after the token
+// lifetime, or with the session if that is sooner.
+func (t *SessionTokens) Issue(session *store.Session, now time.Time) (string, time.Duration, error) {
+	expires := now.Add(t.ttl)
+	if sessionExpiry := time.Unix(session.ExpireAt, 0); sessionExpiry.Before(expires) {
+		expires = sessionExpiry
+	}
+
+	payload, err := json.Marshal(sessionClaims{
+		Subject:    session.Username,
+		Role:       session.Role,
+		SessionID:  session.SessionID,
+		IssuedAt:   now.Unix(),
+		Expires:    expires.Unix(),
+		ShortLived: session.ShortLived,
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encode token claims: %w", err)
+	}
+
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + t.sign(unsigned), expires.Sub(now), nil
+}
+
+// Verify returns the session an access token stands for, or nil if the
+// token is missing, forged or expired.
+func (t *SessionTokens) Verify(token string, now time.Time) *store.Session {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return nil
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(header+"."+payload))) {
+		return nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(decoded, &claims); err != nil || claims.Subject == "" || now.Unix() >= claims.Expires {
+		return nil
+	}
+
+	return &store.Session{
+		SessionID:  claims.SessionID,
+		ExpireAt:   claims.Expires,
+		Username:   claims.Subject,
+		Role:       claims.Role,
+		ShortLived: claims.ShortLived,
+	}
+}
+
+func (t *SessionTokens) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// accessTokenCookie returns the Set-Cookie value carrying an access token.
+// Tokens for short-lived sessions get a browser-session cookie, like the
+// session cookie itself.
+func accessTokenCookie(token string, ttl time.Duration, shortLived bool) string {
+	if shortLived {
+		return fmt.Sprintf("%s=%s; Path=/; HttpOnly; Secure; SameSite=Strict", accessCookie, token)
+	}
+	return fmt.Sprintf("%s=%s; Max-Age=%d; Path=/; HttpOnly; Secure; SameSite=Strict", accessCookie, token, int(ttl.Seconds()))
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// LevelMap maps the levels producers send, in upper case, to the ones
+// entries are stored with, so searches and alert rules only need to know
+// TRACE, DEBUG, INFO, WARN, ERROR and FATAL. Levels it doesn't name are
+// stored in upper case.
+type LevelMap map[string]string
+
+// defaultLevels covers the spellings of common logging libraries, syslog
+// severities and Python's numeric levels
+var defaultLevels = LevelMap{
+	"WARNING":       "WARN",
+	"WRN":           "WARN",
+	"ERR":           "ERROR",
+	"ERRO":          "ERROR",
+	"EROR":          "ERROR",
+	"SEVERE":        "ERROR",
+	"CRITICAL":      "FATAL",
+	"CRIT":          "FATAL",
+	"ALERT":         "FATAL",
+	"EMERG":         "FATAL",
+	"EMERGENCY":     "FATAL",
+	"PANIC":         "FATAL",
+	"INF":           "INFO",
+	"INFORMATION":   "INFO",
+	"INFORMATIONAL": "INFO",
+	"NOTICE":        "INFO",
+	"DBG":           "DEBUG",
+	"FINE":          "DEBUG",
+	"FINER":         "TRACE",
+	"FINEST":        "TRACE",
+	"VERBOSE":       "TRACE",
+	"TRC":           "TRACE",
+
+	// Syslog severities
+	"0": "FATAL",
+	"1": "FATAL",
+	"2": "FATAL",
+	"3": "ERROR",
+	"4": "WARN",
+	"5": "INFO",
+	"6": "INFO",
+	"7": "DEBUG",
+
+	// Python's levelnos
+	"10": "DEBUG",
+	"20": "INFO",
+	"30": "WARN",
+	"40": "ERROR",
+	"50": "FATAL",
+}
+
+// LevelMapFromEnv returns the default mapping with the comma-separated
+// from=to pairs of TINYTAIL_LEVEL_MAP added, such as
+// "notice=NOTICE,60=FATAL". A level mapped to is kept as it is, so mapping
+// to a level the defaults map elsewhere keeps that level.
+func LevelMapFromEnv() (LevelMap, error) {
+	levels := maps.Clone(defaultLevels)
+	overrides := LevelMap{}
+	for _, pair := range splitList(os.Getenv("TINYTAIL_LEVEL_MAP")) {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.ToUpper(strings.TrimSpace(from)), strings.ToUpper(strings.TrimSpace(to))
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("TINYTAIL_LEVEL_MAP: %q is not from=to", pair)
+		}
+		overrides[from] = to
+	}
+
+	for from, to := range overrides {
+		if _, chained := overrides[to]; chained && to != from {
+			return nil, fmt.Errorf("TINYTAIL_LEVEL_MAP: %s is mapped to %s, which is itself mapped to %s", from, to, overrides[to])
+		}
+	}
+	for from, to := range overrides {
+		// Mapping a level twice, or mapping a level to one that is mapped
+		// again, would give a different answer the second time
+		delete(levels, to)
+		for other, level := range levels {
+			if level == from {
+				levels[other] = to
+			}
+		}
+		levels[from] = to
+	}
+	for from, to := range levels {
+		if from == to {
+			delete(levels, from)
+		}
+	}
+	return levels, nil
+}
+
+// normalize returns the level an entry is stored with. Normalizing a level
+// again leaves it as it is.
+func (m LevelMap) normalize(level string) string {
+	if m == nil {
+		m = defaultLevels
+	}
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if mapped, ok := m[level]; ok {
+		return mapped
+	}
+	return level
+}
+
+// normalizeLevels gives the entries their stored levels
+func (m LevelMap) normalizeLevels(entries []store.LogEntry) {
+	for i := range entries {
+		entries[i].Level = m.normalize(entries[i].Level)
+	}
+}
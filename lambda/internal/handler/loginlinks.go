@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// DefaultLoginLinkTTL is how long an emailed sign-in link can be used
+const DefaultLoginLinkTTL = 15 * time.Minute
+
+// LoginLinks issues and verifies one-time sign-in links sent by email. The
+// token is signed so forged or expired links are rejected without a
+// lookup; its nonce is also stored on the user and cleared on use, so each
+// link works once.
+type LoginLinks struct {
+	key []byte
+	ttl time.Duration
+}
+
+type loginLinkClaims struct {
+	Subject string `json:"sub"`
+	Nonce   string `json:"nonce"`
+	Expires int64  `json:"exp"`
+}
+
+// LoginLinksFromEnv returns nil unless TINYTAIL_LOGIN_LINKS is "true", in
+// which case TINYTAIL_LOGIN_LINK_KEY (hex, at least 32 bytes) is required
+// and TINYTAIL_LOGIN_LINK_MINUTES sets how long links last.
+func LoginLinksFromEnv() (*LoginLinks, error) {
+	if os.Getenv("TINYTAIL_LOGIN_LINKS") != "true" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(os.Getenv("TINYTAIL_LOGIN_LINK_KEY"))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("TINYTAIL_LOGIN_LINK_KEY must be at least 32 hex-encoded bytes when login links are enabled")
+	}
+
+	ttl := DefaultLoginLinkTTL
+	if raw := os.Getenv("TINYTAIL_LOGIN_LINK_MINUTES"); raw != "" {
+		minutes, err := strconv.Atoi(raw)
+		if err != nil || minutes <= 0 || minutes > 60 {
+			return nil, fmt.Errorf("TINYTAIL_LOGIN_LINK_MINUTES must be between 1 and 60, got %q", raw)
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+
+	return &LoginLinks{key: key, ttl: ttl}, nil
+}
+
+// Issue returns a signed token for the user and the digest of its nonce,
+// which must be stored for the token to be redeemed
+func (l *LoginLinks) Issue(username string, now time.Time) (string, string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	claims := loginLinkClaims{
+		Subject: username,
+		Nonce:   hex.EncodeToString(nonce),
+		Expires: now.Add(l.ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode link claims: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + l.sign(encoded), nonceDigest(claims.Nonce), nil
+}
+
+// Verify returns the claims of a genuine, unexpired token, or nil
+func (l *LoginLinks) Verify(token string, now time.Time) *loginLinkClaims {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(l.sign(payload))) {
+		return nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	var claims loginLinkClaims
+	if err := json.Unmarshal(decoded, &claims); err != nil || claims.Subject == "" || claims.Nonce == "" || now.Unix() >= claims.Expires {
+		return nil
+	}
+	return &claims
+}
+
+// sign is keyed separately from anything else so a login link can't be
+// passed off as another kind of token
+func (l *LoginLinks) sign(payload string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte("login-link." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func nonceDigest(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestLoginLink emails a one-time sign-in link to the user. The response
+// is the same whether or not the account exists or has an email address, so
+// it can't be used to discover usernames.
+func (h *Handler) requestLoginLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.config.LoginLinks == nil {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Not found"})
+	}
+
+	var linkReq struct {
+		Username string `json:"username"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &linkReq); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+	username := strings.TrimSpace(linkReq.Username)
+	if username == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "username is required"})
+	}
+
+	sent := map[string]interface{}{
+		"success": true,
+		"message": "If that account has an email address, a sign-in link is on its way",
+	}
+
+	user, err := h.userStore.GetUser(ctx, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to send sign-in link"})
+	}
+	if user == nil || user.Disabled || user.NotificationAddress() == "" {
+		return jsonResponse(http.StatusOK, sent)
+	}
+
+	token, digest, err := h.config.LoginLinks.Issue(user.Username, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to issue login link", "error", err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to send sign-in link"})
+	}
+	if err := h.userStore.SetLoginLink(ctx, user.Username, digest); err != nil {
+		slog.ErrorContext(ctx, "Failed to store login link", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to send sign-in link"})
+	}
+
+	link := h.publicBaseURL(request) + "/login?link=" + url.QueryEscape(token)
+	subject := "TinyTail: your sign-in link"
+	body := fmt.Sprintf(`Use this link to sign in to TinyTail as %s:
+
+%s
+
+It works once and expires in %s. If you didn't ask for it, you can ignore this email.
+`, user.Username, link, describeDuration(h.config.LoginLinks.ttl))
+
+	// A send failure gets the same response too; it shows up in the logs
+	// and the SES failure counter instead
+	if err := h.mailer.Send(ctx, user.NotificationAddress(), subject, body, ""); err != nil {
+		slog.ErrorContext(ctx, "Failed to send login link", "recipient", user.NotificationAddress(), "error", err)
+		return jsonResponse(http.StatusOK, sent)
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Actor: user.Username, Action: store.AuditLoginLinkSent})
+
+	return jsonResponse(http.StatusOK, sent)
+}
+
+// redeemLoginLink signs in with a token from an emailed link. It takes a
+// POST from the login page rather than the link itself, so link scanners
+// fetching the URL don't use up the link.
+func (h *Handler) redeemLoginLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.config.LoginLinks == nil {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "Not found"})
+	}
+
+	var redeemReq struct {
+		Token    string `json:"token"`
+		Remember bool   `json:"remember"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &redeemReq); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	invalid := map[string]string{"error": "This sign-in link is invalid, expired or already used"}
+
+	claims := h.config.LoginLinks.Verify(redeemReq.Token, time.Now())
+	if claims == nil {
+		h.audit(ctx, request, store.AuditEvent{Action: store.AuditLoginFailed, Detail: "invalid login link"})
+		return jsonResponse(http.StatusUnauthorized, invalid)
+	}
+
+	consumed, err := h.userStore.ConsumeLoginLink(ctx, claims.Subject, nonceDigest(claims.Nonce))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to consume login link", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to sign in"})
+	}
+	if !consumed {
+		h.audit(ctx, request, store.AuditEvent{Actor: claims.Subject, Action: store.AuditLoginFailed, Detail: "login link already used"})
+		return jsonResponse(http.StatusUnauthorized, invalid)
+	}
+
+	user, err := h.userStore.GetUser(ctx, claims.Subject)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to sign in"})
+	}
+	if user == nil || user.Disabled {
+		h.audit(ctx, request, store.AuditEvent{Actor: claims.Subject, Action: store.AuditLoginFailed, Detail: "login link for disabled account"})
+		return jsonResponse(http.StatusUnauthorized, invalid)
+	}
+
+	return h.startSession(ctx, request, user, redeemReq.Remember, "login link")
+}
@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// logQuery is a LogQL log query in the subset TinyTail understands: a
+// stream selector and line filters, e.g.
+//
+//	{source="checkout", level=~"ERROR|WARN"} |= "timeout" != "retrying"
+//
+// Selectors can match level, source, logger and env, which picks the
+// environments to read (the default one unless it's given). Other pipeline
+// stages and metric queries aren't supported.
+type logQuery struct {
+	matchers []labelMatcher
+	filters  []lineFilter
+}
+
+// labelMatcher is one of a stream selector's matchers: =, !=, =~ or !~
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// lineFilter is a line filter expression: |=, !=, |~ or !~
+type lineFilter struct {
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (f lineFilter) matches(line string) bool {
+	switch f.op {
+	case "|=":
+		return strings.Contains(line, f.value)
+	case "!=":
+		return !strings.Contains(line, f.value)
+	case "|~":
+		return f.re.MatchString(line)
+	default:
+		return !f.re.MatchString(line)
+	}
+}
+
+// lokiLabels are the labels TinyTail's streams can have. env is the
+// environment an entry is from.
+var lokiLabels = []string{"env", "level", "logger", "source"}
+
+// matches reports whether an entry from the named environment is selected
+func (q logQuery) matches(env string, entry store.LogEntry) bool {
+	for _, m := range q.matchers {
+		if !m.matches(lokiLabel(env, entry, m.name)) {
+			return false
+		}
+	}
+	for _, f := range q.filters {
+		if !f.matches(entry.Message) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectsEnv reports whether the query reads an environment: those its
+// env matchers allow, or the default one if it has none
+func (q logQuery) selectsEnv(env string) bool {
+	matched := false
+	for _, m := range q.matchers {
+		if m.name != "env" {
+			continue
+		}
+		if !m.matches(env) {
+			return false
+		}
+		matched = true
+	}
+	return matched || env == store.DefaultEnvironment
+}
+
+// lokiLabel returns an entry's value for a label; labels it doesn't have
+// are empty, as in Loki
+func lokiLabel(env string, entry store.LogEntry, name string) string {
+	switch name {
+	case "env":
+		return env
+	case "level":
+		return entry.Level
+	case "logger":
+		return entry.Logger
+	case "source":
+		return entry.Source
+	}
+	return ""
+}
+
+// parseLogQL reads a log query
+func parseLogQL(query string) (logQuery, error) {
+	p := &logQLParser{input: query}
+	q, err := p.query()
+	if err != nil {
+		return logQuery{}, fmt.Errorf("parse error at position %d: %w", p.pos+1, err)
+	}
+	return q, nil
+}
+
+// parseStreamSelector reads a stream selector alone, as label and series
+// requests send in match[]
+func parseStreamSelector(selector string) (logQuery, error) {
+	q, err := parseLogQL(selector)
+	if err == nil && len(q.filters) > 0 {
+		err = fmt.Errorf("expected a stream selector, not a query")
+	}
+	return q, err
+}
+
+type logQLParser struct {
+	input string
+	pos   int
+}
+
+func (p *logQLParser) query() (logQuery, error) {
+	var q logQuery
+	p.skipSpace()
+	if !p.consume("{") {
+		if p.identifier() != "" {
+			return q, fmt.Errorf("metric queries aren't supported; only stream selectors with line filters are")
+		}
+		return q, fmt.Errorf("expected a stream selector like {source=\"web\"}")
+	}
+	for {
+		p.skipSpace()
+		if p.consume("}") {
+			break
+		}
+		if len(q.matchers) > 0 && !p.consume(",") {
+			return q, fmt.Errorf("expected , or }")
+		}
+		p.skipSpace()
+		name := p.identifier()
+		if name == "" {
+			return q, fmt.Errorf("expected a label name")
+		}
+		p.skipSpace()
+		op := p.operator("=~", "!~", "!=", "=")
+		if op == "" {
+			return q, fmt.Errorf("expected =, !=, =~ or !~ after %s", name)
+		}
+		p.skipSpace()
+		value, err := p.stringLiteral()
+		if err != nil {
+			return q, err
+		}
+		m := labelMatcher{name: name, op: op, value: value}
+		if op == "=~" || op == "!~" {
+			// Label regexes match the whole value, as in Prometheus
+			if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return q, err
+			}
+		}
+		q.matchers = append(q.matchers, m)
+	}
+
+	for {
+		p.skipSpace()
+		if p.pos == len(p.input) {
+			return q, nil
+		}
+		op := p.operator("|=", "!=", "|~", "!~")
+		if op == "" {
+			if p.consume("|") {
+				p.skipSpace()
+				return q, fmt.Errorf("the %q stage isn't supported; only line filters (|=, !=, |~, !~) are", p.identifier())
+			}
+			return q, fmt.Errorf("expected a line filter")
+		}
+		p.skipSpace()
+		value, err := p.stringLiteral()
+		if err != nil {
+			return q, err
+		}
+		f := lineFilter{op: op, value: value}
+		if op == "|~" || op == "!~" {
+			if f.re, err = regexp.Compile(value); err != nil {
+				return q, err
+			}
+		}
+		q.filters = append(q.filters, f)
+	}
+}
+
+func (p *logQLParser) skipSpace() {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\r\n", rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *logQLParser) consume(token string) bool {
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// operator consumes the first of ops found, longest first
+func (p *logQLParser) operator(ops ...string) string {
+	for _, op := range ops {
+		if p.consume(op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *logQLParser) identifier() string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || p.pos > start && c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+// stringLiteral reads a double-quoted string with Go escapes, or a raw
+// string in backquotes
+func (p *logQLParser) stringLiteral() (string, error) {
+	if p.pos == len(p.input) || (p.input[p.pos] != '"' && p.input[p.pos] != '`') {
+		return "", fmt.Errorf("expected a quoted string")
+	}
+	quote := p.input[p.pos]
+	for end := p.pos + 1; end < len(p.input); end++ {
+		if quote == '"' && p.input[end] == '\\' {
+			end++
+			continue
+		}
+		if p.input[end] == quote {
+			value, err := strconv.Unquote(p.input[p.pos : end+1])
+			if err != nil {
+				return "", fmt.Errorf("invalid string %s", p.input[p.pos:end+1])
+			}
+			p.pos = end + 1
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
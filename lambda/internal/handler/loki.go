@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Loki's defaults for requests that don't say how much to read
+const (
+	lokiDefaultRange = time.Hour
+	lokiDefaultLimit = 100
+)
+
+// lokiMaxLimit is the most lines a query returns
+const lokiMaxLimit = 5000
+
+// lokiLabelSample is how many of the newest entries label value and series
+// requests look at, since finding every value would read the whole range
+const lokiLabelSample = 5000
+
+// lokiEntry is an entry and the environment it's from
+type lokiEntry struct {
+	env string
+	store.LogEntry
+}
+
+// lokiStream is a stream in a query result; values are [Unix nanoseconds,
+// line] pairs
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func lokiSuccess(data any) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusOK, map[string]any{"status": "success", "data": data})
+}
+
+// lokiError answers as Loki does, with the error as plain text
+func lokiError(status int, message string) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		Body:       message,
+	}, nil
+}
+
+// lokiQueryRange answers Loki's range queries: the lines matching a log
+// query, newest first unless direction is forward, grouped into streams
+// by their labels
+func (h *Handler) lokiQueryRange(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	params := request.QueryStringParameters
+	end, err := parseLokiTime(params["end"], time.Now())
+	if err != nil {
+		return lokiError(http.StatusBadRequest, err.Error())
+	}
+	start, err := parseLokiTime(params["start"], end.Add(-lokiDefaultRange))
+	if err != nil {
+		return lokiError(http.StatusBadRequest, err.Error())
+	}
+	return h.lokiQuery(ctx, request, start, end)
+}
+
+// lokiInstantQuery answers Loki's instant queries, which for log queries
+// are range queries over the hour before time
+func (h *Handler) lokiInstantQuery(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	at, err := parseLokiTime(request.QueryStringParameters["time"], time.Now())
+	if err != nil {
+		return lokiError(http.StatusBadRequest, err.Error())
+	}
+	return h.lokiQuery(ctx, request, at.Add(-lokiDefaultRange), at)
+}
+
+func (h *Handler) lokiQuery(ctx context.Context, request events.APIGatewayProxyRequest, start, end time.Time) (events.APIGatewayProxyResponse, error) {
+	params := request.QueryStringParameters
+	query, err := parseLogQL(params["query"])
+	if err != nil {
+		return lokiError(http.StatusBadRequest, err.Error())
+	}
+	limit := lokiDefaultLimit
+	if limitStr := params["limit"]; limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 {
+			return lokiError(http.StatusBadRequest, "invalid limit")
+		}
+		limit = min(limit, lokiMaxLimit)
+	}
+	forward := strings.EqualFold(params["direction"], "forward")
+
+	entries, err := h.readLoki(ctx, query, start, end, limit, forward)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query logs for Loki", "error", err)
+		h.recordStoreError(err)
+		return lokiError(http.StatusInternalServerError, "failed to query logs")
+	}
+
+	streams := map[string]*lokiStream{}
+	var order []string
+	for _, entry := range entries {
+		labels := h.lokiStreamLabels(entry)
+		key := fmt.Sprint(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			order = append(order, key)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Message})
+	}
+	result := make([]*lokiStream, 0, len(order))
+	for _, key := range order {
+		result = append(result, streams[key])
+	}
+
+	return lokiSuccess(map[string]any{
+		"resultType": "streams",
+		"result":     result,
+		"stats":      map[string]any{},
+	})
+}
+
+// lokiLabelNames lists the labels streams can have
+func (h *Handler) lokiLabelNames(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	names := slices.Clone(lokiLabels)
+	if len(h.environments.Names()) < 2 {
+		names = slices.DeleteFunc(names, func(name string) bool { return name == "env" })
+	}
+	return lokiSuccess(names)
+}
+
+// lokiLabelValues lists a label's values among the newest entries in the
+// range that match the query, if one is given
+func (h *Handler) lokiLabelValues(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	name := pathParam(ctx, "name")
+	if name == "env" {
+		return lokiSuccess(h.environments.Names())
+	}
+	if !slices.Contains(lokiLabels, name) {
+		return lokiSuccess([]string{})
+	}
+
+	entries, err := h.lokiSample(ctx, request, []string{request.QueryStringParameters["query"]})
+	if err != nil {
+		return lokiError(http.StatusBadRequest, err.Error())
+	}
+	values := map[string]bool{}
+	for _, entry := range entries {
+		if value := lokiLabel(entry.env, entry.LogEntry, name); value != "" {
+			values[value] = true
+		}
+	}
+	return lokiSuccess(slices.Sorted(maps.Keys(values)))
+}
+
+// lokiSeries lists the label sets of the streams matching the match[]
+// selectors among the newest entries in the range
+func (h *Handler) lokiSeries(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	selectors := request.MultiValueQueryStringParameters["match[]"]
+	if len(selectors) == 0 {
+		if selector := request.QueryStringParameters["match[]"]; selector != "" {
+			selectors = []string{selector}
+		}
+	}
+	if len(selectors) == 0 {
+		return lokiError(http.StatusBadRequest, "match[] is required")
+	}
+
+	entries, err := h.lokiSample(ctx, request, selectors)
+	if err != nil {
+		return lokiError(http.StatusBadRequest, err.Error())
+	}
+	seen := map[string]bool{}
+	series := []map[string]string{}
+	for _, entry := range entries {
+		labels := h.lokiStreamLabels(entry)
+		if key := fmt.Sprint(labels); !seen[key] {
+			seen[key] = true
+			series = append(series, labels)
+		}
+	}
+	return lokiSuccess(series)
+}
+
+// lokiSample returns the newest entries in the request's range matching
+// any of the selectors; an empty selector matches everything
+func (h *Handler) lokiSample(ctx context.Context, request events.APIGatewayProxyRequest, selectors []string) ([]lokiEntry, error) {
+	params := request.QueryStringParameters
+	end, err := parseLokiTime(params["end"], time.Now())
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseLokiTime(params["start"], end.Add(-lokiDefaultRange))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []lokiEntry
+	seen := map[string]bool{}
+	for _, selector := range selectors {
+		query := logQuery{}
+		if strings.TrimSpace(selector) != "" {
+			if query, err = parseStreamSelector(selector); err != nil {
+				return nil, err
+			}
+		}
+		matched, err := h.readLoki(ctx, query, start, end, lokiLabelSample, false)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to read logs for Loki labels", "error", err)
+			h.recordStoreError(err)
+			return nil, fmt.Errorf("failed to read logs")
+		}
+		for _, entry := range matched {
+			if key := entry.env + "/" + entry.Cursor; !seen[key] {
+				seen[key] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// readLoki returns up to limit entries matching the query, from each
+// environment it selects, newest first unless forward. Near the request's
+// deadline it returns what it has.
+func (h *Handler) readLoki(ctx context.Context, query logQuery, start, end time.Time, limit int, forward bool) ([]lokiEntry, error) {
+	var entries []lokiEntry
+	for _, env := range h.environments.Names() {
+		if !query.selectsEnv(env) {
+			continue
+		}
+		logStore, _ := h.environments.Get(env)
+		each := logStore.EachLogNewestFirst
+		if forward {
+			each = logStore.EachLog
+		}
+
+		found := 0
+		err := each(ctx, start, end, func(entry store.LogEntry) bool {
+			if nearDeadline(ctx) {
+				slog.WarnContext(ctx, "Ran out of time reading logs for Loki", "env", env, "read_to", entry.Timestamp)
+				return false
+			}
+			if !query.matches(env, entry) {
+				return true
+			}
+			entries = append(entries, lokiEntry{env: env, LogEntry: entry})
+			found++
+			return found < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if forward {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		}
+		return entries[i].Timestamp.After(entries[j].Timestamp)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// lokiStreamLabels returns the labels of an entry's stream. Empty labels
+// are left out, as Loki does, and env only appears when there's more than
+// one environment.
+func (h *Handler) lokiStreamLabels(entry lokiEntry) map[string]string {
+	labels := map[string]string{}
+	for _, name := range lokiLabels {
+		if name == "env" && len(h.environments.Names()) < 2 {
+			continue
+		}
+		if value := lokiLabel(entry.env, entry.LogEntry, name); value != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// parseLokiTime reads a time as Loki accepts it: Unix nanoseconds, Unix
+// seconds with a fraction, or RFC3339
+func parseLokiTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ns), nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; use Unix nanoseconds or RFC3339", value)
+}
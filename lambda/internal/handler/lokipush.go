@@ -0,0 +1,380 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/protowire"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Loki's push API, /loki/api/v1/push, takes streams of lines, each stream
+// named by a set of labels. Promtail and Grafana Agent post a snappy-compressed protobuf
+// PushRequest; other clients may post the same as JSON:
+//
+//	{"streams": [{"stream": {"job": "api"}, "values": [["<unix ns>", "line", {"trace_id": "..."}]]}]}
+//
+// where the third element, the line's structured metadata, is optional.
+
+// lokiPushStream is a stream of a push request, decoded from either format
+type lokiPushStream struct {
+	Labels map[string]string
+	Lines  []lokiPushLine
+}
+
+// lokiPushLine is one line of a stream and its structured metadata
+type lokiPushLine struct {
+	Timestamp time.Time
+	Line      string
+	Metadata  map[string]string
+}
+
+// ingestLokiPush stores the lines of a Loki push request. It authenticates like
+// /logs/ingest and, as clients batch by size, has no batch limit.
+func (h *Handler) ingestLokiPush(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(secret.Env)
+	if !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", secret.Env)})
+	}
+
+	// Protobuf is binary media to API Gateway, so it arrives base64-encoded
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(request.Body); err != nil {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid base64 body"})
+		}
+	}
+	var streams []lokiPushStream
+	var err error
+	switch mediaType, _, _ := mime.ParseMediaType(requestHeader(request, "Content-Type")); mediaType {
+	case "application/x-protobuf":
+		streams, err = decodeLokiPush(body)
+	case "application/json":
+		streams, err = parseLokiPush(body)
+	default:
+		return jsonResponse(http.StatusUnsupportedMediaType, map[string]string{"error": "Content-Type must be application/x-protobuf or application/json"})
+	}
+	if err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid push request: " + err.Error()})
+	}
+
+	source := request.QueryStringParameters["source"]
+	var entries []store.LogEntry
+	for _, stream := range streams {
+		for _, line := range stream.Lines {
+			entries = append(entries, lokiPushEntry(stream.Labels, line, source))
+		}
+	}
+	secret.stamp(entries)
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	queued, stored, err := h.storeEntries(ctx, logStore, secret.Env, entries)
+	if err != nil {
+		return jsonResponse(http.StatusInternalServerError, map[string]any{"error": "Failed to store log", "stored": stored})
+	}
+	if len(entries) > 0 {
+		recordIngest(len(entries), len(body))
+	}
+
+	if queued > 0 {
+		return jsonResponse(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// lokiPushEntry turns a line into an entry. The source, logger and level
+// labels the query API serves become those fields, so streams read back
+// as they were pushed; without a source label, it's the service_name, app
+// or job label, unless the request names one. A trace_id becomes the
+// request ID. The other labels and the line's structured metadata are
+// appended to the message as key=value fields, so {job="api"} is found by
+// job=api.
+func lokiPushEntry(labels map[string]string, line lokiPushLine, source string) store.LogEntry {
+	fields := map[string]string{}
+	for name, value := range labels {
+		fields[name] = value
+	}
+	for name, value := range line.Metadata {
+		fields[name] = value
+	}
+
+	entry := store.LogEntry{
+		Message:   strings.TrimRight(line.Line, "\r\n"),
+		Timestamp: line.Timestamp,
+		Source:    cmp.Or(source, fields["source"], fields["service_name"], fields["app"], fields["job"], "loki"),
+		Logger:    fields["logger"],
+		RequestID: fields["trace_id"],
+	}
+	entry.Level = lineLevel(cmp.Or(fields["level"], fields["detected_level"]), entry.Message)
+	for _, name := range []string{"source", "logger", "level", "detected_level", "trace_id"} {
+		delete(fields, name)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var message strings.Builder
+	message.WriteString(entry.Message)
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&message, " %s=%s", name, value)
+	}
+	entry.Message = strings.TrimPrefix(message.String(), " ")
+	return entry
+}
+
+// parseLokiPush reads a push request in JSON
+func parseLokiPush(body []byte) ([]lokiPushStream, error) {
+	var push struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+
+	streams := make([]lokiPushStream, len(push.Streams))
+	for i, s := range push.Streams {
+		streams[i].Labels = s.Stream
+		for _, value := range s.Values {
+			if len(value) < 2 {
+				return nil, errors.New("each value must be [timestamp, line]")
+			}
+			var line lokiPushLine
+			var nanos string
+			if err := json.Unmarshal(value[0], &nanos); err != nil {
+				return nil, errors.New("timestamps must be strings of Unix nanoseconds")
+			}
+			n, err := strconv.ParseInt(nanos, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", nanos)
+			}
+			line.Timestamp = time.Unix(0, n)
+			if err := json.Unmarshal(value[1], &line.Line); err != nil {
+				return nil, errors.New("lines must be strings")
+			}
+			if len(value) > 2 {
+				if err := json.Unmarshal(value[2], &line.Metadata); err != nil {
+					return nil, errors.New("structured metadata must be an object of strings")
+				}
+			}
+			streams[i].Lines = append(streams[i].Lines, line)
+		}
+	}
+	return streams, nil
+}
+
+// decodeLokiPush reads a snappy-compressed protobuf PushRequest: streams
+// (field 1) of a labels string (1) and entries (2), each a timestamp (1),
+// line (2) and structured metadata name and value pairs (3)
+func decodeLokiPush(body []byte) ([]lokiPushStream, error) {
+	data, err := snappyDecode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var streams []lokiPushStream
+	r := protowire.NewReader(data)
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			var stream lokiPushStream
+			var labels string
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.BytesType:
+						labels = string(r.Bytes())
+					case field == 2 && wireType == protowire.BytesType:
+						var line lokiPushLine
+						r.Message(line.decode)
+						stream.Lines = append(stream.Lines, line)
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+			if stream.Labels, err = parseLokiLabels(labels); err != nil {
+				return nil, err
+			}
+			streams = append(streams, stream)
+		default:
+			r.Skip(wireType)
+		}
+	}
+	return streams, r.Err()
+}
+
+func (l *lokiPushLine) decode(r *protowire.Reader) {
+	for r.More() {
+		switch field, wireType := r.Key(); {
+		case field == 1 && wireType == protowire.BytesType:
+			// google.protobuf.Timestamp: seconds and nanos
+			var seconds, nanos int64
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.VarintType:
+						seconds = int64(r.Varint())
+					case field == 2 && wireType == protowire.VarintType:
+						nanos = int64(r.Varint())
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+			l.Timestamp = time.Unix(seconds, nanos)
+		case field == 2 && wireType == protowire.BytesType:
+			l.Line = string(r.Bytes())
+		case field == 3 && wireType == protowire.BytesType:
+			var name, value string
+			r.Message(func(r *protowire.Reader) {
+				for r.More() {
+					switch field, wireType := r.Key(); {
+					case field == 1 && wireType == protowire.BytesType:
+						name = string(r.Bytes())
+					case field == 2 && wireType == protowire.BytesType:
+						value = string(r.Bytes())
+					default:
+						r.Skip(wireType)
+					}
+				}
+			})
+			if l.Metadata == nil {
+				l.Metadata = map[string]string{}
+			}
+			l.Metadata[name] = value
+		default:
+			r.Skip(wireType)
+		}
+	}
+}
+
+// parseLokiLabels reads a stream's labels as the protobuf format sends
+// them, in PromQL's selector syntax: {job="api", env="prod"}
+func parseLokiLabels(text string) (map[string]string, error) {
+	labels := map[string]string{}
+	rest := strings.TrimSpace(text)
+	rest, ok := strings.CutPrefix(rest, "{")
+	if !ok || !strings.HasSuffix(rest, "}") {
+		return nil, fmt.Errorf("invalid labels %q", text)
+	}
+	rest = strings.TrimSpace(strings.TrimSuffix(rest, "}"))
+	for rest != "" {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid labels %q", text)
+		}
+		quoted, err := strconv.QuotedPrefix(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %q", text)
+		}
+		labels[strings.TrimSpace(name)], _ = strconv.Unquote(quoted)
+		rest = strings.TrimSpace(strings.TrimSpace(value)[len(quoted):])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+	return labels, nil
+}
+
+// maxLokiPushBytes bounds a decompressed push request, well past the 1 MB
+// batches Promtail sends by default
+const maxLokiPushBytes = 20 << 20
+
+// snappyDecode decompresses a snappy block: its length, then literals and
+// copies of earlier output
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > maxLokiPushBytes {
+		return nil, errors.New("invalid snappy length")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var size, offset int
+		switch tag & 3 {
+		case 0: // A literal, its length in the tag or the bytes after it
+			size = int(tag>>2) + 1
+			src = src[1:]
+			if size > 60 {
+				extra := size - 60
+				if len(src) < extra {
+					return nil, errors.New("truncated snappy literal")
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				size++
+				src = src[extra:]
+			}
+			if size > len(src) || len(dst)+size > int(length) {
+				return nil, errors.New("truncated snappy literal")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			size = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errors.New("truncated snappy copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+size > int(length) {
+			return nil, errors.New("invalid snappy copy")
+		}
+		// Copies may overlap what they're copying
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(length) {
+		return nil, errors.New("snappy data is shorter than its length")
+	}
+	return dst, nil
+}
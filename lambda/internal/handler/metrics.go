@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/tinytail/tinytail/internal/metrics"
+)
+
+// Authentication methods reported in the AuthFailures metric's Method
+// dimension
+const (
+	authMethodIngest    = "ingest"
+	authMethodIngestIAM = "ingest-iam"
+	authMethodAPIKey    = "api-key"
+	authMethodLogin     = "login"
+	authMethodSentry    = "sentry"
+	authMethodFirehose  = "firehose"
+)
+
+// recordAuthFailure logs rejected credentials and emits an AuthFailures
+// metric, so a spike shows up on a dashboard without searching the logs
+func recordAuthFailure(ctx context.Context, method string) {
+	slog.WarnContext(ctx, "Rejected credentials", "method", method)
+	metrics.Emit(map[string]string{"Method": method},
+		metrics.Metric{Name: "AuthFailures", Unit: metrics.Count, Value: 1})
+}
+
+// recordPanic logs a recovered panic with its stack and emits a Panics
+// metric
+func recordPanic(ctx context.Context, recovered any) {
+	slog.ErrorContext(ctx, "Recovered from panic handling request", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+	metrics.Emit(map[string]string{"Handler": "http"},
+		metrics.Metric{Name: "Panics", Unit: metrics.Count, Value: 1})
+}
+
+// recordIngest emits the entries and bytes an ingest request stored
+func recordIngest(entries, bytes int) {
+	metrics.Emit(nil,
+		metrics.Metric{Name: "IngestedEntries", Unit: metrics.Count, Value: float64(entries)},
+		metrics.Metric{Name: "IngestedBytes", Unit: metrics.Bytes, Value: float64(bytes)})
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// deviceFingerprint identifies the user agent and source IP a sign-in came
+// from, without storing either
+func deviceFingerprint(userAgent, sourceIP string) string {
+	sum := sha256.Sum256([]byte(userAgent + "\n" + sourceIP))
+	return hex.EncodeToString(sum[:16])
+}
+
+// publicBaseURL returns the externally reachable UI address, without a
+// trailing slash: TINYTAIL_BASE_URL if set, otherwise the host and stage the
+// request arrived on
+func (h *Handler) publicBaseURL(request events.APIGatewayProxyRequest) string {
+	if h.config.PublicBaseURL != "" {
+		return strings.TrimRight(h.config.PublicBaseURL, "/")
+	}
+	base := "https://" + requestHeader(request, "Host")
+	if stage := request.RequestContext.Stage; stage != "" && stage != "$default" {
+		base += "/" + stage
+	}
+	return base
+}
+
+// notifyNewDevice emails the user when they sign in from a user agent and
+// IP address combination they haven't used before, with a link that ends
+// the new session. Failures are logged; they never block the sign-in.
+func (h *Handler) notifyNewDevice(ctx context.Context, request events.APIGatewayProxyRequest, user *store.User, session *store.Session) {
+	if !h.config.LoginNotifications || user.CreatedAt.IsZero() {
+		return // Off, or the bootstrap admin, which has no account to track
+	}
+
+	sourceIP := request.RequestContext.Identity.SourceIP
+	isNew, err := h.userStore.RememberDevice(ctx, user.Username, deviceFingerprint(session.UserAgent, sourceIP))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to record sign-in device", "user", user.Username, "error", err)
+		h.recordStoreError(err)
+		return
+	}
+	recipient := user.NotificationAddress()
+	if !isNew || recipient == "" {
+		return
+	}
+
+	token, err := h.sessionStore.SetRevokeToken(ctx, session.SessionID)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to create revoke link", "user", user.Username, "error", err)
+		h.recordStoreError(err)
+		return
+	}
+
+	userAgent := session.UserAgent
+	if userAgent == "" {
+		userAgent = "unknown"
+	}
+	revokeLink := h.publicBaseURL(request) + "/auth/revoke?token=" + url.QueryEscape(token)
+
+	subject := fmt.Sprintf("TinyTail: new sign-in for %s", user.Username)
+	body := fmt.Sprintf(`Your TinyTail account %s was just signed in to from a device or network it hasn't used before.
+
+Time:       %s
+IP address: %s
+Browser:    %s
+
+If this was you, there's nothing to do.
+
+If it wasn't, end that session now and change your password:
+%s
+`, user.Username, session.CreatedAt.UTC().Format(time.RFC1123), sourceIP, userAgent, revokeLink)
+
+	if err := h.mailer.Send(ctx, recipient, subject, body, ""); err != nil {
+		slog.WarnContext(ctx, "Failed to send sign-in notification", "recipient", recipient, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "Sent new device sign-in notification", "user", user.Username)
+}
+
+// serveRevokePage shows the confirmation page for a revoke link. Revoking
+// takes a POST so link scanners fetching the URL don't end the session.
+func (h *Handler) serveRevokePage(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "text/html",
+		},
+		Body: revokeHTML,
+	}, nil
+}
+
+// revokeSession ends the session a sign-in notification was sent about.
+// The token is the only credential needed: whoever holds the email may end
+// the session, but can't use it.
+func (h *Handler) revokeSession(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var revokeReq struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &revokeReq); err != nil || revokeReq.Token == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "token is required"})
+	}
+
+	session, err := h.sessionStore.RevokeSession(ctx, revokeReq.Token)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to revoke session", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to end session"})
+	}
+	if session == nil {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "That session has already ended"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{
+		Actor:  session.Username,
+		Action: store.AuditSessionRevoke,
+		Detail: "from sign-in notification",
+	})
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"success": true, "username": session.Username})
+}
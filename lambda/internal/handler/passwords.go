@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// PasswordMaxAgeFromEnv reads TINYTAIL_PASSWORD_MAX_AGE_DAYS. Zero, the
+// default, lets passwords live forever.
+func PasswordMaxAgeFromEnv() (time.Duration, error) {
+	raw := os.Getenv("TINYTAIL_PASSWORD_MAX_AGE_DAYS")
+	if raw == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(raw)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("TINYTAIL_PASSWORD_MAX_AGE_DAYS must be a whole number of days, got %q", raw)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// passwordExpired reports whether the user must choose a new password
+// before signing in
+func (h *Handler) passwordExpired(user *store.User, now time.Time) bool {
+	if h.config.PasswordMaxAge == 0 || user.PasswordSetAt().IsZero() {
+		return false // Rotation is off, or this is the bootstrap login
+	}
+	return now.After(user.PasswordSetAt().Add(h.config.PasswordMaxAge))
+}
+
+// changePassword sets a new password for a user who proves they know the
+// current one. It doesn't need a session, so users whose password has
+// expired can still change it; the username defaults to the signed-in
+// user's. The user's other sessions are ended.
+func (h *Handler) changePassword(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var changeReq struct {
+		Username        string `json:"username"`
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &changeReq); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	sessionID := h.getSessionFromCookie(request)
+	username := strings.TrimSpace(changeReq.Username)
+	if username == "" && sessionID != "" {
+		if session, err := h.sessionStore.ValidateSession(ctx, sessionID); err == nil && session != nil {
+			username = session.Username
+		}
+	}
+	if username == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "username is required"})
+	}
+	if changeReq.NewPassword == changeReq.CurrentPassword {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "The new password must differ from the current one"})
+	}
+
+	user, err := h.userStore.Authenticate(ctx, username, changeReq.CurrentPassword)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to authenticate user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to change password"})
+	}
+	if user == nil {
+		if username == bootstrapUsername && h.config.UIPassword.Matches(changeReq.CurrentPassword) {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "The bootstrap password is set at deploy time; create a user account instead"})
+		}
+		h.audit(ctx, request, store.AuditEvent{Actor: username, Action: store.AuditPasswordChangeFailed})
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Invalid username or password"})
+	}
+
+	err = h.userStore.SetPassword(ctx, user.Username, changeReq.NewPassword)
+	switch {
+	case errors.Is(err, store.ErrInvalidPassword):
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to change password", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to change password"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Actor: user.Username, Action: store.AuditPasswordChange})
+
+	// Anyone holding a session from the old password loses it
+	if _, err := h.sessionStore.DeleteUserSessions(ctx, user.Username, sessionID); err != nil {
+		slog.ErrorContext(ctx, "Failed to end sessions after password change", "user", user.Username, "error", err)
+		h.recordStoreError(err)
+	}
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{"success": true})
+}
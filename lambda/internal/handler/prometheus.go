@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// queryDurationBuckets are the upper bounds, in seconds, of the query
+// latency histogram's buckets
+var queryDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// rollupFamily describes a rollup metric for the exposition format
+type rollupFamily struct {
+	name string
+	kind string
+	help string
+}
+
+// rollupFamilies are the metrics GET /metrics describes, in the order
+// they're written
+var rollupFamilies = []rollupFamily{
+	{store.RollupLogEntries, "counter", "Log entries stored, by environment, level and source, with sources past the first 100 counted as other."},
+	{store.RollupIngestRequests, "counter", "Ingest requests, by response status code."},
+	{store.RollupIngestErrors, "counter", "Ingest requests that were rejected or failed, by response status code."},
+	{store.RollupAlertEvaluations, "counter", "Alert rule evaluations, by rule and status."},
+	{store.RollupQueryDuration, "histogram", "Time to serve log queries, by route."},
+	{store.RollupForwardedEntries, "counter", "Log entries relayed by forwarding rules, by rule and outcome."},
+	{store.RollupDroppedEntries, "counter", "Log entries discarded at ingest by drop rules, by rule."},
+}
+
+// serveMetrics serves the rollup counters in Prometheus's text format
+func (h *Handler) serveMetrics(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if h.health == nil {
+		return jsonResponse(http.StatusServiceUnavailable, map[string]string{"error": "Metrics are kept in the alerts table, which does not exist"})
+	}
+	totals, err := h.health.Rollups(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read rollup counters", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to read metrics"})
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "text/plain; version=0.0.4; charset=utf-8",
+		},
+		Body: formatRollups(totals),
+	}, nil
+}
+
+// formatRollups writes rollup totals in the text exposition format. Series
+// of metrics this version doesn't know, written by a newer one, are listed
+// as untyped.
+func formatRollups(totals map[string]float64) string {
+	families := map[string][]string{}
+	for series := range totals {
+		name := rollupFamilyName(series)
+		families[name] = append(families[name], series)
+	}
+
+	var b strings.Builder
+	write := func(name, kind, help string) {
+		series := families[name]
+		if len(series) == 0 {
+			return
+		}
+		if help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, kind)
+		slices.SortFunc(series, compareSeries)
+		for _, s := range series {
+			fmt.Fprintf(&b, "%s %s\n", s, strconv.FormatFloat(totals[s], 'f', -1, 64))
+		}
+		delete(families, name)
+	}
+	for _, family := range rollupFamilies {
+		write(family.name, family.kind, family.help)
+	}
+	for _, name := range slices.Sorted(maps.Keys(families)) {
+		write(name, "untyped", "")
+	}
+	return b.String()
+}
+
+// rollupFamilyName returns the metric a series belongs to: its name, less
+// the _bucket, _sum or _count suffix for a histogram's series
+func rollupFamilyName(series string) string {
+	name, _, _ := strings.Cut(series, "{")
+	for _, family := range rollupFamilies {
+		if family.kind != "histogram" {
+			continue
+		}
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if name == family.name+suffix {
+				return family.name
+			}
+		}
+	}
+	return name
+}
+
+// compareSeries orders series by name and labels, with a histogram's
+// buckets in order of their bounds rather than alphabetically
+func compareSeries(a, b string) int {
+	aSeries, aBound := splitBound(a)
+	bSeries, bBound := splitBound(b)
+	if c := strings.Compare(aSeries, bSeries); c != 0 {
+		return c
+	}
+	return cmp.Compare(aBound, bBound)
+}
+
+// splitBound removes a bucket's le label, returning its bound
+func splitBound(series string) (string, float64) {
+	i := strings.Index(series, `le="`)
+	if i < 0 {
+		return series, 0
+	}
+	value, rest, ok := strings.Cut(series[i+len(`le="`):], `"`)
+	bound, err := strconv.ParseFloat(value, 64) // Including "+Inf"
+	if !ok || err != nil {
+		return series, 0
+	}
+	return series[:i] + rest, bound
+}
+
+// countedIngest counts ingest requests, and those that were rejected or
+// failed, by response status code
+func (h *Handler) countedIngest(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		response, err := next(ctx, request)
+		status := response.StatusCode
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		code := strconv.Itoa(status)
+		h.health.AddRollup(store.RollupSeries(store.RollupIngestRequests, "code", code), 1)
+		if status >= http.StatusBadRequest {
+			h.health.AddRollup(store.RollupSeries(store.RollupIngestErrors, "code", code), 1)
+		}
+		return response, err
+	}
+}
+
+// maxVolumeSources bounds the sources log volume is counted by. Every
+// series is an attribute of the one rollups item, which can't grow past
+// DynamoDB's 400 KB item limit, and sources are whatever producers send.
+const maxVolumeSources = 100
+
+// otherVolumeSource counts the entries of sources past maxVolumeSources
+const otherVolumeSource = "other"
+
+// volumeSourcesReload is how often a container rereads the sources already
+// counted, so containers mostly agree on which they are
+const volumeSourcesReload = time.Minute
+
+// volumeSources is the sources log volume is counted by
+type volumeSources struct {
+	mu       sync.Mutex
+	known    map[string]bool
+	loadedAt time.Time
+}
+
+// loadVolumeSources reads the sources already counted from the rollups
+func (h *Handler) loadVolumeSources(ctx context.Context) []string {
+	totals, err := h.health.Rollups(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read the sources log volume is counted by", "error", err)
+	}
+	var sources []string
+	for series := range totals {
+		rest, ok := strings.CutPrefix(series, store.RollupLogEntries+"{")
+		if !ok {
+			continue
+		}
+		if _, quoted, ok := strings.Cut(rest, `,source="`); ok {
+			sources = append(sources, sourceLabelUnescaper.Replace(strings.TrimSuffix(quoted, `"}`)))
+		}
+	}
+	return sources
+}
+
+// sourceLabelUnescaper undoes the escaping of RollupSeries label values
+var sourceLabelUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+
+// volumeSource returns the label source's entries are counted under: the
+// source, if it's already counted or there's room for it, or else
+// otherVolumeSource
+func (h *Handler) volumeSource(ctx context.Context, source string) string {
+	v := &h.volumeSources
+	v.mu.Lock()
+	// One caller rereads the sources, without holding up the others, which
+	// go on with those already known
+	if v.known == nil || time.Since(v.loadedAt) >= volumeSourcesReload {
+		if v.known == nil {
+			v.known = map[string]bool{}
+		}
+		v.loadedAt = time.Now()
+		v.mu.Unlock()
+		sources := h.loadVolumeSources(ctx)
+		v.mu.Lock()
+		for _, known := range sources {
+			v.known[known] = true
+		}
+	}
+	defer v.mu.Unlock()
+
+	if v.known[source] {
+		return source
+	}
+	if len(v.known) < maxVolumeSources {
+		v.known[source] = true
+		return source
+	}
+	return otherVolumeSource
+}
+
+// recordIngestedVolume counts stored entries by environment, level and
+// source, with sources past maxVolumeSources counted as otherVolumeSource
+func (h *Handler) recordIngestedVolume(ctx context.Context, env string, entries []store.LogEntry) {
+	if h.health == nil || len(entries) == 0 {
+		return
+	}
+	if env == "" {
+		env = store.DefaultEnvironment
+	}
+	for _, entry := range entries {
+		source := h.volumeSource(ctx, entry.Source)
+		h.health.AddRollup(store.RollupSeries(store.RollupLogEntries, "env", env, "level", entry.Level, "source", source), 1)
+	}
+}
+
+// timedQuery adds the time to serve a log query to the query latency
+// histogram
+func (h *Handler) timedQuery(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		response, err := next(ctx, request)
+		seconds := time.Since(start).Seconds()
+
+		route := routePattern(ctx)
+		bucket := store.RollupQueryDuration + "_bucket"
+		for _, bound := range queryDurationBuckets {
+			if seconds <= bound {
+				h.health.AddRollup(store.RollupSeries(bucket, "route", route, "le", strconv.FormatFloat(bound, 'f', -1, 64)), 1)
+			}
+		}
+		h.health.AddRollup(store.RollupSeries(bucket, "route", route, "le", "+Inf"), 1)
+		h.health.AddRollup(store.RollupSeries(store.RollupQueryDuration+"_sum", "route", route), seconds)
+		h.health.AddRollup(store.RollupSeries(store.RollupQueryDuration+"_count", "route", route), 1)
+		return response, err
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/metrics"
+)
+
+// RateLimitConfig caps how fast each ingest secret, ingest key or IAM
+// caller may send entries, so one runaway producer can't flood the table.
+// Each container keeps its own token buckets, so the cap applies per
+// container rather than across them.
+type RateLimitConfig struct {
+	// PerSecond is the sustained rate in entries per second; zero disables
+	// the limit
+	PerSecond float64
+
+	// Burst is how many entries may arrive at once after a quiet spell
+	Burst float64
+}
+
+// RateLimitConfigFromEnv reads TINYTAIL_INGEST_RATE_LIMIT, entries per
+// second, and TINYTAIL_INGEST_RATE_BURST, which defaults to ten seconds'
+// worth and is never less than a full batch.
+func RateLimitConfigFromEnv() (RateLimitConfig, error) {
+	var config RateLimitConfig
+	if raw := os.Getenv("TINYTAIL_INGEST_RATE_LIMIT"); raw != "" {
+		perSecond, err := strconv.ParseFloat(raw, 64)
+		if err != nil || perSecond < 0 || math.IsInf(perSecond, 0) {
+			return config, fmt.Errorf("TINYTAIL_INGEST_RATE_LIMIT must be a number of entries per second, got %q", raw)
+		}
+		config.PerSecond = perSecond
+	}
+	config.Burst = max(10*config.PerSecond, MaxIngestBatch)
+
+	if raw := os.Getenv("TINYTAIL_INGEST_RATE_BURST"); raw != "" {
+		burst, err := strconv.Atoi(raw)
+		if err != nil || burst < MaxIngestBatch {
+			return config, fmt.Errorf("TINYTAIL_INGEST_RATE_BURST must be a number of entries of at least %d, got %q", MaxIngestBatch, raw)
+		}
+		config.Burst = float64(burst)
+	}
+	return config, nil
+}
+
+// rateLimiter holds a token bucket for each producer
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the entries a producer may send now, refilled at the
+// configured rate up to the burst
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take spends n of the producer's tokens, or returns how long until it has
+// enough. A batch larger than the burst costs the whole burst.
+func (l *rateLimiter) take(config RateLimitConfig, producer string, n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	bucket, ok := l.buckets[producer]
+	if !ok {
+		bucket = &tokenBucket{tokens: config.Burst, updated: now}
+		l.buckets[producer] = bucket
+	}
+	bucket.tokens = min(config.Burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*config.PerSecond)
+	bucket.updated = now
+
+	cost := min(float64(n), config.Burst)
+	if bucket.tokens >= cost {
+		bucket.tokens -= cost
+		return 0
+	}
+	return time.Duration((cost - bucket.tokens) / config.PerSecond * float64(time.Second))
+}
+
+// throttled returns how long the producer must wait before sending the
+// entries, or zero if they may be stored now
+func (h *Handler) throttled(ctx context.Context, secret *IngestSecret, entries int) time.Duration {
+	if h.config.IngestRateLimit.PerSecond <= 0 || secret == nil || entries == 0 {
+		return 0
+	}
+	wait := h.ingestLimiter.take(h.config.IngestRateLimit, secret.ID, entries, time.Now())
+	if wait > 0 {
+		recordIngestThrottled(ctx, secret.ID, entries)
+	}
+	return wait
+}
+
+// ingestThrottled answers a throttled ingest request
+func ingestThrottled(wait time.Duration) (events.APIGatewayProxyResponse, error) {
+	response, err := jsonResponse(http.StatusTooManyRequests, map[string]string{"error": "Rate limit exceeded"})
+	return withRetryAfter(response, wait), err
+}
+
+// withRetryAfter tells the producer how many seconds to wait, rounded up
+func withRetryAfter(response events.APIGatewayProxyResponse, wait time.Duration) events.APIGatewayProxyResponse {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers["Retry-After"] = strconv.Itoa(int(math.Ceil(wait.Seconds())))
+	return response
+}
+
+// recordIngestThrottled logs a throttled request and emits an
+// IngestThrottled metric counting the entries turned away
+func recordIngestThrottled(ctx context.Context, secretID string, entries int) {
+	slog.WarnContext(ctx, "Throttled ingest request", "secret_id", secretID, "entries", entries)
+	metrics.Emit(nil,
+		metrics.Metric{Name: "IngestThrottled", Unit: metrics.Count, Value: float64(entries)})
+}
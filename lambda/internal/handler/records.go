@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// maxRecordBytes bounds a decompressed record, well past the 1 MB a
+// Firehose or Kinesis record may be
+const maxRecordBytes = 20 << 20
+
+// cloudWatchLogsData is the batch a CloudWatch Logs subscription filter
+// delivers, gzipped, as each record of a stream
+type cloudWatchLogsData struct {
+	MessageType string `json:"messageType"` // DATA_MESSAGE, or CONTROL_MESSAGE to check the stream
+	LogGroup    string `json:"logGroup"`
+	LogStream   string `json:"logStream"`
+	LogEvents   []struct {
+		Timestamp int64  `json:"timestamp"` // Unix milliseconds
+		Message   string `json:"message"`
+	} `json:"logEvents"`
+}
+
+// RecordEntries reads the entries in a record delivered by a stream. A
+// record may be a CloudWatch Logs subscription's batch, or lines that are
+// each an entry as JSON or plain text, optionally gzipped. Entries without
+// a source get the one given.
+func RecordEntries(data []byte, source string) ([]store.LogEntry, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(io.LimitReader(zr, maxRecordBytes+1)); err != nil {
+			return nil, err
+		}
+		if len(data) > maxRecordBytes {
+			return nil, errors.New("record is too large once decompressed")
+		}
+	}
+
+	var logsData cloudWatchLogsData
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) && json.Unmarshal(data, &logsData) == nil && logsData.MessageType != "" {
+		entries := make([]store.LogEntry, 0, len(logsData.LogEvents))
+		if logsData.MessageType != "DATA_MESSAGE" {
+			return entries, nil
+		}
+		for _, event := range logsData.LogEvents {
+			message := strings.TrimRight(event.Message, "\r\n")
+			entries = append(entries, store.LogEntry{
+				Timestamp: time.UnixMilli(event.Timestamp),
+				Level:     lineLevel("", message),
+				Source:    logsData.LogGroup,
+				Logger:    logsData.LogStream,
+				Message:   message,
+			})
+		}
+		return entries, nil
+	}
+
+	var entries []store.LogEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		entries = append(entries, LineEntry(line, source))
+	}
+	return entries, scanner.Err()
+}
+
+// LineEntry reads a line of a log file or stream record: an entry as JSON
+// if it is one, and otherwise plain text with its level guessed from the
+// message. Entries without a source get the one given.
+func LineEntry(line, source string) store.LogEntry {
+	var entry store.LogEntry
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &entry) != nil || entry.Message == "" {
+		entry = store.LogEntry{Message: line, Level: lineLevel("", line)}
+	}
+	if entry.Source == "" {
+		entry.Source = source
+	}
+	return entry
+}
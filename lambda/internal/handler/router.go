@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// routeFunc handles a request once the router has picked its route
+type routeFunc func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// middleware wraps a route with behaviour shared between routes, such as
+// checking the caller's role
+type middleware func(routeFunc) routeFunc
+
+// routeEntry is one method and path pattern and what serves it
+type routeEntry struct {
+	method   string
+	pattern  string
+	segments []string
+	handle   routeFunc
+}
+
+// router matches requests to routes by method and path. A pattern is a
+// path whose segments may be {name} parameters, read with pathParam.
+type router struct {
+	routes []routeEntry
+
+	// middleware runs around every matched route, outside its own
+	middleware []middleware
+}
+
+// use adds middleware that runs around every route
+func (r *router) use(middleware ...middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// handle adds a route. Its middleware runs in the order given, before the
+// route itself.
+func (r *router) handle(method, pattern string, handle routeFunc, middleware ...middleware) {
+	r.routes = append(r.routes, routeEntry{
+		method:   method,
+		pattern:  pattern,
+		segments: splitPath(pattern),
+		handle:   chain(handle, middleware),
+	})
+}
+
+// chain wraps handle so the first middleware runs first
+func chain(handle routeFunc, middleware []middleware) routeFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handle = middleware[i](handle)
+	}
+	return handle
+}
+
+// matchedRoute is the route serving a request, kept in its context
+type matchedRoute struct {
+	pattern string
+	params  map[string]string
+}
+
+type matchedRouteKey struct{}
+
+// pathParam returns a {name} segment of the request's path
+func pathParam(ctx context.Context, name string) string {
+	if route, ok := ctx.Value(matchedRouteKey{}).(*matchedRoute); ok {
+		return route.params[name]
+	}
+	return ""
+}
+
+// routePattern returns the pattern of the route serving the request
+func routePattern(ctx context.Context) string {
+	if route, ok := ctx.Value(matchedRouteKey{}).(*matchedRoute); ok {
+		return route.pattern
+	}
+	return ""
+}
+
+// serve runs the route for the request's method and path, which has had
+// any stage prefix removed. A path served only for other methods gets a
+// 405 listing them.
+func (r *router) serve(ctx context.Context, request events.APIGatewayProxyRequest, path string) (events.APIGatewayProxyResponse, error) {
+	segments := splitPath(path)
+	var allowed []string
+	for _, route := range r.routes {
+		params, ok := matchPath(route.segments, segments)
+		if !ok {
+			continue
+		}
+		if route.method != request.HTTPMethod {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		ctx = context.WithValue(ctx, matchedRouteKey{}, &matchedRoute{pattern: route.pattern, params: params})
+		return chain(route.handle, r.middleware)(ctx, request)
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		response, err := jsonResponse(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		response.Headers["Allow"] = strings.Join(allowed, ", ")
+		return response, err
+	}
+	return jsonResponse(http.StatusNotFound, map[string]string{"error": "Not found"})
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// matchPath matches path segments against a pattern's, returning the
+// values of its {name} segments
+func matchPath(pattern, path []string) (map[string]string, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, segment := range pattern {
+		if name, ok := strings.CutPrefix(segment, "{"); ok && strings.HasSuffix(name, "}") {
+			if path[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[strings.TrimSuffix(name, "}")] = path[i]
+			continue
+		}
+		if segment != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// authenticated requires a session (see requireAuth)
+func (h *Handler) authenticated(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return h.requireAuth(ctx, request, next)
+	}
+}
+
+// withRole requires a session or API key with at least the role (see
+// requireRole)
+func (h *Handler) withRole(role string) middleware {
+	return func(next routeFunc) routeFunc {
+		return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			return h.requireRole(ctx, request, role, next)
+		}
+	}
+}
+
+// sessionsOnly hides routes that sign in, out or manage sessions when
+// there are none, in no-auth mode
+func (h *Handler) sessionsOnly(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if h.config.NoAuth {
+			return jsonResponse(http.StatusNotFound, map[string]string{"error": "Sign-in is disabled in no-auth mode"})
+		}
+		return next(ctx, request)
+	}
+}
+
+// sameOrigin rejects browser requests made by another site. Browsers send
+// Origin with every POST; it must name the host the request was made to,
+// or that of the configured public URL. Requests without one, such as
+// scripts using an API key, are let through.
+func (h *Handler) sameOrigin(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		origin := requestHeader(request, "Origin")
+		if origin != "" && !h.trustedOrigin(request, origin) {
+			slog.WarnContext(ctx, "Rejected cross-site request", "origin", origin)
+			return jsonResponse(http.StatusForbidden, map[string]string{"error": "Cross-site request rejected"})
+		}
+		return next(ctx, request)
+	}
+}
+
+func (h *Handler) trustedOrigin(request events.APIGatewayProxyRequest, origin string) bool {
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false // Includes "null", sent by sandboxed and redirected pages
+	}
+	hosts := []string{requestHeader(request, "X-Forwarded-Host"), requestHeader(request, "Host")}
+	if public, err := url.Parse(h.config.PublicBaseURL); err == nil {
+		hosts = append(hosts, public.Host)
+	}
+	for _, host := range hosts {
+		if host != "" && strings.EqualFold(host, parsed.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// observed emits a RequestLatency metric per route, so a slow endpoint
+// shows up without searching the logs
+func observed(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		response, err := next(ctx, request)
+		metrics.Emit(map[string]string{"Route": request.HTTPMethod + " " + routePattern(ctx)},
+			metrics.Metric{Name: "RequestLatency", Unit: metrics.Milliseconds, Value: metrics.Since(start)})
+		return response, err
+	}
+}
+
+// gzipMinBytes is the smallest response worth compressing
+const gzipMinBytes = 1024
+
+// gzipped compresses large responses for clients that accept gzip, when
+// TINYTAIL_GZIP_RESPONSES is on. The body is sent base64-encoded, which
+// HTTP APIs, load balancers and `tinytail serve` decode; REST APIs only do
+// for binary media types.
+func (h *Handler) gzipped(next routeFunc) routeFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		response, err := next(ctx, request)
+		if err != nil || !h.config.GzipResponses || response.IsBase64Encoded || len(response.Body) < gzipMinBytes ||
+			!strings.Contains(requestHeader(request, "Accept-Encoding"), "gzip") {
+			return response, err
+		}
+
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write([]byte(response.Body)); err != nil {
+			return response, nil
+		}
+		if err := writer.Close(); err != nil {
+			return response, nil
+		}
+
+		if response.Headers == nil {
+			response.Headers = map[string]string{}
+		}
+		response.Headers["Content-Encoding"] = "gzip"
+		response.Headers["Vary"] = "Accept-Encoding"
+		response.Body = base64.StdEncoding.EncodeToString(compressed.Bytes())
+		response.IsBase64Encoded = true
+		return response, nil
+	}
+}
+
+// routes lists every endpoint with the checks it needs
+func (h *Handler) routes() *router {
+	r := &router{}
+	r.use(observed)
+
+	readOnly := h.withRole(store.RoleReadOnly)
+	readWrite := h.withRole(store.RoleReadWrite)
+	admin := h.withRole(store.RoleAdmin)
+
+	// Public routes - no auth required
+	r.handle("GET", "/login", h.serveLoginPage, h.sessionsOnly)
+	r.handle("POST", "/auth/login", h.handleLogin, h.sessionsOnly, h.sameOrigin)
+	r.handle("POST", "/auth/password", h.changePassword, h.sessionsOnly, h.sameOrigin)
+	r.handle("POST", "/auth/link", h.requestLoginLink, h.sessionsOnly, h.sameOrigin)
+	r.handle("POST", "/auth/link/redeem", h.redeemLoginLink, h.sessionsOnly, h.sameOrigin)
+	r.handle("GET", "/auth/revoke", h.serveRevokePage, h.sessionsOnly)
+	r.handle("POST", "/auth/revoke", h.revokeSession, h.sessionsOnly, h.sameOrigin)
+	r.handle("POST", "/logs/ingest", h.ingestLogs, h.countedIngest)
+	r.handle("POST", "/logs/ingest/iam", h.ingestLogsIAM, h.countedIngest)
+	r.handle("POST", "/logs/ingest/firelens", h.ingestFireLens, h.countedIngest)
+	r.handle("POST", "/logs/ingest/syslog", h.ingestSyslog, h.countedIngest)
+	r.handle("POST", "/logs/ingest/vector", h.ingestVector, h.countedIngest)
+	r.handle("POST", "/logs/ingest/firehose", h.ingestFirehose, h.countedIngest)
+	r.handle("POST", "/logs/ingest/lambda", h.ingestLambdaTelemetry, h.countedIngest)
+	r.handle("POST", "/heartbeat", h.postHeartbeat, h.countedIngest)
+	r.handle("POST", "/api/{project}/envelope", h.ingestSentryEnvelope, h.countedIngest)
+	r.handle("POST", "/api/{project}/store", h.ingestSentryEvent, h.countedIngest)
+	r.handle("GET", "/js/{file}", h.serveStaticJS)
+
+	// Feed readers can't sign in; the URL carries a signed token instead
+	r.handle("GET", "/feeds/errors.atom", h.serveErrorsFeed, h.gzipped)
+
+	// Protected routes - require a session, or a session or API key with
+	// the route's minimum role
+	r.handle("GET", "/", h.serveIndex, h.authenticated)
+	r.handle("POST", "/auth/logout", h.handleLogout, h.sessionsOnly, h.sameOrigin, h.authenticated)
+	r.handle("GET", "/logs/latest", h.getLatestLogs, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/logs", h.getLogs, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/logs/date", h.getLogsByDate, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/logs/datetime", h.getLogsByDateTime, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/logs/search", h.searchLogs, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/environments", h.listEnvironments, readOnly)
+	r.handle("GET", "/metrics", h.serveMetrics, readOnly)
+	r.handle("GET", "/heartbeats/stale", h.listStaleSources, readOnly)
+	r.handle("POST", "/feeds/token", h.createFeedToken, h.sameOrigin, readOnly)
+
+	// Grafana's JSON data sources POST their queries from its server, so
+	// these read-only routes don't check the origin
+	r.handle("GET", "/grafana", h.grafanaTest, readOnly)
+	r.handle("POST", "/grafana/search", h.grafanaSearch, readOnly)
+	r.handle("POST", "/grafana/query", h.grafanaQuery, readOnly, h.gzipped, h.timedQuery)
+	r.handle("POST", "/grafana/annotations", h.grafanaAnnotations, readOnly, h.gzipped, h.timedQuery)
+
+	// Enough of Loki's query API for Grafana's Loki data source
+	r.handle("GET", "/loki/api/v1/query_range", h.lokiQueryRange, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/loki/api/v1/query", h.lokiInstantQuery, readOnly, h.gzipped, h.timedQuery)
+	r.handle("GET", "/loki/api/v1/labels", h.lokiLabelNames, readOnly)
+	r.handle("GET", "/loki/api/v1/label", h.lokiLabelNames, readOnly)
+	r.handle("GET", "/loki/api/v1/label/{name}/values", h.lokiLabelValues, readOnly)
+	r.handle("GET", "/loki/api/v1/series", h.lokiSeries, readOnly, h.gzipped)
+	r.handle("POST", "/loki/api/v1/push", h.ingestLokiPush, h.countedIngest)
+	r.handle("POST", "/alerts/preview", h.previewAlertRule, h.sameOrigin, readWrite, h.gzipped)
+
+	// Admin routes - require the admin role
+	r.handle("GET", "/admin/users", h.listUsers, admin)
+	r.handle("POST", "/admin/users", h.createUser, h.sameOrigin, admin)
+	r.handle("POST", "/admin/users/disable", h.setUserDisabled(true), h.sameOrigin, admin)
+	r.handle("POST", "/admin/users/enable", h.setUserDisabled(false), h.sameOrigin, admin)
+	r.handle("POST", "/admin/users/role", h.setUserRole, h.sameOrigin, admin)
+	r.handle("GET", "/admin/api-keys", h.listAPIKeys, admin)
+	r.handle("POST", "/admin/api-keys", h.createAPIKey, h.sameOrigin, admin)
+	r.handle("POST", "/admin/api-keys/revoke", h.revokeAPIKey, h.sameOrigin, admin)
+	r.handle("GET", "/admin/ingest-keys", h.listIngestKeys, admin)
+	r.handle("POST", "/admin/ingest-keys", h.createIngestKey, h.sameOrigin, admin)
+	r.handle("POST", "/admin/ingest-keys/label", h.labelIngestKey, h.sameOrigin, admin)
+	r.handle("POST", "/admin/ingest-keys/revoke", h.revokeIngestKey, h.sameOrigin, admin)
+	r.handle("GET", "/admin/forwarding-rules", h.listForwardingRules, admin)
+	r.handle("POST", "/admin/forwarding-rules", h.createForwardingRule, h.sameOrigin, admin)
+	r.handle("POST", "/admin/forwarding-rules/delete", h.deleteForwardingRule, h.sameOrigin, admin)
+	r.handle("GET", "/admin/drop-rules", h.listDropRules, admin)
+	r.handle("POST", "/admin/drop-rules", h.createDropRule, h.sameOrigin, admin)
+	r.handle("POST", "/admin/drop-rules/delete", h.deleteDropRule, h.sameOrigin, admin)
+	r.handle("POST", "/admin/heartbeats/forget", h.forgetHeartbeat, h.sameOrigin, admin)
+	r.handle("POST", "/admin/sessions/prune", h.pruneSessions, h.sessionsOnly, h.sameOrigin, admin)
+	r.handle("GET", "/audit", h.listAuditEvents, admin, h.gzipped)
+
+	return r
+}
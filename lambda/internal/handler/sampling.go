@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// SampleRates stores only a share of the entries at noisy levels, such as
+// 5% of DEBUG, so they can be left on in production without paying to store
+// every one. Levels not listed are all stored.
+type SampleRates map[string]float64
+
+// SampleRatesFromEnv reads TINYTAIL_SAMPLE_RATES, comma-separated
+// LEVEL=rate pairs where the rate is a fraction or a percentage, e.g.
+// DEBUG=5%,TRACE=0.01
+func SampleRatesFromEnv() (SampleRates, error) {
+	raw := os.Getenv("TINYTAIL_SAMPLE_RATES")
+	if raw == "" {
+		return nil, nil
+	}
+
+	rates := SampleRates{}
+	for _, pair := range strings.Split(raw, ",") {
+		level, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		level = strings.ToUpper(strings.TrimSpace(level))
+		if !ok || level == "" {
+			return nil, fmt.Errorf("TINYTAIL_SAMPLE_RATES: %q is not LEVEL=rate", pair)
+		}
+		value = strings.TrimSpace(value)
+		percent := strings.HasSuffix(value, "%")
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if percent {
+			rate /= 100
+		}
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("TINYTAIL_SAMPLE_RATES: the rate for %s must be between 0 and 1 or 0%% and 100%%, got %q", level, value)
+		}
+		rates[level] = rate
+	}
+	return rates, nil
+}
+
+// sample decides whether to store an entry, setting the SampleRate of one
+// kept at a level that's sampled, so counts can be scaled back up. An entry
+// with a dedup or stable ID gets the same answer each time it's sent.
+func (r SampleRates) sample(entry *store.LogEntry) bool {
+	rate, ok := r[strings.ToUpper(entry.Level)]
+	if !ok || rate >= 1 {
+		return true
+	}
+
+	draw := rand.Float64()
+	if name := cmp.Or(entry.DedupID, entry.StableID); name != "" {
+		hash := fnv.New64a()
+		hash.Write([]byte(name))
+		draw = float64(hash.Sum64()>>11) / (1 << 53)
+	}
+	if draw >= rate {
+		return false
+	}
+
+	entry.SampleRate = rate
+	return true
+}
+
+// recordSampledOut emits a SampledOut metric counting the entries sampling
+// dropped
+func recordSampledOut(entries int) {
+	if entries == 0 {
+		return
+	}
+	metrics.Emit(nil,
+		metrics.Metric{Name: "SampledOut", Unit: metrics.Count, Value: float64(entries)})
+}
@@ -0,0 +1,443 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Sentry SDKs report to a DSN, https://KEY@HOST/PATH/PROJECT, by posting
+// envelopes to PATH/api/PROJECT/envelope/ (or, in old SDKs, single events
+// to PATH/api/PROJECT/store/). With an ingest secret as the key and the
+// API's URL as the rest, they report to TinyTail, which stores each error
+// event as an entry with its stack trace in the message. The project ID is
+// only there because SDKs require one.
+
+// maxSentryBody bounds a decompressed envelope, as Sentry's own limit does
+const maxSentryBody = 20 << 20
+
+// ingestSentryEnvelope stores the events in a Sentry envelope. Its other
+// items, such as sessions and transactions, are accepted and dropped.
+func (h *Handler) ingestSentryEnvelope(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body, err := sentryBody(request)
+	if err != nil {
+		return sentryResponse(http.StatusUnsupportedMediaType, map[string]string{"detail": err.Error()})
+	}
+	header, sentryEvents, err := parseSentryEnvelope(body)
+	if err != nil {
+		return sentryResponse(http.StatusBadRequest, map[string]string{"detail": "Invalid envelope: " + err.Error()})
+	}
+
+	// Browser SDKs may only name the key in the envelope's DSN
+	dsnKey := ""
+	if dsn, err := url.Parse(header.DSN); err == nil && dsn.User != nil {
+		dsnKey = dsn.User.Username()
+	}
+	secret := h.authenticateSentry(ctx, request, dsnKey)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodSentry)
+		return sentryResponse(http.StatusUnauthorized, map[string]string{"detail": "Unauthorized"})
+	}
+	return h.storeSentryEvents(ctx, secret, sentryEvents, header.EventID, len(body))
+}
+
+// ingestSentryEvent stores a single event posted to the store endpoint
+func (h *Handler) ingestSentryEvent(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateSentry(ctx, request, "")
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodSentry)
+		return sentryResponse(http.StatusUnauthorized, map[string]string{"detail": "Unauthorized"})
+	}
+	body, err := sentryBody(request)
+	if err != nil {
+		return sentryResponse(http.StatusUnsupportedMediaType, map[string]string{"detail": err.Error()})
+	}
+	var event sentryEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return sentryResponse(http.StatusBadRequest, map[string]string{"detail": "Invalid event"})
+	}
+	return h.storeSentryEvents(ctx, secret, []sentryEvent{event}, event.EventID, len(body))
+}
+
+// storeSentryEvents stores events as entries in the secret's environment
+// and answers as Sentry does, with the ID of the event
+func (h *Handler) storeSentryEvents(ctx context.Context, secret *IngestSecret, sentryEvents []sentryEvent, id string, bodyBytes int) (events.APIGatewayProxyResponse, error) {
+	env := secret.Env
+	logStore, ok := h.environments.Get(env)
+	if !ok {
+		return sentryResponse(http.StatusBadRequest, map[string]string{"detail": fmt.Sprintf("Unknown environment %q", env)})
+	}
+
+	entries := make([]store.LogEntry, len(sentryEvents))
+	for i, event := range sentryEvents {
+		entries[i] = event.entry()
+	}
+	secret.stamp(entries)
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		response, err := sentryResponse(http.StatusTooManyRequests, map[string]string{"detail": "Rate limit exceeded"})
+		return withRetryAfter(response, wait), err
+	}
+	if _, _, err := h.storeEntries(ctx, logStore, env, entries); err != nil {
+		return sentryResponse(http.StatusInternalServerError, map[string]string{"detail": "Failed to store event"})
+	}
+	if len(entries) > 0 {
+		recordIngest(len(entries), bodyBytes)
+	}
+	return sentryResponse(http.StatusOK, map[string]string{"id": id})
+}
+
+// sentryResponse is a JSON response browser SDKs may read from any origin
+func sentryResponse(status int, body any) (events.APIGatewayProxyResponse, error) {
+	response, err := jsonResponse(status, body)
+	response.Headers["Access-Control-Allow-Origin"] = "*"
+	return response, err
+}
+
+// authenticateSentry returns the ingest secret a Sentry request was made
+// with, or nil. SDKs send the DSN's key in X-Sentry-Auth, or from browsers
+// in the sentry_key query parameter or the envelope. They can't sign
+// requests, so nothing is accepted when signatures are required.
+func (h *Handler) authenticateSentry(ctx context.Context, request events.APIGatewayProxyRequest, dsnKey string) *IngestSecret {
+	if h.config.IngestSignature.Required {
+		slog.WarnContext(ctx, "Rejected Sentry request because ingest signatures are required")
+		return nil
+	}
+
+	key := request.QueryStringParameters["sentry_key"]
+	for _, header := range []string{"X-Sentry-Auth", "Authorization"} {
+		params, ok := strings.CutPrefix(requestHeader(request, header), "Sentry ")
+		if !ok {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			if name, value, _ := strings.Cut(strings.TrimSpace(param), "="); name == "sentry_key" {
+				key = value
+			}
+		}
+	}
+	key = cmp.Or(key, dsnKey)
+	if key == "" {
+		return nil
+	}
+
+	secret := h.matchIngestSecret(ctx, key)
+	if secret == nil {
+		return nil
+	}
+	if secret.Expired(time.Now()) {
+		slog.WarnContext(ctx, "Rejected Sentry request using an expired secret", "secret_id", secret.ID)
+		return nil
+	}
+	return secret
+}
+
+// sentryBody returns a request's body, decompressed. Envelopes are binary
+// media to API Gateway, so they arrive base64-encoded.
+func sentryBody(request events.APIGatewayProxyRequest) ([]byte, error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(request.Body); err != nil {
+			return nil, errors.New("invalid base64 body")
+		}
+	}
+
+	var reader io.Reader
+	switch encoding := requestHeader(request, "Content-Encoding"); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.New("invalid gzip body")
+		}
+		reader = zr
+	case "deflate":
+		reader = flate.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q; configure the SDK to use gzip", encoding)
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxSentryBody+1))
+	if err != nil || len(data) > maxSentryBody {
+		return nil, errors.New("body could not be decompressed")
+	}
+	return data, nil
+}
+
+// sentryEnvelopeHeader is the first line of an envelope
+type sentryEnvelopeHeader struct {
+	EventID string `json:"event_id"`
+	DSN     string `json:"dsn"`
+}
+
+// parseSentryEnvelope reads an envelope's header and its event items. An
+// envelope is a header line, then items: each a header line and a payload
+// of the header's length, or up to the next newline without one.
+func parseSentryEnvelope(body []byte) (sentryEnvelopeHeader, []sentryEvent, error) {
+	var header sentryEnvelopeHeader
+	r := bufio.NewReader(bytes.NewReader(body))
+	line, err := r.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return header, nil, err
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, nil, errors.New("invalid header")
+	}
+
+	var sentryEvents []sentryEvent
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return header, sentryEvents, nil
+			}
+			continue
+		}
+		var item struct {
+			Type   string `json:"type"`
+			Length *int   `json:"length"`
+		}
+		if err := json.Unmarshal(line, &item); err != nil {
+			return header, nil, errors.New("invalid item header")
+		}
+
+		var payload []byte
+		if item.Length != nil {
+			if *item.Length < 0 || *item.Length > len(body) {
+				return header, nil, errors.New("invalid item length")
+			}
+			payload = make([]byte, *item.Length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return header, nil, errors.New("item is shorter than its length")
+			}
+			if next, err := r.Peek(1); err == nil && next[0] == '\n' {
+				r.Discard(1)
+			}
+		} else {
+			payload, err = r.ReadBytes('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				return header, nil, err
+			}
+		}
+
+		if item.Type != "event" {
+			continue
+		}
+		var event sentryEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return header, nil, errors.New("invalid event")
+		}
+		sentryEvents = append(sentryEvents, event)
+	}
+}
+
+// sentryEvent is the part of a Sentry event TinyTail keeps
+type sentryEvent struct {
+	EventID     string          `json:"event_id"`
+	Timestamp   json.RawMessage `json:"timestamp"` // RFC3339 or Unix seconds
+	Level       string          `json:"level"`
+	Logger      string          `json:"logger"`
+	ServerName  string          `json:"server_name"`
+	Release     string          `json:"release"`
+	Environment string          `json:"environment"`
+	Transaction string          `json:"transaction"`
+	Message     json.RawMessage `json:"message"` // A string, or like LogEntry
+	LogEntry    *struct {
+		Formatted string `json:"formatted"`
+		Message   string `json:"message"`
+	} `json:"logentry"`
+	Exception json.RawMessage `json:"exception"` // {"values": [...]}, or the list
+	Tags      json.RawMessage `json:"tags"`      // An object, or [key, value] pairs
+	Contexts  struct {
+		Trace struct {
+			TraceID string `json:"trace_id"`
+		} `json:"trace"`
+	} `json:"contexts"`
+}
+
+// sentryException is one exception of an event, with its stack trace
+// listed oldest frame first
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Module     string `json:"module"`
+	Stacktrace *struct {
+		Frames []struct {
+			Function string `json:"function"`
+			Module   string `json:"module"`
+			Filename string `json:"filename"`
+			AbsPath  string `json:"abs_path"`
+			Lineno   int    `json:"lineno"`
+		} `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+// sentryLevels maps Sentry's levels to TinyTail's
+var sentryLevels = map[string]string{
+	"fatal":   "FATAL",
+	"error":   "ERROR",
+	"warning": "WARN",
+	"info":    "INFO",
+	"log":     "INFO",
+	"debug":   "DEBUG",
+}
+
+// entry turns an event into an entry. The message is the event's message
+// and exceptions, outermost first like a Java stack trace, with the tags,
+// environment and release as key=value fields on the first line. The trace
+// ID, or else the event ID, is the request ID.
+func (e *sentryEvent) entry() store.LogEntry {
+	var exceptions []sentryException
+	if err := json.Unmarshal(e.Exception, &exceptions); err != nil {
+		var wrapped struct {
+			Values []sentryException `json:"values"`
+		}
+		_ = json.Unmarshal(e.Exception, &wrapped)
+		exceptions = wrapped.Values
+	}
+
+	var lines []string
+	if message := e.message(); message != "" {
+		lines = append(lines, message)
+	}
+	for i := len(exceptions) - 1; i >= 0; i-- {
+		exception := exceptions[i]
+		line := cmp.Or(exception.Type, "Error")
+		if exception.Module != "" {
+			line = exception.Module + "." + line
+		}
+		if exception.Value != "" {
+			line += ": " + exception.Value
+		}
+		if i < len(exceptions)-1 {
+			line = "Caused by: " + line
+		}
+		lines = append(lines, line)
+		if exception.Stacktrace == nil {
+			continue
+		}
+		frames := exception.Stacktrace.Frames
+		for j := len(frames) - 1; j >= 0; j-- {
+			frame := frames[j]
+			function := cmp.Or(frame.Function, "?")
+			if frame.Module != "" {
+				function = frame.Module + "." + function
+			}
+			location := cmp.Or(frame.Filename, frame.AbsPath, "unknown")
+			if frame.Lineno > 0 {
+				location += ":" + strconv.Itoa(frame.Lineno)
+			}
+			lines = append(lines, fmt.Sprintf("    at %s (%s)", function, location))
+		}
+	}
+	if len(lines) == 0 {
+		lines = []string{"(no message)"}
+	}
+	lines[0] += e.fields()
+
+	source := e.ServerName
+	if name, _, ok := strings.Cut(e.Release, "@"); ok && name != "" {
+		source = name
+	}
+	return store.LogEntry{
+		Timestamp: e.time(),
+		Level:     cmp.Or(sentryLevels[strings.ToLower(e.Level)], "ERROR"),
+		Source:    cmp.Or(source, "sentry"),
+		Logger:    cmp.Or(e.Logger, "sentry"),
+		RequestID: cmp.Or(e.Contexts.Trace.TraceID, e.EventID),
+		Message:   strings.Join(lines, "\n"),
+	}
+}
+
+// message returns the event's own message, if it has one
+func (e *sentryEvent) message() string {
+	if e.LogEntry != nil {
+		return cmp.Or(e.LogEntry.Formatted, e.LogEntry.Message)
+	}
+	var text string
+	if json.Unmarshal(e.Message, &text) == nil {
+		return text
+	}
+	var structured struct {
+		Formatted string `json:"formatted"`
+		Message   string `json:"message"`
+	}
+	_ = json.Unmarshal(e.Message, &structured)
+	return cmp.Or(structured.Formatted, structured.Message)
+}
+
+// fields formats the tags, environment, release and transaction as
+// key=value pairs, quoting values with spaces
+func (e *sentryEvent) fields() string {
+	fields := map[string]string{}
+	for name, value := range map[string]string{"environment": e.Environment, "release": e.Release, "transaction": e.Transaction} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	var tags map[string]any
+	if err := json.Unmarshal(e.Tags, &tags); err != nil {
+		var pairs [][2]any
+		_ = json.Unmarshal(e.Tags, &pairs)
+		tags = map[string]any{}
+		for _, pair := range pairs {
+			if name, ok := pair[0].(string); ok {
+				tags[name] = pair[1]
+			}
+		}
+	}
+	for name, value := range tags {
+		fields[name] = fmt.Sprint(value)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", name, value)
+	}
+	return b.String()
+}
+
+// time reads the event's timestamp, which SDKs send as RFC3339 or as Unix
+// seconds
+func (e *sentryEvent) time() time.Time {
+	var seconds float64
+	if json.Unmarshal(e.Timestamp, &seconds) == nil && seconds > 0 {
+		return time.UnixMicro(int64(seconds * 1e6))
+	}
+	var text string
+	if json.Unmarshal(e.Timestamp, &text) == nil {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999"} {
+			if t, err := time.Parse(layout, text); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Now()
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SignatureHeader carries an HMAC of the ingest request body, in the form
+// "t=<unix seconds>,v1=<hex HMAC-SHA256>", with "k=<key ID>" added for
+// requests signed with an ingest key. The HMAC covers "<t>.<body>" and is
+// keyed with the credential's signing key (see store.IngestSigningKey),
+// which is kept apart from the digest the bearer token is checked against.
+const SignatureHeader = "X-TinyTail-Signature"
+
+// DefaultSignatureWindow is how far a signature's timestamp may be from now
+const DefaultSignatureWindow = 5 * time.Minute
+
+var (
+	errSignatureMalformed = errors.New("malformed signature header")
+	errSignatureStale     = errors.New("signature timestamp outside the replay window")
+	errSignatureMismatch  = errors.New("signature does not match")
+	errSignatureBody      = errors.New("base64 body does not decode")
+)
+
+// SignatureConfig controls verification of signed ingest requests. Signed
+// requests are always verified; Required also rejects unsigned ones.
+type SignatureConfig struct {
+	Required bool
+	Window   time.Duration
+}
+
+// SignatureConfigFromEnv reads TINYTAIL_INGEST_SIGNATURE ("optional", the
+// default, or "required") and TINYTAIL_INGEST_SIGNATURE_WINDOW_SECONDS.
+func SignatureConfigFromEnv() (SignatureConfig, error) {
+	config := SignatureConfig{Window: DefaultSignatureWindow}
+
+	switch mode := os.Getenv("TINYTAIL_INGEST_SIGNATURE"); mode {
+	case "", "optional":
+	case "required":
+		config.Required = true
+	default:
+		return config, fmt.Errorf("TINYTAIL_INGEST_SIGNATURE must be \"optional\" or \"required\", got %q", mode)
+	}
+
+	if raw := os.Getenv("TINYTAIL_INGEST_SIGNATURE_WINDOW_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return config, fmt.Errorf("TINYTAIL_INGEST_SIGNATURE_WINDOW_SECONDS must be a positive number of seconds, got %q", raw)
+		}
+		config.Window = time.Duration(seconds) * time.Second
+	}
+
+	return config, nil
+}
+
+// requestHeader looks up a header regardless of how the client cased it
+func requestHeader(request events.APIGatewayProxyRequest, name string) string {
+	if value, ok := request.Headers[name]; ok {
+		return value
+	}
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// signature is a parsed X-TinyTail-Signature header
+type signature struct {
+	timestamp string
+	keyID     string
+	mac       []byte
+}
+
+// parseSignature reads a signature header, checking that its timestamp is
+// within window of now
+func parseSignature(header string, now time.Time, window time.Duration) (signature, error) {
+	var sig signature
+	for _, field := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "t":
+			sig.timestamp = value
+		case "k":
+			sig.keyID = value
+		case "v1":
+			decoded, err := hex.DecodeString(value)
+			if err != nil {
+				return sig, errSignatureMalformed
+			}
+			sig.mac = decoded
+		}
+	}
+	if sig.timestamp == "" || sig.mac == nil {
+		return sig, errSignatureMalformed
+	}
+
+	seconds, err := strconv.ParseInt(sig.timestamp, 10, 64)
+	if err != nil {
+		return sig, errSignatureMalformed
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > window || skew < -window {
+		return sig, errSignatureStale
+	}
+	return sig, nil
+}
+
+// message is what the signature covers: its timestamp, a dot and the body
+func (sig signature) message(body []byte) []byte {
+	return append([]byte(sig.timestamp+"."), body...)
+}
+
+// verifySignature returns the configured secret or ingest key that signed a
+// request. The body is checked as the producer sent it, decoded if API
+// Gateway passed it on base64-encoded.
+func (h *Handler) verifySignature(ctx context.Context, request events.APIGatewayProxyRequest, header string, now time.Time) (*IngestSecret, error) {
+	sig, err := parseSignature(header, now, h.config.IngestSignature.Window)
+	if err != nil {
+		return nil, err
+	}
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		if body, err = base64.StdEncoding.DecodeString(request.Body); err != nil {
+			return nil, errSignatureBody
+		}
+	}
+	message := sig.message(body)
+
+	if sig.keyID == "" {
+		return h.config.IngestSecrets.VerifySignature(sig, message)
+	}
+	secret := h.signingIngestKey(ctx, sig.keyID)
+	if secret == nil || !secret.Credential.verifyHMAC(message, sig.mac) {
+		return nil, errSignatureMismatch
+	}
+	return secret, nil
+}
+
+// VerifySignature returns the configured secret whose signing key produced
+// the signature over message. Every secret is checked so the time taken
+// doesn't depend on which one matched.
+func (s IngestSecrets) VerifySignature(sig signature, message []byte) (*IngestSecret, error) {
+	var matched *IngestSecret
+	for i := range s {
+		if s[i].Credential.verifyHMAC(message, sig.mac) && matched == nil {
+			matched = &s[i]
+		}
+	}
+	if matched == nil {
+		return nil, errSignatureMismatch
+	}
+	return matched, nil
+}
+
+// verifyHMAC reports whether mac is the HMAC-SHA256 of message keyed with the
+// credential's signing key. A credential without one verifies nothing.
+func (c *Credential) verifyHMAC(message, mac []byte) bool {
+	if c == nil || c.signingKey == nil {
+		return false
+	}
+	h := hmac.New(sha256.New, c.signingKey)
+	h.Write(message)
+	return hmac.Equal(h.Sum(nil), mac)
+}
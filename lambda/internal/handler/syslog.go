@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Syslog relays (rsyslog's omhttp, syslog-ng's http destination, and the
+// appliances that embed them) post one or more messages per request: a line
+// each, octet-counted as in RFC 6587 ("<length> <message>"), or as a JSON
+// array of strings. Each message may be RFC 5424 or the older BSD format of
+// RFC 3164.
+
+// syslogLevels maps a message's severity, the low three bits of its
+// priority, to a level, as the agent's journal input does
+var syslogLevels = [8]string{"FATAL", "FATAL", "FATAL", "ERROR", "WARN", "INFO", "INFO", "DEBUG"}
+
+// syslogFacilities names the facilities, the rest of the priority
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// syslogDefaultPriority is user.notice, which RFC 3164 says relays assume
+// for messages without a priority
+const syslogDefaultPriority = 13
+
+// ingestSyslog stores the syslog messages in the body of an ingest request.
+// Each becomes an entry whose source is the sending host and whose logger
+// is the application; the facility, process ID, message ID and structured
+// data are added to the message as key=value fields.
+func (h *Handler) ingestSyslog(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(secret.Env)
+	if !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", secret.Env)})
+	}
+	messages, err := splitSyslogMessages(request.Body)
+	if err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	// Hosts that leave out their name are named by the request instead
+	source := cmp.Or(request.QueryStringParameters["source"], "syslog")
+	now := time.Now()
+	entries := make([]store.LogEntry, len(messages))
+	for i, message := range messages {
+		entries[i] = parseSyslog(message, now)
+		entries[i].Source = cmp.Or(entries[i].Source, source)
+	}
+	secret.stamp(entries)
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	queued, stored, err := h.storeEntries(ctx, logStore, secret.Env, entries)
+	if err != nil {
+		return jsonResponse(http.StatusInternalServerError, map[string]any{"error": "Failed to store log", "stored": stored})
+	}
+	recordIngest(len(entries), len(request.Body))
+
+	if queued > 0 {
+		return jsonResponse(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// splitSyslogMessages splits a body into messages, skipping blank lines
+func splitSyslogMessages(body string) ([]string, error) {
+	body = strings.TrimSpace(body)
+	if strings.HasPrefix(body, "[") {
+		var messages []string
+		if err := json.Unmarshal([]byte(body), &messages); err != nil {
+			return nil, errors.New("a JSON body must be an array of strings")
+		}
+		return messages, nil
+	}
+
+	var messages []string
+	for body != "" {
+		// Octet counting: the length, a space, then exactly that many bytes
+		if digits, rest, ok := strings.Cut(body, " "); ok && strings.HasPrefix(rest, "<") {
+			if length, err := strconv.Atoi(digits); err == nil {
+				if length > len(rest) {
+					return nil, fmt.Errorf("message %d is shorter than its length", len(messages)+1)
+				}
+				messages = append(messages, rest[:length])
+				body = strings.TrimLeft(rest[length:], "\r\n ")
+				continue
+			}
+		}
+		line, rest, _ := strings.Cut(body, "\n")
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			messages = append(messages, line)
+		}
+		body = rest
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("no syslog messages in the body")
+	}
+	return messages, nil
+}
+
+// parseSyslog turns a message into an entry. Whatever can't be parsed is
+// kept in the message, so nothing a device sent is lost.
+func parseSyslog(message string, now time.Time) store.LogEntry {
+	priority, rest := syslogPriority(message)
+	fields := map[string]string{}
+	if facility := priority / 8; facility < len(syslogFacilities) {
+		fields["facility"] = syslogFacilities[facility]
+	}
+
+	var entry store.LogEntry
+	if after, ok := strings.CutPrefix(rest, "1 "); ok {
+		entry = parseRFC5424(after, fields)
+	} else {
+		entry = parseRFC3164(rest, fields, now)
+	}
+	entry.Level = syslogLevels[priority%8]
+
+	names := make([]string, 0, len(fields))
+	for name, value := range fields {
+		if value != "" && value != "-" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(entry.Message)
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", name, value)
+	}
+	entry.Message = strings.TrimPrefix(b.String(), " ")
+	return entry
+}
+
+// syslogPriority reads the <PRI> a message starts with
+func syslogPriority(message string) (int, string) {
+	if !strings.HasPrefix(message, "<") {
+		return syslogDefaultPriority, message
+	}
+	digits, rest, ok := strings.Cut(message[1:], ">")
+	priority, err := strconv.Atoi(digits)
+	if !ok || err != nil || len(digits) > 3 || priority < 0 || priority > 191 {
+		return syslogDefaultPriority, message
+	}
+	return priority, rest
+}
+
+// parseRFC5424 reads what follows "<PRI>1 ": the timestamp, host name, app
+// name, process ID and message ID, structured data, and the message.
+// Structured data parameters become fields.
+func parseRFC5424(header string, fields map[string]string) store.LogEntry {
+	parts := strings.SplitN(header, " ", 6)
+	if len(parts) < 6 {
+		return store.LogEntry{Message: header}
+	}
+	var entry store.LogEntry
+	if t, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+		entry.Timestamp = t
+	}
+	entry.Source = nilValue(parts[1])
+	entry.Logger = nilValue(parts[2])
+	fields["pid"] = parts[3]
+	fields["msgid"] = parts[4]
+
+	rest := parts[5]
+	if after, ok := strings.CutPrefix(rest, "-"); ok {
+		rest = after
+	} else {
+		rest = parseStructuredData(rest, fields)
+	}
+	entry.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return entry
+}
+
+// nilValue reads RFC 5424's "-" as empty
+func nilValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// parseStructuredData reads the [id name="value" ...] elements at the start
+// of text into fields, returning what follows them
+func parseStructuredData(text string, fields map[string]string) string {
+	for strings.HasPrefix(text, "[") {
+		i := 1
+		// The element's ID, then its parameters
+		for i < len(text) && text[i] != ' ' && text[i] != ']' {
+			i++
+		}
+		for i < len(text) && text[i] == ' ' {
+			i++
+			start := i
+			for i < len(text) && text[i] != '=' {
+				i++
+			}
+			name := text[start:i]
+			if i+1 >= len(text) || text[i+1] != '"' {
+				return text
+			}
+			i += 2
+			var value strings.Builder
+			for i < len(text) && text[i] != '"' {
+				if text[i] == '\\' && i+1 < len(text) && strings.IndexByte(`"\]`, text[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(text[i])
+				i++
+			}
+			fields[name] = value.String()
+			i++ // The closing quote
+		}
+		if i >= len(text) || text[i] != ']' {
+			return text
+		}
+		text = text[i+1:]
+	}
+	return text
+}
+
+// bsdTimestamp is RFC 3164's timestamp, without a year or time zone
+const bsdTimestamp = "Jan _2 15:04:05"
+
+// parseRFC3164 reads the BSD format: a timestamp, the host name, and a tag
+// such as "sshd[1234]:" before the message. Many devices leave out the host
+// name or send an RFC 3339 timestamp instead, so both are allowed.
+func parseRFC3164(text string, fields map[string]string, now time.Time) store.LogEntry {
+	var entry store.LogEntry
+	if len(text) >= len(bsdTimestamp) {
+		if t, err := time.ParseInLocation(bsdTimestamp, text[:len(bsdTimestamp)], time.UTC); err == nil {
+			// The year is the one that puts the time nearest now
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			entry.Timestamp = t
+			text = strings.TrimPrefix(text[len(bsdTimestamp):], " ")
+		}
+	}
+	if entry.Timestamp.IsZero() {
+		first, rest, _ := strings.Cut(text, " ")
+		if t, err := time.Parse(time.RFC3339Nano, first); err == nil {
+			entry.Timestamp = t
+			text = rest
+		}
+	}
+
+	// Without a timestamp, there's no telling a host name from a word
+	if first, rest, ok := strings.Cut(text, " "); ok && !entry.Timestamp.IsZero() && !strings.HasSuffix(first, ":") && !strings.Contains(first, "[") {
+		entry.Source = first
+		text = rest
+	}
+	if tag, rest, ok := strings.Cut(text, ": "); ok && len(tag) <= 48 && !strings.Contains(tag, " ") {
+		if name, pid, ok := strings.Cut(tag, "["); ok {
+			tag = name
+			fields["pid"] = strings.TrimSuffix(pid, "]")
+		}
+		entry.Logger = tag
+		text = rest
+	}
+	entry.Message = text
+	return entry
+}
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// A Lambda extension subscribed to the Telemetry API (or the older Logs
+// API) is sent batches of the function's output and Lambda's own platform
+// events as a JSON array of {"time", "type", "record"} objects. An
+// extension that relays each batch unchanged to /logs/ingest/lambda stores
+// the function's logs without them going through CloudWatch Logs.
+
+// lambdaTextLevel matches the level the Node.js and Python runtimes put in
+// each line of text output: "INFO" after the timestamp and request ID, or
+// "[INFO]" first
+var lambdaTextLevel = regexp.MustCompile(`^\[?(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL)\]?$`)
+
+// telemetryEvent is one event of a Telemetry API batch
+type telemetryEvent struct {
+	Time   time.Time       `json:"time"`
+	Type   string          `json:"type"`
+	Record json.RawMessage `json:"record"`
+}
+
+// ingestLambdaTelemetry stores a batch of Telemetry API events. It
+// authenticates like /logs/ingest. The source is the request's source
+// parameter, which an extension sets to AWS_LAMBDA_FUNCTION_NAME, or else
+// the ingest key's label, or "lambda".
+func (h *Handler) ingestLambdaTelemetry(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(secret.Env)
+	if !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", secret.Env)})
+	}
+	var batch []telemetryEvent
+	if err := json.Unmarshal([]byte(request.Body), &batch); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	source := request.QueryStringParameters["source"]
+	entries := make([]store.LogEntry, 0, len(batch))
+	for _, event := range batch {
+		if entry, ok := telemetryEntry(event, source); ok {
+			entries = append(entries, entry)
+		}
+	}
+	secret.stamp(entries)
+	for i := range entries {
+		entries[i].Source = cmp.Or(entries[i].Source, "lambda")
+	}
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	queued, stored, err := h.storeEntries(ctx, logStore, secret.Env, entries)
+	if err != nil {
+		return jsonResponse(http.StatusInternalServerError, map[string]any{"error": "Failed to store log", "stored": stored})
+	}
+	recordIngest(len(entries), len(request.Body))
+
+	if queued > 0 {
+		return jsonResponse(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// telemetryEntry turns an event into an entry; ok is false for an event
+// with nothing to store, such as an empty line
+func telemetryEntry(event telemetryEvent, source string) (entry store.LogEntry, ok bool) {
+	entry = store.LogEntry{Source: source, Timestamp: event.Time, Logger: event.Type}
+	switch event.Type {
+	case "function", "extension":
+		var line string
+		if err := json.Unmarshal(event.Record, &line); err == nil {
+			return lambdaTextEntry(entry, line)
+		}
+		var record map[string]any
+		if err := json.Unmarshal(event.Record, &record); err != nil || record == nil {
+			return entry, false
+		}
+		return lambdaJSONEntry(entry, record), true
+	default:
+		var record map[string]any
+		if err := json.Unmarshal(event.Record, &record); err != nil {
+			record = map[string]any{}
+			if len(event.Record) > 0 && string(event.Record) != "null" {
+				record["record"] = string(event.Record)
+			}
+		}
+		return platformEntry(entry, event.Type, record), true
+	}
+}
+
+// lambdaTextEntry reads a line of a function's text output. The Node.js
+// runtime writes "<time>\t<request ID>\t<LEVEL>\t<message>" and Python
+// "[LEVEL]\t<time>\t<request ID>\t<message>"; other lines are stored whole,
+// with the level found in them if there is one.
+func lambdaTextEntry(entry store.LogEntry, line string) (store.LogEntry, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return entry, false
+	}
+	entry.Message = line
+
+	parts := strings.SplitN(line, "\t", 4)
+	if len(parts) == 4 {
+		level, timestamp, requestID := parts[2], parts[0], parts[1]
+		if lambdaTextLevel.MatchString(parts[0]) {
+			level, timestamp, requestID = parts[0], parts[1], parts[2]
+		}
+		if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil && lambdaTextLevel.MatchString(level) {
+			entry.Timestamp = t
+			entry.RequestID = requestID
+			entry.Level = strings.Trim(level, "[]")
+			entry.Message = parts[3]
+		}
+	}
+	entry.Level = lineLevel(entry.Level, entry.Message)
+	return entry, true
+}
+
+// lambdaJSONEntry reads a log record a function wrote with Lambda's JSON log
+// format. Its message, level and requestId fill those fields, and the rest
+// are appended to the message as key=value fields.
+func lambdaJSONEntry(entry store.LogEntry, record map[string]any) store.LogEntry {
+	take := func(name string) string {
+		value, ok := record[name]
+		if !ok {
+			return ""
+		}
+		delete(record, name)
+		if s, ok := value.(string); ok {
+			return s
+		}
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+
+	entry.Message = strings.TrimRight(cmp.Or(take("message"), take("msg")), "\r\n")
+	entry.Level = take("level")
+	entry.RequestID = take("requestId")
+	entry.Logger = cmp.Or(take("logger"), entry.Logger)
+	if t, err := time.Parse(time.RFC3339Nano, take("timestamp")); err == nil {
+		entry.Timestamp = t
+	}
+	entry.Message = withFields(entry.Message, record)
+	return entry
+}
+
+// platformEntry describes one of Lambda's own events, such as
+// platform.report with an invocation's duration and memory use. An event
+// with a status other than success is an ERROR, platform.logsDropped a
+// WARN, and the reports INFO; the rest, such as platform.start, are DEBUG.
+func platformEntry(entry store.LogEntry, eventType string, record map[string]any) store.LogEntry {
+	if requestID, ok := record["requestId"].(string); ok {
+		entry.RequestID = requestID
+		delete(record, "requestId")
+	}
+
+	status, _ := record["status"].(string)
+	switch {
+	case status != "" && status != "success":
+		entry.Level = "ERROR"
+	case eventType == "platform.logsDropped":
+		entry.Level = "WARN"
+	case eventType == "platform.report" || eventType == "platform.initReport":
+		entry.Level = "INFO"
+	default:
+		entry.Level = "DEBUG"
+	}
+	entry.Logger = "platform"
+	entry.Message = withFields(eventType, record)
+	return entry
+}
+
+// withFields appends an object's fields to a message as key=value fields,
+// sorted, with nested ones named by their dotted path and arrays kept as
+// JSON
+func withFields(message string, object map[string]any) string {
+	fields := map[string]string{}
+	var flatten func(prefix string, object map[string]any)
+	flatten = func(prefix string, object map[string]any) {
+		for name, value := range object {
+			switch value := value.(type) {
+			case map[string]any:
+				flatten(prefix+name+".", value)
+			case string:
+				fields[prefix+name] = value
+			default:
+				encoded, _ := json.Marshal(value)
+				fields[prefix+name] = string(encoded)
+			}
+		}
+	}
+	flatten("", object)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(message)
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", name, value)
+	}
+	return strings.TrimPrefix(b.String(), " ")
+}
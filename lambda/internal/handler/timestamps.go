@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/metrics"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// TimestampRules keep producers with broken clocks from storing entries
+// that sort into next year, ahead of everything else in the latest view, or
+// so far back they're never seen. Entries are checked as they arrive from
+// any source.
+type TimestampRules struct {
+	// MaxAhead is how far past the time an entry arrives its timestamp may
+	// be; zero allows any
+	MaxAhead time.Duration
+
+	// MaxAge is how far before the time an entry arrives its timestamp may
+	// be; zero allows any
+	MaxAge time.Duration
+
+	// Clamp gives an entry outside the range the time it arrived instead of
+	// turning it away
+	Clamp bool
+
+	// RecordReceived stores the time each entry arrived beside its
+	// timestamp
+	RecordReceived bool
+}
+
+// TimestampRulesFromEnv reads TINYTAIL_MAX_TIMESTAMP_AHEAD (default 5m) and
+// TINYTAIL_MAX_TIMESTAMP_AGE (default the 180 days entries are kept), each
+// a duration such as 90s, 2h or 30d or 0 for no limit,
+// TINYTAIL_OUT_OF_RANGE_TIMESTAMPS ("clamp", the default, or "reject") and
+// TINYTAIL_RECORD_RECEIVED_AT
+func TimestampRulesFromEnv() (TimestampRules, error) {
+	rules := TimestampRules{MaxAhead: 5 * time.Minute, MaxAge: store.TTLDays * 24 * time.Hour, Clamp: true}
+	var err error
+	if rules.MaxAhead, err = envAge("TINYTAIL_MAX_TIMESTAMP_AHEAD", rules.MaxAhead); err != nil {
+		return rules, err
+	}
+	if rules.MaxAge, err = envAge("TINYTAIL_MAX_TIMESTAMP_AGE", rules.MaxAge); err != nil {
+		return rules, err
+	}
+
+	switch mode := os.Getenv("TINYTAIL_OUT_OF_RANGE_TIMESTAMPS"); mode {
+	case "", "clamp":
+	case "reject":
+		rules.Clamp = false
+	default:
+		return rules, fmt.Errorf("TINYTAIL_OUT_OF_RANGE_TIMESTAMPS must be clamp or reject, got %q", mode)
+	}
+
+	if raw := os.Getenv("TINYTAIL_RECORD_RECEIVED_AT"); raw != "" {
+		if rules.RecordReceived, err = strconv.ParseBool(raw); err != nil {
+			return rules, fmt.Errorf("TINYTAIL_RECORD_RECEIVED_AT must be true or false, got %q", raw)
+		}
+	}
+	return rules, nil
+}
+
+// envAge reads a duration setting that may also be given in days, such as
+// 30d
+func envAge(name string, defaultValue time.Duration) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return defaultValue, nil
+	}
+	d, err := parseAge(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as 90s, 2h or 30d, got %q", name, raw)
+	}
+	return d, nil
+}
+
+// parseAge reads a duration that may also be given in days, such as 30d
+func parseAge(raw string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", raw)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", raw)
+	}
+	return d, nil
+}
+
+// outOfRange says how a timestamp is out of range for an entry arriving at
+// now, or returns "" if it isn't
+func (r TimestampRules) outOfRange(timestamp, now time.Time) string {
+	switch {
+	case timestamp.IsZero():
+		return ""
+	case r.MaxAhead > 0 && timestamp.After(now.Add(r.MaxAhead)):
+		return "is more than " + describeDuration(r.MaxAhead) + " in the future"
+	case r.MaxAge > 0 && timestamp.Before(now.Add(-r.MaxAge)):
+		return "is more than " + describeDuration(r.MaxAge) + " old"
+	}
+	return ""
+}
+
+// check returns the entries whose timestamps are out of range, if they're
+// to be turned away, or else clamps them, so a request can be rejected
+// before any of it is stored
+func (r TimestampRules) check(entries []store.LogEntry, now time.Time) []fieldError {
+	var problems []fieldError
+	clamped := 0
+	for i := range entries {
+		reason := r.outOfRange(entries[i].Timestamp, now)
+		if reason == "" {
+			continue
+		}
+		if r.Clamp {
+			clamp(&entries[i], now)
+			clamped++
+			continue
+		}
+		problems = append(problems, fieldError{Entry: i, Field: "timestamp", Reason: reason})
+	}
+	recordOutOfRange(clamped + len(problems))
+	return problems
+}
+
+// apply stamps an entry arriving at now with the time it arrived, if that's
+// recorded, and clamps its timestamp if it's out of range and clamping is
+// on, reporting whether it was out of range. One that isn't clamped is to
+// be dropped.
+func (r TimestampRules) apply(entry *store.LogEntry, now time.Time) bool {
+	entry.ReceivedAt = time.Time{}
+	if r.RecordReceived {
+		entry.ReceivedAt = now
+	}
+	if r.outOfRange(entry.Timestamp, now) == "" {
+		return false
+	}
+	if r.Clamp {
+		clamp(entry, now)
+	}
+	return true
+}
+
+// clamp gives an entry the time it arrived, keeping the timestamp it was
+// sent with as an original_timestamp=<time> field at the end of its first
+// line
+func clamp(entry *store.LogEntry, now time.Time) {
+	first, rest, multiline := strings.Cut(entry.Message, "\n")
+	entry.Message = first + " original_timestamp=" + entry.Timestamp.Format(time.RFC3339Nano)
+	if multiline {
+		entry.Message += "\n" + rest
+	}
+	entry.Timestamp = now
+}
+
+// recordOutOfRange emits an OutOfRangeTimestamps metric counting entries
+// clamped or turned away
+func recordOutOfRange(entries int) {
+	if entries == 0 {
+		return
+	}
+	metrics.Emit(nil,
+		metrics.Metric{Name: "OutOfRangeTimestamps", Unit: metrics.Count, Value: float64(entries)})
+}
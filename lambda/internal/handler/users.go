@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/logging"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// bootstrapUsername is the account name used when signing in with
+// TINYTAIL_UI_PASSWORD before any users have been created.
+const bootstrapUsername = "admin"
+
+const invalidRoleMessage = `role must be "admin", "read-write" or "read-only"`
+
+type sessionContextKey struct{}
+
+// requestSummary collects what the "Request handled" log line reports that
+// is only known once a route has run
+type requestSummary struct {
+	session bool
+}
+
+type requestSummaryKey struct{}
+
+func withSession(ctx context.Context, session *store.Session) context.Context {
+	if summary, ok := ctx.Value(requestSummaryKey{}).(*requestSummary); ok {
+		summary.session = true
+	}
+	return context.WithValue(logging.With(ctx, "user", session.Username), sessionContextKey{}, session)
+}
+
+// currentSession returns the session of the signed-in user, set by
+// requireAuth.
+func currentSession(ctx context.Context) *store.Session {
+	session, _ := ctx.Value(sessionContextKey{}).(*store.Session)
+	return session
+}
+
+// authenticateUser checks the credentials against the users table. Until the
+// first user is created, the shared TINYTAIL_UI_PASSWORD signs in as an
+// admin so the first real accounts can be set up.
+func (h *Handler) authenticateUser(ctx context.Context, username, password string) (*store.User, error) {
+	if username != "" {
+		user, err := h.userStore.Authenticate(ctx, username, password)
+		if err != nil || user != nil {
+			return user, err
+		}
+	}
+
+	if (username != "" && username != bootstrapUsername) || !h.config.UIPassword.Matches(password) {
+		return nil, nil
+	}
+
+	hasUsers, err := h.userStore.HasUsers(ctx)
+	if err != nil || hasUsers {
+		return nil, err
+	}
+
+	return &store.User{Username: bootstrapUsername, Role: store.RoleAdmin}, nil
+}
+
+// sessionUserActive reports whether the session's user may still use
+// TinyTail: the account exists and isn't disabled, or this is a bootstrap
+// session and no users have been created yet. The session's role is updated
+// from the account so role changes also apply immediately.
+func (h *Handler) sessionUserActive(ctx context.Context, session *store.Session) (bool, error) {
+	if session.Username == "" {
+		return false, nil // Created before user accounts existed
+	}
+
+	user, err := h.userStore.GetUser(ctx, session.Username)
+	if err != nil {
+		return false, err
+	}
+	if user != nil {
+		session.Role = user.Role
+		return !user.Disabled, nil
+	}
+
+	if session.Username != bootstrapUsername {
+		return false, nil
+	}
+	hasUsers, err := h.userStore.HasUsers(ctx)
+	return !hasUsers, err
+}
+
+// requireAdmin wraps handlers that manage TinyTail itself
+func (h *Handler) requireAdmin(ctx context.Context, request events.APIGatewayProxyRequest, handler func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	return h.requireRole(ctx, request, store.RoleAdmin, handler)
+}
+
+func (h *Handler) listUsers(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	users, err := h.userStore.ListUsers(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list users", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to list users"})
+	}
+
+	return jsonResponse(http.StatusOK, users)
+}
+
+func (h *Handler) createUser(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var createReq struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+		Email    string `json:"email"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &createReq); err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	username := strings.TrimSpace(createReq.Username)
+	if username == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "username is required"})
+	}
+
+	role := createReq.Role
+	if role == "" {
+		role = store.RoleReadWrite
+	}
+	if !store.ValidRole(role) {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": invalidRoleMessage})
+	}
+
+	email := strings.TrimSpace(createReq.Email)
+	if email != "" && !strings.Contains(email, "@") {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "email must be an email address"})
+	}
+
+	user, err := h.userStore.CreateUser(ctx, username, createReq.Password, role, email, currentSession(ctx).Username)
+	switch {
+	case errors.Is(err, store.ErrInvalidPassword):
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, store.ErrUserExists):
+		return jsonResponse(http.StatusConflict, map[string]string{"error": "User already exists"})
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to create user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditUserCreate, Target: user.Username, Detail: user.Role})
+
+	return jsonResponse(http.StatusCreated, user)
+}
+
+func (h *Handler) setUserDisabled(disabled bool) func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var userReq struct {
+			Username string `json:"username"`
+		}
+
+		if err := json.Unmarshal([]byte(request.Body), &userReq); err != nil || userReq.Username == "" {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "username is required"})
+		}
+
+		if disabled && userReq.Username == currentSession(ctx).Username {
+			return jsonResponse(http.StatusBadRequest, map[string]string{"error": "You can't disable your own account"})
+		}
+
+		err := h.userStore.SetDisabled(ctx, userReq.Username, disabled)
+		if errors.Is(err, store.ErrUserNotFound) {
+			return jsonResponse(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update user", "error", err)
+			h.recordStoreError(err)
+			return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to update user"})
+		}
+
+		action := store.AuditUserEnable
+		if disabled {
+			action = store.AuditUserDisable
+		}
+		h.audit(ctx, request, store.AuditEvent{Action: action, Target: userReq.Username})
+
+		return jsonResponse(http.StatusOK, map[string]interface{}{"username": userReq.Username, "disabled": disabled})
+	}
+}
+
+func (h *Handler) setUserRole(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var roleReq struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+
+	if err := json.Unmarshal([]byte(request.Body), &roleReq); err != nil || roleReq.Username == "" {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "username is required"})
+	}
+	if !store.ValidRole(roleReq.Role) {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": invalidRoleMessage})
+	}
+
+	if roleReq.Username == currentSession(ctx).Username && roleReq.Role != store.RoleAdmin {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "You can't remove your own admin role"})
+	}
+
+	err := h.userStore.SetRole(ctx, roleReq.Username, roleReq.Role)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return jsonResponse(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to update user", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to update user"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{Action: store.AuditUserRole, Target: roleReq.Username, Detail: roleReq.Role})
+
+	return jsonResponse(http.StatusOK, map[string]string{"username": roleReq.Username, "role": roleReq.Role})
+}
+
+// PruneSessions deletes expired sessions, and sessions of users that no
+// longer exist or are disabled, without waiting for DynamoDB TTL
+func (h *Handler) PruneSessions(ctx context.Context) (*store.PruneResult, error) {
+	if h.sessionStore == nil {
+		return nil, nil // No-auth mode keeps no sessions
+	}
+	users, err := h.userStore.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	active := map[string]bool{}
+	for _, user := range users {
+		active[user.Username] = !user.Disabled
+	}
+
+	return h.sessionStore.PruneSessions(ctx, func(session *store.Session) bool {
+		if session.Username == bootstrapUsername && len(users) == 0 {
+			return false
+		}
+		return !active[session.Username]
+	})
+}
+
+// pruneSessions runs PruneSessions on an admin's request
+func (h *Handler) pruneSessions(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	result, err := h.PruneSessions(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to prune sessions", "error", err)
+		h.recordStoreError(err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to prune sessions"})
+	}
+
+	h.audit(ctx, request, store.AuditEvent{
+		Action: store.AuditSessionPrune,
+		Detail: fmt.Sprintf("deleted %d of %d (%d expired, %d orphaned)", result.Deleted, result.Scanned, result.Expired, result.Orphaned),
+	})
+
+	return jsonResponse(http.StatusOK, result)
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// truncatedMarker ends a message cut down to the size limit
+const truncatedMarker = " [TRUNCATED]"
+
+// entryFields are the fields an entry can be required to have
+var entryFields = []string{"message", "level", "source", "logger", "timestamp", "request_id"}
+
+// EntryRules are the checks entries sent to /logs/ingest or by invocation
+// must pass before any of them is stored. The zero value accepts anything.
+type EntryRules struct {
+	// MaxMessageSize is the longest message in bytes; zero leaves messages
+	// of any length, split into parts if they don't fit in one item
+	MaxMessageSize int
+
+	// TruncateMessages cuts longer messages down instead of rejecting them
+	TruncateMessages bool
+
+	// Required lists the fields every entry must have
+	Required []string
+
+	// Levels lists the levels entries may have, in upper case; empty allows
+	// any
+	Levels []string
+}
+
+// EntryRulesFromEnv reads TINYTAIL_MAX_MESSAGE_SIZE, in bytes or 0 for no
+// limit, TINYTAIL_OVERSIZE_MESSAGES ("reject", the default, or "truncate"),
+// and the comma-separated TINYTAIL_REQUIRED_FIELDS and
+// TINYTAIL_ALLOWED_LEVELS
+func EntryRulesFromEnv() (EntryRules, error) {
+	var rules EntryRules
+	if raw := os.Getenv("TINYTAIL_MAX_MESSAGE_SIZE"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < 0 || (size > 0 && size < len(truncatedMarker)) {
+			return rules, fmt.Errorf("TINYTAIL_MAX_MESSAGE_SIZE must be 0 or a number of bytes of at least %d, got %q", len(truncatedMarker), raw)
+		}
+		rules.MaxMessageSize = size
+	}
+
+	switch mode := os.Getenv("TINYTAIL_OVERSIZE_MESSAGES"); mode {
+	case "", "reject":
+	case "truncate":
+		rules.TruncateMessages = true
+	default:
+		return rules, fmt.Errorf("TINYTAIL_OVERSIZE_MESSAGES must be reject or truncate, got %q", mode)
+	}
+
+	for _, field := range splitList(os.Getenv("TINYTAIL_REQUIRED_FIELDS")) {
+		if !slices.Contains(entryFields, field) {
+			return rules, fmt.Errorf("TINYTAIL_REQUIRED_FIELDS: %q is not one of %s", field, strings.Join(entryFields, ", "))
+		}
+		rules.Required = append(rules.Required, field)
+	}
+
+	for _, level := range splitList(os.Getenv("TINYTAIL_ALLOWED_LEVELS")) {
+		rules.Levels = append(rules.Levels, strings.ToUpper(level))
+	}
+	// Entries without a level are stored as INFO
+	if len(rules.Levels) > 0 && !slices.Contains(rules.Levels, "INFO") && !slices.Contains(rules.Required, "level") {
+		return rules, errors.New("TINYTAIL_ALLOWED_LEVELS must include INFO, which entries without a level are given, unless TINYTAIL_REQUIRED_FIELDS includes level")
+	}
+	return rules, nil
+}
+
+// splitList splits a comma-separated setting, dropping blank items
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// fieldError says which field of which entry failed validation
+type fieldError struct {
+	// Entry is the entry's position in the request, from 0
+	Entry  int    `json:"entry"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e fieldError) String() string {
+	return fmt.Sprintf("entry %d: %s %s", e.Entry, e.Field, e.Reason)
+}
+
+// check returns the ways the entries break the rules, having cut down
+// messages that are too long if they're to be truncated
+func (r EntryRules) check(entries []store.LogEntry) []fieldError {
+	var problems []fieldError
+	for i := range entries {
+		entry := &entries[i]
+		for _, field := range r.Required {
+			if entryField(entry, field) == "" {
+				problems = append(problems, fieldError{Entry: i, Field: field, Reason: "is required"})
+			}
+		}
+
+		if entry.Level != "" && len(r.Levels) > 0 && !slices.Contains(r.Levels, strings.ToUpper(entry.Level)) {
+			problems = append(problems, fieldError{Entry: i, Field: "level", Reason: "must be one of " + strings.Join(r.Levels, ", ")})
+		}
+
+		if r.MaxMessageSize > 0 && len(entry.Message) > r.MaxMessageSize {
+			if r.TruncateMessages {
+				entry.Message = truncate(entry.Message, r.MaxMessageSize-len(truncatedMarker)) + truncatedMarker
+				continue
+			}
+			problems = append(problems, fieldError{Entry: i, Field: "message", Reason: fmt.Sprintf("is longer than %d bytes", r.MaxMessageSize)})
+		}
+	}
+	return problems
+}
+
+// entryField returns one of entryFields of an entry, empty if it's unset
+func entryField(entry *store.LogEntry, field string) string {
+	switch field {
+	case "message":
+		return entry.Message
+	case "level":
+		return entry.Level
+	case "source":
+		return entry.Source
+	case "logger":
+		return entry.Logger
+	case "request_id":
+		return entry.RequestID
+	case "timestamp":
+		if entry.Timestamp.IsZero() {
+			return ""
+		}
+		return entry.Timestamp.String()
+	}
+	return ""
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// invalidEntries answers a request whose entries failed validation, listing
+// each problem so the producer can tell which field to fix
+func invalidEntries(problems []fieldError) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(http.StatusBadRequest, map[string]any{"error": "Invalid entries", "fields": problems})
+}
+
+// invalidEntriesError describes the problems as an error, for invocations
+func invalidEntriesError(problems []fieldError) error {
+	reasons := make([]string, len(problems))
+	for i, problem := range problems {
+		reasons[i] = problem.String()
+	}
+	return fmt.Errorf("invalid entries: %s", strings.Join(reasons, "; "))
+}
@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// Vector's http sink posts each batch of events as a JSON array (or, with
+// framing newline_delimited, one event per line). A log event is an object
+// of whatever fields its pipeline gave it: sources add message, timestamp,
+// host and source_type, and others such as file or a kubernetes object.
+
+// defaultVectorFields are the event fields each entry field is read from
+var defaultVectorFields = VectorFields{
+	"message":    "message",
+	"timestamp":  "timestamp",
+	"level":      "level",
+	"source":     "host",
+	"logger":     "source_type",
+	"request_id": "request_id",
+}
+
+// VectorFields maps entry fields (message, timestamp, level, source, logger
+// and request_id) to the event fields they're read from, with nested
+// fields named by dotted paths such as kubernetes.pod_name
+type VectorFields map[string]string
+
+// VectorMapping is how Vector events become entries: Fields for every
+// secret, and BySecret for those of one secret's producers
+type VectorMapping struct {
+	Fields   VectorFields
+	BySecret map[string]VectorFields
+}
+
+// VectorMappingFromEnv reads TINYTAIL_VECTOR_FIELDS, comma-separated
+// field=path mappings such as "source=kubernetes.pod_name,level=severity".
+// A mapping written secret-id:field=path applies only to requests made
+// with that ingest secret.
+func VectorMappingFromEnv() (VectorMapping, error) {
+	mapping := VectorMapping{Fields: VectorFields{}, BySecret: map[string]VectorFields{}}
+	for _, item := range strings.Split(os.Getenv("TINYTAIL_VECTOR_FIELDS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		field, path, ok := strings.Cut(item, "=")
+		secretID, name, scoped := strings.Cut(field, ":")
+		if !scoped {
+			name = field
+		}
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if _, known := defaultVectorFields[name]; !ok || !known || path == "" || (scoped && secretID == "") {
+			return mapping, fmt.Errorf("TINYTAIL_VECTOR_FIELDS: invalid mapping %q (want [secret-id:]field=path, with field one of message, timestamp, level, source, logger or request_id)", item)
+		}
+
+		fields := mapping.Fields
+		if scoped {
+			if fields = mapping.BySecret[secretID]; fields == nil {
+				fields = VectorFields{}
+				mapping.BySecret[secretID] = fields
+			}
+		}
+		fields[name] = path
+	}
+	return mapping, nil
+}
+
+// fields returns the mapping for requests made with the secret
+func (m VectorMapping) fields(secretID string) VectorFields {
+	fields := VectorFields{}
+	for _, layer := range []VectorFields{defaultVectorFields, m.Fields, m.BySecret[secretID]} {
+		for name, path := range layer {
+			fields[name] = path
+		}
+	}
+	return fields
+}
+
+// ingestVector stores the events Vector's http sink posts. It authenticates
+// like /logs/ingest, but as Vector's batches are sized in bytes, takes any
+// number of events and writes them with BatchWriteItem, MaxIngestBatch at
+// a time. A part that fails is queued, if there is an ingest queue.
+// Vector sends the same batch again after a failure, so the entries are
+// stabilized by a hash of the body and a retry overwrites what was stored.
+func (h *Handler) ingestVector(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	secret := h.authenticateIngest(ctx, request)
+	if secret == nil {
+		recordAuthFailure(ctx, authMethodIngest)
+		return jsonResponse(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	h.health.Add(store.CounterIngestRequests, 1)
+
+	logStore, ok := h.environments.Get(secret.Env)
+	if !ok {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown environment %q", secret.Env)})
+	}
+	vectorEvents, err := parseVectorEvents(request.Body)
+	if err != nil {
+		return jsonResponse(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
+	}
+
+	fields := h.config.Vector.fields(secret.ID)
+	entries := make([]store.LogEntry, len(vectorEvents))
+	for i, event := range vectorEvents {
+		entries[i] = vectorEntry(event, fields)
+	}
+	secret.stamp(entries)
+	if wait := h.throttled(ctx, secret, len(entries)); wait > 0 {
+		return ingestThrottled(wait)
+	}
+
+	sum := sha256.Sum256([]byte(request.Body))
+	if err := h.stabilize(ctx, logStore, secret.Env, secret, "vector/"+hex.EncodeToString(sum[:16]), entries); err != nil {
+		slog.ErrorContext(ctx, "Failed to record Vector batch", "error", err)
+		return jsonResponse(http.StatusInternalServerError, map[string]string{"error": "Failed to store log"})
+	}
+
+	kept := h.batchEntries(ctx, entries)
+	queued := 0
+	for start := 0; start < len(kept); start += MaxIngestBatch {
+		part := kept[start:min(start+MaxIngestBatch, len(kept))]
+		err := h.writeBatch(ctx, logStore, secret.Env, part)
+		if err == nil {
+			continue
+		}
+		// The part is accepted if it can be stored later from the queue;
+		// any of it already written is overwritten then
+		if h.ingestQueue != nil && h.queueAll(ctx, secret.Env, part, err) {
+			slog.WarnContext(ctx, "Queued Vector entries that failed to store", "error", err, "entries", len(part))
+			queued += len(part)
+			continue
+		}
+		slog.ErrorContext(ctx, "Failed to store Vector batch", "error", err, "stored", start)
+		return jsonResponse(http.StatusInternalServerError, map[string]any{"error": "Failed to store log", "stored": start})
+	}
+	recordIngest(len(entries), len(request.Body))
+
+	if queued > 0 {
+		return jsonResponse(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// parseVectorEvents reads a JSON array of events, one per line, or a
+// single event
+func parseVectorEvents(body string) ([]map[string]any, error) {
+	var vectorEvents []map[string]any
+	if body = strings.TrimSpace(body); strings.HasPrefix(body, "[") {
+		err := json.Unmarshal([]byte(body), &vectorEvents)
+		return vectorEvents, err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	for decoder.More() {
+		var event map[string]any
+		if err := decoder.Decode(&event); err != nil {
+			return nil, err
+		}
+		vectorEvents = append(vectorEvents, event)
+	}
+	return vectorEvents, nil
+}
+
+// vectorEntry turns an event into an entry, reading each entry field from
+// the event field mapped to it. The event's other fields are appended to
+// the message as key=value fields, nested ones by their dotted path.
+func vectorEntry(event map[string]any, mapping VectorFields) store.LogEntry {
+	take := func(name string) any {
+		value, _ := takeVectorField(event, mapping[name])
+		return value
+	}
+	text := func(name string) string {
+		switch value := take(name).(type) {
+		case nil:
+			return ""
+		case string:
+			return value
+		default:
+			return fmt.Sprint(value)
+		}
+	}
+
+	entry := store.LogEntry{
+		Message:   strings.TrimRight(text("message"), "\r\n"),
+		Timestamp: fireLensTime(take("timestamp")),
+		Source:    cmp.Or(text("source"), "vector"),
+		Logger:    text("logger"),
+		RequestID: text("request_id"),
+	}
+	entry.Level = lineLevel(text("level"), entry.Message)
+
+	fields := map[string]string{}
+	flattenVectorFields(fields, "", event)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var message strings.Builder
+	message.WriteString(entry.Message)
+	for _, name := range names {
+		value := fields[name]
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&message, " %s=%s", name, value)
+	}
+	entry.Message = strings.TrimPrefix(message.String(), " ")
+	return entry
+}
+
+// takeVectorField removes the field at a dotted path from an event and
+// returns it. A key that itself contains dots, as Vector allows, is found
+// before a nested field.
+func takeVectorField(event map[string]any, path string) (any, bool) {
+	if value, ok := event[path]; ok {
+		delete(event, path)
+		return value, true
+	}
+	name, rest, ok := strings.Cut(path, ".")
+	if !ok {
+		return nil, false
+	}
+	nested, isObject := event[name].(map[string]any)
+	if !isObject {
+		return nil, false
+	}
+	value, found := takeVectorField(nested, rest)
+	if found && len(nested) == 0 {
+		delete(event, name)
+	}
+	return value, found
+}
+
+// flattenVectorFields adds an event's fields to fields, naming nested ones
+// by their dotted path. Arrays are kept as JSON.
+func flattenVectorFields(fields map[string]string, prefix string, event map[string]any) {
+	for key, value := range event {
+		name := prefix + key
+		switch value := value.(type) {
+		case nil:
+		case string:
+			if value != "" {
+				fields[name] = value
+			}
+		case map[string]any:
+			flattenVectorFields(fields, name+".", value)
+		default:
+			if encoded, err := json.Marshal(value); err == nil {
+				fields[name] = string(encoded)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ingest
+
+import "time"
+
+// MaxBatchBytes keeps a batch well inside API Gateway's and Lambda's
+// request size limits
+const MaxBatchBytes = 1 << 20
+
+// BatchOptions say when a batch is sent
+type BatchOptions struct {
+	// Size is the most items in a batch
+	Size int
+
+	// Bytes is roughly the most a batch's items add up to, by the size
+	// function given to Batches (default MaxBatchBytes)
+	Bytes int
+
+	// Interval is the longest an item waits for its batch to fill
+	Interval time.Duration
+}
+
+// Batches groups the items read from in, calling send with each batch when
+// it fills up or its first item has waited Interval, until in is closed.
+// The slice passed to send is reused afterwards.
+func Batches[T any](in <-chan T, opts BatchOptions, size func(T) int, send func([]T)) {
+	if opts.Bytes <= 0 {
+		opts.Bytes = MaxBatchBytes
+	}
+
+	var batch []T
+	batchBytes := 0
+	flush := func() {
+		if len(batch) > 0 {
+			send(batch)
+		}
+		batch, batchBytes = batch[:0], 0
+	}
+
+	timer := time.NewTimer(opts.Interval)
+	timer.Stop()
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) > 0 && batchBytes+size(item) > opts.Bytes {
+				flush()
+			}
+			if len(batch) == 0 {
+				timer.Reset(opts.Interval)
+			}
+			batch = append(batch, item)
+			batchBytes += size(item)
+			if len(batch) >= opts.Size {
+				timer.Stop()
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Package ingest sends batches of log entries to a TinyTail deployment's
+// ingest endpoint, for the commands that ship logs from outside Lambda.
+package ingest
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// requestTimeout bounds each request; the API answers within 29 seconds
+const requestTimeout = 35 * time.Second
+
+// Client posts entries to /logs/ingest with an ingest secret
+type Client struct {
+	url    string
+	secret string
+	http   *http.Client
+}
+
+// NewClient returns a client for the API at baseURL, including the stage
+// (e.g. https://abc123.execute-api.us-east-2.amazonaws.com/prod)
+func NewClient(baseURL, secret string) *Client {
+	return &Client{
+		url:    strings.TrimSuffix(baseURL, "/") + "/logs/ingest",
+		secret: secret,
+		http:   &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// StatusError is a response other than 2xx
+type StatusError struct {
+	Status  int
+	Message string
+
+	// Stored counts the entries at the start of the batch that were stored
+	// before one failed
+	Stored int
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+// RejectedError is entries of a batch the API turned away as invalid, which
+// it would turn away again
+type RejectedError struct {
+	// Reasons gives why each entry was rejected, by its position in the batch
+	Reasons map[int]string
+}
+
+func (e *RejectedError) Error() string {
+	positions := make([]int, 0, len(e.Reasons))
+	for position := range e.Reasons {
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+	reasons := make([]string, len(positions))
+	for i, position := range positions {
+		reasons[i] = fmt.Sprintf("entry %d: %s", position, e.Reasons[position])
+	}
+	return fmt.Sprintf("%d entries rejected: %s", len(positions), strings.Join(reasons, "; "))
+}
+
+// Retryable reports whether another attempt could succeed: network errors,
+// throttling and server errors are worth retrying, rejected requests aren't
+func Retryable(err error) bool {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		return false
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Status == http.StatusTooManyRequests || status.Status >= 500
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// Retry says how often Send tries again
+type Retry struct {
+	// Attempts is how many further attempts are made; negative keeps trying
+	// until the context is done
+	Attempts int
+
+	// Delay is the wait before the first retry, doubling for each one after
+	// up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// Send posts a batch, retrying failures that another attempt could fix.
+// The function answers for each entry, so only the entries it didn't store
+// are sent again. It returns how many entries at the start of the batch
+// were stored or rejected; entries rejected as invalid aren't retried, and
+// are reported in a *RejectedError.
+//
+// Entries without a timestamp or dedup ID are given them, in place, so an
+// entry whose attempt timed out after it was stored isn't stored twice,
+// even when the caller sends the batch again.
+func (c *Client) Send(ctx context.Context, entries []store.LogEntry, retry Retry) (int, error) {
+	if err := identify(entries); err != nil {
+		return 0, err
+	}
+
+	// pending holds the positions of the entries still to be sent
+	pending := make([]int, len(entries))
+	for i := range pending {
+		pending[i] = i
+	}
+	rejected := &RejectedError{Reasons: map[int]string{}}
+	done := func(err error) (int, error) {
+		n := len(entries)
+		if len(pending) > 0 {
+			n = pending[0]
+		}
+		if len(rejected.Reasons) > 0 {
+			err = errors.Join(rejected, err)
+		}
+		return n, err
+	}
+
+	delay := retry.Delay
+	for attempt := 0; ; attempt++ {
+		batch := make([]store.LogEntry, len(pending))
+		for i, position := range pending {
+			batch[i] = entries[position]
+		}
+		results, _, err := c.post(ctx, batch, true)
+
+		var retrying []int
+		for i, position := range pending {
+			switch results[i].Status {
+			case itemAccepted:
+			case itemRejected:
+				rejected.Reasons[position] = results[i].reason()
+			default:
+				// The function answered, but couldn't store every entry
+				if err == nil {
+					err = &StatusError{Status: http.StatusInternalServerError, Message: results[i].reason()}
+				}
+				retrying = append(retrying, position)
+			}
+		}
+		pending = retrying
+
+		if len(pending) == 0 {
+			return done(nil)
+		}
+		if !Retryable(err) || (retry.Attempts >= 0 && attempt >= retry.Attempts) {
+			return done(err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return done(err)
+		}
+		delay *= 2
+		if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+}
+
+// identify gives entries the timestamp and dedup ID the function needs to
+// recognise them when they're sent again
+func identify(entries []store.LogEntry) error {
+	var batch [12]byte
+	if _, err := rand.Read(batch[:]); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(batch[:])
+	now := time.Now()
+	for i := range entries {
+		if entries[i].Timestamp.IsZero() {
+			entries[i].Timestamp = now
+		}
+		if entries[i].DedupID == "" {
+			entries[i].DedupID = id + "/" + strconv.Itoa(i)
+		}
+	}
+	return nil
+}
+
+// Post makes one attempt at sending a batch, without retrying. It reports
+// whether the function queued entries it couldn't store straight away,
+// usually because DynamoDB was throttling.
+func (c *Client) Post(ctx context.Context, entries []store.LogEntry) (queued bool, err error) {
+	_, queued, err = c.post(ctx, entries, false)
+	return queued, err
+}
+
+// The statuses the function gives each entry of a batch sent with
+// items=true
+const (
+	itemAccepted  = "accepted"
+	itemRejected  = "rejected"
+	itemRetryable = "retryable"
+)
+
+// itemResult is what became of one entry of a batch
+type itemResult struct {
+	Status string `json:"status"`
+	Queued bool   `json:"queued"`
+	Errors []struct {
+		Field  string `json:"field"`
+		Reason string `json:"reason"`
+	} `json:"errors"`
+	Error string `json:"error"`
+}
+
+// reason describes why an entry wasn't accepted
+func (r itemResult) reason() string {
+	if len(r.Errors) == 0 {
+		return cmp.Or(r.Error, r.Status)
+	}
+	reasons := make([]string, len(r.Errors))
+	for i, problem := range r.Errors {
+		reasons[i] = problem.Field + " " + problem.Reason
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// post makes one attempt at sending a batch, returning what became of each
+// entry and whether any were queued instead of stored. With items, the
+// function answers for each entry; otherwise, or from a function too old
+// to, the results are made from how many entries it says it stored.
+func (c *Client) post(ctx context.Context, entries []store.LogEntry, items bool) ([]itemResult, bool, error) {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return nil, false, err
+	}
+	url := c.url
+	if items {
+		url += "?items=true"
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.secret)
+	request.Header.Set("Content-Type", "application/json")
+
+	results := make([]itemResult, len(entries))
+	response, err := c.http.Do(request)
+	if err != nil {
+		return results, false, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return results, false, err
+	}
+
+	var apiResponse struct {
+		Error  string       `json:"error"`
+		Stored int          `json:"stored"`
+		Items  []itemResult `json:"items"`
+	}
+	_ = json.Unmarshal(responseBody, &apiResponse)
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		if len(apiResponse.Items) == len(entries) {
+			queued := false
+			for _, item := range apiResponse.Items {
+				queued = queued || item.Queued
+			}
+			return apiResponse.Items, queued, nil
+		}
+		for i := range results {
+			results[i].Status = itemAccepted
+		}
+		return results, response.StatusCode == http.StatusAccepted, nil
+	}
+
+	for i := range results[:min(apiResponse.Stored, len(results))] {
+		results[i].Status = itemAccepted
+	}
+	return results, false, &StatusError{Status: response.StatusCode, Message: apiResponse.Error, Stored: apiResponse.Stored}
+}
@@ -0,0 +1,98 @@
+// Package logfiles reads the log files dropped into an S3 bucket, so rotated
+// files shipped by cron, logrotate or an S3 sync turn up in TinyTail without
+// an agent. The bucket's event notifications invoke the function with each
+// new object, whose lines are stored as entries.
+package logfiles
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxLineBytes is the longest line a file may have
+const maxLineBytes = 1 << 20
+
+// Config says which bucket's objects are log files
+type Config struct {
+	// Bucket is the bucket log files are dropped into; empty disables
+	Bucket string
+
+	// Env is the environment entries are stored in; empty is the default
+	Env string
+}
+
+// ConfigFromEnv reads TINYTAIL_LOG_BUCKET and TINYTAIL_LOG_BUCKET_ENV
+func ConfigFromEnv() Config {
+	return Config{
+		Bucket: os.Getenv("TINYTAIL_LOG_BUCKET"),
+		Env:    os.Getenv("TINYTAIL_LOG_BUCKET_ENV"),
+	}
+}
+
+// Source names the source of a file's entries: the top-level prefix of its
+// key, such as "nginx" for nginx/access.log.1.gz, or for a file at the top
+// of the bucket its name up to the first dot, such as "app" for
+// app.log.2024-06-01.gz
+func Source(key string) string {
+	if prefix, _, ok := strings.Cut(key, "/"); ok && prefix != "" {
+		return prefix
+	}
+	name, _, _ := strings.Cut(path.Base(key), ".")
+	return name
+}
+
+// Files reads log files from S3
+type Files struct {
+	client *s3.Client
+}
+
+func NewFiles(client *s3.Client) *Files {
+	return &Files{client: client}
+}
+
+// Read calls each with every non-blank line of a file, in order, stopping
+// at the first error. Gzipped files, known by their content rather than
+// their name, are decompressed as they're read.
+func (f *Files) Read(ctx context.Context, bucket, key string, each func(line string) error) error {
+	output, err := f.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	body := bufio.NewReader(output.Body)
+	var r io.Reader = body
+	if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineBytes)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := each(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Package logging sets up TinyTail's structured JSON logs. Records carry
+// attributes attached to the context they are logged with, so everything
+// logged while handling a request can be correlated by its request ID.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// level is shared by the default logger so it can be set once the
+// configuration has been read
+var level = new(slog.LevelVar)
+
+// Setup makes a JSON logger writing to stdout the default for slog and the
+// log package. It logs at info level until SetLevel is called.
+func Setup() {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// SetLevel changes the minimum level logged
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// LevelFromEnv reads TINYTAIL_LOG_LEVEL: debug, info (the default), warn
+// or error
+func LevelFromEnv() (slog.Level, error) {
+	value := os.Getenv("TINYTAIL_LOG_LEVEL")
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(value))); err != nil {
+		return slog.LevelInfo, fmt.Errorf("TINYTAIL_LOG_LEVEL must be debug, info, warn or error, got %q", value)
+	}
+	return l, nil
+}
+
+type attrsKey struct{}
+
+// With returns a context whose log records carry the given attributes, as
+// key-value pairs like slog.Logger.With, in addition to any already
+// attached
+func With(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs[:len(attrs):len(attrs)], a)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// contextHandler adds the attributes attached with With to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	err := h.Handler.Handle(ctx, record)
+	if sink != nil && record.Level >= slog.LevelWarn {
+		sink.store(ctx, record)
+	}
+	return err
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinytail/tinytail/internal/store"
+)
+
+// SelfIngestSource is the Source of TinyTail's own entries in its log table
+const SelfIngestSource = "tinytail"
+
+// selfIngestPerMinute caps how many of its own entries TinyTail stores, so
+// a burst of failures can't turn into a burst of writes
+const selfIngestPerMinute = 60
+
+// selfIngestTimeout bounds how long a warning can delay the work that
+// logged it
+const selfIngestTimeout = 2 * time.Second
+
+// selfIngester stores warnings and errors in the log table
+type selfIngester struct {
+	logs *store.LogStore
+
+	mu          sync.Mutex
+	windowStart time.Time
+	written     int
+	dropped     int
+}
+
+var sink *selfIngester
+
+// SelfIngest stores every warning and error logged from now on in the log
+// table as well, under Source "tinytail", so TinyTail's own problems show up
+// in its viewer and can be alerted on
+func SelfIngest(logs *store.LogStore) {
+	sink = &selfIngester{logs: logs}
+}
+
+type suppressKey struct{}
+
+// WithoutSelfIngest returns a context whose log records are not stored in
+// the log table. Work that could log about storing TinyTail's own entries,
+// such as evaluating alert rules against them, runs under it so a failure
+// can't feed itself.
+func WithoutSelfIngest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, suppressKey{}, true)
+}
+
+func (s *selfIngester) store(ctx context.Context, record slog.Record) {
+	if suppressed, _ := ctx.Value(suppressKey{}).(bool); suppressed {
+		return
+	}
+	allowed, dropped := s.allow(record.Time)
+	if !allowed {
+		return
+	}
+
+	entry := store.LogEntry{
+		Level:     record.Level.String(),
+		Source:    SelfIngestSource,
+		Timestamp: record.Time,
+	}
+	var attrs []string
+	record.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "request_id":
+			entry.RequestID = a.Value.String()
+		case "aws_request_id":
+			if entry.RequestID == "" {
+				entry.RequestID = a.Value.String()
+			}
+		case "route", "event_source":
+			if entry.Logger == "" {
+				entry.Logger = a.Value.String()
+			}
+		}
+		attrs = append(attrs, a.String())
+		return true
+	})
+	entry.Message = record.Message
+	if len(attrs) > 0 {
+		entry.Message += " " + strings.Join(attrs, " ")
+	}
+
+	// Anything logged while storing, and the store's own failure, must not
+	// come back here
+	ctx, cancel := context.WithTimeout(WithoutSelfIngest(context.WithoutCancel(ctx)), selfIngestTimeout)
+	defer cancel()
+	if dropped > 0 {
+		_ = s.logs.StoreLogEntry(ctx, &store.LogEntry{
+			Level:     slog.LevelWarn.String(),
+			Source:    SelfIngestSource,
+			Timestamp: record.Time,
+			Message:   fmt.Sprintf("%d further TinyTail warnings and errors were not stored in the previous minute; see CloudWatch Logs", dropped),
+		})
+	}
+	if err := s.logs.StoreLogEntry(ctx, &entry); err != nil {
+		slog.WarnContext(ctx, "Failed to store TinyTail's own log entry", "error", err)
+	}
+}
+
+// allow enforces the per-minute cap. When a new minute starts, it also
+// returns how many entries the previous one dropped, so that can be noted.
+func (s *selfIngester) allow(now time.Time) (allowed bool, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.windowStart) >= time.Minute {
+		dropped = s.dropped
+		s.windowStart, s.written, s.dropped = now, 0, 0
+	}
+	if s.written >= selfIngestPerMinute {
+		s.dropped++
+		return false, 0
+	}
+	s.written++
+	return true, dropped
+}
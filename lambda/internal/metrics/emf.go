@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultNamespace is the CloudWatch namespace metrics are published under.
+const DefaultNamespace = "TinyTail"
+
+// Units supported by CloudWatch that TinyTail uses.
+const (
+	Count        = "Count"
+	Milliseconds = "Milliseconds"
+	Bytes        = "Bytes"
+)
+
+// Metric is a single named value.
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// Emit writes the metrics to stdout in CloudWatch Embedded Metric Format.
+// Lambda forwards stdout to CloudWatch Logs, which extracts the metrics
+// without any API calls. All metrics share the given dimensions.
+func Emit(dimensions map[string]string, metrics ...Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	namespace := os.Getenv("TINYTAIL_METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	dimensionNames := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+	}
+	sort.Strings(dimensionNames)
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	doc := make(map[string]interface{}, len(dimensions)+len(metrics)+1)
+	for name, value := range dimensions {
+		doc[name] = value
+	}
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		doc[m.Name] = m.Value
+	}
+
+	doc["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{dimensionNames},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// Since returns the milliseconds elapsed since start, for latency metrics.
+func Since(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
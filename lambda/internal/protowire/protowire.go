@@ -0,0 +1,117 @@
+// Package protowire reads protobuf messages field by field, for the few
+// messages TinyTail decodes without generated code: OTLP export requests
+// in the agent, and Loki push requests in the API.
+package protowire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protobuf wire types
+const (
+	VarintType  = 0
+	Fixed64Type = 1
+	BytesType   = 2
+	Fixed32Type = 5
+)
+
+// Reader reads protobuf fields from a message. Its first error sticks, so
+// decoders check Err once they've read everything.
+type Reader struct {
+	b   []byte
+	err error
+}
+
+// NewReader reads the fields of an encoded message
+func NewReader(b []byte) *Reader {
+	return &Reader{b: b}
+}
+
+// More reports whether there are fields left to read
+func (r *Reader) More() bool {
+	return r.err == nil && len(r.b) > 0
+}
+
+// Err is the first error reading the message, if any
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func (r *Reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.b = nil
+}
+
+// Key reads a field's number and wire type
+func (r *Reader) Key() (int, int) {
+	key := r.Varint()
+	return int(key >> 3), int(key & 7)
+}
+
+func (r *Reader) Varint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail(errors.New("truncated varint"))
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *Reader) Fixed(size int) uint64 {
+	if len(r.b) < size {
+		r.fail(errors.New("truncated fixed-size field"))
+		return 0
+	}
+	var v uint64
+	if size == 8 {
+		v = binary.LittleEndian.Uint64(r.b)
+	} else {
+		v = uint64(binary.LittleEndian.Uint32(r.b))
+	}
+	r.b = r.b[size:]
+	return v
+}
+
+func (r *Reader) Bytes() []byte {
+	n := r.Varint()
+	if n > uint64(len(r.b)) {
+		r.fail(errors.New("truncated length-delimited field"))
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// Skip reads past a field the decoder doesn't use
+func (r *Reader) Skip(wireType int) {
+	switch wireType {
+	case VarintType:
+		r.Varint()
+	case Fixed64Type:
+		r.Fixed(8)
+	case BytesType:
+		r.Bytes()
+	case Fixed32Type:
+		r.Fixed(4)
+	default:
+		r.fail(fmt.Errorf("unsupported wire type %d", wireType))
+	}
+}
+
+// Message decodes a length-delimited field as a nested message
+func (r *Reader) Message(decode func(*Reader)) {
+	nested := &Reader{b: r.Bytes()}
+	if r.err != nil {
+		return
+	}
+	decode(nested)
+	if nested.err != nil {
+		r.fail(nested.err)
+	}
+}
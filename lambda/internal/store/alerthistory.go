@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// alertHistoryKey is the alerts table item listing the latest alerts sent,
+// newest first, so they can be shown without scanning the table
+const alertHistoryKey = "alert-history"
+
+// AlertHistoryLimit is how many alerts the history keeps
+const AlertHistoryLimit = 50
+
+// FiredAlert is an alert that was sent: Matches entries matching Pattern
+// from Since until FiredAt, a window of Window
+type FiredAlert struct {
+	RuleID  string    `dynamodbav:"rule_id" json:"rule_id"`
+	Pattern string    `dynamodbav:"pattern,omitempty" json:"pattern,omitempty"`
+	Matches int       `dynamodbav:"matches" json:"matches"`
+	Window  string    `dynamodbav:"window,omitempty" json:"window,omitempty"`
+	Since   time.Time `dynamodbav:"since" json:"since"`
+	FiredAt time.Time `dynamodbav:"fired_at" json:"fired_at"`
+}
+
+// AlertHistory keeps the latest alerts sent in the alerts table. A nil
+// AlertHistory records nothing and has nothing to show.
+type AlertHistory struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewAlertHistory(client *dynamodb.Client, tableName string) *AlertHistory {
+	return &AlertHistory{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+// Record adds an alert to the front of the history, then trims the oldest
+// beyond AlertHistoryLimit
+func (h *AlertHistory) Record(ctx context.Context, alert FiredAlert) error {
+	if h == nil {
+		return nil
+	}
+	av, err := attributevalue.Marshal([]FiredAlert{alert})
+	if err != nil {
+		return err
+	}
+
+	key := map[string]types.AttributeValue{
+		"ruleID": &types.AttributeValueMemberS{Value: alertHistoryKey},
+	}
+	result, err := h.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(h.tableName),
+		Key:              key,
+		UpdateExpression: aws.String("SET alerts = list_append(:alert, if_not_exists(alerts, :empty))"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":alert": av,
+			":empty": &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record alert history: %w", err)
+	}
+
+	alerts, _ := result.Attributes["alerts"].(*types.AttributeValueMemberL)
+	if alerts == nil || len(alerts.Value) <= AlertHistoryLimit {
+		return nil
+	}
+	removed := make([]string, 0, len(alerts.Value)-AlertHistoryLimit)
+	for i := AlertHistoryLimit; i < len(alerts.Value); i++ {
+		removed = append(removed, fmt.Sprintf("alerts[%d]", i))
+	}
+	_, err = h.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(h.tableName),
+		Key:              key,
+		UpdateExpression: aws.String("REMOVE " + strings.Join(removed, ", ")),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to trim alert history: %w", err)
+	}
+	return nil
+}
+
+// Recent returns the alerts sent since the given time, newest first
+func (h *AlertHistory) Recent(ctx context.Context, since time.Time) ([]FiredAlert, error) {
+	if h == nil {
+		return nil, nil
+	}
+	result, err := h.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: alertHistoryKey},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert history: %w", err)
+	}
+
+	var item struct {
+		Alerts []FiredAlert `dynamodbav:"alerts"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alert history: %w", err)
+	}
+	recent := item.Alerts[:0]
+	for _, alert := range item.Alerts {
+		if !alert.FiredAt.Before(since) {
+			recent = append(recent, alert)
+		}
+	}
+	return recent, nil
+}
@@ -0,0 +1,279 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// APIKeyPrefix starts every API key, making leaked keys easy to spot
+const APIKeyPrefix = "tt_"
+
+// RoleIngest is the role of ingest keys, which may only write logs. It
+// isn't a role users or other keys can be given, and grants no access to
+// the API.
+const RoleIngest = "ingest"
+
+// ErrAPIKeyNotFound is returned when revoking or renaming a key that
+// doesn't exist
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey grants programmatic access with the key's role. Only a SHA-256 hash
+// of the secret part is stored; the full key is shown once, when it is
+// created.
+type APIKey struct {
+	KeyID      string     `dynamodbav:"key_id" json:"key_id"`
+	Name       string     `dynamodbav:"name" json:"name"`
+	Role       string     `dynamodbav:"role,omitempty" json:"role"`
+	SecretHash string     `dynamodbav:"secret_hash" json:"-"`
+	CreatedAt  time.Time  `dynamodbav:"created_at" json:"created_at"`
+	CreatedBy  string     `dynamodbav:"created_by,omitempty" json:"created_by,omitempty"`
+	Revoked    bool       `dynamodbav:"revoked" json:"revoked"`
+	RevokedAt  *time.Time `dynamodbav:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+
+	// Env is the environment an ingest key's entries are stored in; empty
+	// is the default
+	Env string `dynamodbav:"env,omitempty" json:"env,omitempty"`
+
+	// SigningKey is the hex key an ingest key's requests are signed with
+	// (see IngestSigningKey); keys created before signing have none
+	SigningKey string `dynamodbav:"signing_key,omitempty" json:"-"`
+}
+
+type APIKeyStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewAPIKeyStore(client *dynamodb.Client, tableName string) *APIKeyStore {
+	return &APIKeyStore{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+// CreateAPIKey generates and stores a new key, returning its metadata and
+// the full key (tt_<id>_<secret>), which can't be recovered later
+func (s *APIKeyStore) CreateAPIKey(ctx context.Context, name, role, createdBy string) (*APIKey, string, error) {
+	return s.createKey(ctx, &APIKey{Name: name, Role: role, CreatedBy: createdBy})
+}
+
+// CreateIngestKey generates and stores a key producers write logs to env
+// with, named after the service that uses it
+func (s *APIKeyStore) CreateIngestKey(ctx context.Context, name, env, createdBy string) (*APIKey, string, error) {
+	return s.createKey(ctx, &APIKey{Name: name, Role: RoleIngest, Env: env, CreatedBy: createdBy})
+}
+
+func (s *APIKeyStore) createKey(ctx context.Context, key *APIKey) (*APIKey, string, error) {
+	id, err := randomHex(6)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	fullKey := APIKeyPrefix + id + "_" + secret
+	key.KeyID = id
+	key.SecretHash = hashAPIKeySecret(secret)
+	key.CreatedAt = time.Now()
+	if key.Role == RoleIngest {
+		key.SigningKey = hex.EncodeToString(IngestSigningKey(fullKey))
+	}
+
+	av, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal api key: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.tableName),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(key_id)"),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to store api key: %w", err)
+	}
+
+	return key, fullKey, nil
+}
+
+// ListAPIKeys returns every key, including revoked ones
+func (s *APIKeyStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName: aws.String(s.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list api keys: %w", err)
+		}
+		var pageKeys []APIKey
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageKeys); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal api keys: %w", err)
+		}
+		for i := range pageKeys {
+			pageKeys[i].defaultRole()
+		}
+		keys = append(keys, pageKeys...)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey permanently disables a key. The record is kept so it still
+// shows up when listing keys.
+func (s *APIKeyStore) RevokeAPIKey(ctx context.Context, keyID string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key_id": &types.AttributeValueMemberS{Value: keyID},
+		},
+		UpdateExpression:    aws.String("SET revoked = :revoked, revoked_at = :now"),
+		ConditionExpression: aws.String("attribute_exists(key_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked": &types.AttributeValueMemberBOOL{Value: true},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return ErrAPIKeyNotFound
+		}
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	return nil
+}
+
+// RenameAPIKey changes a key's name, which for an ingest key is the label
+// its entries are stamped with
+func (s *APIKeyStore) RenameAPIKey(ctx context.Context, keyID, name string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key_id": &types.AttributeValueMemberS{Value: keyID},
+		},
+		UpdateExpression:         aws.String("SET #name = :name"),
+		ConditionExpression:      aws.String("attribute_exists(key_id)"),
+		ExpressionAttributeNames: map[string]string{"#name": "name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: name},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return ErrAPIKeyNotFound
+		}
+		return fmt.Errorf("failed to rename api key: %w", err)
+	}
+	return nil
+}
+
+// ValidateAPIKey returns the key's record if the full key is valid and not
+// revoked, or nil otherwise
+func (s *APIKeyStore) ValidateAPIKey(ctx context.Context, fullKey string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(fullKey, APIKeyPrefix)
+	if !ok {
+		return nil, nil
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return nil, nil
+	}
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key_id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var key APIKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api key: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.SecretHash)) != 1 || key.Revoked {
+		return nil, nil
+	}
+
+	key.defaultRole()
+	return &key, nil
+}
+
+// IngestKey returns the ingest key with the given ID if it exists and isn't
+// revoked, or nil otherwise, for checking requests it signed
+func (s *APIKeyStore) IngestKey(ctx context.Context, keyID string) (*APIKey, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key_id": &types.AttributeValueMemberS{Value: keyID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var key APIKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api key: %w", err)
+	}
+	if key.Revoked || key.Role != RoleIngest {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+// IngestSigningKey derives the key a producer signs ingest requests with
+// from its ingest secret or key: the HMAC-SHA256 of "tinytail-ingest-signing"
+// keyed with the secret. It's worked out when the secret is issued and kept
+// apart from the secret's digest, so holding the digest isn't enough to sign.
+func IngestSigningKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("tinytail-ingest-signing"))
+	return mac.Sum(nil)
+}
+
+// defaultRole gives keys created before roles existed the read-only access
+// they had then
+func (k *APIKey) defaultRole() {
+	if k.Role == "" {
+		k.Role = RoleReadOnly
+	}
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
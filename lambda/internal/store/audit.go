@@ -0,0 +1,225 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// AuditPartitionKey keeps audit events in the logs table but apart from
+	// ingested logs, so they never show up in log searches or trigger alerts
+	AuditPartitionKey = "AUDIT"
+	// AuditTTLDays is how long audit events are kept
+	AuditTTLDays = 365
+)
+
+// Audited actions
+const (
+	AuditLogin         = "login"
+	AuditLoginLinkSent = "login_link_sent"
+	AuditLoginFailed   = "login_failed"
+	AuditLogout        = "logout"
+	AuditSearch        = "search"
+	AuditUserCreate    = "user_create"
+	AuditUserDisable   = "user_disable"
+	AuditUserEnable    = "user_enable"
+	AuditUserRole      = "user_role"
+	AuditAPIKeyCreate  = "api_key_create"
+	AuditAPIKeyRevoke  = "api_key_revoke"
+	AuditSessionPrune  = "session_prune"
+	AuditSessionRevoke = "session_revoke"
+
+	AuditForwardingRuleCreate = "forwarding_rule_create"
+	AuditForwardingRuleDelete = "forwarding_rule_delete"
+	AuditDropRuleCreate       = "drop_rule_create"
+	AuditDropRuleDelete       = "drop_rule_delete"
+	AuditHeartbeatForget      = "heartbeat_forget"
+
+	AuditIngestKeyCreate = "ingest_key_create"
+	AuditIngestKeyLabel  = "ingest_key_label"
+	AuditIngestKeyRevoke = "ingest_key_revoke"
+
+	AuditPasswordChange       = "password_change"
+	AuditPasswordChangeFailed = "password_change_failed"
+	AuditAuditLogRead         = "audit_read"
+	AuditFeedTokenCreate      = "feed_token_create"
+)
+
+// AuditEvent records who did what, and from where
+type AuditEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	SourceIP  string    `json:"source_ip,omitempty"`
+	Cursor    string    `json:"cursor,omitempty"`
+}
+
+type dynamoDBAuditItem struct {
+	PK           string `dynamodbav:"pk"`
+	TimestampSeq string `dynamodbav:"timestamp_seq"`
+	Timestamp    string `dynamodbav:"timestamp"`
+	Actor        string `dynamodbav:"actor"`
+	Action       string `dynamodbav:"action"`
+	Target       string `dynamodbav:"target,omitempty"`
+	Detail       string `dynamodbav:"detail,omitempty"`
+	SourceIP     string `dynamodbav:"source_ip,omitempty"`
+	ExpireAt     int64  `dynamodbav:"expire_at"`
+}
+
+type AuditStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+// NewAuditStore returns a store writing to the audit partition of the logs
+// table
+func NewAuditStore(client *dynamodb.Client, logsTableName string) *AuditStore {
+	return &AuditStore{
+		client:    client,
+		tableName: logsTableName,
+	}
+}
+
+// Record stores an audit event
+func (s *AuditStore) Record(ctx context.Context, event AuditEvent) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	item := dynamoDBAuditItem{
+		PK:           AuditPartitionKey,
+		TimestampSeq: ulid.MustNew(ulid.Timestamp(event.Timestamp), rand.Reader).String(),
+		Timestamp:    event.Timestamp.Format(time.RFC3339Nano),
+		Actor:        event.Actor,
+		Action:       event.Action,
+		Target:       event.Target,
+		Detail:       event.Detail,
+		SourceIP:     event.SourceIP,
+		ExpireAt:     event.Timestamp.Add(AuditTTLDays * 24 * time.Hour).Unix(),
+	}
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store audit event: %w", err)
+	}
+	return nil
+}
+
+// AuditFilter narrows ListAuditEvents. Empty fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+// ListAuditEvents returns up to limit events matching the filter, newest
+// first, starting before beforeCursor if set. The returned cursor continues
+// the listing and is empty once there is nothing older.
+func (s *AuditStore) ListAuditEvents(ctx context.Context, filter AuditFilter, beforeCursor string, limit int) ([]AuditEvent, string, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	upper := beforeCursor
+	if upper == "" && !filter.Until.IsZero() {
+		upper = ulid.MustNew(ulid.Timestamp(filter.Until), nil).String()
+	}
+
+	keyCondition := "pk = :pk"
+	values := map[string]types.AttributeValue{
+		":pk": &types.AttributeValueMemberS{Value: AuditPartitionKey},
+	}
+	if upper != "" {
+		keyCondition += " AND timestamp_seq < :upper"
+		values[":upper"] = &types.AttributeValueMemberS{Value: upper}
+	}
+	if !filter.Since.IsZero() {
+		lower := ulid.MustNew(ulid.Timestamp(filter.Since), nil).String()
+		if upper != "" {
+			keyCondition = "pk = :pk AND timestamp_seq BETWEEN :lower AND :upper"
+		} else {
+			keyCondition += " AND timestamp_seq >= :lower"
+		}
+		values[":lower"] = &types.AttributeValueMemberS{Value: lower}
+	}
+
+	var filterExpr []string
+	names := map[string]string{}
+	if filter.Actor != "" {
+		filterExpr = append(filterExpr, "#actor = :actor")
+		names["#actor"] = "actor"
+		values[":actor"] = &types.AttributeValueMemberS{Value: filter.Actor}
+	}
+	if filter.Action != "" {
+		filterExpr = append(filterExpr, "#action = :action")
+		names["#action"] = "action"
+		values[":action"] = &types.AttributeValueMemberS{Value: filter.Action}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tableName),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+	}
+	if len(filterExpr) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filterExpr, " AND "))
+		input.ExpressionAttributeNames = names
+	}
+
+	events := []AuditEvent{}
+	for {
+		output, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to query audit events: %w", err)
+		}
+
+		var items []dynamoDBAuditItem
+		if err := attributevalue.UnmarshalListOfMaps(output.Items, &items); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal audit events: %w", err)
+		}
+		for _, item := range items {
+			ts, _ := time.Parse(time.RFC3339Nano, item.Timestamp)
+			events = append(events, AuditEvent{
+				Timestamp: ts,
+				Actor:     item.Actor,
+				Action:    item.Action,
+				Target:    item.Target,
+				Detail:    item.Detail,
+				SourceIP:  item.SourceIP,
+				Cursor:    item.TimestampSeq,
+			})
+			if len(events) == limit {
+				return events, item.TimestampSeq, nil
+			}
+		}
+
+		if output.LastEvaluatedKey == nil {
+			return events, "", nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,22 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TimeBudgetReserve is kept back from a request's deadline to answer with
+// what was read so far: paginated reads don't start another page once
+// less than this is left.
+const TimeBudgetReserve = 2 * time.Second
+
+// ErrTimeBudget is returned by reads that need every page when they ran
+// out of time before reading them all
+var ErrTimeBudget = errors.New("ran out of time before reading every page")
+
+// outOfTime reports whether ctx's deadline is too close to read another page
+func outOfTime(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < TimeBudgetReserve
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/tinytail/tinytail/internal/metrics"
+)
+
+// DedupPartitionKey keeps a record of each dedup ID in the logs table but
+// apart from ingested logs, naming the item its entry was stored as
+const DedupPartitionKey = "DEDUP"
+
+// DedupTTL is how long a dedup ID is remembered; an entry sent again after
+// that is stored again
+const DedupTTL = 7 * 24 * time.Hour
+
+// dedupRecord records that the entry with a dedup ID has been stored
+type dedupRecord struct {
+	PK       string `dynamodbav:"pk"`
+	DedupID  string `dynamodbav:"timestamp_seq"`
+	ItemID   string `dynamodbav:"item_id"`
+	ExpireAt int64  `dynamodbav:"expire_at"`
+}
+
+// storeOnce stores an entry's item together with the record of its dedup
+// ID, in one transaction, unless the record already exists. The record is
+// keyed by the dedup ID alone, so an entry sent again is recognised even
+// when it was given a different timestamp, such as the time it arrived. It
+// returns the ID the entry is stored as: id, or the first attempt's if it
+// was already stored.
+func (s *LogStore) storeOnce(ctx context.Context, item map[string]types.AttributeValue, dedupID, id string) (string, error) {
+	now := time.Now()
+	record, err := attributevalue.MarshalMap(dedupRecord{
+		PK:       DedupPartitionKey,
+		DedupID:  dedupID,
+		ItemID:   id,
+		ExpireAt: now.Add(DedupTTL).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal dedup record: %w", err)
+	}
+
+	start := time.Now()
+	_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName: aws.String(s.tableName),
+				Item:      record,
+				// TTL can take days to remove an expired record
+				ConditionExpression:                 aws.String("attribute_not_exists(pk) OR expire_at < :now"),
+				ExpressionAttributeValues:           map[string]types.AttributeValue{":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)}},
+				ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+			}},
+			{Put: &types.Put{
+				TableName: aws.String(s.tableName),
+				Item:      item,
+			}},
+		},
+	})
+	observeLatency("StoreLatency", "PutLogEntry", start)
+
+	// A retried entry finds its record already there
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+		aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		slog.DebugContext(ctx, "Dropped duplicate log entry", "dedup_id", dedupID)
+		metrics.Emit(nil, metrics.Metric{Name: "DuplicateEntries", Unit: metrics.Count, Value: 1})
+		var existing dedupRecord
+		_ = attributevalue.UnmarshalMap(canceled.CancellationReasons[0].Item, &existing)
+		return existing.ItemID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// batchRecord records when a batch with stable IDs first arrived
+type batchRecord struct {
+	PK        string `dynamodbav:"pk"`
+	BatchID   string `dynamodbav:"timestamp_seq"`
+	FirstSeen int64  `dynamodbav:"first_seen"` // Unix milliseconds
+	ExpireAt  int64  `dynamodbav:"expire_at"`
+}
+
+// BatchTime returns when the batch named batchID first arrived, recording
+// now if this is the first time. Entries of a batch sent again whole are
+// given it as their timestamp when they have none, so that with their
+// StableIDs they're stored as the same items as the first time. One small
+// record is written per batch, not per entry.
+func (s *LogStore) BatchTime(ctx context.Context, batchID string, now time.Time) (time.Time, error) {
+	record, err := attributevalue.MarshalMap(batchRecord{
+		PK:        DedupPartitionKey,
+		BatchID:   "batch#" + batchID,
+		FirstSeen: now.UnixMilli(),
+		ExpireAt:  now.Add(DedupTTL).Unix(),
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to marshal batch record: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                           aws.String(s.tableName),
+		Item:                                record,
+		ConditionExpression:                 aws.String("attribute_not_exists(pk) OR expire_at < :now"),
+		ExpressionAttributeValues:           map[string]types.AttributeValue{":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)}},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		var existing batchRecord
+		if err := attributevalue.UnmarshalMap(failed.Item, &existing); err != nil {
+			return time.Time{}, fmt.Errorf("failed to unmarshal batch record: %w", err)
+		}
+		return time.UnixMilli(existing.FirstSeen), nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to record batch: %w", err)
+	}
+	return now, nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// dropRulesKey is the alerts table item holding every drop rule, as a
+// versioned list ingest reads whole
+const dropRulesKey = "drop-rules"
+
+// ErrDropRuleNotFound is returned when deleting a rule that doesn't exist
+var ErrDropRuleNotFound = errors.New("drop rule not found")
+
+// DropRule discards ingested entries matching its filters before they're
+// stored, for known noise such as health checks and load balancer probes.
+// Empty filters match everything, but a rule has at least one.
+type DropRule struct {
+	ID   string `dynamodbav:"id" json:"id"`
+	Name string `dynamodbav:"name" json:"name"`
+
+	// Levels and Sources match entries with any of the given values; Pattern
+	// matches messages containing it, ignoring case
+	Levels  []string `dynamodbav:"levels,omitempty" json:"levels,omitempty"`
+	Sources []string `dynamodbav:"sources,omitempty" json:"sources,omitempty"`
+	Pattern string   `dynamodbav:"pattern,omitempty" json:"pattern,omitempty"`
+
+	CreatedAt time.Time `dynamodbav:"created_at" json:"created_at"`
+	CreatedBy string    `dynamodbav:"created_by,omitempty" json:"created_by,omitempty"`
+}
+
+// Matches reports whether an entry passes the rule's filters, and so is
+// dropped
+func (r *DropRule) Matches(entry LogEntry) bool {
+	if len(r.Levels) > 0 && !slices.ContainsFunc(r.Levels, func(level string) bool { return strings.EqualFold(level, entry.Level) }) {
+		return false
+	}
+	if len(r.Sources) > 0 && !slices.Contains(r.Sources, entry.Source) {
+		return false
+	}
+	return r.Pattern == "" || strings.Contains(strings.ToLower(entry.Message), strings.ToLower(r.Pattern))
+}
+
+type DropRuleStore struct {
+	rules versionedList[DropRule]
+}
+
+func NewDropRuleStore(client *dynamodb.Client, tableName string) *DropRuleStore {
+	return &DropRuleStore{
+		rules: versionedList[DropRule]{client: client, tableName: tableName, key: dropRulesKey, what: "drop rules"},
+	}
+}
+
+// DropRules returns every rule, oldest first
+func (s *DropRuleStore) DropRules(ctx context.Context) ([]DropRule, error) {
+	rules, _, err := s.rules.load(ctx)
+	return rules, err
+}
+
+// CreateDropRule gives the rule an ID and stores it
+func (s *DropRuleStore) CreateDropRule(ctx context.Context, rule *DropRule) error {
+	id, err := randomHex(6)
+	if err != nil {
+		return err
+	}
+	rule.ID = id
+	rule.CreatedAt = time.Now()
+
+	err = s.rules.update(ctx, func(rules []DropRule) ([]DropRule, error) {
+		return append(rules, *rule), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store drop rule: %w", err)
+	}
+	return nil
+}
+
+// DeleteDropRule removes a rule
+func (s *DropRuleStore) DeleteDropRule(ctx context.Context, id string) error {
+	err := s.rules.update(ctx, func(rules []DropRule) ([]DropRule, error) {
+		i := slices.IndexFunc(rules, func(rule DropRule) bool { return rule.ID == id })
+		if i < 0 {
+			return nil, ErrDropRuleNotFound
+		}
+		return slices.Delete(rules, i, i+1), nil
+	})
+	if err != nil && !errors.Is(err, ErrDropRuleNotFound) {
+		return fmt.Errorf("failed to delete drop rule: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultEnvironment names the environment kept in the main logs table
+const DefaultEnvironment = "default"
+
+var environmentName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// ParseEnvironments reads a comma-separated list of environment names, each
+// optionally with its logs table as name=table. Without one, the table is
+// the main logs table's name with "-<name>" appended, e.g.
+// TinyTailLogs-staging.
+func ParseEnvironments(value, logsTable string) (map[string]string, error) {
+	tables := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, table, hasTable := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !environmentName.MatchString(name) || name == DefaultEnvironment {
+			return nil, fmt.Errorf("invalid environment %q: use up to 32 lowercase letters, digits and dashes, other than %q", name, DefaultEnvironment)
+		}
+		if _, dup := tables[name]; dup {
+			return nil, fmt.Errorf("environment %q is listed twice", name)
+		}
+		if table = strings.TrimSpace(table); !hasTable || table == "" {
+			table = logsTable + "-" + name
+		}
+		tables[name] = table
+	}
+	return tables, nil
+}
+
+// Environments holds a log store per environment, so one deployment can
+// keep production and staging logs apart
+type Environments struct {
+	stores map[string]*LogStore
+}
+
+// NewEnvironments serves the default environment from defaultStore and
+// each of the others from its own store
+func NewEnvironments(defaultStore *LogStore, others map[string]*LogStore) *Environments {
+	stores := map[string]*LogStore{DefaultEnvironment: defaultStore}
+	for name, store := range others {
+		stores[name] = store
+	}
+	return &Environments{stores: stores}
+}
+
+// Get returns the named environment's store; an empty name is the default
+func (e *Environments) Get(name string) (*LogStore, bool) {
+	if name == "" {
+		name = DefaultEnvironment
+	}
+	store, ok := e.stores[name]
+	return store, ok
+}
+
+// Names lists the environments, the default first
+func (e *Environments) Names() []string {
+	names := make([]string, 0, len(e.stores))
+	for name := range e.stores {
+		if name != DefaultEnvironment {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{DefaultEnvironment}, names...)
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// forwardingRulesKey is the alerts table item holding every forwarding
+// rule, as a versioned list the stream consumer reads whole
+const forwardingRulesKey = "forwarding-rules"
+
+// ErrForwardingRuleNotFound is returned when deleting a rule that doesn't
+// exist
+var ErrForwardingRuleNotFound = errors.New("forwarding rule not found")
+
+// ForwardingRule relays new entries matching its filters, as they arrive,
+// to either an HTTP endpoint or a CloudWatch Logs group. Empty filters
+// match everything. The secret signs each HTTP delivery and is only shown
+// when the rule is created.
+type ForwardingRule struct {
+	ID       string `dynamodbav:"id" json:"id"`
+	Name     string `dynamodbav:"name" json:"name"`
+	URL      string `dynamodbav:"url,omitempty" json:"url,omitempty"`
+	LogGroup string `dynamodbav:"log_group,omitempty" json:"log_group,omitempty"`
+
+	// Levels and Sources match entries with any of the given values; Pattern
+	// matches messages containing it, ignoring case
+	Levels  []string `dynamodbav:"levels,omitempty" json:"levels,omitempty"`
+	Sources []string `dynamodbav:"sources,omitempty" json:"sources,omitempty"`
+	Pattern string   `dynamodbav:"pattern,omitempty" json:"pattern,omitempty"`
+
+	// Headers are sent with every HTTP delivery, e.g. a SIEM's ingest token
+	Headers map[string]string `dynamodbav:"headers,omitempty" json:"headers,omitempty"`
+
+	Secret    string    `dynamodbav:"secret" json:"-"`
+	CreatedAt time.Time `dynamodbav:"created_at" json:"created_at"`
+	CreatedBy string    `dynamodbav:"created_by,omitempty" json:"created_by,omitempty"`
+}
+
+// Matches reports whether an entry passes the rule's filters
+func (r *ForwardingRule) Matches(entry LogEntry) bool {
+	if len(r.Levels) > 0 && !slices.ContainsFunc(r.Levels, func(level string) bool { return strings.EqualFold(level, entry.Level) }) {
+		return false
+	}
+	if len(r.Sources) > 0 && !slices.Contains(r.Sources, entry.Source) {
+		return false
+	}
+	return r.Pattern == "" || strings.Contains(strings.ToLower(entry.Message), strings.ToLower(r.Pattern))
+}
+
+type ForwardingRuleStore struct {
+	rules versionedList[ForwardingRule]
+}
+
+func NewForwardingRuleStore(client *dynamodb.Client, tableName string) *ForwardingRuleStore {
+	return &ForwardingRuleStore{
+		rules: versionedList[ForwardingRule]{client: client, tableName: tableName, key: forwardingRulesKey, what: "forwarding rules"},
+	}
+}
+
+// ForwardingRules returns every rule, oldest first
+func (s *ForwardingRuleStore) ForwardingRules(ctx context.Context) ([]ForwardingRule, error) {
+	rules, _, err := s.rules.load(ctx)
+	return rules, err
+}
+
+// CreateForwardingRule gives the rule an ID and signing secret and stores
+// it, returning the secret
+func (s *ForwardingRuleStore) CreateForwardingRule(ctx context.Context, rule *ForwardingRule) (string, error) {
+	id, err := randomHex(6)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	rule.ID = id
+	rule.Secret = secret
+	rule.CreatedAt = time.Now()
+
+	err = s.rules.update(ctx, func(rules []ForwardingRule) ([]ForwardingRule, error) {
+		return append(rules, *rule), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store forwarding rule: %w", err)
+	}
+	return secret, nil
+}
+
+// DeleteForwardingRule removes a rule; entries queued for it are dropped
+// when they're retried
+func (s *ForwardingRuleStore) DeleteForwardingRule(ctx context.Context, id string) error {
+	err := s.rules.update(ctx, func(rules []ForwardingRule) ([]ForwardingRule, error) {
+		i := slices.IndexFunc(rules, func(rule ForwardingRule) bool { return rule.ID == id })
+		if i < 0 {
+			return nil, ErrForwardingRuleNotFound
+		}
+		return slices.Delete(rules, i, i+1), nil
+	})
+	if err != nil && !errors.Is(err, ErrForwardingRuleNotFound) {
+		return fmt.Errorf("failed to delete forwarding rule: %w", err)
+	}
+	return err
+}
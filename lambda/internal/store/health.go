@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// Internal health counters used by TinyTail's self-monitoring alerts.
+const (
+	CounterDynamoDBThrottles = "dynamodb-throttles"
+	CounterIngestRequests    = "ingest-requests"
+	CounterIngestErrors      = "ingest-5xx"
+	CounterSESFailures       = "ses-failures"
+	CounterIngestDropped     = "ingest-dropped"
+	CounterForwardDropped    = "forward-dropped"
+)
+
+// healthFlushInterval bounds how long routine counts (like ingest request
+// totals) are held in memory before being written. Failure counts are
+// written at the end of the invocation that saw them.
+const healthFlushInterval = time.Minute
+
+// HealthCounters tracks TinyTail's own failures in per-minute buckets in the
+// alerts table, so self-monitoring doesn't depend on the logs table (or on
+// the failing component logging anything at all). Counts are accumulated in
+// memory and written with one UpdateItem per counter on Flush.
+type HealthCounters struct {
+	client    *dynamodb.Client
+	tableName string
+
+	mu        sync.Mutex
+	pending   map[string]int
+	rollups   map[string]float64
+	urgent    bool
+	lastFlush time.Time
+}
+
+func NewHealthCounters(client *dynamodb.Client, tableName string) *HealthCounters {
+	return &HealthCounters{
+		client:    client,
+		tableName: tableName,
+		pending:   make(map[string]int),
+		rollups:   make(map[string]float64),
+		lastFlush: time.Now(),
+	}
+}
+
+// Add records n occurrences of the named counter. Anything other than the
+// ingest request total marks the counters for writing on the next Flush.
+func (h *HealthCounters) Add(name string, n int) {
+	if h == nil || n <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending[name] += n
+	if name != CounterIngestRequests {
+		h.urgent = true
+	}
+}
+
+// Flush writes pending counts to the current minute bucket, and pending
+// rollups to their totals, if a failure was recorded or the flush interval
+// has passed.
+func (h *HealthCounters) Flush(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	if (len(h.pending) == 0 && len(h.rollups) == 0) || (!h.urgent && time.Since(h.lastFlush) < healthFlushInterval) {
+		h.mu.Unlock()
+		return nil
+	}
+	pending, rollups := h.pending, h.rollups
+	h.pending = make(map[string]int)
+	h.rollups = make(map[string]float64)
+	h.urgent = false
+	h.lastFlush = time.Now()
+	h.mu.Unlock()
+
+	bucket := time.Now().Truncate(time.Minute)
+	ttl := bucket.Add(24 * time.Hour).Unix()
+
+	var errs []error
+	for name, n := range pending {
+		_, err := h.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(h.tableName),
+			Key: map[string]types.AttributeValue{
+				"ruleID": &types.AttributeValueMemberS{Value: healthKey(name, bucket)},
+			},
+			UpdateExpression: aws.String("ADD #count :n SET #ttl = :ttl"),
+			ExpressionAttributeNames: map[string]string{
+				"#count": "count",
+				"#ttl":   "ttl",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":n":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", n)},
+				":ttl": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
+			},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if err := h.flushRollups(ctx, rollups); err != nil {
+		errs = append(errs, fmt.Errorf("rollups: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Sum returns the counter's total over the minute buckets since the given
+// time. Windows are limited to 100 minutes (one BatchGetItem).
+func (h *HealthCounters) Sum(ctx context.Context, name string, since time.Time) (int, error) {
+	var keys []map[string]types.AttributeValue
+	for bucket := since.Truncate(time.Minute); !bucket.After(time.Now()) && len(keys) < 100; bucket = bucket.Add(time.Minute) {
+		keys = append(keys, map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: healthKey(name, bucket)},
+		})
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	total := 0
+	requestItems := map[string]types.KeysAndAttributes{
+		h.tableName: {Keys: keys, ProjectionExpression: aws.String("#count"), ExpressionAttributeNames: map[string]string{"#count": "count"}},
+	}
+	for len(requestItems) > 0 {
+		result, err := h.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: requestItems})
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range result.Responses[h.tableName] {
+			if countAttr, ok := item["count"].(*types.AttributeValueMemberN); ok {
+				var n int
+				fmt.Sscanf(countAttr.Value, "%d", &n)
+				total += n
+			}
+		}
+		requestItems = result.UnprocessedKeys
+	}
+
+	return total, nil
+}
+
+func healthKey(name string, bucket time.Time) string {
+	return fmt.Sprintf("health#%s#%d", name, bucket.Unix())
+}
+
+// IsThrottle reports whether err is a DynamoDB throttling error that
+// survived the SDK's retries.
+func IsThrottle(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// heartbeatPrefix begins the keys of the alerts table items holding each
+// source's last heartbeat, heartbeat#<env>/<source>. Each source has its own
+// item, as there's no telling how many services will send them.
+const heartbeatPrefix = "heartbeat#"
+
+// Heartbeat is when a source last said it was alive
+type Heartbeat struct {
+	Source   string    `dynamodbav:"source" json:"source"`
+	Env      string    `dynamodbav:"env" json:"env"`
+	LastSeen time.Time `dynamodbav:"last_seen" json:"last_seen"`
+}
+
+// heartbeatItem is a Heartbeat as stored in the alerts table
+type heartbeatItem struct {
+	Key string `dynamodbav:"ruleID"`
+	Heartbeat
+}
+
+// heartbeatID is the alerts table key of a source's heartbeat
+func heartbeatID(env, source string) string {
+	return heartbeatPrefix + env + "/" + source
+}
+
+// HeartbeatStore records heartbeats from the services sending logs, so one
+// that has stopped, and so stopped logging, can be told apart from one with
+// nothing to say
+type HeartbeatStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewHeartbeatStore(client *dynamodb.Client, tableName string) *HeartbeatStore {
+	return &HeartbeatStore{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+// Beat records a heartbeat from a source in an environment
+func (s *HeartbeatStore) Beat(ctx context.Context, env, source string, at time.Time) error {
+	if env == "" {
+		env = DefaultEnvironment
+	}
+	item, err := attributevalue.MarshalMap(heartbeatItem{
+		Key:       heartbeatID(env, source),
+		Heartbeat: Heartbeat{Source: source, Env: env, LastSeen: at},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+	return nil
+}
+
+// Heartbeats returns every source's last heartbeat, the longest silent
+// first. It's only asked for now and then, so the alerts table is scanned
+// rather than indexed.
+func (s *HeartbeatStore) Heartbeats(ctx context.Context) ([]Heartbeat, error) {
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName:        aws.String(s.tableName),
+		FilterExpression: aws.String("begins_with(ruleID, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: heartbeatPrefix},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+
+	heartbeats := []Heartbeat{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read heartbeats: %w", err)
+		}
+		for _, item := range page.Items {
+			var heartbeat Heartbeat
+			if err := attributevalue.UnmarshalMap(item, &heartbeat); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal heartbeat: %w", err)
+			}
+			heartbeats = append(heartbeats, heartbeat)
+		}
+	}
+	sort.Slice(heartbeats, func(i, j int) bool {
+		return heartbeats[i].LastSeen.Before(heartbeats[j].LastSeen)
+	})
+	return heartbeats, nil
+}
+
+// Forget removes a source's heartbeat, for a service that has been retired
+// and shouldn't be listed as silent
+func (s *HeartbeatStore) Forget(ctx context.Context, env, source string) error {
+	if env == "" {
+		env = DefaultEnvironment
+	}
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: heartbeatID(env, source)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove heartbeat: %w", err)
+	}
+	return nil
+}
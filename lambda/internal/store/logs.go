@@ -1,10 +1,18 @@
 package store
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -12,12 +20,21 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/oklog/ulid/v2"
+	"github.com/tinytail/tinytail/internal/metrics"
 )
 
 const (
-	MaxMessageSize = 350 * 1024 //350KB
-	TTLDays        = 180
-	PartitionKey   = "LOGS"
+	DefaultMaxMessageSize = 350 * 1024 //350KB
+	TTLDays               = 180
+	PartitionKey          = "LOGS"
+)
+
+// A message is stored in one item up to the max message size, which must
+// leave room in DynamoDB's 400 KB item limit for the entry's other
+// attributes and the [CONTINUED n/N] marker of a split message
+const (
+	minMessageSize     = 1024
+	maxItemMessageSize = 400*1024 - 16*1024
 )
 
 // LogEntry represents a log entry exposed to handlers and API
@@ -29,37 +46,112 @@ type LogEntry struct {
 	Timestamp time.Time `json:"timestamp"`
 	RequestID string    `json:"request_id"`
 	Cursor    string    `json:"cursor,omitempty"`
+
+	// DedupID names an entry a producer may send more than once, such as
+	// when retrying an upload whose response was lost. It isn't stored with
+	// the entry: an entry with the same DedupID as one stored within
+	// DedupTTL is dropped, whatever its timestamp.
+	DedupID string `json:"dedup_id,omitempty"`
+
+	// StableID is set by sources that send a whole batch again when any of
+	// it fails. The entry's item ID is derived from it, so storing it again
+	// with the same timestamp overwrites the item rather than adding one.
+	// Unlike DedupID nothing else is written, so it's still batch-written.
+	StableID string `json:"-"`
+
+	// ReceivedAt is when TinyTail received the entry, if that's recorded,
+	// which can differ from the timestamp a producer's clock gave it
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+
+	// SampleRate is the share of entries at its level that were stored when
+	// it was kept by sampling, such as 0.05, or zero if it wasn't sampled
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// UnmarshalJSON takes a numeric level, such as Python's 20 or a syslog
+// severity, as its digits, for ingest to map to a name
+func (e *LogEntry) UnmarshalJSON(data []byte) error {
+	type plainEntry LogEntry
+	decoded := struct {
+		*plainEntry
+		Level json.RawMessage `json:"level"`
+	}{plainEntry: (*plainEntry)(e)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	var number json.Number
+	switch {
+	case len(decoded.Level) == 0 || string(decoded.Level) == "null":
+	case json.Unmarshal(decoded.Level, &e.Level) == nil:
+	case json.Unmarshal(decoded.Level, &number) == nil:
+		e.Level = number.String()
+	default:
+		return fmt.Errorf("level must be a string or a number, got %s", decoded.Level)
+	}
+	return nil
 }
 
 // SearchResponse represents the result of a search operation
 type SearchResponse struct {
 	Logs               []LogEntry `json:"logs"`
 	ContinuationCursor string     `json:"continuation_cursor,omitempty"` // Cursor to continue searching from if batch limit reached
+
+	// Partial is set when the search stopped early to answer before the
+	// request's deadline; ContinuationCursor picks up where it stopped
+	Partial bool `json:"partial,omitempty"`
 }
 
 // dynamoDBLogItem represents a log item as stored in DynamoDB (internal use only)
 type dynamoDBLogItem struct {
-	PK           string `dynamodbav:"pk"`
-	TimestampSeq string `dynamodbav:"timestamp_seq"`
-	Timestamp    string `dynamodbav:"timestamp"`
-	Level        string `dynamodbav:"level"`
-	Message      string `dynamodbav:"message"`
-	Source       string `dynamodbav:"source"`
-	Logger       string `dynamodbav:"logger"`
-	RequestID    string `dynamodbav:"request_id"`
-	ExpireAt     int64  `dynamodbav:"expire_at,omitempty"`
+	PK           string  `dynamodbav:"pk"`
+	TimestampSeq string  `dynamodbav:"timestamp_seq"`
+	Timestamp    string  `dynamodbav:"timestamp"`
+	Level        string  `dynamodbav:"level"`
+	Message      string  `dynamodbav:"message"`
+	Source       string  `dynamodbav:"source"`
+	Logger       string  `dynamodbav:"logger"`
+	RequestID    string  `dynamodbav:"request_id"`
+	ExpireAt     int64   `dynamodbav:"expire_at,omitempty"`
+	ReceivedAt   string  `dynamodbav:"received_at,omitempty"`
+	SampleRate   float64 `dynamodbav:"sample_rate,omitempty"`
 }
 
 type LogStore struct {
 	client    *dynamodb.Client
 	tableName string
+
+	// maxMessageSize is the longest message stored in one item; longer
+	// ones are split into parts
+	maxMessageSize int
 }
 
-func NewLogStore(client *dynamodb.Client, tableName string) *LogStore {
+// NewLogStore stores entries in tableName, splitting messages longer than
+// maxMessageSize bytes, or DefaultMaxMessageSize if it's zero
+func NewLogStore(client *dynamodb.Client, tableName string, maxMessageSize int) *LogStore {
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
 	return &LogStore{
-		client:    client,
-		tableName: tableName,
+		client:         client,
+		tableName:      tableName,
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// MaxMessageSizeFromEnv reads TINYTAIL_SPLIT_MESSAGE_SIZE, the longest
+// message in bytes stored as one entry, defaulting to DefaultMaxMessageSize.
+// It rejects sizes under 1 KB or too large to fit in an item.
+func MaxMessageSizeFromEnv() (int, error) {
+	raw := os.Getenv("TINYTAIL_SPLIT_MESSAGE_SIZE")
+	if raw == "" {
+		return DefaultMaxMessageSize, nil
+	}
+	size, err := strconv.Atoi(raw)
+	if err != nil || size < minMessageSize || size > maxItemMessageSize {
+		return 0, fmt.Errorf("TINYTAIL_SPLIT_MESSAGE_SIZE must be a number of bytes between %d and %d, got %q", minMessageSize, maxItemMessageSize, raw)
 	}
+	return size, nil
 }
 
 // TimeToCursor converts a time.Time to a ULID cursor string
@@ -67,22 +159,28 @@ func (s *LogStore) TimeToCursor(t time.Time) string {
 	return ulid.MustNew(ulid.Timestamp(t), nil).String()
 }
 
+// StoreLogEntry stores an entry, setting its Cursor to the ULID it's stored
+// under (its first part's, if it's split)
 func (s *LogStore) StoreLogEntry(ctx context.Context, entry *LogEntry) error {
 	messageBytes := []byte(entry.Message)
 
 	// If message fits in one entry, store it directly
-	if len(messageBytes) <= MaxMessageSize {
-		id := ulid.MustNew(ulid.Timestamp(entry.Timestamp), rand.Reader)
-		return s.storeSingleItem(ctx, entry, id.String())
+	if len(messageBytes) <= s.maxMessageSize {
+		id, err := s.storeSingleItem(ctx, entry, itemID(entry))
+		if err != nil {
+			return err
+		}
+		entry.Cursor = id
+		return nil
 	}
 
 	// Split large message into multiple separate log entries with sequential timestamps
-	numParts := (len(messageBytes) + MaxMessageSize - 1) / MaxMessageSize
+	numParts := (len(messageBytes) + s.maxMessageSize - 1) / s.maxMessageSize
 	baseTimestamp := entry.Timestamp
 
 	for i := 0; i < numParts; i++ {
-		start := i * MaxMessageSize
-		end := start + MaxMessageSize
+		start := i * s.maxMessageSize
+		end := start + s.maxMessageSize
 		if end > len(messageBytes) {
 			end = len(messageBytes)
 		}
@@ -94,6 +192,17 @@ func (s *LogStore) StoreLogEntry(ctx context.Context, entry *LogEntry) error {
 			Logger:    entry.Logger,
 			RequestID: entry.RequestID,
 			Timestamp: baseTimestamp.Add(time.Duration(i) * time.Millisecond), // Sequential timestamps
+
+			ReceivedAt: entry.ReceivedAt,
+			SampleRate: entry.SampleRate,
+		}
+		// Each part is recorded on its own, so a retry stores only the parts
+		// that weren't
+		if entry.DedupID != "" {
+			partEntry.DedupID = fmt.Sprintf("%s#%d/%d", entry.DedupID, i+1, numParts)
+		}
+		if entry.StableID != "" {
+			partEntry.StableID = fmt.Sprintf("%s#%d/%d", entry.StableID, i+1, numParts)
 		}
 
 		// Add continuation markers
@@ -106,16 +215,60 @@ func (s *LogStore) StoreLogEntry(ctx context.Context, entry *LogEntry) error {
 		}
 
 		// Generate unique ULID for each part
-		id := ulid.MustNew(ulid.Timestamp(partEntry.Timestamp), rand.Reader)
-		if err := s.storeSingleItem(ctx, partEntry, id.String()); err != nil {
+		id, err := s.storeSingleItem(ctx, partEntry, itemID(partEntry))
+		if err != nil {
 			return fmt.Errorf("failed to store part %d: %w", i, err)
 		}
+		if i == 0 {
+			entry.Cursor = id
+		}
 	}
 
 	return nil
 }
 
-func (s *LogStore) storeSingleItem(ctx context.Context, entry *LogEntry, ulidStr string) error {
+// storeSingleItem stores an entry under the given ULID, returning the ULID
+// it's stored under, which for an entry already stored with the same
+// DedupID is the one it was stored under then
+func (s *LogStore) storeSingleItem(ctx context.Context, entry *LogEntry, ulidStr string) (string, error) {
+	av, err := logItem(entry, ulidStr)
+	if err != nil {
+		return "", err
+	}
+	if entry.DedupID != "" {
+		return s.storeOnce(ctx, av, entry.DedupID, ulidStr)
+	}
+
+	start := time.Now()
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      av,
+	})
+	observeLatency("StoreLatency", "PutLogEntry", start)
+	if err != nil {
+		return "", err
+	}
+	return ulidStr, nil
+}
+
+// itemID returns the ULID an entry is stored under. An entry with a DedupID
+// or StableID gets its randomness from a hash of it, so sending it again
+// with the same timestamp overwrites the item rather than adding one; for a
+// DedupID, the dedup record (see storeOnce) catches it otherwise.
+func itemID(entry *LogEntry) string {
+	name := cmp.Or(entry.DedupID, entry.StableID)
+	if name == "" {
+		return ulid.MustNew(ulid.Timestamp(entry.Timestamp), rand.Reader).String()
+	}
+	sum := sha256.Sum256([]byte(name))
+	var id ulid.ULID
+	_ = id.SetTime(ulid.Timestamp(entry.Timestamp))
+	_ = id.SetEntropy(sum[:10])
+	return id.String()
+}
+
+// logItem is an entry as it's stored, under the given ULID
+func logItem(entry *LogEntry, ulidStr string) (map[string]types.AttributeValue, error) {
 	expireAt := time.Now().Add(TTLDays * 24 * time.Hour).Unix()
 
 	// Use default request_id if empty (DynamoDB GSI requires non-empty strings)
@@ -134,19 +287,97 @@ func (s *LogStore) storeSingleItem(ctx context.Context, entry *LogEntry, ulidStr
 		Logger:       entry.Logger,
 		RequestID:    requestID,
 		ExpireAt:     expireAt,
+		SampleRate:   entry.SampleRate,
+	}
+	if !entry.ReceivedAt.IsZero() {
+		item.ReceivedAt = entry.ReceivedAt.Format(time.RFC3339Nano)
 	}
 
 	av, err := attributevalue.MarshalMap(item)
 	if err != nil {
-		return fmt.Errorf("failed to marshal item: %w", err)
+		return nil, fmt.Errorf("failed to marshal item: %w", err)
 	}
+	return av, nil
+}
 
-	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(s.tableName),
-		Item:      av,
-	})
+// maxBatchWrite is the most requests one BatchWriteItem call takes
+const maxBatchWrite = 25
+
+// StoreLogEntries stores entries with BatchWriteItem, 25 to a call, for
+// sources that deliver many at once. Entries too long for one item are
+// stored in parts by StoreLogEntry, as are entries with a DedupID, since
+// BatchWriteItem can't skip items that already exist; those are written
+// several at a time. Items DynamoDB leaves unprocessed are retried a few
+// times; on an error, some entries may already be stored.
+func (s *LogStore) StoreLogEntries(ctx context.Context, entries []LogEntry) error {
+	var requests []types.WriteRequest
+	var separate []*LogEntry
+	for i := range entries {
+		entry := &entries[i]
+		if len(entry.Message) > s.maxMessageSize || entry.DedupID != "" {
+			separate = append(separate, entry)
+			continue
+		}
+		item, err := logItem(entry, itemID(entry))
+		if err != nil {
+			return err
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+	if err := s.storeSeparately(ctx, separate); err != nil {
+		return err
+	}
 
-	return err
+	for start := 0; start < len(requests); start += maxBatchWrite {
+		end := min(start+maxBatchWrite, len(requests))
+		pending := map[string][]types.WriteRequest{s.tableName: requests[start:end]}
+		for attempt := 0; len(pending[s.tableName]) > 0; attempt++ {
+			if attempt == 5 {
+				return fmt.Errorf("%d log entries were left unprocessed", len(pending[s.tableName]))
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+			begin := time.Now()
+			output, err := s.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			observeLatency("StoreLatency", "BatchWriteLogEntries", begin)
+			if err != nil {
+				return fmt.Errorf("failed to store log entries: %w", err)
+			}
+			pending = output.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+// maxConcurrentPuts bounds how many of the entries StoreLogEntries writes
+// one at a time are in flight at once
+const maxConcurrentPuts = 16
+
+// storeSeparately stores entries with StoreLogEntry, several at once,
+// returning the first error
+func (s *LogStore) storeSeparately(ctx context.Context, entries []*LogEntry) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	slots := make(chan struct{}, maxConcurrentPuts)
+	for _, entry := range entries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := s.StoreLogEntry(ctx, entry); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
 }
 
 func (s *LogStore) GetRecentLogs(ctx context.Context, minutes int) ([]LogEntry, error) {
@@ -169,16 +400,35 @@ func (s *LogStore) SearchLogs(ctx context.Context, query string, startTime, endT
 }
 
 func (s *LogStore) SearchLogsWithLimit(ctx context.Context, query string, startTime, endTime time.Time, limit int) ([]LogEntry, error) {
-	logs, err := s.queryLogsByTimeRange(ctx, startTime, endTime)
+	logs, partial, err := s.SearchLogsWithinBudget(ctx, query, startTime, endTime, limit)
 	if err != nil {
 		return nil, err
 	}
+	if partial {
+		return nil, ErrTimeBudget
+	}
+	return logs, nil
+}
+
+// SearchLogsWithinBudget is SearchLogsWithLimit for callers that can use
+// incomplete results: near ctx's deadline it stops reading and returns the
+// matches among the newest entries read, with partial set.
+func (s *LogStore) SearchLogsWithinBudget(ctx context.Context, query string, startTime, endTime time.Time, limit int) ([]LogEntry, bool, error) {
+	logs, partial, err := s.queryLogsByTimeRangeWithinBudget(ctx, startTime, endTime)
+	if err != nil {
+		return nil, false, err
+	}
+	return filterLogs(logs, query, limit), partial, nil
+}
 
+// filterLogs returns up to limit (zero for all) of the entries whose
+// message, level or source contains query
+func filterLogs(logs []LogEntry, query string, limit int) []LogEntry {
 	if query == "" {
 		if limit > 0 && len(logs) > limit {
-			return logs[:limit], nil
+			return logs[:limit]
 		}
-		return logs, nil
+		return logs
 	}
 
 	var filtered []LogEntry
@@ -194,7 +444,7 @@ func (s *LogStore) SearchLogsWithLimit(ctx context.Context, query string, startT
 		}
 	}
 
-	return filtered, nil
+	return filtered
 }
 
 func (s *LogStore) SearchLogsWithCursor(ctx context.Context, query string, startTime, endTime time.Time, beforeCursor string, limit int) ([]LogEntry, error) {
@@ -252,6 +502,17 @@ func (s *LogStore) SearchLogsWithCursor(ctx context.Context, query string, start
 }
 
 func (s *LogStore) queryLogsByTimeRange(ctx context.Context, startTime, endTime time.Time) ([]LogEntry, error) {
+	logs, partial, err := s.queryLogsByTimeRangeWithinBudget(ctx, startTime, endTime)
+	if partial {
+		return nil, ErrTimeBudget
+	}
+	return logs, err
+}
+
+// queryLogsByTimeRangeWithinBudget reads the entries in a time range, newest
+// first, stopping with partial set when ctx's deadline is too close for
+// another page
+func (s *LogStore) queryLogsByTimeRangeWithinBudget(ctx context.Context, startTime, endTime time.Time) ([]LogEntry, bool, error) {
 	startULID := ulid.MustNew(ulid.Timestamp(startTime), nil)
 	endULID := ulid.MustNew(ulid.Timestamp(endTime), nil)
 
@@ -266,23 +527,32 @@ func (s *LogStore) queryLogsByTimeRange(ctx context.Context, startTime, endTime
 		ScanIndexForward: aws.Bool(false),
 	}
 
+	start := time.Now()
+	defer observeLatency("QueryLatency", "QueryTimeRange", start)
+
 	var allLogs []LogEntry
 	paginator := dynamodb.NewQueryPaginator(s.client, input)
 	for paginator.HasMorePages() {
+		if len(allLogs) > 0 && outOfTime(ctx) {
+			return allLogs, true, nil
+		}
 		output, err := paginator.NextPage(ctx)
+		if errors.Is(err, context.DeadlineExceeded) && len(allLogs) > 0 {
+			return allLogs, true, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to query logs: %w", err)
+			return nil, false, fmt.Errorf("failed to query logs: %w", err)
 		}
 
 		items, err := s.unmarshalAndReassemble(output.Items)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		allLogs = append(allLogs, items...)
 	}
 
-	return allLogs, nil
+	return allLogs, false, nil
 }
 
 func (s *LogStore) unmarshalAndReassemble(items []map[string]types.AttributeValue) ([]LogEntry, error) {
@@ -297,6 +567,7 @@ func (s *LogStore) unmarshalAndReassemble(items []map[string]types.AttributeValu
 
 		timestamp, _ := time.Parse(time.RFC3339Nano, dbItem.Timestamp)
 		ulidCursor := strings.Split(dbItem.TimestampSeq, "#")[0]
+		receivedAt, _ := time.Parse(time.RFC3339Nano, dbItem.ReceivedAt)
 
 		logs = append(logs, LogEntry{
 			Level:     dbItem.Level,
@@ -306,6 +577,9 @@ func (s *LogStore) unmarshalAndReassemble(items []map[string]types.AttributeValu
 			Timestamp: timestamp,
 			RequestID: dbItem.RequestID,
 			Cursor:    ulidCursor,
+
+			ReceivedAt: receivedAt,
+			SampleRate: dbItem.SampleRate,
 		})
 	}
 
@@ -322,7 +596,8 @@ func (s *LogStore) SearchLogsWithoutTimeWindow(ctx context.Context, query string
 		matchLimit = 100
 	}
 
-	fmt.Printf("[SearchDebug] Starting search - query: '%s', beforeCursor: '%s', matchLimit: %d\n", query, beforeCursor, matchLimit)
+	searchStart := time.Now()
+	slog.DebugContext(ctx, "Search starting", "query", query, "before_cursor", beforeCursor, "match_limit", matchLimit)
 
 	matches := []LogEntry{}         // Initialize as empty slice, not nil
 	currentCursor := beforeCursor
@@ -333,35 +608,46 @@ func (s *LogStore) SearchLogsWithoutTimeWindow(ctx context.Context, query string
 	oldestMatchCursor := ""         // Track the oldest match cursor
 
 	lowerQuery := strings.ToLower(query)
-	fmt.Printf("[SearchDebug] Lowercase query: '%s'\n", lowerQuery)
 	batchesProcessed := 0
 	totalLogsExamined := 0
 	reachedEnd := false
+	partial := false // Stopped to answer before the deadline
 
 	for batch := 0; batch < maxBatches && len(matches) < targetMatches; batch++ {
+		// Every search reads at least one batch; later ones only fit if
+		// there's time left to answer afterwards
+		if batch > 0 && outOfTime(ctx) {
+			partial = true
+			break
+		}
+
 		// Query a batch of logs starting from currentCursor going backwards
-		fmt.Printf("[SearchDebug] Batch %d: calling GetLogs with beforeCursor='%s'\n", batch+1, currentCursor)
+		slog.DebugContext(ctx, "Search reading batch", "batch", batch+1, "before_cursor", currentCursor)
 		logs, err := s.GetLogs(ctx, batchSize, "", currentCursor)
+		if errors.Is(err, context.DeadlineExceeded) && batch > 0 {
+			partial = true
+			break
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		fmt.Printf("[SearchDebug] Batch %d: received %d logs (matches so far: %d)\n", batch+1, len(logs), len(matches))
+		slog.DebugContext(ctx, "Search read batch", "batch", batch+1, "logs", len(logs), "matches", len(matches))
 		if len(logs) > 0 {
-			fmt.Printf("[SearchDebug] Batch %d: first log cursor='%s', last log cursor='%s'\n",
-				batch+1, logs[0].Cursor, logs[len(logs)-1].Cursor)
+			slog.DebugContext(ctx, "Search batch cursors", "batch", batch+1,
+				"first_cursor", logs[0].Cursor, "last_cursor", logs[len(logs)-1].Cursor)
 		}
 
 		if len(logs) == 0 {
-			fmt.Printf("[SearchDebug] No logs returned, setting reachedEnd=true\n")
+			slog.DebugContext(ctx, "Search reached the oldest log")
 			reachedEnd = true
 			break // No more logs available
 		}
 
 		// Debug: show first log message from first batch
 		if batch == 0 && len(logs) > 0 {
-			fmt.Printf("[SearchDebug] Sample log from batch 1: message='%s', level='%s', source='%s'\n",
-				logs[0].Message, logs[0].Level, logs[0].Source)
+			slog.DebugContext(ctx, "Search sample log", "message", logs[0].Message,
+				"level", logs[0].Level, "source", logs[0].Source)
 		}
 
 		batchesProcessed++
@@ -382,7 +668,7 @@ func (s *LogStore) SearchLogsWithoutTimeWindow(ctx context.Context, query string
 
 		// If we found enough matches, stop examining batches
 		if len(matches) >= targetMatches {
-			fmt.Printf("[SearchDebug] Found %d matches (target: %d), stopping batch examination\n", len(matches), targetMatches)
+			slog.DebugContext(ctx, "Search found enough matches", "matches", len(matches), "target", targetMatches)
 			break
 		}
 
@@ -397,23 +683,31 @@ func (s *LogStore) SearchLogsWithoutTimeWindow(ctx context.Context, query string
 		// Getting <1000 logs might just mean we're between log clusters
 		// Continue to let the next batch try with the oldest cursor
 		if len(logs) == 0 {
-			fmt.Printf("[SearchDebug] Batch returned 0 logs, setting reachedEnd=true\n")
+			slog.DebugContext(ctx, "Search reached the oldest log")
 			reachedEnd = true
 			break
 		}
 	}
 
-	fmt.Printf("[SearchDebug] Search complete: processed %d batches, examined %d total logs, found %d matches, reachedEnd=%v, oldestExaminedCursor=%s, oldestMatchCursor=%s\n",
-		batchesProcessed, totalLogsExamined, len(matches), reachedEnd, oldestExaminedCursor, oldestMatchCursor)
+	metrics.Emit(nil,
+		metrics.Metric{Name: "SearchLatency", Unit: metrics.Milliseconds, Value: metrics.Since(searchStart)},
+		metrics.Metric{Name: "SearchMatches", Unit: metrics.Count, Value: float64(len(matches))},
+		metrics.Metric{Name: "SearchLogsExamined", Unit: metrics.Count, Value: float64(totalLogsExamined)},
+		metrics.Metric{Name: "SearchBatches", Unit: metrics.Count, Value: float64(batchesProcessed)})
+
+	slog.InfoContext(ctx, "Search complete", "batches", batchesProcessed, "examined", totalLogsExamined,
+		"matches", len(matches), "reached_end", reachedEnd, "partial", partial,
+		"oldest_examined_cursor", oldestExaminedCursor, "oldest_match_cursor", oldestMatchCursor)
 
 	// Log first and last match cursors to verify no duplicates
 	if len(matches) > 0 {
-		fmt.Printf("[SearchDebug] Matches: first cursor='%s', last cursor='%s'\n",
-			matches[0].Cursor, matches[len(matches)-1].Cursor)
+		slog.DebugContext(ctx, "Search match cursors",
+			"first_cursor", matches[0].Cursor, "last_cursor", matches[len(matches)-1].Cursor)
 	}
 
 	response := &SearchResponse{
-		Logs: matches,
+		Logs:    matches,
+		Partial: partial,
 	}
 
 	// Determine which cursor to use for continuation:
@@ -432,14 +726,18 @@ func (s *LogStore) SearchLogsWithoutTimeWindow(ctx context.Context, query string
 		// We hit the batch limit without filling matches
 		cursorToUse = oldestExaminedCursor
 		cursorReason = "oldestExaminedCursor (batch limit reached)"
+	} else if partial && oldestExaminedCursor != "" {
+		// We ran out of time without filling matches
+		cursorToUse = oldestExaminedCursor
+		cursorReason = "oldestExaminedCursor (time budget reached)"
 	}
 
 	if cursorToUse != "" {
-		fmt.Printf("[SearchDebug] Providing continuation cursor (%s): %s\n", cursorReason, cursorToUse)
+		slog.DebugContext(ctx, "Search continuation cursor", "reason", cursorReason, "cursor", cursorToUse)
 		response.ContinuationCursor = cursorToUse
 	} else {
-		fmt.Printf("[SearchDebug] NOT providing continuation cursor (matches=%d, batches=%d, reachedEnd=%v)\n",
-			len(matches), batchesProcessed, reachedEnd)
+		slog.DebugContext(ctx, "Search has no continuation cursor",
+			"matches", len(matches), "batches", batchesProcessed, "reached_end", reachedEnd)
 	}
 
 	return response, nil
@@ -487,7 +785,9 @@ func (s *LogStore) GetLogs(ctx context.Context, limit int, afterCursor, beforeCu
 		Limit:                     aws.Int32(int32(limit)),
 	}
 
+	start := time.Now()
 	output, err := s.client.Query(ctx, input)
+	observeLatency("QueryLatency", "GetLogs", start)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query logs: %w", err)
 	}
@@ -534,7 +834,9 @@ func (s *LogStore) getLogsByTimeRangeWithDirection(ctx context.Context, startTim
 		Limit:            aws.Int32(int32(limit * 2)),
 	}
 
+	start := time.Now()
 	output, err := s.client.Query(ctx, input)
+	observeLatency("QueryLatency", "GetLogsByTimeRange", start)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query logs: %w", err)
 	}
@@ -550,3 +852,52 @@ func (s *LogStore) getLogsByTimeRangeWithDirection(ctx context.Context, startTim
 
 	return allLogs, nil
 }
+
+// EachLog calls visit for every entry between startTime and endTime, oldest
+// first, reading a page at a time so a whole day's entries never need to be
+// held in memory. It stops early when visit returns false.
+func (s *LogStore) EachLog(ctx context.Context, startTime, endTime time.Time, visit func(LogEntry) bool) error {
+	return s.eachLog(ctx, startTime, endTime, true, visit)
+}
+
+// EachLogNewestFirst is EachLog in the other direction, for readers that
+// want the newest entries in a range without reading it all
+func (s *LogStore) EachLogNewestFirst(ctx context.Context, startTime, endTime time.Time, visit func(LogEntry) bool) error {
+	return s.eachLog(ctx, startTime, endTime, false, visit)
+}
+
+func (s *LogStore) eachLog(ctx context.Context, startTime, endTime time.Time, scanForward bool, visit func(LogEntry) bool) error {
+	startULID := ulid.MustNew(ulid.Timestamp(startTime), nil)
+	endULID := ulid.MustNew(ulid.Timestamp(endTime), nil)
+
+	start := time.Now()
+	defer observeLatency("QueryLatency", "EachLog", start)
+
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		KeyConditionExpression: aws.String("pk = :pk AND timestamp_seq BETWEEN :start AND :end"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":    &types.AttributeValueMemberS{Value: PartitionKey},
+			":start": &types.AttributeValueMemberS{Value: startULID.String() + "#0"},
+			":end":   &types.AttributeValueMemberS{Value: endULID.String() + "#999"},
+		},
+		ScanIndexForward: aws.Bool(scanForward),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to query logs: %w", err)
+		}
+
+		entries, err := s.unmarshalAndReassemble(output.Items)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !visit(entry) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
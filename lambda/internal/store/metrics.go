@@ -0,0 +1,14 @@
+package store
+
+import (
+	"time"
+
+	"github.com/tinytail/tinytail/internal/metrics"
+)
+
+// observeLatency emits how long a DynamoDB call took, by operation, e.g.
+// observeLatency("QueryLatency", "GetLogs", start)
+func observeLatency(name, operation string, start time.Time) {
+	metrics.Emit(map[string]string{"Operation": operation},
+		metrics.Metric{Name: name, Unit: metrics.Milliseconds, Value: metrics.Since(start)})
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// rollupsKey is the alerts table item holding the rollup counters. These
+// are running totals that never expire, unlike the per-minute health
+// counters, so they can be exposed as Prometheus counters. Each series is a
+// number attribute of the item, named in Prometheus's notation (see
+// RollupSeries), so all of them are read with one GetItem.
+const rollupsKey = "rollups"
+
+// internalAlertsItems are alerts table items holding TinyTail's own state
+// rather than a rule's, although they're keyed like a rule's own item
+var internalAlertsItems = map[string]bool{rollupsKey: true, forwardingRulesKey: true, dropRulesKey: true, alertHistoryKey: true}
+
+// IsInternalAlertsItem reports whether an alerts table key holds TinyTail's
+// own state, which alert state pruning must leave alone
+func IsInternalAlertsItem(key string) bool {
+	return internalAlertsItems[key] || strings.HasPrefix(key, heartbeatPrefix)
+}
+
+// Rollup metrics, exposed by GET /metrics
+const (
+	RollupLogEntries       = "tinytail_log_entries_total"
+	RollupIngestRequests   = "tinytail_ingest_requests_total"
+	RollupIngestErrors     = "tinytail_ingest_errors_total"
+	RollupAlertEvaluations = "tinytail_alert_evaluations_total"
+	RollupQueryDuration    = "tinytail_query_duration_seconds"
+	RollupForwardedEntries = "tinytail_forwarded_entries_total"
+	RollupDroppedEntries   = "tinytail_dropped_entries_total"
+)
+
+// rollupBatch is the most series one UpdateItem adds to, keeping its
+// expression well under DynamoDB's 4KB limit
+const rollupBatch = 100
+
+// labelEscaper escapes a Prometheus label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// RollupSeries names a series of the metric with the given label name and
+// value pairs, e.g. tinytail_log_entries_total{level="ERROR"}
+func RollupSeries(metric string, labels ...string) string {
+	if len(labels) < 2 {
+		return metric
+	}
+	var b strings.Builder
+	b.WriteString(metric)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// AddRollup adds n to a rollup series. Like the ingest request count, it is
+// held in memory until a Flush after the flush interval.
+func (h *HealthCounters) AddRollup(series string, n float64) {
+	if h == nil || n == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rollups[series] += n
+}
+
+// flushRollups adds pending amounts to the stored totals
+func (h *HealthCounters) flushRollups(ctx context.Context, rollups map[string]float64) error {
+	series := slices.Sorted(maps.Keys(rollups))
+	for len(series) > 0 {
+		batch := series[:min(rollupBatch, len(series))]
+		series = series[len(batch):]
+
+		names := map[string]string{}
+		values := map[string]types.AttributeValue{}
+		adds := make([]string, 0, len(batch))
+		for i, name := range batch {
+			names[fmt.Sprintf("#s%d", i)] = name
+			values[fmt.Sprintf(":n%d", i)] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(rollups[name], 'f', -1, 64)}
+			adds = append(adds, fmt.Sprintf("#s%d :n%d", i, i))
+		}
+		_, err := h.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(h.tableName),
+			Key: map[string]types.AttributeValue{
+				"ruleID": &types.AttributeValueMemberS{Value: rollupsKey},
+			},
+			UpdateExpression:          aws.String("ADD " + strings.Join(adds, ", ")),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollups returns the total of every rollup series, by name. Amounts not
+// yet flushed, here or in other instances, aren't included. Without an
+// alerts table there are none.
+func (h *HealthCounters) Rollups(ctx context.Context) (map[string]float64, error) {
+	if h == nil {
+		return nil, nil
+	}
+	result, err := h.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: rollupsKey},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]float64, len(result.Item))
+	for name, attr := range result.Item {
+		number, ok := attr.(*types.AttributeValueMemberN)
+		if !ok {
+			continue
+		}
+		if value, err := strconv.ParseFloat(number.Value, 64); err == nil {
+			totals[name] = value
+		}
+	}
+	return totals, nil
+}
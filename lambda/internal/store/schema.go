@@ -0,0 +1,386 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TableNames names the DynamoDB tables
+type TableNames struct {
+	Logs     string
+	Sessions string
+	Users    string
+	APIKeys  string
+	Alerts   string
+
+	// EnvironmentLogs maps each additional environment to its logs table
+	EnvironmentLogs map[string]string
+}
+
+// TableSchema is what TinyTail expects of one table: the same definitions
+// as infrastructure/template.yaml, for deployments that don't use it
+type TableSchema struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+
+	// TTLAttribute is the attribute DynamoDB TTL expires items by, if any
+	TTLAttribute string
+
+	// Stream is the stream view the table needs, if any
+	Stream types.StreamViewType
+
+	Indexes []IndexSchema
+}
+
+// IndexSchema is a global secondary index projecting all attributes
+type IndexSchema struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+}
+
+// Schemas returns the expected schema of every table. All key attributes
+// are strings.
+func Schemas(names TableNames) []TableSchema {
+	schemas := []TableSchema{
+		{
+			Name:         names.Logs,
+			HashKey:      "pk",
+			RangeKey:     "timestamp_seq",
+			TTLAttribute: "expire_at",
+			// Realtime alerts read new entries from the stream
+			Stream:  types.StreamViewTypeNewImage,
+			Indexes: []IndexSchema{{Name: "request_id-index", HashKey: "request_id", RangeKey: "timestamp_seq"}},
+		},
+		{Name: names.Sessions, HashKey: "session_id", TTLAttribute: "expire_at"},
+		{Name: names.Users, HashKey: "username"},
+		{Name: names.APIKeys, HashKey: "key_id"},
+		{Name: names.Alerts, HashKey: "ruleID", TTLAttribute: "ttl"},
+	}
+
+	// Other environments' logs tables are like the main one, but realtime
+	// alerts only read the main table's stream
+	for _, env := range sortedKeys(names.EnvironmentLogs) {
+		schemas = append(schemas, TableSchema{
+			Name:         names.EnvironmentLogs[env],
+			HashKey:      "pk",
+			RangeKey:     "timestamp_seq",
+			TTLAttribute: "expire_at",
+			Indexes:      []IndexSchema{{Name: "request_id-index", HashKey: "request_id", RangeKey: "timestamp_seq"}},
+		})
+	}
+	return schemas
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tableWaitTimeout bounds how long Bootstrap waits for a new table or index
+// to become active
+const tableWaitTimeout = 5 * time.Minute
+
+// CheckSchema compares an existing table with its schema and returns
+// every difference. A missing table is reported as a single problem.
+func CheckSchema(ctx context.Context, client *dynamodb.Client, schema TableSchema) ([]string, error) {
+	described, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(schema.Name)})
+	if isNotFound(err) {
+		return []string{fmt.Sprintf("table %s does not exist", schema.Name)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %w", schema.Name, err)
+	}
+	table := described.Table
+
+	var problems []string
+	wantKeys := fmt.Sprintf("%s (HASH)", schema.HashKey)
+	if schema.RangeKey != "" {
+		wantKeys += fmt.Sprintf(", %s (RANGE)", schema.RangeKey)
+	}
+	if got := describeKeys(table.KeySchema); got != wantKeys {
+		problems = append(problems, fmt.Sprintf("table %s has key %s, want %s; the table must be recreated", schema.Name, got, wantKeys))
+	}
+
+	keyTypes := map[string]types.ScalarAttributeType{}
+	for _, def := range table.AttributeDefinitions {
+		keyTypes[aws.ToString(def.AttributeName)] = def.AttributeType
+	}
+	for _, name := range schema.keyAttributes() {
+		if t, ok := keyTypes[name]; ok && t != types.ScalarAttributeTypeS {
+			problems = append(problems, fmt.Sprintf("table %s key attribute %s is type %s, want S", schema.Name, name, t))
+		}
+	}
+
+	for _, index := range schema.Indexes {
+		found := false
+		for _, existing := range table.GlobalSecondaryIndexes {
+			if aws.ToString(existing.IndexName) != index.Name {
+				continue
+			}
+			found = true
+			want := fmt.Sprintf("%s (HASH), %s (RANGE)", index.HashKey, index.RangeKey)
+			if got := describeKeys(existing.KeySchema); got != want {
+				problems = append(problems, fmt.Sprintf("index %s on %s has key %s, want %s", index.Name, schema.Name, got, want))
+			}
+			if existing.Projection == nil || existing.Projection.ProjectionType != types.ProjectionTypeAll {
+				problems = append(problems, fmt.Sprintf("index %s on %s must project all attributes", index.Name, schema.Name))
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("table %s is missing index %s", schema.Name, index.Name))
+		}
+	}
+
+	if schema.Stream != "" {
+		stream := table.StreamSpecification
+		if stream == nil || !aws.ToBool(stream.StreamEnabled) {
+			problems = append(problems, fmt.Sprintf("table %s has no stream; realtime alerts need a %s stream", schema.Name, schema.Stream))
+		} else if stream.StreamViewType != schema.Stream && stream.StreamViewType != types.StreamViewTypeNewAndOldImages {
+			problems = append(problems, fmt.Sprintf("table %s stream is %s, want %s", schema.Name, stream.StreamViewType, schema.Stream))
+		}
+	}
+
+	if schema.TTLAttribute != "" {
+		ttl, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(schema.Name)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe TTL of %s: %w", schema.Name, err)
+		}
+		if problem := checkTTL(schema, ttl.TimeToLiveDescription); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems, nil
+}
+
+func checkTTL(schema TableSchema, ttl *types.TimeToLiveDescription) string {
+	if ttl == nil || ttl.TimeToLiveStatus == types.TimeToLiveStatusDisabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusDisabling {
+		return fmt.Sprintf("table %s does not have TTL enabled on %s; old items will never expire", schema.Name, schema.TTLAttribute)
+	}
+	if got := aws.ToString(ttl.AttributeName); got != schema.TTLAttribute {
+		return fmt.Sprintf("table %s TTL is on %s, want %s", schema.Name, got, schema.TTLAttribute)
+	}
+	return ""
+}
+
+// Bootstrap creates the table if it doesn't exist and adds whatever an
+// existing one is missing that can be added in place: indexes, the stream
+// and TTL. Problems that need the table recreated are returned rather than
+// fixed. It returns a description of each change made.
+func Bootstrap(ctx context.Context, client *dynamodb.Client, schema TableSchema) (changes []string, err error) {
+	described, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(schema.Name)})
+	switch {
+	case isNotFound(err):
+		if err := createTable(ctx, client, schema); err != nil {
+			return nil, err
+		}
+		changes = append(changes, fmt.Sprintf("created table %s", schema.Name))
+	case err != nil:
+		return nil, fmt.Errorf("failed to describe table %s: %w", schema.Name, err)
+	default:
+		added, err := addMissing(ctx, client, schema, described.Table)
+		changes = append(changes, added...)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	if schema.TTLAttribute != "" {
+		ttl, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(schema.Name)})
+		if err != nil {
+			return changes, fmt.Errorf("failed to describe TTL of %s: %w", schema.Name, err)
+		}
+		// TTL can only be changed to a different attribute by disabling it
+		// first, which takes up to an hour; leave that to CheckSchema
+		if status := ttl.TimeToLiveDescription; status == nil || status.TimeToLiveStatus == types.TimeToLiveStatusDisabled {
+			_, err := client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+				TableName: aws.String(schema.Name),
+				TimeToLiveSpecification: &types.TimeToLiveSpecification{
+					AttributeName: aws.String(schema.TTLAttribute),
+					Enabled:       aws.Bool(true),
+				},
+			})
+			if err != nil {
+				return changes, fmt.Errorf("failed to enable TTL on %s: %w", schema.Name, err)
+			}
+			changes = append(changes, fmt.Sprintf("enabled TTL on %s.%s", schema.Name, schema.TTLAttribute))
+		}
+	}
+
+	return changes, nil
+}
+
+func createTable(ctx context.Context, client *dynamodb.Client, schema TableSchema) error {
+	input := &dynamodb.CreateTableInput{
+		TableName:   aws.String(schema.Name),
+		BillingMode: types.BillingModePayPerRequest,
+		KeySchema:   keySchema(schema.HashKey, schema.RangeKey),
+	}
+	for _, name := range schema.keyAttributes() {
+		input.AttributeDefinitions = append(input.AttributeDefinitions, types.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: types.ScalarAttributeTypeS,
+		})
+	}
+	for _, index := range schema.Indexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(index.Name),
+			KeySchema:  keySchema(index.HashKey, index.RangeKey),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	if schema.Stream != "" {
+		input.StreamSpecification = &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: schema.Stream}
+	}
+
+	if _, err := client.CreateTable(ctx, input); err != nil {
+		return fmt.Errorf("failed to create table %s: %w", schema.Name, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(schema.Name)}, tableWaitTimeout); err != nil {
+		return fmt.Errorf("table %s did not become active: %w", schema.Name, err)
+	}
+	return nil
+}
+
+// addMissing adds indexes and the stream to an existing table. DynamoDB
+// allows one index creation at a time, so each is waited for.
+func addMissing(ctx context.Context, client *dynamodb.Client, schema TableSchema, table *types.TableDescription) ([]string, error) {
+	var changes []string
+
+	for _, index := range schema.Indexes {
+		exists := false
+		for _, existing := range table.GlobalSecondaryIndexes {
+			exists = exists || aws.ToString(existing.IndexName) == index.Name
+		}
+		if exists {
+			continue
+		}
+
+		var definitions []types.AttributeDefinition
+		for _, name := range []string{index.HashKey, index.RangeKey} {
+			definitions = append(definitions, types.AttributeDefinition{AttributeName: aws.String(name), AttributeType: types.ScalarAttributeTypeS})
+		}
+		_, err := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            aws.String(schema.Name),
+			AttributeDefinitions: definitions,
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  aws.String(index.Name),
+					KeySchema:  keySchema(index.HashKey, index.RangeKey),
+					Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				},
+			}},
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to add index %s to %s: %w", index.Name, schema.Name, err)
+		}
+		if err := waitForIndexes(ctx, client, schema.Name); err != nil {
+			return changes, err
+		}
+		changes = append(changes, fmt.Sprintf("added index %s to %s", index.Name, schema.Name))
+	}
+
+	if schema.Stream != "" && (table.StreamSpecification == nil || !aws.ToBool(table.StreamSpecification.StreamEnabled)) {
+		_, err := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:           aws.String(schema.Name),
+			StreamSpecification: &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: schema.Stream},
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to enable the stream on %s: %w", schema.Name, err)
+		}
+		changes = append(changes, fmt.Sprintf("enabled %s stream on %s", schema.Stream, schema.Name))
+	}
+
+	return changes, nil
+}
+
+// waitForIndexes waits until the table and all its indexes are active
+func waitForIndexes(ctx context.Context, client *dynamodb.Client, name string) error {
+	deadline := time.Now().Add(tableWaitTimeout)
+	for time.Now().Before(deadline) {
+		described, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+		if err != nil {
+			return fmt.Errorf("failed to describe table %s: %w", name, err)
+		}
+		active := described.Table.TableStatus == types.TableStatusActive
+		for _, index := range described.Table.GlobalSecondaryIndexes {
+			active = active && index.IndexStatus == types.IndexStatusActive
+		}
+		if active {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return fmt.Errorf("indexes on %s did not become active within %s", name, tableWaitTimeout)
+}
+
+func (s TableSchema) keyAttributes() []string {
+	names := []string{s.HashKey}
+	if s.RangeKey != "" {
+		names = append(names, s.RangeKey)
+	}
+	for _, index := range s.Indexes {
+		for _, name := range []string{index.HashKey, index.RangeKey} {
+			seen := false
+			for _, existing := range names {
+				seen = seen || existing == name
+			}
+			if !seen {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func keySchema(hashKey, rangeKey string) []types.KeySchemaElement {
+	keys := []types.KeySchemaElement{{AttributeName: aws.String(hashKey), KeyType: types.KeyTypeHash}}
+	if rangeKey != "" {
+		keys = append(keys, types.KeySchemaElement{AttributeName: aws.String(rangeKey), KeyType: types.KeyTypeRange})
+	}
+	return keys
+}
+
+// describeKeys renders a key schema as "a (HASH), b (RANGE)"
+func describeKeys(keys []types.KeySchemaElement) string {
+	var s string
+	for i, key := range keys {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s (%s)", aws.ToString(key.AttributeName), key.KeyType)
+	}
+	return s
+}
+
+// TableExists reports whether the table exists
+func TableExists(ctx context.Context, client *dynamodb.Client, name string) (bool, error) {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func isNotFound(err error) bool {
+	var notFound *types.ResourceNotFoundException
+	return errors.As(err, &notFound)
+}
@@ -2,7 +2,12 @@ package store
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,39 +18,157 @@ import (
 )
 
 const (
+	// SessionTTLDays is the default idle lifetime: sessions expire after
+	// this long without use
 	SessionTTLDays = 14
+	// SessionMaxDays is the default absolute lifetime, however active the
+	// session is
+	SessionMaxDays = 30
+	// SessionShortHours is the default absolute lifetime of sessions created
+	// without "keep me signed in"
+	SessionShortHours = 12
+
+	// sessionLifetimeLimitDays bounds both lifetimes
+	sessionLifetimeLimitDays = 365
+
+	// sessionRefreshInterval throttles expiry refreshes to one write per
+	// session per hour
+	sessionRefreshInterval = time.Hour
 )
 
+// SessionLifetime bounds how long a UI session lasts
+type SessionLifetime struct {
+	Idle  time.Duration // Expires after this long without use
+	Max   time.Duration // Expires this long after sign-in regardless of use
+	Short time.Duration // Max for sessions created without "keep me signed in"
+}
+
+// SessionLifetimeFromEnv reads TINYTAIL_SESSION_IDLE_DAYS,
+// TINYTAIL_SESSION_MAX_DAYS and TINYTAIL_SESSION_SHORT_HOURS, defaulting to
+// SessionTTLDays, SessionMaxDays and SessionShortHours. Fractional days are
+// allowed (0.5 is 12 hours). It rejects values that aren't positive numbers,
+// exceed a year, or have the idle timeout or short lifetime longer than the
+// absolute lifetime.
+func SessionLifetimeFromEnv() (SessionLifetime, error) {
+	idle, err := envDuration("TINYTAIL_SESSION_IDLE_DAYS", SessionTTLDays, 24*time.Hour)
+	if err != nil {
+		return SessionLifetime{}, err
+	}
+	max, err := envDuration("TINYTAIL_SESSION_MAX_DAYS", SessionMaxDays, 24*time.Hour)
+	if err != nil {
+		return SessionLifetime{}, err
+	}
+	short, err := envDuration("TINYTAIL_SESSION_SHORT_HOURS", SessionShortHours, time.Hour)
+	if err != nil {
+		return SessionLifetime{}, err
+	}
+	if idle > max {
+		return SessionLifetime{}, fmt.Errorf("TINYTAIL_SESSION_IDLE_DAYS (%s) must not exceed TINYTAIL_SESSION_MAX_DAYS (%s)", idle, max)
+	}
+	if short > max {
+		return SessionLifetime{}, fmt.Errorf("TINYTAIL_SESSION_SHORT_HOURS (%s) must not exceed TINYTAIL_SESSION_MAX_DAYS (%s)", short, max)
+	}
+	return SessionLifetime{Idle: idle, Max: max, Short: short}, nil
+}
+
 type Session struct {
 	SessionID string    `dynamodbav:"session_id"`
 	CreatedAt time.Time `dynamodbav:"created_at"`
 	ExpireAt  int64     `dynamodbav:"expire_at"`
 	UserAgent string    `dynamodbav:"user_agent,omitempty"`
+	Username  string    `dynamodbav:"username,omitempty"`
+	Role      string    `dynamodbav:"role,omitempty"`
+	// ShortLived sessions were created without "keep me signed in" and end
+	// after the short lifetime
+	ShortLived bool `dynamodbav:"short_lived,omitempty"`
+	// RevokeToken lets the session be ended from a link in a sign-in
+	// notification, without exposing the session ID itself
+	RevokeToken string `dynamodbav:"revoke_token,omitempty"`
 }
 
 type SessionStore struct {
-	client    *dynamodb.Client
-	tableName string
+	client      *dynamodb.Client
+	tableName   string
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	shortLife   time.Duration
 }
 
-func NewSessionStore(client *dynamodb.Client, tableName string) *SessionStore {
+func NewSessionStore(client *dynamodb.Client, tableName string, lifetime SessionLifetime) *SessionStore {
 	return &SessionStore{
-		client:    client,
-		tableName: tableName,
+		client:      client,
+		tableName:   tableName,
+		idleTimeout: lifetime.Idle,
+		maxLifetime: lifetime.Max,
+		shortLife:   lifetime.Short,
+	}
+}
+
+// envDuration reads a positive number of units (days or hours) from the
+// environment, up to a year
+func envDuration(name string, defaultValue float64, unit time.Duration) (time.Duration, error) {
+	value := defaultValue
+	if raw := os.Getenv(name); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		limit := float64(sessionLifetimeLimitDays*24*time.Hour) / float64(unit)
+		if err != nil || parsed <= 0 || parsed > limit {
+			return 0, fmt.Errorf("%s must be a number between 0 and %g, got %q", name, limit, raw)
+		}
+		value = parsed
+	}
+	return time.Duration(value * float64(unit)).Round(time.Minute), nil
+}
+
+// MaxLifetime is the absolute session lifetime, used for the cookie expiry
+func (s *SessionStore) MaxLifetime() time.Duration {
+	return s.maxLifetime
+}
+
+// ShortLifetime is the absolute lifetime of sessions created without
+// "keep me signed in"
+func (s *SessionStore) ShortLifetime() time.Duration {
+	return s.shortLife
+}
+
+// IdleTimeout is how long a session lasts without use
+func (s *SessionStore) IdleTimeout() time.Duration {
+	return s.idleTimeout
+}
+
+// lifetimeFor returns the absolute lifetime of a session
+func (s *SessionStore) lifetimeFor(session *Session) time.Duration {
+	if session.ShortLived {
+		return s.shortLife
 	}
+	return s.maxLifetime
 }
 
-// CreateSession creates a new session with a 2-week TTL
-func (s *SessionStore) CreateSession(ctx context.Context, userAgent string) (*Session, error) {
+// expiryFor returns when a session used now should expire: after the idle
+// timeout, but never later than its absolute lifetime
+func (s *SessionStore) expiryFor(session *Session, now time.Time) time.Time {
+	expiry := now.Add(s.idleTimeout)
+	if absolute := session.CreatedAt.Add(s.lifetimeFor(session)); expiry.After(absolute) {
+		return absolute
+	}
+	return expiry
+}
+
+// CreateSession creates a new session for the user with an idle expiry.
+// Without remember, the session is short-lived: it ends after the short
+// lifetime, and the cookie is meant to end with the browser session.
+func (s *SessionStore) CreateSession(ctx context.Context, username, role, userAgent string, remember bool) (*Session, error) {
 	now := time.Now()
 	sessionID := uuid.New().String()
 
 	session := &Session{
-		SessionID: sessionID,
-		CreatedAt: now,
-		ExpireAt:  now.Add(SessionTTLDays * 24 * time.Hour).Unix(),
-		UserAgent: userAgent,
+		SessionID:  sessionID,
+		CreatedAt:  now,
+		UserAgent:  userAgent,
+		Username:   username,
+		Role:       role,
+		ShortLived: !remember,
 	}
+	session.ExpireAt = s.expiryFor(session, now).Unix()
 
 	av, err := attributevalue.MarshalMap(session)
 	if err != nil {
@@ -63,8 +186,10 @@ func (s *SessionStore) CreateSession(ctx context.Context, userAgent string) (*Se
 	return session, nil
 }
 
-// ValidateSession checks if a session exists and is not expired
-func (s *SessionStore) ValidateSession(ctx context.Context, sessionID string) (bool, error) {
+// ValidateSession returns the session if it exists and is not expired, or
+// nil otherwise. Using a session pushes its expiry out by the idle timeout
+// (at most once an hour), up to the absolute lifetime.
+func (s *SessionStore) ValidateSession(ctx context.Context, sessionID string) (*Session, error) {
 	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.tableName),
 		Key: map[string]types.AttributeValue{
@@ -72,25 +197,52 @@ func (s *SessionStore) ValidateSession(ctx context.Context, sessionID string) (b
 		},
 	})
 	if err != nil {
-		return false, fmt.Errorf("failed to get session: %w", err)
+		return nil, fmt.Errorf("failed to get session: %w", err)
 	}
 
 	if result.Item == nil {
-		return false, nil
+		return nil, nil
 	}
 
 	var session Session
 	err = attributevalue.UnmarshalMap(result.Item, &session)
 	if err != nil {
-		return false, fmt.Errorf("failed to unmarshal session: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
 	}
 
 	// Check if expired (although DynamoDB TTL should handle this)
-	if session.ExpireAt < time.Now().Unix() {
-		return false, nil
+	now := time.Now()
+	if session.ExpireAt < now.Unix() || !now.Before(session.CreatedAt.Add(s.lifetimeFor(&session))) {
+		return nil, nil
+	}
+
+	// Slide the expiry forward for active sessions
+	newExpiry := s.expiryFor(&session, now).Unix()
+	if newExpiry-session.ExpireAt >= int64(sessionRefreshInterval/time.Second) {
+		if err := s.refreshExpiry(ctx, sessionID, newExpiry); err != nil {
+			// The session is still valid - try again on the next request
+			slog.WarnContext(ctx, "Failed to refresh session expiry", "error", err)
+		} else {
+			session.ExpireAt = newExpiry
+		}
 	}
 
-	return true, nil
+	return &session, nil
+}
+
+func (s *SessionStore) refreshExpiry(ctx context.Context, sessionID string, expireAt int64) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"session_id": &types.AttributeValueMemberS{Value: sessionID},
+		},
+		UpdateExpression:    aws.String("SET expire_at = :expire_at"),
+		ConditionExpression: aws.String("attribute_exists(session_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expire_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expireAt, 10)},
+		},
+	})
+	return err
 }
 
 // DeleteSession removes a session (for logout)
@@ -106,4 +258,177 @@ func (s *SessionStore) DeleteSession(ctx context.Context, sessionID string) erro
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// SetRevokeToken gives the session a random token that RevokeSession
+// accepts, and returns it
+func (s *SessionStore) SetRevokeToken(ctx context.Context, sessionID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate revoke token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"session_id": &types.AttributeValueMemberS{Value: sessionID},
+		},
+		UpdateExpression:    aws.String("SET revoke_token = :token"),
+		ConditionExpression: aws.String("attribute_exists(session_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: token},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to set revoke token: %w", err)
+	}
+	return token, nil
+}
+
+// RevokeSession deletes the session holding the revoke token and returns
+// it, or nil if no session does (it has already ended). Revocation is rare,
+// so the table is scanned rather than indexed.
+func (s *SessionStore) RevokeSession(ctx context.Context, token string) (*Session, error) {
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName:        aws.String(s.tableName),
+		FilterExpression: aws.String("revoke_token = :token"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: token},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sessions: %w", err)
+		}
+		if len(page.Items) == 0 {
+			continue
+		}
+
+		var session Session
+		if err := attributevalue.UnmarshalMap(page.Items[0], &session); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+		}
+		if err := s.DeleteSession(ctx, session.SessionID); err != nil {
+			return nil, err
+		}
+		return &session, nil
+	}
+	return nil, nil
+}
+
+// PruneResult reports what PruneSessions found and removed
+type PruneResult struct {
+	Scanned  int `json:"scanned"`
+	Expired  int `json:"expired"`
+	Orphaned int `json:"orphaned"`
+	Deleted  int `json:"deleted"`
+}
+
+// PruneSessions deletes sessions that have expired but not yet been removed
+// by DynamoDB TTL (which can lag by days), along with those orphaned reports
+// as belonging to no active user.
+func (s *SessionStore) PruneSessions(ctx context.Context, orphaned func(*Session) bool) (*PruneResult, error) {
+	result := &PruneResult{}
+	now := time.Now()
+
+	var doomed []string
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName: aws.String(s.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sessions: %w", err)
+		}
+		var sessions []Session
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &sessions); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sessions: %w", err)
+		}
+
+		for i := range sessions {
+			session := &sessions[i]
+			result.Scanned++
+			switch {
+			case session.ExpireAt < now.Unix() || !now.Before(session.CreatedAt.Add(s.lifetimeFor(session))):
+				result.Expired++
+			case orphaned(session):
+				result.Orphaned++
+			default:
+				continue
+			}
+			doomed = append(doomed, session.SessionID)
+		}
+	}
+
+	deleted, err := s.deleteSessions(ctx, doomed)
+	result.Deleted = deleted
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// DeleteUserSessions deletes every session of the user except keepID,
+// returning how many were deleted
+func (s *SessionStore) DeleteUserSessions(ctx context.Context, username, keepID string) (int, error) {
+	var ids []string
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName:            aws.String(s.tableName),
+		FilterExpression:     aws.String("username = :username"),
+		ProjectionExpression: aws.String("session_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":username": &types.AttributeValueMemberS{Value: username},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan sessions: %w", err)
+		}
+		for _, item := range page.Items {
+			if id, ok := item["session_id"].(*types.AttributeValueMemberS); ok && id.Value != keepID {
+				ids = append(ids, id.Value)
+			}
+		}
+	}
+
+	return s.deleteSessions(ctx, ids)
+}
+
+// deleteSessions deletes sessions in batches, returning how many were
+// deleted
+func (s *SessionStore) deleteSessions(ctx context.Context, ids []string) (int, error) {
+	deleted := 0
+
+	// BatchWriteItem takes at most 25 requests
+	for start := 0; start < len(ids); start += 25 {
+		end := min(start+25, len(ids))
+		var requests []types.WriteRequest
+		for _, id := range ids[start:end] {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{
+					Key: map[string]types.AttributeValue{
+						"session_id": &types.AttributeValueMemberS{Value: id},
+					},
+				},
+			})
+		}
+
+		pending := map[string][]types.WriteRequest{s.tableName: requests}
+		for attempt := 0; len(pending[s.tableName]) > 0 && attempt < 5; attempt++ {
+			output, err := s.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete sessions: %w", err)
+			}
+			deleted += len(pending[s.tableName]) - len(output.UnprocessedItems[s.tableName])
+			pending = output.UnprocessedItems
+			if len(pending[s.tableName]) > 0 {
+				time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+			}
+		}
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// LogEntryFromStreamImage converts the NewImage of a DynamoDB stream record
+// into a LogEntry. ok is false for items that aren't log entries.
+func LogEntryFromStreamImage(image map[string]events.DynamoDBAttributeValue) (entry LogEntry, ok bool) {
+	getString := func(name string) string {
+		attr, exists := image[name]
+		if !exists || attr.DataType() != events.DataTypeString {
+			return ""
+		}
+		return attr.String()
+	}
+
+	if getString("pk") != PartitionKey {
+		return LogEntry{}, false
+	}
+
+	timestamp, _ := time.Parse(time.RFC3339Nano, getString("timestamp"))
+	receivedAt, _ := time.Parse(time.RFC3339Nano, getString("received_at"))
+	var sampleRate float64
+	if attr, exists := image["sample_rate"]; exists && attr.DataType() == events.DataTypeNumber {
+		sampleRate, _ = attr.Float()
+	}
+
+	return LogEntry{
+		Level:     getString("level"),
+		Message:   getString("message"),
+		Source:    getString("source"),
+		Logger:    getString("logger"),
+		Timestamp: timestamp,
+		RequestID: getString("request_id"),
+		Cursor:    strings.Split(getString("timestamp_seq"), "#")[0],
+
+		ReceivedAt: receivedAt,
+		SampleRate: sampleRate,
+	}, true
+}
@@ -0,0 +1,415 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from most to least privileged. Admins manage users and API keys,
+// read-write users can also author alert rules, and read-only users can only
+// view and search logs.
+const (
+	RoleAdmin     = "admin"
+	RoleReadWrite = "read-write"
+	RoleReadOnly  = "read-only"
+
+	// roleLegacyUser is the role users were given before read-only access
+	// existed. It grants read-write access.
+	roleLegacyUser = "user"
+)
+
+// ValidRole reports whether role can be assigned to a user or API key
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleReadWrite || role == RoleReadOnly
+}
+
+// RoleAllows reports whether role grants at least the access of required
+func RoleAllows(role, required string) bool {
+	return roleRank(role) >= roleRank(required)
+}
+
+func roleRank(role string) int {
+	switch role {
+	case RoleAdmin:
+		return 3
+	case RoleReadWrite, roleLegacyUser:
+		return 2
+	case RoleReadOnly:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Password length bounds for new users. bcrypt ignores anything past 72
+// bytes, so longer passwords are rejected rather than silently truncated.
+const (
+	MinPasswordLength = 12
+	MaxPasswordLength = 72
+)
+
+var (
+	// ErrUserExists is returned when creating a username that is taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned when updating a user that doesn't exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidPassword is returned for passwords outside the length bounds
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+type User struct {
+	Username     string    `dynamodbav:"username" json:"username"`
+	PasswordHash string    `dynamodbav:"password_hash" json:"-"`
+	Role         string    `dynamodbav:"role" json:"role"`
+	Disabled     bool      `dynamodbav:"disabled" json:"disabled"`
+	CreatedAt    time.Time `dynamodbav:"created_at" json:"created_at"`
+	CreatedBy    string    `dynamodbav:"created_by,omitempty" json:"created_by,omitempty"`
+	// PasswordChangedAt is unset for users created before it was tracked;
+	// PasswordSetAt falls back to CreatedAt for them
+	PasswordChangedAt time.Time `dynamodbav:"password_changed_at,omitempty" json:"password_changed_at,omitempty"`
+	// Email receives account notifications such as sign-ins from new devices
+	Email string `dynamodbav:"email,omitempty" json:"email,omitempty"`
+	// KnownDevices holds fingerprints of the user agent and IP address
+	// combinations the user has signed in from
+	KnownDevices []string `dynamodbav:"known_devices,stringset,omitempty" json:"-"`
+	// LoginLink is the digest of the nonce in the user's outstanding
+	// sign-in link, cleared when the link is used
+	LoginLink string `dynamodbav:"login_link,omitempty" json:"-"`
+}
+
+// NotificationAddress returns where account notifications go: the user's
+// email, or the username if it is an email address
+func (u *User) NotificationAddress() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	if strings.Contains(u.Username, "@") {
+		return u.Username
+	}
+	return ""
+}
+
+// PasswordSetAt returns when the user's current password was set
+func (u *User) PasswordSetAt() time.Time {
+	if u.PasswordChangedAt.IsZero() {
+		return u.CreatedAt
+	}
+	return u.PasswordChangedAt
+}
+
+type UserStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewUserStore(client *dynamodb.Client, tableName string) *UserStore {
+	return &UserStore{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+// CreateUser stores a new user with a bcrypt hash of the password
+func (s *UserStore) CreateUser(ctx context.Context, username, password, role, email, createdBy string) (*User, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user := &User{
+		Username:          username,
+		PasswordHash:      hash,
+		Role:              role,
+		CreatedAt:         now,
+		CreatedBy:         createdBy,
+		PasswordChangedAt: now,
+		Email:             email,
+	}
+
+	av, err := attributevalue.MarshalMap(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal user: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.tableName),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(username)"),
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return nil, ErrUserExists
+		}
+		return nil, fmt.Errorf("failed to store user: %w", err)
+	}
+
+	return user, nil
+}
+
+// GetUser returns the user, or nil if it doesn't exist
+func (s *UserStore) GetUser(ctx context.Context, username string) (*User, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var user User
+	if err := attributevalue.UnmarshalMap(result.Item, &user); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+
+	return &user, nil
+}
+
+// ListUsers returns every user. The table is expected to stay small.
+func (s *UserStore) ListUsers(ctx context.Context) ([]User, error) {
+	users := []User{}
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{
+		TableName: aws.String(s.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users: %w", err)
+		}
+		var pageUsers []User
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageUsers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal users: %w", err)
+		}
+		users = append(users, pageUsers...)
+	}
+	return users, nil
+}
+
+// HasUsers reports whether any user has been created yet
+func (s *UserStore) HasUsers(ctx context.Context) (bool, error) {
+	result, err := s.client.Scan(ctx, &dynamodb.ScanInput{
+		TableName:            aws.String(s.tableName),
+		Limit:                aws.Int32(1),
+		ProjectionExpression: aws.String("username"),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check users: %w", err)
+	}
+	return len(result.Items) > 0, nil
+}
+
+// SetDisabled disables or re-enables a user
+func (s *UserStore) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET disabled = :disabled"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":disabled": &types.AttributeValueMemberBOOL{Value: disabled},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// SetPassword replaces a user's password
+func (s *UserStore) SetPassword(ctx context.Context, username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET password_hash = :hash, password_changed_at = :now"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: hash},
+			":now":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+// RememberDevice records that the user signed in from the device with the
+// given fingerprint. It reports whether the device is new, which is never
+// the case for the user's first recorded sign-in: there is nothing to
+// compare it with.
+func (s *UserStore) RememberDevice(ctx context.Context, username, fingerprint string) (bool, error) {
+	result, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("ADD known_devices :device"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":device": &types.AttributeValueMemberSS{Value: []string{fingerprint}},
+		},
+		ReturnValues: types.ReturnValueUpdatedOld,
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return false, ErrUserNotFound
+		}
+		return false, fmt.Errorf("failed to record device: %w", err)
+	}
+
+	known, ok := result.Attributes["known_devices"].(*types.AttributeValueMemberSS)
+	if !ok {
+		return false, nil // First sign-in since devices were tracked
+	}
+	for _, device := range known.Value {
+		if device == fingerprint {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SetLoginLink records the nonce digest of a new sign-in link. Only the
+// latest link works: issuing one invalidates any before it.
+func (s *UserStore) SetLoginLink(ctx context.Context, username, nonceDigest string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET login_link = :link"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":link": &types.AttributeValueMemberS{Value: nonceDigest},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to store login link: %w", err)
+	}
+	return nil
+}
+
+// ConsumeLoginLink clears the user's sign-in link if its nonce digest
+// matches, reporting whether it did. Clearing and checking happen in one
+// conditional write, so each link signs in at most once.
+func (s *UserStore) ConsumeLoginLink(ctx context.Context, username, nonceDigest string) (bool, error) {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("REMOVE login_link"),
+		ConditionExpression: aws.String("login_link = :link"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":link": &types.AttributeValueMemberS{Value: nonceDigest},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to consume login link: %w", err)
+	}
+	return true, nil
+}
+
+// hashPassword checks the length bounds and returns the bcrypt hash
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return "", fmt.Errorf("%w: must be %d to %d characters", ErrInvalidPassword, MinPasswordLength, MaxPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// SetRole changes a user's role
+func (s *UserStore) SetRole(ctx context.Context, username, role string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:         aws.String("SET #role = :role"),
+		ConditionExpression:      aws.String("attribute_exists(username)"),
+		ExpressionAttributeNames: map[string]string{"#role": "role"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":role": &types.AttributeValueMemberS{Value: role},
+		},
+	})
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// Authenticate returns the user if the password matches and the account is
+// enabled, or nil otherwise
+func (s *UserStore) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		// Spend the same time as a real check so usernames can't be probed
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || user.Disabled {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+// dummyPasswordHash is compared against for unknown usernames. It is a
+// precomputed DefaultCost hash so cold starts don't pay for generating one.
+var dummyPasswordHash = []byte("$2a$10$pjdm8LM43cun.mtUWhTsnuUJuMNwm4B7u6L/X5vEJQkA/mrYYAkX6")
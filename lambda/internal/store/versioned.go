@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// listUpdateAttempts is how often a change to a versioned list is retried
+// when another one got in first
+const listUpdateAttempts = 3
+
+// versionedList is an alerts table item holding a short list of rules.
+// There are only ever a handful, and they're needed all at once, so they're
+// kept as one list read with a single GetItem. A version number guards
+// against two admins changing the list at once.
+type versionedList[T any] struct {
+	client    *dynamodb.Client
+	tableName string
+	key       string
+
+	// what names the list in errors, e.g. "forwarding rules"
+	what string
+}
+
+// load reads the list and the version it was stored with, zero if there is
+// none yet
+func (l *versionedList[T]) load(ctx context.Context) ([]T, int, error) {
+	result, err := l.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(l.tableName),
+		Key: map[string]types.AttributeValue{
+			"ruleID": &types.AttributeValueMemberS{Value: l.key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", l.what, err)
+	}
+
+	var item struct {
+		Rules   []T `dynamodbav:"rules"`
+		Version int `dynamodbav:"version"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal %s: %w", l.what, err)
+	}
+	if item.Rules == nil {
+		item.Rules = []T{}
+	}
+	return item.Rules, item.Version, nil
+}
+
+// update applies change to the stored list, starting again from a fresh
+// read if someone else changed it in the meantime
+func (l *versionedList[T]) update(ctx context.Context, change func([]T) ([]T, error)) error {
+	for attempt := 1; ; attempt++ {
+		rules, version, err := l.load(ctx)
+		if err != nil {
+			return err
+		}
+		if rules, err = change(rules); err != nil {
+			return err
+		}
+		av, err := attributevalue.Marshal(rules)
+		if err != nil {
+			return err
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(l.tableName),
+			Item: map[string]types.AttributeValue{
+				"ruleID":  &types.AttributeValueMemberS{Value: l.key},
+				"rules":   av,
+				"version": &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(ruleID)"),
+		}
+		if version > 0 {
+			input.ConditionExpression = aws.String("version = :version")
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":version": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+			}
+		}
+		_, err = l.client.PutItem(ctx, input)
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) && attempt < listUpdateAttempts {
+			continue
+		}
+		return err
+	}
+}
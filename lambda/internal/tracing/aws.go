@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"reflect"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Instrument adds a subsegment for every AWS SDK call, retries included,
+// to a client's middleware stack. Add it to aws.Config.APIOptions before
+// creating clients.
+func (t *Tracer) Instrument(stack *middleware.Stack) error {
+	if err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("XRaySubsegment", t.traceCall), middleware.After); err != nil {
+		return err
+	}
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("XRayTraceHeader", propagateTraceHeader), middleware.After)
+}
+
+func (t *Tracer) traceCall(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	ctx, segment := t.Start(ctx, awsmiddleware.GetServiceID(ctx))
+	if segment == nil {
+		return next.HandleInitialize(ctx, in)
+	}
+
+	segment.doc.Namespace = "aws"
+	segment.doc.AWS = map[string]string{
+		"operation": awsmiddleware.GetOperationName(ctx),
+		"region":    awsmiddleware.GetRegion(ctx),
+	}
+	if table := tableName(in.Parameters); table != "" {
+		segment.doc.AWS["table_name"] = table
+	}
+
+	out, metadata, err := next.HandleInitialize(ctx, in)
+
+	if requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+		segment.doc.AWS["request_id"] = requestID
+	}
+	if response, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+		segment.doc.HTTP = &httpInfo{}
+		segment.doc.HTTP.Response.Status = response.StatusCode
+	}
+	segment.Close(err)
+	return out, metadata, err
+}
+
+// propagateTraceHeader makes the call's subsegment the parent of the
+// service's own segment, in place of the invocation's segment the SDK would
+// otherwise send
+func propagateTraceHeader(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+	if segment, ok := ctx.Value(segmentKey{}).(*Segment); ok {
+		if request, ok := in.Request.(*smithyhttp.Request); ok {
+			request.Header.Set("X-Amzn-Trace-Id", segment.traceHeader())
+		}
+	}
+	return next.HandleBuild(ctx, in)
+}
+
+// tableName returns the TableName of a DynamoDB operation's input, so the
+// service map can tell tables apart
+func tableName(input interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(input))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	field := v.FieldByName("TableName")
+	if !field.IsValid() {
+		return ""
+	}
+	if name, ok := field.Interface().(*string); ok && name != nil {
+		return *name
+	}
+	return ""
+}
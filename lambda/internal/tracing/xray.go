@@ -0,0 +1,232 @@
+// Package tracing sends AWS X-Ray subsegments for TinyTail's own work and
+// the AWS calls it makes, so slow queries and throttling show up in the
+// service map with their timings.
+//
+// Lambda creates each invocation's segment when active tracing is on;
+// subsegments are sent under it to the X-Ray daemon Lambda runs alongside
+// the function. A nil *Tracer, or an invocation that isn't sampled, traces
+// nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// daemonHeader precedes every document sent to the daemon
+const daemonHeader = `{"format": "json", "version": 1}` + "\n"
+
+// Tracer sends subsegments to the X-Ray daemon
+type Tracer struct {
+	conn net.Conn
+}
+
+// New returns a tracer sending to the daemon at AWS_XRAY_DAEMON_ADDRESS,
+// which Lambda sets when active tracing is on
+func New() (*Tracer, error) {
+	conn, err := net.Dial("udp", daemonAddress(os.Getenv("AWS_XRAY_DAEMON_ADDRESS")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the X-Ray daemon: %w", err)
+	}
+	return &Tracer{conn: conn}, nil
+}
+
+// daemonAddress accepts "host:port" or the "tcp:host:port udp:host:port"
+// form, of which only the UDP address is used
+func daemonAddress(value string) string {
+	if value == "" {
+		return "127.0.0.1:2000"
+	}
+	for _, part := range strings.Fields(value) {
+		if addr, ok := strings.CutPrefix(part, "udp:"); ok {
+			return addr
+		}
+	}
+	return value
+}
+
+// Segment is an open subsegment. Its methods do nothing on a nil Segment.
+type Segment struct {
+	tracer *Tracer
+	doc    document
+}
+
+type document struct {
+	ID          string            `json:"id"`
+	TraceID     string            `json:"trace_id"`
+	ParentID    string            `json:"parent_id"`
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	StartTime   float64           `json:"start_time"`
+	EndTime     float64           `json:"end_time"`
+	Error       bool              `json:"error,omitempty"`
+	Throttle    bool              `json:"throttle,omitempty"`
+	Fault       bool              `json:"fault,omitempty"`
+	Cause       *cause            `json:"cause,omitempty"`
+	HTTP        *httpInfo         `json:"http,omitempty"`
+	AWS         map[string]string `json:"aws,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type cause struct {
+	Exceptions []exception `json:"exceptions"`
+}
+
+type exception struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+}
+
+type httpInfo struct {
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+type segmentKey struct{}
+
+// Start opens a subsegment of the one in ctx, or of the invocation's
+// segment, and returns a context carrying it. The segment is nil if
+// tracing is off or the invocation isn't sampled.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Segment) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	var traceID, parentID string
+	if parent, ok := ctx.Value(segmentKey{}).(*Segment); ok {
+		traceID, parentID = parent.doc.TraceID, parent.doc.ID
+	} else {
+		header := parseTraceHeader(invocationTraceHeader(ctx))
+		if !header.sampled || header.root == "" || header.parent == "" {
+			return ctx, nil
+		}
+		traceID, parentID = header.root, header.parent
+	}
+
+	segment := &Segment{
+		tracer: t,
+		doc: document{
+			ID:        newID(),
+			TraceID:   traceID,
+			ParentID:  parentID,
+			Type:      "subsegment",
+			Name:      name,
+			StartTime: epochSeconds(time.Now()),
+		},
+	}
+	return context.WithValue(ctx, segmentKey{}, segment), segment
+}
+
+// Annotate adds an indexed annotation, which X-Ray can filter traces by
+func (s *Segment) Annotate(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.doc.Annotations == nil {
+		s.doc.Annotations = map[string]string{}
+	}
+	s.doc.Annotations[key] = value
+}
+
+// Close ends the subsegment and sends it, recording err if not nil.
+// Throttling and other client errors are told apart from faults by the
+// HTTP status where there is one.
+func (s *Segment) Close(err error) {
+	if s == nil {
+		return
+	}
+	s.doc.EndTime = epochSeconds(time.Now())
+
+	if err != nil {
+		status := 0
+		if s.doc.HTTP != nil {
+			status = s.doc.HTTP.Response.Status
+		}
+		s.doc.Throttle = status == 429 || isThrottle(err)
+		s.doc.Error = s.doc.Throttle || (status >= 400 && status < 500)
+		s.doc.Fault = !s.doc.Error
+		s.doc.Cause = &cause{Exceptions: []exception{{ID: newID(), Message: err.Error(), Type: fmt.Sprintf("%T", err)}}}
+	}
+
+	s.tracer.send(s.doc)
+}
+
+// traceHeader is the X-Amzn-Trace-Id value identifying this subsegment as
+// the parent of work done downstream
+func (s *Segment) traceHeader() string {
+	return fmt.Sprintf("Root=%s;Parent=%s;Sampled=1", s.doc.TraceID, s.doc.ID)
+}
+
+// send writes the document to the daemon. Tracing is best effort, so
+// failures are ignored rather than slowing or failing the request.
+func (t *Tracer) send(doc document) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	_, _ = t.conn.Write(append([]byte(daemonHeader), body...))
+}
+
+type traceHeader struct {
+	root    string
+	parent  string
+	sampled bool
+}
+
+// invocationTraceHeader returns the trace header Lambda passed with the
+// current invocation
+func invocationTraceHeader(ctx context.Context) string {
+	if header, ok := ctx.Value("x-amzn-trace-id").(string); ok && header != "" {
+		return header
+	}
+	return os.Getenv("_X_AMZN_TRACE_ID")
+}
+
+// parseTraceHeader reads "Root=1-...;Parent=...;Sampled=1"
+func parseTraceHeader(value string) traceHeader {
+	var header traceHeader
+	for _, field := range strings.Split(value, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Root":
+			header.root = val
+		case "Parent":
+			header.parent = val
+		case "Sampled":
+			header.sampled = val == "1"
+		}
+	}
+	return header
+}
+
+func isThrottle(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code := apiErr.ErrorCode()
+	return strings.Contains(code, "Throttl") || code == "ProvisionedThroughputExceededException" || code == "RequestLimitExceeded"
+}
+
+func newID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
@@ -27,6 +27,43 @@ generate_secret() {
     openssl rand -base64 $length | tr -d "=+/" | cut -c1-$length
 }
 
+# Function to hash a secret so only its digest is deployed
+sha256_hex() {
+    printf '%s' "$1" | openssl dgst -sha256 -r | cut -d' ' -f1
+}
+
+# Function to derive the key requests signed with an ingest secret are
+# checked with, kept apart from the secret's digest
+signing_key_hex() {
+    printf 'tinytail-ingest-signing' | openssl dgst -sha256 -mac HMAC -macopt "key:$1" -r | cut -d' ' -f1
+}
+
+# Function to turn "id[:env]=secret[@expiry] ..." into the JSON list of
+# hashed ingest secrets the stack expects
+ingest_secrets_json() {
+    local json="" entry id env secret expires
+    for entry in $1; do
+        id="${entry%%=*}"
+        secret="${entry#*=}"
+        env=""
+        if [[ "$id" == *:* ]]; then
+            env="${id#*:}"
+            id="${id%%:*}"
+        fi
+        expires=""
+        if [[ "$secret" == *@* ]]; then
+            expires="${secret#*@}"
+            secret="${secret%%@*}"
+        fi
+        [ -n "$json" ] && json="$json,"
+        json="$json{\"id\":\"$id\",\"sha256\":\"$(sha256_hex "$secret")\",\"signing_key\":\"$(signing_key_hex "$secret")\""
+        [ -n "$expires" ] && json="$json,\"expires\":\"$expires\""
+        [ -n "$env" ] && json="$json,\"env\":\"$env\""
+        json="$json}"
+    done
+    echo "[$json]"
+}
+
 # Check if secrets file exists
 if [ -f "$SECRETS_FILE" ]; then
     # Automatically use existing secrets
@@ -76,6 +113,70 @@ fi
 # Set defaults for optional parameters
 ALERT_RULES="${ALERT_RULES:-[]}"
 ALERT_FROM_EMAIL="${ALERT_FROM_EMAIL:-}"
+BASE_URL="${BASE_URL:-}"
+ALERT_RULES_SOURCE="${ALERT_RULES_SOURCE:-}"
+SELF_MONITOR_EMAIL="${SELF_MONITOR_EMAIL:-}"
+EXTRA_INGEST_SECRETS="${EXTRA_INGEST_SECRETS:-}"
+INGEST_ALLOWED_CIDRS="${INGEST_ALLOWED_CIDRS:-}"
+UI_ALLOWED_CIDRS="${UI_ALLOWED_CIDRS:-}"
+INGEST_IAM_PRINCIPALS="${INGEST_IAM_PRINCIPALS:-}"
+INGEST_SIGNATURE_MODE="${INGEST_SIGNATURE_MODE:-optional}"
+INGEST_SIGNATURE_WINDOW_SECONDS="${INGEST_SIGNATURE_WINDOW_SECONDS:-300}"
+INGEST_RATE_LIMIT="${INGEST_RATE_LIMIT:-0}"
+SAMPLE_RATES="${SAMPLE_RATES:-}"
+MAX_MESSAGE_SIZE="${MAX_MESSAGE_SIZE:-0}"
+SPLIT_MESSAGE_SIZE="${SPLIT_MESSAGE_SIZE:-358400}"
+OVERSIZE_MESSAGES="${OVERSIZE_MESSAGES:-reject}"
+REQUIRED_FIELDS="${REQUIRED_FIELDS:-}"
+ALLOWED_LEVELS="${ALLOWED_LEVELS:-}"
+LEVEL_MAP="${LEVEL_MAP:-}"
+MAX_TIMESTAMP_AHEAD="${MAX_TIMESTAMP_AHEAD:-5m}"
+MAX_TIMESTAMP_AGE="${MAX_TIMESTAMP_AGE:-180d}"
+OUT_OF_RANGE_TIMESTAMPS="${OUT_OF_RANGE_TIMESTAMPS:-clamp}"
+RECORD_RECEIVED_AT="${RECORD_RECEIVED_AT:-false}"
+TRUST_AUTHORIZER="${TRUST_AUTHORIZER:-false}"
+AUTHORIZER_GROUP_ROLES="${AUTHORIZER_GROUP_ROLES:-}"
+AUTHORIZER_DEFAULT_ROLE="${AUTHORIZER_DEFAULT_ROLE:-}"
+CONTENT_SECURITY_POLICY="${CONTENT_SECURITY_POLICY:-}"
+SESSION_IDLE_DAYS="${SESSION_IDLE_DAYS:-14}"
+SESSION_MAX_DAYS="${SESSION_MAX_DAYS:-30}"
+SESSION_SHORT_HOURS="${SESSION_SHORT_HOURS:-12}"
+SINGLE_SESSION="${SINGLE_SESSION:-false}"
+PASSWORD_MAX_AGE_DAYS="${PASSWORD_MAX_AGE_DAYS:-0}"
+LOGIN_NOTIFICATIONS="${LOGIN_NOTIFICATIONS:-true}"
+LOGIN_LINKS="${LOGIN_LINKS:-false}"
+CONFIG_SSM_PATH="${CONFIG_SSM_PATH:-}"
+LOGIN_LINK_KEY="${LOGIN_LINK_KEY:-}"
+LOGIN_LINK_MINUTES="${LOGIN_LINK_MINUTES:-15}"
+FEED_KEY="${FEED_KEY:-}"
+FEED_TOKEN_DAYS="${FEED_TOKEN_DAYS:-90}"
+SESSION_MODE="${SESSION_MODE:-dynamodb}"
+SESSION_SIGNING_KEY="${SESSION_SIGNING_KEY:-}"
+SESSION_TOKEN_MINUTES="${SESSION_TOKEN_MINUTES:-5}"
+TRACING="${TRACING:-false}"
+LOG_LEVEL="${LOG_LEVEL:-info}"
+SELF_INGEST="${SELF_INGEST:-true}"
+INGEST_DLQ="${INGEST_DLQ:-false}"
+INGEST_DLQ_MAX_ATTEMPTS="${INGEST_DLQ_MAX_ATTEMPTS:-5}"
+FORWARD_DLQ="${FORWARD_DLQ:-false}"
+FORWARD_DLQ_MAX_ATTEMPTS="${FORWARD_DLQ_MAX_ATTEMPTS:-5}"
+DIGEST_EMAIL="${DIGEST_EMAIL:-}"
+ENVIRONMENTS="${ENVIRONMENTS:-}"
+CLOUDTRAIL="${CLOUDTRAIL:-false}"
+CLOUDTRAIL_BUCKET="${CLOUDTRAIL_BUCKET:-}"
+KINESIS_STREAM_ARN="${KINESIS_STREAM_ARN:-}"
+LOG_BUCKET="${LOG_BUCKET:-}"
+APP_EVENT_SOURCE="${APP_EVENT_SOURCE:-}"
+
+if [ "$SESSION_MODE" = "jwt" ] && [ -z "$SESSION_SIGNING_KEY" ]; then
+    echo "SESSION_MODE=jwt needs SESSION_SIGNING_KEY in $SECRETS_FILE (generate one with: openssl rand -hex 32)"
+    exit 1
+fi
+
+if [ "$LOGIN_LINKS" = "true" ] && [ -z "$LOGIN_LINK_KEY" ]; then
+    echo "LOGIN_LINKS=true needs LOGIN_LINK_KEY in $SECRETS_FILE (generate one with: openssl rand -hex 32)"
+    exit 1
+fi
 
 echo ""
 echo "================================================"
@@ -128,7 +229,7 @@ sam deploy \
     --region "$REGION" \
     --profile "$PROFILE" \
     --capabilities CAPABILITY_IAM \
-    --parameter-overrides "IngestSecret=$INGEST_SECRET" "UIPassword=$UI_PASSWORD" "AlertFromEmail=$ALERT_FROM_EMAIL" \
+    --parameter-overrides "IngestSecretHash=$(sha256_hex "$INGEST_SECRET")" "IngestSigningKey=$(signing_key_hex "$INGEST_SECRET")" "UIPasswordHash=$(sha256_hex "$UI_PASSWORD")" "AdditionalIngestSecrets=$(ingest_secrets_json "$EXTRA_INGEST_SECRETS")" "AlertFromEmail=$ALERT_FROM_EMAIL" "PublicBaseURL=$BASE_URL" "AlertRulesSource=$ALERT_RULES_SOURCE" "SelfMonitorEmail=$SELF_MONITOR_EMAIL" "IngestAllowedCIDRs=$INGEST_ALLOWED_CIDRS" "UIAllowedCIDRs=$UI_ALLOWED_CIDRS" "IngestIAMPrincipals=$INGEST_IAM_PRINCIPALS" "IngestSignatureMode=$INGEST_SIGNATURE_MODE" "IngestSignatureWindowSeconds=$INGEST_SIGNATURE_WINDOW_SECONDS" "IngestRateLimit=$INGEST_RATE_LIMIT" "SampleRates=$SAMPLE_RATES" "MaxMessageSize=$MAX_MESSAGE_SIZE" "SplitMessageSize=$SPLIT_MESSAGE_SIZE" "OversizeMessages=$OVERSIZE_MESSAGES" "RequiredFields=$REQUIRED_FIELDS" "AllowedLevels=$ALLOWED_LEVELS" "LevelMap=$LEVEL_MAP" "MaxTimestampAhead=$MAX_TIMESTAMP_AHEAD" "MaxTimestampAge=$MAX_TIMESTAMP_AGE" "OutOfRangeTimestamps=$OUT_OF_RANGE_TIMESTAMPS" "RecordReceivedAt=$RECORD_RECEIVED_AT" "TrustAuthorizer=$TRUST_AUTHORIZER" "AuthorizerGroupRoles=$AUTHORIZER_GROUP_ROLES" "AuthorizerDefaultRole=$AUTHORIZER_DEFAULT_ROLE" "ContentSecurityPolicy=$CONTENT_SECURITY_POLICY" "SessionIdleDays=$SESSION_IDLE_DAYS" "SessionMaxDays=$SESSION_MAX_DAYS" "SessionShortHours=$SESSION_SHORT_HOURS" "SingleSession=$SINGLE_SESSION" "PasswordMaxAgeDays=$PASSWORD_MAX_AGE_DAYS" "LoginNotifications=$LOGIN_NOTIFICATIONS" "LoginLinks=$LOGIN_LINKS" "LoginLinkKey=$LOGIN_LINK_KEY" "LoginLinkMinutes=$LOGIN_LINK_MINUTES" "FeedKey=$FEED_KEY" "FeedTokenDays=$FEED_TOKEN_DAYS" "ConfigSSMPath=$CONFIG_SSM_PATH" "SessionMode=$SESSION_MODE" "SessionSigningKey=$SESSION_SIGNING_KEY" "SessionTokenMinutes=$SESSION_TOKEN_MINUTES" "Tracing=$TRACING" "LogLevel=$LOG_LEVEL" "SelfIngest=$SELF_INGEST" "IngestDLQ=$INGEST_DLQ" "IngestDLQMaxAttempts=$INGEST_DLQ_MAX_ATTEMPTS" "ForwardDLQ=$FORWARD_DLQ" "ForwardDLQMaxAttempts=$FORWARD_DLQ_MAX_ATTEMPTS" "DigestEmail=$DIGEST_EMAIL" "Environments=$ENVIRONMENTS" "CloudTrail=$CLOUDTRAIL" "CloudTrailBucket=$CLOUDTRAIL_BUCKET" "KinesisStreamArn=$KINESIS_STREAM_ARN" "LogBucket=$LOG_BUCKET" "AppEventSource=$APP_EVENT_SOURCE" \
     --s3-bucket tinytail-deployments \
     --s3-prefix "$STACK_NAME"
 
@@ -163,7 +264,7 @@ echo "  TinyTail Web UI"
 echo "================================================"
 echo ""
 echo "URL:      $UI_URL"
-echo "Password: $UI_PASSWORD"
+echo "Password: $UI_PASSWORD (user \"admin\", until the first user account is created)"
 echo ""
 
 echo "================================================"